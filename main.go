@@ -25,6 +25,7 @@ var (
 	pipelinePluginUrl = flag.String("pipeline-plugin-url", LookupEnvOrString("PIPELINE_PLUGIN_URL", "http://127.0.0.1:8081/api/v1/plugin"), "pipeline plugin url.")
 	agentVersion      = flag.String("agent-version", LookupEnvOrString("AGENT_VERSION", "latest"), "kubespace agent version.")
 	agentRepository   = flag.String("agent-repository", LookupEnvOrString("AGENT_REPOSITORY", "kubespace/agent"), "kubespace agent version.")
+	pipelineMaxBuilds = flag.Int("pipeline-max-concurrent-builds", LookupEnvOrInt("PIPELINE_MAX_CONCURRENT_BUILDS", 0), "max pipeline builds running at the same time, 0 means unlimited.")
 )
 
 func LookupEnvOrString(key string, defaultVal string) string {
@@ -81,6 +82,7 @@ func main() {
 	conf2.AppConfig.PipelinePluginUrl = *pipelinePluginUrl
 	conf2.AppConfig.AgentVersion = *agentVersion
 	conf2.AppConfig.AgentRepository = *agentRepository
+	conf2.AppConfig.PipelineMaxConcurrentBuilds = *pipelineMaxBuilds
 	server, err := buildServer()
 	if err != nil {
 		panic(err)
@@ -4,6 +4,8 @@ type GlobalConf struct {
 	PipelinePluginUrl string
 	AgentVersion      string
 	AgentRepository   string
+	// 全局同时执行的最大流水线构建数，超过时构建排队等待，为0时不限制
+	PipelineMaxConcurrentBuilds int
 }
 
 var AppConfig = &GlobalConf{}
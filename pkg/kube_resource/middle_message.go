@@ -11,6 +11,21 @@ import (
 	"time"
 )
 
+// KubeMessage 与集群agent之间的消息通道，MiddleMessage通过redis实现
+type KubeMessage interface {
+	SendRequest(request *MiddleRequest) *utils.Response
+	ClusterConnected(cluster string) bool
+	HasWatchReceive(cluster string) bool
+	// NewLogSession 创建接收日志的会话，使用完需要Close
+	NewLogSession() LogSession
+}
+
+// LogSession 阻塞接收agent发送的日志
+type LogSession interface {
+	ReceiveLog(sessionId string, reqHandle func(string)) error
+	Close()
+}
+
 type MiddleMessage struct {
 	options *oredis.Options
 	client  *redis.Client
@@ -38,6 +53,15 @@ func NewMiddleMessageWithClient(op *oredis.Options, client *redis.Client) *Middl
 	}
 }
 
+// NewSession 使用相同的redis配置创建新的连接，用于日志等阻塞接收的会话，使用完需要Close
+func (m *MiddleMessage) NewSession() *MiddleMessage {
+	return NewMiddleMessage(m.options)
+}
+
+func (m *MiddleMessage) NewLogSession() LogSession {
+	return m.NewSession()
+}
+
 func (m *MiddleMessage) Close() {
 	m.client.Close()
 }
@@ -94,7 +118,7 @@ func (m *MiddleMessage) SendRequest(request *MiddleRequest) *utils.Response {
 	}
 	_, err = m.client.Publish(m.Context, reqPubKey, reqData).Result()
 	if err != nil {
-		klog.Error("publish request error: %s", err.Error())
+		klog.Errorf("publish request error: %s", err.Error())
 		return &utils.Response{Code: code.RedisError, Msg: err.Error()}
 	}
 
@@ -135,7 +159,7 @@ func (m *MiddleMessage) HasGlobalWatchReceive() bool {
 		return false
 	}
 	if num, ok := subNums[watchKey]; !ok || num <= 0 {
-		klog.Errorf("watch global %s is not in subscribe")
+		klog.Errorf("watch global %s is not in subscribe", watchKey)
 		return false
 	}
 	return true
@@ -175,7 +199,7 @@ func (m *MiddleMessage) SendGlobalWatch(data interface{}) {
 	}
 	_, err = m.client.Publish(m.Context, watchPubKey, respData).Result()
 	if err != nil {
-		klog.Error("publish watch response error: %s", err.Error())
+		klog.Errorf("publish watch response error: %s", err.Error())
 		return
 	}
 	//klog.V(1).Infof("send global watch %s", string(respData))
@@ -235,7 +259,7 @@ func (m *MiddleMessage) SendWatch(cluster string, midRes *MiddleResponse) {
 	}
 	_, err = m.client.Publish(m.Context, watchPubKey, respData).Result()
 	if err != nil {
-		klog.Error("publish watch response error: %s", err.Error())
+		klog.Errorf("publish watch response error: %s", err.Error())
 		return
 	}
 }
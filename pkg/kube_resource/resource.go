@@ -23,7 +23,7 @@ const (
 
 type KubeResource struct {
 	ResType     string
-	KubeMessage *MiddleMessage
+	KubeMessage KubeMessage
 }
 
 func (k *KubeResource) Get(cluster string, params interface{}) *utils.Response {
@@ -158,7 +158,7 @@ type KubeResources struct {
 	Crd            *KubeResource
 }
 
-func NewKubeResources(message *MiddleMessage) *KubeResources {
+func NewKubeResources(message KubeMessage) *KubeResources {
 	return &KubeResources{
 		Watch:          &WatchResource{&KubeResource{ResType: WatchResType, KubeMessage: message}},
 		Pod:            &KubeResource{ResType: PodType, KubeMessage: message},
@@ -0,0 +1,31 @@
+package manager
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"time"
+)
+
+// LockManager 基于redis的分布式锁，多副本部署时保证同一任务只会被一个副本执行
+type LockManager struct {
+	modelKey string
+	client   *redis.Client
+	context.Context
+}
+
+func NewLockManager(redisClient *redis.Client) *LockManager {
+	return &LockManager{
+		modelKey: "osp:lock",
+		Context:  context.Background(),
+		client:   redisClient,
+	}
+}
+
+// Lock 获取锁，获取成功返回true，锁在expiration之后自动释放
+func (l *LockManager) Lock(key string, expiration time.Duration) (bool, error) {
+	return l.client.SetNX(l.Context, l.modelKey+":"+key, time.Now().String(), expiration).Result()
+}
+
+func (l *LockManager) Unlock(key string) error {
+	return l.client.Del(l.Context, l.modelKey+":"+key).Err()
+}
@@ -1,38 +1,128 @@
 package pipeline
 
 import (
+	"errors"
 	"github.com/kubespace/kubespace/pkg/model/types"
 	"gorm.io/gorm"
+	"sync"
 	"time"
 )
 
+// JobLogChunkSize 每块日志的最大字节数，超过后新建日志块
+const JobLogChunkSize = 64 * 1024
+
 type JobLog struct {
 	DB *gorm.DB
+	// 同一个任务的日志可能由插件以及流水线服务同时追加，新建日志块时需要加锁
+	lock sync.Mutex
 }
 
 func NewJobLogManager(db *gorm.DB) *JobLog {
 	return &JobLog{DB: db}
 }
 
-func (l *JobLog) UpdateLog(jobId uint, log string) error {
-	var cnt int64
-	if err := l.DB.Model(&types.PipelineRunJobLog{}).Where("job_run_id", jobId).Count(&cnt).Error; err != nil {
+type jobLogChunk struct {
+	ID        uint
+	LogOffset int64
+	Size      int64
+}
+
+// lastChunk 获取任务最后一块日志的偏移以及大小，不读取日志内容
+func (l *JobLog) lastChunk(jobId uint) (*jobLogChunk, error) {
+	var chunk jobLogChunk
+	err := l.DB.Model(&types.PipelineRunJobLog{}).
+		Select("id, log_offset, LENGTH(logs) AS size").
+		Where("job_run_id = ?", jobId).
+		Order("log_offset desc, id desc").
+		Limit(1).
+		Take(&chunk).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &chunk, nil
+}
+
+// AppendLog 在任务日志末尾追加日志，最后一块日志未写满时直接追加到该块，否则新建日志块
+func (l *JobLog) AppendLog(jobId uint, log string) error {
+	if log == "" {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	chunk, err := l.lastChunk(jobId)
+	if err != nil {
 		return err
 	}
-	if cnt == 0 {
-		log := types.PipelineRunJobLog{
-			JobRunId:   jobId,
-			Logs:       log,
-			CreateTime: time.Now(),
-			UpdateTime: time.Now(),
+	if chunk != nil && chunk.Size+int64(len(log)) <= JobLogChunkSize {
+		return l.DB.Model(&types.PipelineRunJobLog{}).Where("id = ?", chunk.ID).Updates(map[string]interface{}{
+			"logs":        gorm.Expr("CONCAT(IFNULL(logs, ''), ?)", log),
+			"update_time": time.Now(),
+		}).Error
+	}
+	var offset int64 = 0
+	if chunk != nil {
+		offset = chunk.LogOffset + chunk.Size
+	}
+	return l.DB.Create(&types.PipelineRunJobLog{
+		JobRunId:   jobId,
+		Logs:       log,
+		LogOffset:  offset,
+		CreateTime: time.Now(),
+		UpdateTime: time.Now(),
+	}).Error
+}
+
+// Size 获取任务日志的总字节数
+func (l *JobLog) Size(jobId uint) (int64, error) {
+	chunk, err := l.lastChunk(jobId)
+	if err != nil || chunk == nil {
+		return 0, err
+	}
+	return chunk.LogOffset + chunk.Size, nil
+}
+
+// GetLogFrom 获取任务日志从offset字节偏移开始的内容，返回日志以及下一次读取的偏移
+func (l *JobLog) GetLogFrom(jobId uint, offset int64) (string, int64, error) {
+	var chunks []types.PipelineRunJobLog
+	err := l.DB.Where("job_run_id = ? AND log_offset + LENGTH(logs) > ?", jobId, offset).
+		Order("log_offset, id").
+		Find(&chunks).Error
+	if err != nil {
+		return "", offset, err
+	}
+	var logs []byte
+	for _, chunk := range chunks {
+		data := []byte(chunk.Logs)
+		if chunk.LogOffset < offset {
+			data = data[offset-chunk.LogOffset:]
 		}
-		if err := l.DB.Create(&log).Error; err != nil {
+		logs = append(logs, data...)
+		offset = chunk.LogOffset + int64(len(chunk.Logs))
+	}
+	return string(logs), offset, nil
+}
+
+// EachChunk 按顺序遍历任务的日志块，用于下载大日志时避免一次读取全部日志
+func (l *JobLog) EachChunk(jobId uint, fn func(logs string) error) error {
+	var lastId uint = 0
+	var lastOffset int64 = -1
+	for {
+		var chunk types.PipelineRunJobLog
+		err := l.DB.Where("job_run_id = ? AND (log_offset > ? OR (log_offset = ? AND id > ?))", jobId, lastOffset, lastOffset, lastId).
+			Order("log_offset, id").
+			Take(&chunk).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
 			return err
 		}
-	} else {
-		if err := l.DB.Model(types.PipelineRunJobLog{}).Where("job_run_id", jobId).Updates(types.PipelineRunJobLog{Logs: log}).Error; err != nil {
+		if err = fn(chunk.Logs); err != nil {
 			return err
 		}
+		lastId, lastOffset = chunk.ID, chunk.LogOffset
 	}
-	return nil
 }
@@ -99,6 +99,24 @@ func (p *ManagerPipeline) List(workspaceId uint) ([]types.Pipeline, error) {
 	return ps, nil
 }
 
+// ListByTriggerType 获取配置了指定类型触发源的所有流水线
+func (p *ManagerPipeline) ListByTriggerType(triggerType string) ([]types.Pipeline, error) {
+	var ps []types.Pipeline
+	if err := p.DB.Find(&ps).Error; err != nil {
+		return nil, err
+	}
+	var res []types.Pipeline
+	for _, pipeline := range ps {
+		for _, trigger := range pipeline.Triggers {
+			if trigger.Type == triggerType {
+				res = append(res, pipeline)
+				break
+			}
+		}
+	}
+	return res, nil
+}
+
 func (p *ManagerPipeline) Stages(pipelineId uint) ([]*types.PipelineStage, error) {
 	var stages []types.PipelineStage
 	if err := p.DB.Where("pipeline_id = ?", pipelineId).Find(&stages).Error; err != nil {
@@ -107,12 +125,21 @@ func (p *ManagerPipeline) Stages(pipelineId uint) ([]*types.PipelineStage, error
 
 	var seqStages []*types.PipelineStage
 	prevStageId := uint(0)
+	prevStageName := ""
 	for {
 		hasNext := false
 		for i, s := range stages {
 			if s.PrevStageId == prevStageId {
+				// 未配置依赖的阶段，依赖前一个阶段
+				if stages[i].DependsOn == nil {
+					stages[i].DependsOn = types.StringList{}
+					if prevStageName != "" {
+						stages[i].DependsOn = types.StringList{prevStageName}
+					}
+				}
 				seqStages = append(seqStages, &stages[i])
 				prevStageId = s.ID
+				prevStageName = s.Name
 				hasNext = true
 				break
 			}
@@ -139,6 +166,9 @@ func (p *ManagerPipeline) Delete(pipelineId uint) error {
 				if err := tx.Delete(&types.PipelineRunJobLog{}, "job_run_id=?", runJob.ID).Error; err != nil {
 					return err
 				}
+				if err := tx.Delete(&types.PipelineRunJobAttempt{}, "job_run_id=?", runJob.ID).Error; err != nil {
+					return err
+				}
 			}
 			if err := tx.Delete(&types.PipelineRunJob{}, "pipeline_run_id=?", pipelineRun.ID).Error; err != nil {
 				return err
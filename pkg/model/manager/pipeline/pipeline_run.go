@@ -8,6 +8,7 @@ import (
 	"github.com/kubespace/kubespace/pkg/sse"
 	"github.com/kubespace/kubespace/pkg/utils"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"k8s.io/klog"
 	"strings"
 	"time"
@@ -76,19 +77,32 @@ func (p *ManagerPipelineRun) CreatePipelineRun(pipelineRun *types.PipelineRun, s
 			return err
 		}
 		var prevStageRunId uint = 0
+		stageRunIds := make(map[string]uint)
 		for _, stageRun := range stagesRun {
 			stageRun.PipelineRunId = pipelineRun.ID
 			stageRun.PrevStageRunId = prevStageRunId
+			if stageRun.DependsOn != nil {
+				stageRun.PrevStageRunIds = types.UintList{}
+				for _, dep := range stageRun.DependsOn {
+					depId, ok := stageRunIds[dep]
+					if !ok {
+						return fmt.Errorf("阶段「%s」依赖的阶段「%s」不存在", stageRun.Name, dep)
+					}
+					stageRun.PrevStageRunIds = append(stageRun.PrevStageRunIds, depId)
+				}
+			}
 			if err := tx.Create(stageRun).Error; err != nil {
 				return err
 			}
 			for _, jobRun := range stageRun.Jobs {
+				jobRun.PipelineRunId = pipelineRun.ID
 				jobRun.StageRunId = stageRun.ID
 				if err := tx.Create(jobRun).Error; err != nil {
 					return err
 				}
 			}
 			prevStageRunId = stageRun.ID
+			stageRunIds[stageRun.Name] = stageRun.ID
 		}
 		return nil
 	})
@@ -110,19 +124,256 @@ func (p *ManagerPipelineRun) GetStageRunJobs(stageRunId uint) (types.PipelineRun
 	return stageRunJobs, nil
 }
 
-func (p *ManagerPipelineRun) NextStageRun(pipelineRunId uint, stageId uint) (*types.PipelineRunStage, error) {
-	var err error
+// PrevStageRunIds 返回阶段依赖的上游阶段，未配置依赖时为前一个阶段
+func (p *ManagerPipelineRun) PrevStageRunIds(stageRun *types.PipelineRunStage) []uint {
+	if stageRun.PrevStageRunIds != nil {
+		return stageRun.PrevStageRunIds
+	}
+	if stageRun.PrevStageRunId == 0 {
+		return nil
+	}
+	return []uint{stageRun.PrevStageRunId}
+}
+
+// StageRunSucceeded 阶段执行成功或者跳过执行时，都认为阶段已成功，可以继续执行下游阶段
+func StageRunSucceeded(status string) bool {
+	return status == types.PipelineStatusOK || status == types.PipelineStatusSkipped
+}
+
+// ReadyStageRuns 返回构建中可以执行的阶段，即状态为wait且所有上游阶段都执行成功的阶段，
+// 以及构建中的所有阶段是否都已执行成功
+func (p *ManagerPipelineRun) ReadyStageRuns(pipelineRunId uint) ([]*types.PipelineRunStage, bool, error) {
+	stagesRun, err := p.StagesRun(pipelineRunId)
+	if err != nil {
+		return nil, false, err
+	}
+	stageStatus := make(map[uint]string)
+	allOK := true
+	for _, stageRun := range stagesRun {
+		stageStatus[stageRun.ID] = stageRun.Status
+		if !StageRunSucceeded(stageRun.Status) {
+			allOK = false
+		}
+	}
+	var readyStages []*types.PipelineRunStage
+	for _, stageRun := range stagesRun {
+		if stageRun.Status != types.PipelineStatusWait {
+			continue
+		}
+		ready := true
+		for _, prevId := range p.PrevStageRunIds(stageRun) {
+			if !StageRunSucceeded(stageStatus[prevId]) {
+				ready = false
+				break
+			}
+		}
+		if ready {
+			readyStages = append(readyStages, stageRun)
+		}
+	}
+	return readyStages, allOK, nil
+}
+
+// StartStageRun 当阶段状态为fromStatus中的一个时，将阶段置为doing，并将阶段中的任务重置为wait，任务的自动重试次数清零，
+// 返回是否更新成功，多个上游阶段同时完成时，保证下游阶段只会执行一次
+func (p *ManagerPipelineRun) StartStageRun(stageRun *types.PipelineRunStage, fromStatus []string) (bool, error) {
+	return p.transitStageRun(stageRun, fromStatus, types.PipelineStatusDoing, types.PipelineStatusWait)
+}
+
+// SkipStageRun 阶段执行条件不满足时，当阶段状态为fromStatus中的一个时，将阶段以及阶段中的任务置为skipped
+func (p *ManagerPipelineRun) SkipStageRun(stageRun *types.PipelineRunStage, fromStatus []string) (bool, error) {
+	return p.transitStageRun(stageRun, fromStatus, types.PipelineStatusSkipped, types.PipelineStatusSkipped)
+}
+
+// transitStageRun 当阶段状态为fromStatus中的一个时，将阶段置为stageStatus，阶段中的任务置为jobStatus，并更新构建状态
+func (p *ManagerPipelineRun) transitStageRun(stageRun *types.PipelineRunStage, fromStatus []string, stageStatus, jobStatus string) (bool, error) {
+	updated := false
+	now := time.Now()
+	err := p.DB.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&types.PipelineRunStage{}).
+			Where("id = ? and status in ?", stageRun.ID, fromStatus).
+			Updates(map[string]interface{}{
+				"status":      stageStatus,
+				"env":         stageRun.Env,
+				"exec_time":   now,
+				"update_time": now,
+			})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return nil
+		}
+		updated = true
+		return tx.Model(&types.PipelineRunJob{}).
+			Where("stage_run_id = ?", stageRun.ID).
+			Updates(map[string]interface{}{"status": jobStatus, "retries": 0, "retry_time": nil, "update_time": now}).Error
+	})
+	if err != nil || !updated {
+		return false, err
+	}
+	stageRun.Status = stageStatus
+	stageRun.ExecTime = now
+	// 更新构建状态
+	if _, _, err = p.UpdatePipelineStageRun(&UpdateStageObj{
+		StageRunId:     stageRun.ID,
+		StageRunStatus: stageStatus,
+	}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ApproveStageRun 添加审批阶段的审批记录，阶段需要处于暂停等待审批的状态，每个用户只能审批一次，
+// 审批通过人数达到要求后不再接受审批，审批拒绝时阶段置为error，返回阶段以及是否已审批通过
+func (p *ManagerPipelineRun) ApproveStageRun(stageRunId uint, approval *types.PipelineRunStageApproval) (*types.PipelineRunStage, bool, error) {
 	var stageRun types.PipelineRunStage
-	if err = p.DB.Last(&stageRun, "prev_stage_run_id = ? and pipeline_run_id = ?", stageId, pipelineRunId).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, nil
+	approved := false
+	err := p.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&stageRun, stageRunId).Error; err != nil {
+			return err
+		}
+		if stageRun.TriggerMode != types.StageTriggerModeApproval {
+			return fmt.Errorf("当前阶段不是审批阶段")
+		}
+		if stageRun.Status != types.PipelineStatusPause {
+			return fmt.Errorf("当前阶段状态为%s，不能审批", stageRun.Status)
 		}
+		if stageRun.Approvals.Approved() >= stageRun.Approval.RequiredApprovals() {
+			return fmt.Errorf("当前阶段已审批通过")
+		}
+		for _, a := range stageRun.Approvals {
+			if a.UserId == approval.UserId {
+				return fmt.Errorf("用户「%s」已审批过当前阶段", approval.UserName)
+			}
+		}
+		stageRun.Approvals = append(stageRun.Approvals, approval)
+		updates := map[string]interface{}{
+			"approvals":   stageRun.Approvals,
+			"update_time": time.Now(),
+		}
+		if approval.Result == types.StageApprovalReject {
+			stageRun.Status = types.PipelineStatusError
+			updates["status"] = stageRun.Status
+		}
+		approved = stageRun.Approvals.Approved() >= stageRun.Approval.RequiredApprovals()
+		return tx.Model(&types.PipelineRunStage{}).Where("id = ?", stageRunId).Updates(updates).Error
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if stageRun.Status == types.PipelineStatusError {
+		// 更新构建状态
+		if _, _, err = p.UpdatePipelineStageRun(&UpdateStageObj{
+			StageRunId:     stageRunId,
+			StageRunStatus: types.PipelineStatusError,
+		}); err != nil {
+			return nil, false, err
+		}
+	}
+	if stageRun.Jobs, err = p.GetStageRunJobs(stageRunId); err != nil {
+		return nil, false, err
+	}
+	return &stageRun, approved, nil
+}
+
+// ResetStageRunApprovals 清空审批阶段的审批记录，并将阶段置为暂停，重新等待审批
+func (p *ManagerPipelineRun) ResetStageRunApprovals(stageRunId uint) (*types.PipelineRun, *types.PipelineRunStage, error) {
+	if err := p.DB.Model(&types.PipelineRunStage{}).Where("id = ?", stageRunId).Updates(map[string]interface{}{
+		"approvals":   types.PipelineRunStageApprovals{},
+		"update_time": time.Now(),
+	}).Error; err != nil {
+		return nil, nil, err
+	}
+	return p.UpdatePipelineStageRun(&UpdateStageObj{
+		StageRunId:     stageRunId,
+		StageRunStatus: types.PipelineStatusPause,
+	})
+}
+
+// ListUnfinishedPipelineRun 获取所有未完成（wait/doing状态）的流水线构建
+func (p *ManagerPipelineRun) ListUnfinishedPipelineRun() ([]types.PipelineRun, error) {
+	var pipelineRuns []types.PipelineRun
+	statuses := []string{types.PipelineStatusWait, types.PipelineStatusDoing}
+	if err := p.DB.Where("status in ?", statuses).Order("id").Find(&pipelineRuns).Error; err != nil {
 		return nil, err
 	}
-	if stageRun.Jobs, err = p.GetStageRunJobs(stageRun.ID); err != nil {
+	return pipelineRuns, nil
+}
+
+// ListQueuedPipelineRun 获取所有排队等待执行（wait状态）的构建，按照创建顺序排列
+func (p *ManagerPipelineRun) ListQueuedPipelineRun() ([]types.PipelineRun, error) {
+	var pipelineRuns []types.PipelineRun
+	if err := p.DB.Where("status = ?", types.PipelineStatusWait).Order("id").Find(&pipelineRuns).Error; err != nil {
 		return nil, err
 	}
-	return &stageRun, nil
+	return pipelineRuns, nil
+}
+
+// CountActivePipelineRun 统计已开始执行的构建数，返回每条流水线执行中以及暂停的构建数，和全局执行中的构建数
+func (p *ManagerPipelineRun) CountActivePipelineRun() (map[uint]int, int, error) {
+	var rows []struct {
+		PipelineId uint
+		Status     string
+		Cnt        int
+	}
+	if err := p.DB.Model(&types.PipelineRun{}).
+		Select("pipeline_id, status, count(*) as cnt").
+		Where("status in ?", []string{types.PipelineStatusDoing, types.PipelineStatusPause}).
+		Group("pipeline_id, status").
+		Scan(&rows).Error; err != nil {
+		return nil, 0, err
+	}
+	pipelineActive := make(map[uint]int)
+	doing := 0
+	for _, row := range rows {
+		pipelineActive[row.PipelineId] += row.Cnt
+		if row.Status == types.PipelineStatusDoing {
+			doing += row.Cnt
+		}
+	}
+	return pipelineActive, doing, nil
+}
+
+// StartPipelineRun 将排队中的构建置为doing，返回是否更新成功，保证构建只会被启动一次
+func (p *ManagerPipelineRun) StartPipelineRun(pipelineRun *types.PipelineRun) (bool, error) {
+	now := time.Now()
+	res := p.DB.Model(&types.PipelineRun{}).
+		Where("id = ? and status = ?", pipelineRun.ID, types.PipelineStatusWait).
+		Updates(map[string]interface{}{"status": types.PipelineStatusDoing, "update_time": now})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return false, nil
+	}
+	pipelineRun.Status = types.PipelineStatusDoing
+	pipelineRun.UpdateTime = now
+	p.StreamPipelineRun(pipelineRun)
+	return true, nil
+}
+
+// ListPipelineUnfinishedRun 获取流水线所有未完成（wait/doing/pause状态）的构建
+func (p *ManagerPipelineRun) ListPipelineUnfinishedRun(pipelineId uint) ([]types.PipelineRun, error) {
+	var pipelineRuns []types.PipelineRun
+	statuses := []string{types.PipelineStatusWait, types.PipelineStatusDoing, types.PipelineStatusPause}
+	if err := p.DB.Where("pipeline_id = ? and status in ?", pipelineId, statuses).Order("id").Find(&pipelineRuns).Error; err != nil {
+		return nil, err
+	}
+	return pipelineRuns, nil
+}
+
+// ListTimeoutCandidates 获取所有设置了超时时间且正在执行的阶段和任务
+func (p *ManagerPipelineRun) ListTimeoutCandidates() ([]types.PipelineRunStage, []types.PipelineRunJob, error) {
+	var stageRuns []types.PipelineRunStage
+	if err := p.DB.Where("status = ? and timeout > 0", types.PipelineStatusDoing).Find(&stageRuns).Error; err != nil {
+		return nil, nil, err
+	}
+	var jobRuns []types.PipelineRunJob
+	if err := p.DB.Where("status = ? and timeout > 0", types.PipelineStatusDoing).Find(&jobRuns).Error; err != nil {
+		return nil, nil, err
+	}
+	return stageRuns, jobRuns, nil
 }
 
 func (p *ManagerPipelineRun) Get(pipelineRunId uint) (*types.PipelineRun, error) {
@@ -219,32 +470,65 @@ func (p *ManagerPipelineRun) UpdateStageJobRunParams(stageRun *types.PipelineRun
 
 // GetStageRunStatus 根据stage的所有任务的状态返回该stage的状态
 // 1. 如果有doing的job，stage状态为doing；
-// 2. 如果所有job的状态为error/ok/wait，则
-// 	  a. job中有error的，则stage为error；
-//    b. 所有job都为ok，则stage为ok；
-//    c. job中有ok，有wait，则stage为doing；
+// 2. 如果有error的job，阶段失败策略为wait_all且还有wait的job时，stage为doing，否则stage为error；
+// 3. 如果有cancel的job，stage状态为cancel；
+// 4. 如果所有job的状态为ok/skipped/wait，则
+//    a. job中有ok且没有wait，则stage为ok；
+//    b. 所有job都为skipped，则stage为skipped；
+//    c. job中有ok或skipped，有wait，则stage为doing；
 func (p *ManagerPipelineRun) GetStageRunStatus(stageRun *types.PipelineRunStage) string {
-	status := ""
+	hasError, hasCancel, hasWait, hasOK, hasSkipped := false, false, false, false, false
 	for _, jobRun := range stageRun.Jobs {
-		if jobRun.Status == types.PipelineStatusDoing {
+		switch jobRun.Status {
+		case types.PipelineStatusDoing:
 			return types.PipelineStatusDoing
+		case types.PipelineStatusError:
+			hasError = true
+		case types.PipelineStatusCancel:
+			hasCancel = true
+		case types.PipelineStatusWait:
+			hasWait = true
+		case types.PipelineStatusOK:
+			hasOK = true
+		case types.PipelineStatusSkipped:
+			hasSkipped = true
 		}
-		if jobRun.Status == types.PipelineStatusError {
-			status = types.PipelineStatusError
-			continue
-		}
-		if jobRun.Status == types.PipelineStatusOK && status != types.PipelineStatusError {
-			status = types.PipelineStatusOK
-			continue
-		}
-		if jobRun.Status == types.PipelineStatusWait && status == types.PipelineStatusOK {
-			status = types.PipelineStatusDoing
+	}
+	if hasError {
+		if hasWait && stageRun.FailurePolicy != types.StageFailurePolicyFailFast {
+			return types.PipelineStatusDoing
 		}
+		return types.PipelineStatusError
+	}
+	if hasCancel {
+		return types.PipelineStatusCancel
+	}
+	if (hasOK || hasSkipped) && hasWait {
+		return types.PipelineStatusDoing
+	}
+	if hasOK {
+		return types.PipelineStatusOK
 	}
-	if status == "" {
-		status = stageRun.Status
+	if hasSkipped {
+		return types.PipelineStatusSkipped
 	}
-	return status
+	return stageRun.Status
+}
+
+// GetPipelineRunStatus 根据所有阶段的状态返回构建的状态，依次判断是否有doing/error/pause/cancel的阶段，
+// 所有阶段都执行成功时，由执行流程将构建置为ok
+func (p *ManagerPipelineRun) GetPipelineRunStatus(stageStatuses []string) string {
+	for _, status := range []string{
+		types.PipelineStatusDoing,
+		types.PipelineStatusError,
+		types.PipelineStatusPause,
+		types.PipelineStatusCancel,
+	} {
+		if utils.Contains(stageStatuses, status) {
+			return status
+		}
+	}
+	return types.PipelineStatusDoing
 }
 
 func (p *ManagerPipelineRun) GetStageRunEnv(stageRun *types.PipelineRunStage) types.Map {
@@ -258,6 +542,44 @@ func (p *ManagerPipelineRun) GetStageRunEnv(stageRun *types.PipelineRunStage) ty
 	return stageEnvs
 }
 
+// updateJobRunAttempt 任务开始执行时新增一次执行记录，执行结束时更新该次执行的状态以及结果，
+// 任务失败后等待自动重试时，该次执行记为失败
+func (p *ManagerPipelineRun) updateJobRunAttempt(tx *gorm.DB, currJob, runJob *types.PipelineRunJob) error {
+	if currJob.Status != types.PipelineStatusDoing && runJob.Status == types.PipelineStatusDoing {
+		var logOffset int64
+		if err := tx.Model(&types.PipelineRunJobLog{}).
+			Select("IFNULL(MAX(log_offset + LENGTH(logs)), 0)").
+			Where("job_run_id = ?", runJob.ID).
+			Scan(&logOffset).Error; err != nil {
+			return err
+		}
+		runJob.Attempt = currJob.Attempt + 1
+		return tx.Create(&types.PipelineRunJobAttempt{
+			JobRunId:   runJob.ID,
+			Attempt:    runJob.Attempt,
+			Status:     types.PipelineStatusDoing,
+			LogOffset:  logOffset,
+			ExecTime:   runJob.ExecTime,
+			CreateTime: time.Now(),
+			UpdateTime: time.Now(),
+		}).Error
+	}
+	if currJob.Status == types.PipelineStatusDoing && runJob.Status != types.PipelineStatusDoing {
+		status := runJob.Status
+		if status == types.PipelineStatusWait {
+			status = types.PipelineStatusError
+		}
+		return tx.Model(&types.PipelineRunJobAttempt{}).
+			Where("job_run_id = ? and attempt = ?", runJob.ID, currJob.Attempt).
+			Updates(map[string]interface{}{
+				"status":      status,
+				"result":      runJob.Result,
+				"update_time": time.Now(),
+			}).Error
+	}
+	return nil
+}
+
 type UpdateStageObj struct {
 	StageRunId     uint
 	StageRunStatus string
@@ -278,13 +600,28 @@ func (p *ManagerPipelineRun) UpdatePipelineStageRun(updateStageObj *UpdateStageO
 	err := p.DB.Transaction(func(tx *gorm.DB) error {
 		var err error
 
-		if err = tx.Set("gorm:query_option", "FOR UPDATE").First(&stageRun, updateStageObj.StageRunId).Error; err != nil {
+		if err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&stageRun, updateStageObj.StageRunId).Error; err != nil {
 			return err
 		}
 
 		if updateStageObj.StageRunJobs != nil {
 			for _, runJob := range updateStageObj.StageRunJobs {
-				if err := tx.Save(runJob).Error; err != nil {
+				var currJob types.PipelineRunJob
+				if err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&currJob, runJob.ID).Error; err != nil {
+					return err
+				}
+				// 任务已被取消，不再更新任务状态
+				if currJob.Status == types.PipelineStatusCancel {
+					runJob.Status = types.PipelineStatusCancel
+					continue
+				}
+				if err = p.updateJobRunAttempt(tx, &currJob, runJob); err != nil {
+					return err
+				}
+				// 任务的密钥掩码、回调令牌以及执行实例只通过单独的方法更新，避免被内存中的旧数据覆盖，
+				// 已取消的任务不会被更新
+				if err := tx.Select("*").Omit("masks", "callback_token", "executor", "heartbeat_time").
+					Where("status <> ?", types.PipelineStatusCancel).Save(runJob).Error; err != nil {
 					return err
 				}
 			}
@@ -310,14 +647,17 @@ func (p *ManagerPipelineRun) UpdatePipelineStageRun(updateStageObj *UpdateStageO
 		if err = tx.First(&pipelineRun, stageRun.PipelineRunId).Error; err != nil {
 			return err
 		}
-		if stageRun.Status == types.PipelineStatusError {
-			pipelineRun.Status = types.PipelineStatusError
-		} else if stageRun.Status == types.PipelineStatusDoing {
-			pipelineRun.Status = types.PipelineStatusDoing
-		} else if stageRun.Status == types.PipelineStatusOK {
-			pipelineRun.Status = types.PipelineStatusDoing
-		} else if stageRun.Status == types.PipelineStatusPause {
-			pipelineRun.Status = types.PipelineStatusPause
+		// 构建已取消时，不再根据阶段状态更新构建状态
+		if pipelineRun.Status != types.PipelineStatusCancel {
+			var otherStages []types.PipelineRunStage
+			if err = tx.Where("pipeline_run_id = ? and id != ?", stageRun.PipelineRunId, stageRun.ID).Find(&otherStages).Error; err != nil {
+				return err
+			}
+			stageStatuses := []string{stageRun.Status}
+			for _, s := range otherStages {
+				stageStatuses = append(stageStatuses, s.Status)
+			}
+			pipelineRun.Status = p.GetPipelineRunStatus(stageStatuses)
 		}
 		now := time.Now()
 		stageRun.UpdateTime = now
@@ -337,6 +677,65 @@ func (p *ManagerPipelineRun) UpdatePipelineStageRun(updateStageObj *UpdateStageO
 	return &pipelineRun, &stageRun, nil
 }
 
+// CancelPipelineRun 取消流水线构建，将构建以及未完成的阶段、任务状态置为cancel，返回取消之前正在执行的任务
+func (p *ManagerPipelineRun) CancelPipelineRun(pipelineRunId uint) (*types.PipelineRun, types.PipelineRunJobs, error) {
+	var pipelineRun types.PipelineRun
+	var doingJobs types.PipelineRunJobs
+	unfinishedStatus := []string{types.PipelineStatusWait, types.PipelineStatusDoing, types.PipelineStatusPause}
+	err := p.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&pipelineRun, pipelineRunId).Error; err != nil {
+			return err
+		}
+		if !utils.Contains(unfinishedStatus, pipelineRun.Status) {
+			return fmt.Errorf("当前构建状态为%s，不能取消", pipelineRun.Status)
+		}
+		var stageRuns []types.PipelineRunStage
+		if err := tx.Where("pipeline_run_id = ?", pipelineRunId).Find(&stageRuns).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, stageRun := range stageRuns {
+			var jobRuns []types.PipelineRunJob
+			if err := tx.Where("stage_run_id = ?", stageRun.ID).Find(&jobRuns).Error; err != nil {
+				return err
+			}
+			for i, jobRun := range jobRuns {
+				if jobRun.Status != types.PipelineStatusWait && jobRun.Status != types.PipelineStatusDoing {
+					continue
+				}
+				if jobRun.Status == types.PipelineStatusDoing {
+					doingJobs = append(doingJobs, &jobRuns[i])
+					if err := tx.Model(&types.PipelineRunJobAttempt{}).
+						Where("job_run_id = ? and attempt = ?", jobRun.ID, jobRun.Attempt).
+						Updates(map[string]interface{}{"status": types.PipelineStatusCancel, "update_time": now}).Error; err != nil {
+						return err
+					}
+				}
+				jobRuns[i].Status = types.PipelineStatusCancel
+				jobRuns[i].UpdateTime = now
+				if err := tx.Select("status", "update_time").Save(&jobRuns[i]).Error; err != nil {
+					return err
+				}
+			}
+			if utils.Contains(unfinishedStatus, stageRun.Status) {
+				stageRun.Status = types.PipelineStatusCancel
+				stageRun.UpdateTime = now
+				if err := tx.Select("status", "update_time").Save(&stageRun).Error; err != nil {
+					return err
+				}
+			}
+		}
+		pipelineRun.Status = types.PipelineStatusCancel
+		pipelineRun.UpdateTime = now
+		return tx.Save(&pipelineRun).Error
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	p.StreamPipelineRun(&pipelineRun)
+	return &pipelineRun, doingJobs, nil
+}
+
 func (p *ManagerPipelineRun) UpdatePipelineRun(pipelineRun *types.PipelineRun) error {
 	pipelineRun.UpdateTime = time.Now()
 	if err := p.DB.Save(pipelineRun).Error; err != nil {
@@ -348,6 +747,7 @@ func (p *ManagerPipelineRun) UpdatePipelineRun(pipelineRun *types.PipelineRun) e
 
 func (p *ManagerPipelineRun) StreamPipelineRun(pipelineRun *types.PipelineRun) {
 	stageRuns, _ := p.StagesRun(pipelineRun.ID)
+	pipelineRun, stageRuns = p.MaskPipelineRun(pipelineRun, stageRuns)
 	event := sse.Event{
 		Labels: map[string]string{
 			sse.EventLabelType:       sse.EventTypePipelineRun,
@@ -362,19 +762,146 @@ func (p *ManagerPipelineRun) StreamPipelineRun(pipelineRun *types.PipelineRun) {
 	p.middleMessage.SendGlobalWatch(event)
 }
 
+// UpdateJobRunMasks 更新任务执行参数中的密钥掩码
+func (p *ManagerPipelineRun) UpdateJobRunMasks(jobRunId uint, masks []string) error {
+	return p.DB.Model(&types.PipelineRunJob{}).Where("id = ?", jobRunId).
+		Update("masks", types.StringList(masks)).Error
+}
+
+// UpdateJobRunCallbackToken 更新外部插件回调任务的一次性令牌
+func (p *ManagerPipelineRun) UpdateJobRunCallbackToken(jobRunId uint, token string) error {
+	return p.DB.Model(&types.PipelineRunJob{}).Where("id = ?", jobRunId).
+		Update("callback_token", token).Error
+}
+
+// ClaimJobRun 将任务的执行实例设置为executor，并更新心跳时间
+func (p *ManagerPipelineRun) ClaimJobRun(jobRunId uint, executor string) error {
+	return p.DB.Model(&types.PipelineRunJob{}).Where("id = ?", jobRunId).UpdateColumns(map[string]interface{}{
+		"executor":       executor,
+		"heartbeat_time": time.Now(),
+	}).Error
+}
+
+// HeartbeatJobRuns 更新实例executor正在执行以及等待重试的任务心跳时间
+func (p *ManagerPipelineRun) HeartbeatJobRuns(executor string) error {
+	statuses := []string{types.PipelineStatusWait, types.PipelineStatusDoing}
+	return p.DB.Model(&types.PipelineRunJob{}).Where("executor = ? and status in ?", executor, statuses).
+		UpdateColumn("heartbeat_time", time.Now()).Error
+}
+
+// ClaimOrphanedPipelineRun 执行中的构建在expiredBefore之后没有更新，并且未完成任务的执行实例心跳都已超时，
+// 则将未完成的任务转移到实例executor，返回是否转移成功，转移成功的构建由executor恢复执行
+func (p *ManagerPipelineRun) ClaimOrphanedPipelineRun(pipelineRunId uint, executor string, expiredBefore time.Time) (bool, error) {
+	claimed := false
+	err := p.DB.Transaction(func(tx *gorm.DB) error {
+		var pipelineRun types.PipelineRun
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&pipelineRun, pipelineRunId).Error; err != nil {
+			return err
+		}
+		if pipelineRun.Status != types.PipelineStatusDoing || !pipelineRun.UpdateTime.Before(expiredBefore) {
+			return nil
+		}
+		stageRunIds := tx.Model(&types.PipelineRunStage{}).Select("id").Where("pipeline_run_id = ?", pipelineRunId)
+		unfinishedStatus := []string{types.PipelineStatusWait, types.PipelineStatusDoing}
+		var aliveCnt int64
+		if err := tx.Model(&types.PipelineRunJob{}).
+			Where("stage_run_id in (?) and status in ? and heartbeat_time >= ?", stageRunIds, unfinishedStatus, expiredBefore).
+			Count(&aliveCnt).Error; err != nil {
+			return err
+		}
+		if aliveCnt > 0 {
+			return nil
+		}
+		now := time.Now()
+		if err := tx.Model(&types.PipelineRunJob{}).
+			Where("stage_run_id in (?) and status in ?", stageRunIds, unfinishedStatus).
+			UpdateColumns(map[string]interface{}{"executor": executor, "heartbeat_time": now}).Error; err != nil {
+			return err
+		}
+		claimed = true
+		return tx.Model(&pipelineRun).Update("update_time", now).Error
+	})
+	return claimed, err
+}
+
+// ConsumeJobRunCallbackToken 执行中的任务回调令牌匹配时清空令牌，返回令牌是否有效，令牌只能使用一次
+func (p *ManagerPipelineRun) ConsumeJobRunCallbackToken(jobRunId uint, token string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+	result := p.DB.Model(&types.PipelineRunJob{}).
+		Where("id = ? and status = ? and callback_token = ?", jobRunId, types.PipelineStatusDoing, token).
+		Update("callback_token", "")
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// JobRunMasker 获取任务的密钥掩码
+func (p *ManagerPipelineRun) JobRunMasker(jobRunId uint) (*utils.Masker, error) {
+	jobRun, err := p.GetJobRun(jobRunId)
+	if err != nil {
+		return nil, err
+	}
+	return utils.NewMasker(jobRun.Masks), nil
+}
+
+// MaskPipelineRun 使用构建中所有任务的密钥掩码替换构建、阶段以及任务中的参数、环境变量和执行结果，
+// 上游任务的环境变量会传递到下游阶段，因此使用整个构建的掩码。返回替换后的副本，不修改传入的对象
+func (p *ManagerPipelineRun) MaskPipelineRun(pipelineRun *types.PipelineRun, stagesRun []*types.PipelineRunStage) (*types.PipelineRun, []*types.PipelineRunStage) {
+	var masks []string
+	for _, stageRun := range stagesRun {
+		for _, jobRun := range stageRun.Jobs {
+			masks = append(masks, jobRun.Masks...)
+		}
+	}
+	if len(masks) == 0 {
+		return pipelineRun, stagesRun
+	}
+	masker := utils.NewMasker(masks)
+	var maskedRun *types.PipelineRun
+	if pipelineRun != nil {
+		maskedRun = &types.PipelineRun{}
+		if err := masker.MaskJSON(pipelineRun, maskedRun); err != nil {
+			klog.Errorf("mask pipeline run id=%d error: %s", pipelineRun.ID, err.Error())
+			return pipelineRun, nil
+		}
+	}
+	var maskedStages []*types.PipelineRunStage
+	for _, stageRun := range stagesRun {
+		maskedStage := &types.PipelineRunStage{}
+		if err := masker.MaskJSON(stageRun, maskedStage); err != nil {
+			klog.Errorf("mask stage run id=%d error: %s", stageRun.ID, err.Error())
+			return maskedRun, nil
+		}
+		maskedStages = append(maskedStages, maskedStage)
+	}
+	return maskedRun, maskedStages
+}
+
+// GetEnvBeforeStageRun 获取阶段执行前的env
+// 没有上游阶段时为构建的env，有多个上游阶段时，按照阶段id顺序合并上游阶段的env，相同key以后面的阶段为准
 func (p *ManagerPipelineRun) GetEnvBeforeStageRun(stageRun *types.PipelineRunStage) (envs map[string]interface{}, err error) {
-	if stageRun.PrevStageRunId == 0 {
+	prevIds := p.PrevStageRunIds(stageRun)
+	if len(prevIds) == 0 {
 		var pipelineRun types.PipelineRun
 		if err = p.DB.Last(&pipelineRun, "id = ?", stageRun.PipelineRunId).Error; err != nil {
 			return nil, err
 		}
 		envs = pipelineRun.Env
 	} else {
-		var prevStageRun types.PipelineRunStage
-		if err = p.DB.Last(&prevStageRun, "id = ? and pipeline_run_id = ?", stageRun.PrevStageRunId, stageRun.PipelineRunId).Error; err != nil {
+		var prevStageRuns []types.PipelineRunStage
+		if err = p.DB.Order("id").Find(&prevStageRuns, "id in ? and pipeline_run_id = ?", prevIds, stageRun.PipelineRunId).Error; err != nil {
 			return nil, err
 		}
-		envs = prevStageRun.Env
+		envs = make(map[string]interface{})
+		for _, prevStageRun := range prevStageRuns {
+			envs = utils.MergeReplaceMap(envs, prevStageRun.Env)
+		}
+	}
+	if envs == nil {
+		envs = make(map[string]interface{})
 	}
 	for k, v := range stageRun.CustomParams {
 		envs[k] = v
@@ -382,22 +909,62 @@ func (p *ManagerPipelineRun) GetEnvBeforeStageRun(stageRun *types.PipelineRunSta
 	return envs, nil
 }
 
+// ListJobRunAttempts 获取任务的所有执行记录，按执行顺序排列
+func (p *ManagerPipelineRun) ListJobRunAttempts(jobRunId uint) ([]types.PipelineRunJobAttempt, error) {
+	var attempts []types.PipelineRunJobAttempt
+	if err := p.DB.Where("job_run_id = ?", jobRunId).Order("attempt").Find(&attempts).Error; err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+// MaskJobRunAttempts 与MaskPipelineRun一致，使用任务所在构建中所有任务的密钥掩码替换执行记录中的执行结果
+func (p *ManagerPipelineRun) MaskJobRunAttempts(jobRunId uint, attempts []types.PipelineRunJobAttempt) ([]types.PipelineRunJobAttempt, error) {
+	jobRun, err := p.GetJobRun(jobRunId)
+	if err != nil {
+		return nil, err
+	}
+	stagesRun, err := p.StagesRun(jobRun.PipelineRunId)
+	if err != nil {
+		return nil, err
+	}
+	var masks []string
+	for _, stageRun := range stagesRun {
+		for _, job := range stageRun.Jobs {
+			masks = append(masks, job.Masks...)
+		}
+	}
+	if len(masks) == 0 {
+		return attempts, nil
+	}
+	var maskedAttempts []types.PipelineRunJobAttempt
+	if err = utils.NewMasker(masks).MaskJSON(attempts, &maskedAttempts); err != nil {
+		return nil, err
+	}
+	return maskedAttempts, nil
+}
+
+// GetJobRunLog 获取任务日志，withLog为true时按顺序合并所有日志块的内容，否则只返回最后一块日志的元信息
 func (p *ManagerPipelineRun) GetJobRunLog(jobRunId uint, withLog bool) (*types.PipelineRunJobLog, error) {
 	var jobLog types.PipelineRunJobLog
+	if err := p.DB.Select("id", "job_run_id", "log_offset", "create_time", "update_time").
+		Where("job_run_id = ?", jobRunId).Order("log_offset desc, id desc").Take(&jobLog).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
 	if withLog {
-		if err := p.DB.Last(&jobLog, "job_run_id = ?", jobRunId).Error; err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				return nil, nil
-			}
+		var chunks []types.PipelineRunJobLog
+		if err := p.DB.Where("job_run_id = ?", jobRunId).Order("log_offset, id").Find(&chunks).Error; err != nil {
 			return nil, err
 		}
-	} else {
-		if err := p.DB.Select("id", "job_run_id", "create_time", "update_time").Last(&jobLog, "job_run_id = ?", jobRunId).Error; err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				return nil, nil
-			}
-			return nil, err
+		var logs strings.Builder
+		for _, chunk := range chunks {
+			logs.WriteString(chunk.Logs)
 		}
+		jobLog.Logs = logs.String()
+		jobLog.LogOffset = 0
 	}
 	return &jobLog, nil
 }
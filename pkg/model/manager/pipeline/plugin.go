@@ -21,7 +21,7 @@ func NewPipelinePluginManager(db *gorm.DB) *ManagerPipelinePlugin {
 
 func (p *ManagerPipelinePlugin) Get(pluginId uint) (*types.PipelinePlugin, error) {
 	var plugin types.PipelinePlugin
-	if err := p.DB.First(plugin, pluginId).Error; err != nil {
+	if err := p.DB.First(&plugin, pluginId).Error; err != nil {
 		return nil, err
 	}
 	return &plugin, nil
@@ -35,12 +35,68 @@ func (p *ManagerPipelinePlugin) GetByKey(pluginKey string) (*types.PipelinePlugi
 	return &plugin, nil
 }
 
+func (p *ManagerPipelinePlugin) List() ([]types.PipelinePlugin, error) {
+	var plugins []types.PipelinePlugin
+	if err := p.DB.Order("id").Find(&plugins).Error; err != nil {
+		return nil, err
+	}
+	return plugins, nil
+}
+
+func (p *ManagerPipelinePlugin) Create(plugin *types.PipelinePlugin) (*types.PipelinePlugin, error) {
+	if err := p.DB.Create(plugin).Error; err != nil {
+		return nil, err
+	}
+	return plugin, nil
+}
+
+func (p *ManagerPipelinePlugin) Update(plugin *types.PipelinePlugin) (*types.PipelinePlugin, error) {
+	if err := p.DB.Save(plugin).Error; err != nil {
+		return nil, err
+	}
+	return plugin, nil
+}
+
+func (p *ManagerPipelinePlugin) Delete(plugin *types.PipelinePlugin) error {
+	return p.DB.Delete(plugin).Error
+}
+
+// IsBuiltin 插件是否为内置插件，内置插件在服务启动时初始化，不可以通过接口修改
+func (p *ManagerPipelinePlugin) IsBuiltin(pluginKey string) bool {
+	for _, plugin := range BuiltinPlugins {
+		if plugin.Key == pluginKey {
+			return true
+		}
+	}
+	return false
+}
+
+// ReferencedPipelines 返回流水线阶段任务中使用了该插件的流水线id
+func (p *ManagerPipelinePlugin) ReferencedPipelines(pluginKey string) ([]uint, error) {
+	var stages []types.PipelineStage
+	if err := p.DB.Select("pipeline_id", "jobs").Find(&stages).Error; err != nil {
+		return nil, err
+	}
+	var pipelineIds []uint
+	for _, stage := range stages {
+		for _, job := range stage.Jobs {
+			if job.PluginKey == pluginKey {
+				pipelineIds = append(pipelineIds, stage.PipelineId)
+				break
+			}
+		}
+	}
+	return pipelineIds, nil
+}
+
 var BuiltinPlugins = []types.PipelinePlugin{
 	{
-		Name:    "构建代码镜像",
-		Key:     types.BuiltinPluginBuildCodeToImage,
-		Version: "1.0",
-		Url:     conf.AppConfig.PipelinePluginUrl + "/" + types.BuiltinPluginBuildCodeToImage,
+		Name:      "构建代码镜像",
+		Key:       types.BuiltinPluginBuildCodeToImage,
+		Version:   "1.0",
+		Resumable: true,
+		Timeout:   3600,
+		Url:       conf.AppConfig.PipelinePluginUrl + "/" + types.BuiltinPluginBuildCodeToImage,
 		Params: types.PipelinePluginParams{
 			Params: []*types.PipelinePluginParamsSpec{
 				{
@@ -141,10 +197,12 @@ var BuiltinPlugins = []types.PipelinePlugin{
 		},
 	},
 	{
-		Name:    "执行shell脚本",
-		Key:     types.BuiltinPluginExecuteShell,
-		Version: "1.0",
-		Url:     conf.AppConfig.PipelinePluginUrl + "/" + types.BuiltinPluginExecuteShell,
+		Name:      "执行shell脚本",
+		Key:       types.BuiltinPluginExecuteShell,
+		Version:   "1.0",
+		Resumable: false,
+		Timeout:   3600,
+		Url:       conf.AppConfig.PipelinePluginUrl + "/" + types.BuiltinPluginExecuteShell,
 		Params: types.PipelinePluginParams{
 			Params: []*types.PipelinePluginParamsSpec{
 				{
@@ -181,10 +239,60 @@ var BuiltinPlugins = []types.PipelinePlugin{
 		},
 	},
 	{
-		Name:    "升级空间应用",
-		Key:     types.BuiltinPluginUpgradeApp,
-		Version: "1.0",
-		Url:     types.PipelinePluginBuiltinUrl,
+		Name:      "在集群中执行shell脚本",
+		Key:       types.BuiltinPluginExecuteShellJob,
+		Version:   "1.0",
+		Resumable: false,
+		Timeout:   3600,
+		Url:       types.PipelinePluginBuiltinUrl,
+		Params: types.PipelinePluginParams{
+			Params: []*types.PipelinePluginParamsSpec{
+				{
+					ParamName: "cluster",
+					From:      types.PluginParamsFromJob,
+					FromName:  "cluster",
+					Default:   "",
+				},
+				{
+					ParamName: "namespace",
+					From:      types.PluginParamsFromJob,
+					FromName:  "namespace",
+					Default:   "default",
+				},
+				{
+					ParamName: "image",
+					From:      types.PluginParamsFromJob,
+					FromName:  "image",
+					Default:   "",
+				},
+				{
+					ParamName: "script",
+					From:      types.PluginParamsFromJob,
+					FromName:  "script",
+					Default:   "",
+				},
+				{
+					ParamName: "shell",
+					From:      types.PluginParamsFromJob,
+					FromName:  "shell",
+					Default:   "bash",
+				},
+				{
+					ParamName: "env",
+					From:      types.PluginParamsFromPipelineEnv,
+					FromName:  "",
+					Default:   nil,
+				},
+			},
+		},
+	},
+	{
+		Name:      "升级空间应用",
+		Key:       types.BuiltinPluginUpgradeApp,
+		Version:   "1.2",
+		Resumable: true,
+		Timeout:   1800,
+		Url:       types.PipelinePluginBuiltinUrl,
 		Params: types.PipelinePluginParams{
 			Params: []*types.PipelinePluginParamsSpec{
 				{
@@ -211,14 +319,34 @@ var BuiltinPlugins = []types.PipelinePlugin{
 					FromName:  "with_install",
 					Default:   true,
 				},
+				{
+					ParamName: "wait_rollout",
+					From:      types.PluginParamsFromJob,
+					FromName:  "wait_rollout",
+					Default:   true,
+				},
+				{
+					ParamName: "rollout_timeout",
+					From:      types.PluginParamsFromJob,
+					FromName:  "rollout_timeout",
+					Default:   300,
+				},
+				{
+					ParamName: "rollback_on_failure",
+					From:      types.PluginParamsFromJob,
+					FromName:  "rollback_on_failure",
+					Default:   false,
+				},
 			},
 		},
 	},
 	{
-		Name:    "版本发布",
-		Key:     types.BuiltinPluginRelease,
-		Version: "1.0",
-		Url:     conf.AppConfig.PipelinePluginUrl + "/" + types.BuiltinPluginRelease,
+		Name:      "版本发布",
+		Key:       types.BuiltinPluginRelease,
+		Version:   "2.0",
+		Resumable: false,
+		Timeout:   1800,
+		Url:       types.PipelinePluginBuiltinUrl,
 		Params: types.PipelinePluginParams{
 			Params: []*types.PipelinePluginParamsSpec{
 				{
@@ -285,10 +413,12 @@ var BuiltinPlugins = []types.PipelinePlugin{
 		},
 	},
 	{
-		Name:    "部署K8s资源",
-		Key:     types.BuiltinPluginDeployK8s,
-		Version: "1.0",
-		Url:     types.PipelinePluginBuiltinUrl,
+		Name:      "部署K8s资源",
+		Key:       types.BuiltinPluginDeployK8s,
+		Version:   "1.2",
+		Resumable: true,
+		Timeout:   1800,
+		Url:       types.PipelinePluginBuiltinUrl,
 		Params: types.PipelinePluginParams{
 			Params: []*types.PipelinePluginParamsSpec{
 				{
@@ -315,6 +445,150 @@ var BuiltinPlugins = []types.PipelinePlugin{
 					FromName:  "yaml",
 					Default:   "",
 				},
+				{
+					ParamName: "wait_rollout",
+					From:      types.PluginParamsFromJob,
+					FromName:  "wait_rollout",
+					Default:   true,
+				},
+				{
+					ParamName: "rollout_timeout",
+					From:      types.PluginParamsFromJob,
+					FromName:  "rollout_timeout",
+					Default:   300,
+				},
+				{
+					ParamName: "rollback_on_failure",
+					From:      types.PluginParamsFromJob,
+					FromName:  "rollback_on_failure",
+					Default:   false,
+				},
+			},
+		},
+	},
+	{
+		Name:      "部署Helm应用",
+		Key:       types.BuiltinPluginDeployHelm,
+		Version:   "1.0",
+		Resumable: true,
+		Timeout:   1800,
+		Url:       types.PipelinePluginBuiltinUrl,
+		Params: types.PipelinePluginParams{
+			Params: []*types.PipelinePluginParamsSpec{
+				{
+					ParamName: "cluster",
+					From:      types.PluginParamsFromJob,
+					FromName:  "cluster",
+					Default:   "",
+				},
+				{
+					ParamName: "namespace",
+					From:      types.PluginParamsFromJob,
+					FromName:  "namespace",
+					Default:   "default",
+				},
+				{
+					ParamName: "name",
+					From:      types.PluginParamsFromJob,
+					FromName:  "name",
+					Default:   "",
+				},
+				{
+					ParamName: "chart_source",
+					From:      types.PluginParamsFromJob,
+					FromName:  "chart_source",
+					Default:   "app_store",
+				},
+				{
+					ParamName: "app",
+					From:      types.PluginParamsFromJob,
+					FromName:  "app",
+					Default:   0,
+				},
+				{
+					ParamName: "resource",
+					From:      types.PluginParamsFromPipelineResource,
+					FromName:  "resource",
+					Default:   nil,
+				},
+				{
+					ParamName: "chart",
+					From:      types.PluginParamsFromJob,
+					FromName:  "chart",
+					Default:   "",
+				},
+				{
+					ParamName: "chart_version",
+					From:      types.PluginParamsFromJob,
+					FromName:  "chart_version",
+					Default:   "",
+				},
+				{
+					ParamName: "code_url",
+					From:      types.PluginParamsFromEnv,
+					FromName:  "PIPELINE_CODE_URL",
+					Default:   "",
+				},
+				{
+					ParamName: "code_commit_id",
+					From:      types.PluginParamsFromEnv,
+					FromName:  "PIPELINE_CODE_COMMIT_ID",
+					Default:   "",
+				},
+				{
+					ParamName: "code_secret",
+					From:      types.PluginParamsFromCodeSecret,
+					FromName:  "",
+					Default:   nil,
+				},
+				{
+					ParamName: "values",
+					From:      types.PluginParamsFromJob,
+					FromName:  "values",
+					Default:   "",
+				},
+				{
+					ParamName: "set",
+					From:      types.PluginParamsFromJob,
+					FromName:  "set",
+					Default:   nil,
+				},
+				{
+					ParamName: "images",
+					From:      types.PluginParamsFromEnv,
+					FromName:  "CODE_BUILD_IMAGES",
+					Default:   "",
+				},
+				{
+					ParamName: "env",
+					From:      types.PluginParamsFromPipelineEnv,
+					FromName:  "",
+					Default:   nil,
+				},
+				{
+					ParamName: "wait_rollout",
+					From:      types.PluginParamsFromJob,
+					FromName:  "wait_rollout",
+					Default:   true,
+				},
+				{
+					ParamName: "rollout_timeout",
+					From:      types.PluginParamsFromJob,
+					FromName:  "rollout_timeout",
+					Default:   300,
+				},
+			},
+		},
+		ResultEnv: types.PipelinePluginResultEnv{
+			EnvPath: []*types.PipelinePluginResultEnvPath{
+				{
+					ResultName: "revision",
+					EnvName:    "HELM_RELEASE_REVISION",
+				},
+				{
+					ResultName: "manifest",
+					EnvName:    "HELM_RELEASE_MANIFEST",
+				},
 			},
 		},
 	},
@@ -334,7 +608,8 @@ func (p *ManagerPipelinePlugin) Init() {
 		if url != types.PipelinePluginBuiltinUrl {
 			url = conf.AppConfig.PipelinePluginUrl + "/" + plugin.Key
 		}
-		if dbPlugin.ID == 0 || dbPlugin.Version != plugin.Version || dbPlugin.Url != url {
+		if dbPlugin.ID == 0 || dbPlugin.Version != plugin.Version || dbPlugin.Url != url || dbPlugin.Resumable != plugin.Resumable ||
+			dbPlugin.Timeout != plugin.Timeout {
 			plugin.Url = url
 			plugin.UpdateTime = now
 			if dbPlugin.ID == 0 {
@@ -346,6 +621,13 @@ func (p *ManagerPipelinePlugin) Init() {
 				if err := p.DB.Model(&dbPlugin).Updates(plugin).Error; err != nil {
 					klog.Infof("update pipeline plugin %s=%s error: %s", plugin.Key, plugin.Name, err.Error())
 				}
+				// Updates不会更新零值字段
+				if err := p.DB.Model(&dbPlugin).Updates(map[string]interface{}{
+					"resumable": plugin.Resumable,
+					"timeout":   plugin.Timeout,
+				}).Error; err != nil {
+					klog.Infof("update pipeline plugin %s=%s error: %s", plugin.Key, plugin.Name, err.Error())
+				}
 			}
 		}
 	}
@@ -35,3 +35,11 @@ func (l *Release) ExistsRelease(workspaceId uint, version string) (bool, error)
 	}
 	return false, nil
 }
+
+func (l *Release) Create(release *types.PipelineWorkspaceRelease) error {
+	return l.DB.Create(release).Error
+}
+
+func (l *Release) Delete(id uint) error {
+	return l.DB.Delete(&types.PipelineWorkspaceRelease{}, id).Error
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/kubespace/kubespace/pkg/model/types"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"os"
 	"strconv"
 	"time"
@@ -69,6 +70,40 @@ func (v *AppVersionManager) CreateAppVersionWithChartByte(chartBytes []byte, sco
 	return appVersion, nil
 }
 
+// CreateChart 只保存chart包内容，用于流水线部署不属于应用的chart
+func (v *AppVersionManager) CreateChart(path string, chartBytes []byte) error {
+	chart := &types.AppVersionChart{
+		Path:       path,
+		Content:    chartBytes,
+		CreateTime: time.Now(),
+		UpdateTime: time.Now(),
+	}
+	return v.DB.Create(chart).Error
+}
+
+// SaveChart 保存chart包，路径已存在时覆盖chart包内容，用于流水线任务重试或者重新执行时重复保存同一路径的chart
+func (v *AppVersionManager) SaveChart(path string, chartBytes []byte) error {
+	return v.DB.Transaction(func(tx *gorm.DB) error {
+		var chart types.AppVersionChart
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&chart, "path = ?", path).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return tx.Create(&types.AppVersionChart{
+				Path:       path,
+				Content:    chartBytes,
+				CreateTime: time.Now(),
+				UpdateTime: time.Now(),
+			}).Error
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Model(&chart).Updates(map[string]interface{}{
+			"content":     chartBytes,
+			"update_time": time.Now(),
+		}).Error
+	})
+}
+
 func (v *AppVersionManager) GetAppVersion(appVersionId uint) (*types.AppVersion, error) {
 	var appVersion types.AppVersion
 	if err := v.DB.First(&appVersion, "id = ?", appVersionId).Error; err != nil {
@@ -172,6 +172,18 @@ func (a *AppManager) ImportApp(app *types.ProjectApp, appVersion *types.AppVersi
 	})
 }
 
+// GetLatestRevision 获取应用最新的安装版本，没有版本记录时返回nil
+func (a *AppManager) GetLatestRevision(appId uint) (*types.ProjectAppRevision, error) {
+	var revision types.ProjectAppRevision
+	if err := a.DB.Last(&revision, "project_app_id = ?", appId).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &revision, nil
+}
+
 func (a *AppManager) CreateRevision(appVersion *types.AppVersion, app *types.ProjectApp) (*types.ProjectAppRevision, error) {
 	if app.Scope == types.AppVersionScopeProjectApp {
 		var revision types.ProjectAppRevision
@@ -108,6 +108,14 @@ func (r *UserRoleManager) List(scope string, scopeId uint) ([]*types.UserRole, e
 	return resRoles, nil
 }
 
+func (r *UserRoleManager) Get(id uint) (*types.UserRole, error) {
+	var userRole types.UserRole
+	if err := r.DB.First(&userRole, "id=?", id).Error; err != nil {
+		return nil, err
+	}
+	return &userRole, nil
+}
+
 func (r *UserRoleManager) CreateOrUpdate(scope string, scopeId uint, userIds []uint, role string) error {
 	for _, userId := range userIds {
 		var userRole types.UserRole
@@ -16,6 +16,7 @@ type Models struct {
 	*manager.TokenManager
 	*manager.RoleManager
 	*manager.AppManager
+	LockManager *manager.LockManager
 	*pipeline.ManagerPipeline
 	*pipeline.ManagerPipelineRun
 	PipelineWorkspaceManager *pipeline.WorkspaceManager
@@ -44,6 +45,7 @@ func NewModels(redisOp *redis.Options, mysqlOptions *mysql.Options) (*Models, er
 	role := manager.NewRoleManager(client)
 	tk := manager.NewTokenManager(client)
 	app := manager.NewAppManager(client)
+	lock := manager.NewLockManager(client)
 
 	user := manager.NewUserManager(db)
 	userRole := manager.NewUserRoleManager(db, user)
@@ -72,6 +74,7 @@ func NewModels(redisOp *redis.Options, mysqlOptions *mysql.Options) (*Models, er
 		TokenManager:             tk,
 		RoleManager:              role,
 		AppManager:               app,
+		LockManager:              lock,
 		ManagerPipeline:          pipelineMgr,
 		ManagerPipelineRun:       pipelineRunMgr,
 		PipelineWorkspaceManager: pipelineWorkspaceMgr,
@@ -41,6 +41,7 @@ func DbMigrate(db *gorm.DB) error {
 		&types.PipelineRunStage{},
 		&types.PipelineRunJob{},
 		&types.PipelineRunJobLog{},
+		&types.PipelineRunJobAttempt{},
 		&types.PipelineResource{},
 		&types.PipelineWorkspaceRelease{},
 
@@ -22,6 +22,20 @@ const (
 const (
 	StageTriggerModeAuto   = "auto"
 	StageTriggerModeManual = "manual"
+	// StageTriggerModeApproval 审批阶段，执行前暂停，只有指定的审批人审批通过后才会执行
+	StageTriggerModeApproval = "approval"
+)
+
+const (
+	StageApprovalApprove = "approve"
+	StageApprovalReject  = "reject"
+)
+
+const (
+	// StageFailurePolicyWaitAll 阶段中有任务失败时，等待其它任务执行完成
+	StageFailurePolicyWaitAll = "wait_all"
+	// StageFailurePolicyFailFast 阶段中有任务失败时，取消其它未完成的任务
+	StageFailurePolicyFailFast = "fail_fast"
 )
 
 const (
@@ -31,6 +45,8 @@ const (
 	PipelineStatusOK     = "ok"
 	PipelineStatusError  = "error"
 	PipelineStatusPause  = "pause"
+	// PipelineStatusSkipped 阶段或任务的执行条件不满足，跳过执行，跳过视为执行成功
+	PipelineStatusSkipped = "skipped"
 
 	PipelineEnvWorkspaceId         = "PIPELINE_WORKSPACE_ID"
 	PipelineEnvWorkspaceName       = "PIPELINE_WORKSPACE_NAME"
@@ -44,12 +60,24 @@ const (
 const (
 	PipelineTriggerTypeCode     = "code"
 	PipelineTriggerTypePipeline = "pipeline"
+	// PipelineTriggerTypeSchedule 根据cron表达式定时触发构建
+	PipelineTriggerTypeSchedule = "schedule"
+
+	// PipelineSystemUser 定时触发等由系统发起构建时的操作人
+	PipelineSystemUser = "system"
 
 	PipelineTriggerOperatorEqual   = "equal"
 	PipelineTriggerOperatorExclude = "exclude"
 	PipelineTriggerOperatorInclude = "regex"
 )
 
+const (
+	// PipelineDefinitionCode 流水线阶段以及任务从代码仓库中的配置文件读取，每次构建时使用构建提交中的配置
+	PipelineDefinitionCode = "code"
+	// PipelineCodeDefinitionFile 代码仓库中流水线配置文件的路径
+	PipelineCodeDefinitionFile = ".kubespace/pipeline.yaml"
+)
+
 type PipelineWorkspace struct {
 	ID           uint       `gorm:"primaryKey" json:"id"`
 	Name         string     `gorm:"size:255;not null;uniqueIndex" json:"name"`
@@ -63,6 +91,8 @@ type PipelineWorkspace struct {
 	UpdateUser   string     `gorm:"size:50;not null" json:"update_user"`
 	CreateTime   time.Time  `gorm:"column:create_time;not null;autoCreateTime" json:"create_time"`
 	UpdateTime   time.Time  `gorm:"column:update_time;not null;autoUpdateTime" json:"update_time"`
+	// 代码仓库webhook回调的校验密钥，仅在webhook接口中返回
+	WebhookSecret string `gorm:"size:64" json:"-"`
 }
 
 type PipelineWorkspaceRelease struct {
@@ -84,6 +114,57 @@ type Pipeline struct {
 	UpdateUser  string           `gorm:"size:50;not null" json:"update_user"`
 	CreateTime  time.Time        `gorm:"not null;autoCreateTime" json:"create_time"`
 	UpdateTime  time.Time        `gorm:"not null;autoUpdateTime" json:"update_time"`
+	// 代码空间构建时向代码仓库回写提交状态的配置
+	CommitStatus *PipelineCommitStatus `gorm:"type:json" json:"commit_status"`
+	// 流水线阶段的配置来源，为code时从代码仓库的配置文件读取，为空时使用流水线中配置的阶段
+	Definition string `gorm:"size:20;not null;default:''" json:"definition"`
+	// 可以读取流水线配置文件的受保护分支，支持通配符，如release/*，其它分支构建时使用流水线中配置的阶段
+	DefinitionBranches StringList `gorm:"type:json" json:"definition_branches"`
+	// 构建参数定义，构建时校验参数值并注入到构建的环境变量中
+	Params PipelineParams `gorm:"type:json" json:"params"`
+	// 流水线同时执行中（包括暂停）的最大构建数，超过时构建排队等待，为0时不限制
+	MaxConcurrent int `gorm:"not null;default:0" json:"max_concurrent"`
+	// 新建构建时，是否取消同一分支上未完成的旧构建
+	CancelSuperseded bool `gorm:"not null;default:false" json:"cancel_superseded"`
+}
+
+const (
+	CommitStatusProviderGithub = "github"
+	CommitStatusProviderGitlab = "gitlab"
+	CommitStatusProviderGitea  = "gitea"
+)
+
+// PipelineCommitStatus 流水线构建状态回写到代码提交的配置，使用代码空间密钥中的token访问代码仓库api
+type PipelineCommitStatus struct {
+	Enable   bool   `json:"enable"`
+	Provider string `json:"provider"`
+	// 代码仓库api地址，为空时根据代码地址生成
+	ApiUrl string `json:"api_url"`
+	// kubespace访问地址，用于生成构建详情链接，为空时不设置链接
+	KubespaceUrl string `json:"kubespace_url"`
+	// 提交状态的名称，为空时使用kubespace/<流水线名称>
+	Context string `json:"context"`
+}
+
+func (cs *PipelineCommitStatus) Scan(value interface{}) error {
+	bytes, ok := value.([]byte)
+	if !ok {
+		return errors.New(fmt.Sprint("Failed to convert to bytes:", value))
+	}
+	err := json.Unmarshal(bytes, cs)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal bytes: %s", string(bytes))
+	}
+	return nil
+}
+
+// Value return json value, implement driver.Valuer interface
+func (cs PipelineCommitStatus) Value() (driver.Value, error) {
+	bytes, err := json.Marshal(cs)
+	if err != nil {
+		return nil, err
+	}
+	return string(bytes), nil
 }
 
 type PipelineTriggers []*PipelineTrigger
@@ -109,6 +190,49 @@ func (pt PipelineTriggers) Value() (driver.Value, error) {
 	return string(bytes), nil
 }
 
+const (
+	PipelineParamTypeString = "string"
+	PipelineParamTypeChoice = "choice"
+	PipelineParamTypeBool   = "bool"
+	PipelineParamTypeNumber = "number"
+	// PipelineParamTypeSecret 参数值为密钥id，执行任务时才解析为密钥内容，日志中替换为***
+	PipelineParamTypeSecret = "secret"
+)
+
+type PipelineParams []*PipelineParam
+
+// PipelineParam 流水线构建参数，参数名称即注入到构建中的环境变量名称
+type PipelineParam struct {
+	Name        string      `json:"name"`
+	Type        string      `json:"type"`
+	Description string      `json:"description"`
+	Default     interface{} `json:"default"`
+	Required    bool        `json:"required"`
+	// 类型为choice时的可选值，类型为secret时为允许使用的密钥id
+	Options []string `json:"options"`
+}
+
+func (pp *PipelineParams) Scan(value interface{}) error {
+	bytes, ok := value.([]byte)
+	if !ok {
+		return errors.New(fmt.Sprint("Failed to convert to bytes:", value))
+	}
+	err := json.Unmarshal(bytes, pp)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal bytes: %s", string(bytes))
+	}
+	return nil
+}
+
+// Value return json value, implement driver.Valuer interface
+func (pp PipelineParams) Value() (driver.Value, error) {
+	bytes, err := json.Marshal(pp)
+	if err != nil {
+		return nil, err
+	}
+	return string(bytes), nil
+}
+
 const (
 	PipelineBranchTypeBranch  = "branch"
 	PipelineBranchTypeRequest = "request"
@@ -124,6 +248,10 @@ type PipelineTrigger struct {
 	BranchType    string `json:"branch_type"`
 	Operator      string `json:"operator"`
 	Branch        string `json:"branch"`
+	// 定时触发的cron表达式、时区以及构建参数，代码空间使用Branch作为构建分支
+	Cron     string                 `json:"cron"`
+	Timezone string                 `json:"timezone"`
+	Params   map[string]interface{} `json:"params"`
 }
 
 type PipelineStage struct {
@@ -135,6 +263,99 @@ type PipelineStage struct {
 	TriggerMode  string       `gorm:"size:20;not null;" json:"trigger_mode"`
 	PrevStageId  uint         `gorm:"not null" json:"prev_stage_id"`
 	Jobs         PipelineJobs `gorm:"type:json;not null" json:"jobs"`
+	// 阶段中任务的最大并发数，为0时不限制
+	MaxParallel   int    `gorm:"not null;default:0" json:"max_parallel"`
+	FailurePolicy string `gorm:"size:20;not null;default:''" json:"failure_policy"`
+	// 依赖的上游阶段名称，所有上游阶段执行成功后才会执行该阶段
+	DependsOn StringList `gorm:"type:json" json:"depends_on"`
+	// 阶段执行超时时间（秒），为0时不限制
+	Timeout int `gorm:"not null;default:0" json:"timeout"`
+	// 阶段执行条件，根据阶段执行前的env计算，为空时总是执行，不满足时跳过阶段
+	When string `gorm:"size:500;not null;default:''" json:"when"`
+	// 审批阶段的审批人配置
+	Approval PipelineStageApproval `gorm:"type:json" json:"approval"`
+}
+
+// PipelineStageApproval 审批阶段的审批人配置，用户以及角色满足其一即可审批
+type PipelineStageApproval struct {
+	// 可以审批的用户名
+	Users []string `json:"users"`
+	// 可以审批的流水线空间角色，拥有该角色或更高角色的空间成员都可以审批
+	Roles []string `json:"roles"`
+	// 需要审批通过的人数，为0时按1处理
+	Quorum int `json:"quorum"`
+}
+
+// RequiredApprovals 阶段执行需要审批通过的人数
+func (a *PipelineStageApproval) RequiredApprovals() int {
+	if a.Quorum < 1 {
+		return 1
+	}
+	return a.Quorum
+}
+
+func (a *PipelineStageApproval) Scan(value interface{}) error {
+	bytes, ok := value.([]byte)
+	if !ok {
+		return errors.New(fmt.Sprint("Failed to convert to bytes:", value))
+	}
+	err := json.Unmarshal(bytes, a)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal bytes: %s", string(bytes))
+	}
+	return nil
+}
+
+// Value return json value, implement driver.Valuer interface
+func (a PipelineStageApproval) Value() (driver.Value, error) {
+	bytes, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	return string(bytes), nil
+}
+
+// PipelineRunStageApproval 审批阶段的一次审批记录
+type PipelineRunStageApproval struct {
+	UserId   uint      `json:"user_id"`
+	UserName string    `json:"user_name"`
+	Result   string    `json:"result"`
+	Comment  string    `json:"comment"`
+	Time     time.Time `json:"time"`
+}
+
+type PipelineRunStageApprovals []*PipelineRunStageApproval
+
+// Approved 审批通过的人数
+func (a PipelineRunStageApprovals) Approved() int {
+	cnt := 0
+	for _, approval := range a {
+		if approval.Result == StageApprovalApprove {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+func (a *PipelineRunStageApprovals) Scan(value interface{}) error {
+	bytes, ok := value.([]byte)
+	if !ok {
+		return errors.New(fmt.Sprint("Failed to convert to bytes:", value))
+	}
+	err := json.Unmarshal(bytes, a)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal bytes: %s", string(bytes))
+	}
+	return nil
+}
+
+// Value return json value, implement driver.Valuer interface
+func (a PipelineRunStageApprovals) Value() (driver.Value, error) {
+	bytes, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	return string(bytes), nil
 }
 
 func (pj *PipelineJobs) Scan(value interface{}) error {
@@ -164,6 +385,66 @@ type PipelineJob struct {
 	Name      string                 `json:"name"`
 	PluginKey string                 `json:"plugin_key"`
 	Params    map[string]interface{} `json:"params"`
+	// 任务执行超时时间（秒），为0时使用插件的默认超时时间
+	Timeout int `json:"timeout"`
+	// 任务执行条件，根据阶段的env计算，为空时总是执行，不满足时跳过任务
+	When string `json:"when"`
+	// 任务执行失败后的自动重试策略，为空时不重试
+	Retry *PipelineJobRetry `json:"retry"`
+}
+
+// PipelineJobRetry 任务执行失败后的自动重试策略
+type PipelineJobRetry struct {
+	// 最大执行次数，包括第一次执行，小于等于1时不重试
+	MaxAttempts int `json:"max_attempts"`
+	// 第一次重试前等待的秒数
+	Backoff int `json:"backoff"`
+	// 每次重试等待时间相对上一次的倍数，小于1时按1处理，即固定间隔重试
+	BackoffFactor float64 `json:"backoff_factor"`
+	// 重试前最大等待秒数，为0时不限制
+	MaxBackoff int `json:"max_backoff"`
+	// 触发重试的执行结果码，如PluginError，为空时只重试RequestError以及TimeoutError
+	RetryOn []string `json:"retry_on"`
+}
+
+// BackoffDuration 第retries+1次重试前等待的时间
+func (r *PipelineJobRetry) BackoffDuration(retries int) time.Duration {
+	factor := r.BackoffFactor
+	if factor < 1 {
+		factor = 1
+	}
+	backoff := float64(r.Backoff)
+	for i := 0; i < retries; i++ {
+		backoff *= factor
+		if r.MaxBackoff > 0 && backoff >= float64(r.MaxBackoff) {
+			break
+		}
+	}
+	if r.MaxBackoff > 0 && backoff > float64(r.MaxBackoff) {
+		backoff = float64(r.MaxBackoff)
+	}
+	return time.Duration(backoff * float64(time.Second))
+}
+
+func (r *PipelineJobRetry) Scan(value interface{}) error {
+	bytes, ok := value.([]byte)
+	if !ok {
+		return errors.New(fmt.Sprint("Failed to convert to bytes:", value))
+	}
+	err := json.Unmarshal(bytes, r)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal bytes: %s", string(bytes))
+	}
+	return nil
+}
+
+// Value return json value, implement driver.Valuer interface
+func (r PipelineJobRetry) Value() (driver.Value, error) {
+	bytes, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return string(bytes), nil
 }
 
 const (
@@ -176,6 +457,10 @@ const (
 	BuiltinPluginRelease = "release"
 	// BuiltinPluginDeployK8s 替换镜像，并部署k8s资源
 	BuiltinPluginDeployK8s = "deploy_k8s"
+	// BuiltinPluginDeployHelm 安装或升级helm chart到集群
+	BuiltinPluginDeployHelm = "deploy_helm"
+	// BuiltinPluginExecuteShellJob 通过agent在集群中创建Job执行shell脚本，与通过ssh在流水线资源上执行的execute_shell区分
+	BuiltinPluginExecuteShellJob = "execute_shell_job"
 )
 
 const PipelinePluginBuiltinUrl = "builtin"
@@ -190,6 +475,12 @@ type PipelinePlugin struct {
 	ResultEnv  PipelinePluginResultEnv `gorm:"type:json;"`
 	CreateTime time.Time               `gorm:"not null;autoCreateTime"`
 	UpdateTime time.Time               `gorm:"not null;autoUpdateTime"`
+	// 服务重启后，执行中的任务是否可以重新执行，不可以重新执行的任务将置为失败
+	Resumable bool `gorm:"not null;default:false"`
+	// 任务默认的执行超时时间（秒），为0时不限制
+	Timeout int `gorm:"not null;default:0"`
+	// 外部插件请求体签名的密钥，为空时不签名
+	Secret string `gorm:"size:255;not null;default:''"`
 }
 
 type PipelinePluginParams struct {
@@ -286,6 +577,58 @@ func (m Map) Value() (driver.Value, error) {
 	return string(bytes), nil
 }
 
+type StringList []string
+
+func (l *StringList) Scan(value interface{}) error {
+	bytes, ok := value.([]byte)
+	if !ok {
+		return errors.New(fmt.Sprint("Failed to convert to bytes:", value))
+	}
+	err := json.Unmarshal(bytes, l)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal bytes: %s", string(bytes))
+	}
+	return nil
+}
+
+// Value return json value, implement driver.Valuer interface
+func (l StringList) Value() (driver.Value, error) {
+	if l == nil {
+		return nil, nil
+	}
+	bytes, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	return string(bytes), nil
+}
+
+type UintList []uint
+
+func (l *UintList) Scan(value interface{}) error {
+	bytes, ok := value.([]byte)
+	if !ok {
+		return errors.New(fmt.Sprint("Failed to convert to bytes:", value))
+	}
+	err := json.Unmarshal(bytes, l)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal bytes: %s", string(bytes))
+	}
+	return nil
+}
+
+// Value return json value, implement driver.Valuer interface
+func (l UintList) Value() (driver.Value, error) {
+	if l == nil {
+		return nil, nil
+	}
+	bytes, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	return string(bytes), nil
+}
+
 type PipelineRun struct {
 	ID          uint      `gorm:"primaryKey" json:"id"`
 	PipelineId  uint      `gorm:"not null;uniqueIndex:idx_pipeline_build_number" json:"pipeline_id"`
@@ -296,6 +639,8 @@ type PipelineRun struct {
 	Operator    string    `gorm:"size:50;not null" json:"operator"`
 	CreateTime  time.Time `gorm:"not null;autoCreateTime" json:"create_time"`
 	UpdateTime  time.Time `gorm:"not null;autoUpdateTime" json:"update_time"`
+	// 从代码仓库读取流水线配置时，配置文件所在的代码提交，格式为<文件路径>@<提交id>
+	DefinitionRef string `gorm:"size:255;not null;default:''" json:"definition_ref"`
 }
 
 type PipelineRunStage struct {
@@ -308,9 +653,23 @@ type PipelineRunStage struct {
 	Env            Map             `gorm:"type:json" json:"env"`
 	CustomParams   Map             `gorm:"json" json:"custom_params"`
 	Jobs           PipelineRunJobs `gorm:"-" json:"jobs"`
+	MaxParallel    int             `gorm:"not null;default:0" json:"max_parallel"`
+	FailurePolicy  string          `gorm:"size:20;not null;default:''" json:"failure_policy"`
 	ExecTime       time.Time       `gorm:"not null;autoCreateTime" json:"exec_time"`
 	CreateTime     time.Time       `gorm:"not null;autoCreateTime" json:"create_time"`
 	UpdateTime     time.Time       `gorm:"not null;autoUpdateTime" json:"update_time"`
+	// 依赖的上游阶段，为空时依赖PrevStageRunId
+	PrevStageRunIds UintList `gorm:"type:json" json:"prev_stage_run_ids"`
+	// 创建构建时依赖的上游阶段名称
+	DependsOn []string `gorm:"-" json:"-"`
+	// 阶段执行超时时间（秒），为0时不限制
+	Timeout int `gorm:"not null;default:0" json:"timeout"`
+	// 阶段执行条件
+	When string `gorm:"size:500;not null;default:''" json:"when"`
+	// 审批阶段的审批人配置
+	Approval PipelineStageApproval `gorm:"type:json" json:"approval"`
+	// 审批阶段的审批记录，包括审批人以及审批时间，阶段重试时清空重新审批
+	Approvals PipelineRunStageApprovals `gorm:"type:json" json:"approvals"`
 }
 
 type PipelineRunJobs []*PipelineRunJob
@@ -328,14 +687,51 @@ type PipelineRunJob struct {
 	Result     *utils.Response `gorm:"type:json;" json:"result"`
 	CreateTime time.Time       `gorm:"not null;autoCreateTime" json:"create_time"`
 	UpdateTime time.Time       `gorm:"not null;autoUpdateTime" json:"update_time"`
+	// 任务执行超时时间（秒），为0时不限制
+	Timeout  int       `gorm:"not null;default:0" json:"timeout"`
+	ExecTime time.Time `gorm:"not null;autoCreateTime" json:"exec_time"`
+	// 任务执行参数中的密钥，在日志以及接口返回中替换为***
+	Masks StringList `gorm:"type:json" json:"-"`
+	// 外部插件回调的一次性令牌，每次执行任务时重新生成，回调后清空
+	CallbackToken string `gorm:"size:64;not null;default:''" json:"-"`
+	// 任务执行条件
+	When string `gorm:"size:500;not null;default:''" json:"when"`
+	// 任务的自动重试策略
+	Retry PipelineJobRetry `gorm:"type:json" json:"retry"`
+	// 任务的总执行次数，每次执行都会记录到PipelineRunJobAttempt
+	Attempt int `gorm:"not null;default:0" json:"attempt"`
+	// 本次阶段执行中已自动重试的次数，阶段重新执行时清零
+	Retries int `gorm:"not null;default:0" json:"retries"`
+	// 任务等待自动重试时，下一次执行的时间
+	RetryTime *time.Time `json:"retry_time"`
+	// 执行任务的服务实例，实例定时更新未完成任务的心跳时间，心跳超时后任务由其它实例恢复执行
+	Executor      string     `gorm:"size:255;not null;default:''" json:"executor"`
+	HeartbeatTime *time.Time `json:"heartbeat_time"`
+}
+
+// PipelineRunJobAttempt 任务每次执行的状态以及结果，任务日志按执行顺序追加，
+// LogOffset为该次执行的日志在任务完整日志中的起始偏移
+type PipelineRunJobAttempt struct {
+	ID         uint            `gorm:"primaryKey" json:"id"`
+	JobRunId   uint            `gorm:"not null;uniqueIndex:idx_job_run_attempt" json:"job_run_id"`
+	Attempt    int             `gorm:"not null;uniqueIndex:idx_job_run_attempt" json:"attempt"`
+	Status     string          `gorm:"size:50;not null" json:"status"`
+	Result     *utils.Response `gorm:"type:json;" json:"result"`
+	LogOffset  int64           `gorm:"not null;default:0" json:"log_offset"`
+	ExecTime   time.Time       `gorm:"not null;autoCreateTime" json:"exec_time"`
+	CreateTime time.Time       `gorm:"not null;autoCreateTime" json:"create_time"`
+	UpdateTime time.Time       `gorm:"not null;autoUpdateTime" json:"update_time"`
 }
 
+// PipelineRunJobLog 任务日志按顺序分块存储，每块日志只在末尾追加，写满后新建下一块
 type PipelineRunJobLog struct {
 	ID         uint      `gorm:"primaryKey" json:"id"`
-	JobRunId   uint      `gorm:"column:job_run_id;not null" json:"job_run_id"`
+	JobRunId   uint      `gorm:"column:job_run_id;not null;index:idx_job_log_offset" json:"job_run_id"`
 	Logs       string    `gorm:"type:longtext" json:"logs"`
 	CreateTime time.Time `gorm:"not null;autoCreateTime" json:"create_time"`
 	UpdateTime time.Time `gorm:"not null;autoUpdateTime" json:"update_time"`
+	// 该块日志在任务完整日志中的起始字节偏移
+	LogOffset int64 `gorm:"not null;default:0;index:idx_job_log_offset" json:"log_offset"`
 }
 
 type PipelineResource struct {
@@ -49,6 +49,36 @@ var AllPermissions = []Permission{
 		Name:       "角色管理",
 		Operations: []string{OpGet, OpCreate, OpUpdate, OpDelete},
 	},
+	{
+		Scope:      "settings",
+		Object:     "user_role",
+		Name:       "成员权限",
+		Operations: []string{OpGet, OpCreate, OpUpdate, OpDelete},
+	},
+	{
+		Scope:      "settings",
+		Object:     "settings_secret",
+		Name:       "密钥管理",
+		Operations: []string{OpGet, OpCreate, OpUpdate, OpDelete},
+	},
+	{
+		Scope:      "settings",
+		Object:     "image_registry",
+		Name:       "镜像仓库",
+		Operations: []string{OpGet, OpCreate, OpUpdate, OpDelete},
+	},
+	{
+		Scope:      "settings",
+		Object:     "appstore",
+		Name:       "应用商店",
+		Operations: []string{OpGet, OpCreate, OpUpdate, OpDelete},
+	},
+	{
+		Scope:      "settings",
+		Object:     "pipeline_plugin",
+		Name:       "流水线插件",
+		Operations: []string{OpGet, OpCreate, OpUpdate, OpDelete},
+	},
 	{
 		Scope:      "cluster",
 		Object:     "node",
@@ -175,6 +205,89 @@ var AllPermissions = []Permission{
 		Name:       "角色",
 		Operations: []string{OpGet, OpCreate, OpUpdate, OpDelete},
 	},
+	{
+		Scope:      "cluster",
+		Object:     "endpoints",
+		Name:       "端点",
+		Operations: []string{OpGet, OpCreate, OpUpdate, OpDelete},
+	},
+	{
+		Scope:      "cluster",
+		Object:     "helm",
+		Name:       "Helm应用",
+		Operations: []string{OpGet, OpCreate, OpUpdate, OpDelete},
+	},
+	{
+		Scope:      "cluster",
+		Object:     "crd",
+		Name:       "自定义资源",
+		Operations: []string{OpGet, OpCreate, OpUpdate, OpDelete},
+	},
+	{
+		Scope:      "pipeline",
+		Object:     "workspace",
+		Name:       "流水线空间",
+		Operations: []string{OpGet, OpCreate, OpUpdate, OpDelete},
+	},
+	{
+		Scope:      "pipeline",
+		Object:     "pipeline",
+		Name:       "流水线",
+		Operations: []string{OpGet, OpCreate, OpUpdate, OpDelete},
+	},
+	{
+		Scope:      "pipeline",
+		Object:     "build",
+		Name:       "流水线构建",
+		Operations: []string{OpGet, OpCreate, OpUpdate, OpDelete},
+	},
+	{
+		Scope:      "pipeline",
+		Object:     "resource",
+		Name:       "流水线资源",
+		Operations: []string{OpGet, OpCreate, OpUpdate, OpDelete},
+	},
+	{
+		Scope:      "project",
+		Object:     "project",
+		Name:       "工作空间",
+		Operations: []string{OpGet, OpCreate, OpUpdate, OpDelete},
+	},
+	{
+		Scope:      "project",
+		Object:     "app",
+		Name:       "空间应用",
+		Operations: []string{OpGet, OpCreate, OpUpdate, OpDelete},
+	},
+}
+
+// adminObjects 增删改需要admin角色的对象，外部插件可以通过参数获取流水线的代码密钥、镜像仓库等密钥，
+// 只能由管理员注册和修改
+var adminObjects = map[string]bool{
+	"user_role":       true,
+	"pipeline_plugin": true,
+}
+
+// OperationRoleType 返回对象操作需要的最低用户角色，查看需要viewer角色，增删改需要editor角色，
+// 对成员权限以及流水线插件的修改需要admin角色
+func OperationRoleType(object, operation string) string {
+	if operation == OpGet {
+		return RoleTypeViewer
+	}
+	if adminObjects[object] {
+		return RoleTypeAdmin
+	}
+	return RoleTypeEditor
+}
+
+// HasPermissionObject 判断操作对象是否在权限列表中
+func HasPermissionObject(object string) bool {
+	for _, p := range AllPermissions {
+		if p.Object == object {
+			return true
+		}
+	}
+	return false
 }
 
 var (
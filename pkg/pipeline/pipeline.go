@@ -9,6 +9,8 @@ import (
 	"github.com/kubespace/kubespace/pkg/utils/code"
 	"github.com/kubespace/kubespace/pkg/views/serializers"
 	"gorm.io/gorm"
+	"path"
+	"strings"
 	"time"
 )
 
@@ -28,13 +30,19 @@ func (p *ServicePipeline) Create(pipelineSer *serializers.PipelineSerializer, us
 		return &utils.Response{Code: code.DBError, Msg: err.Error()}
 	}
 	pipeline := &types.Pipeline{
-		Name:        pipelineSer.Name,
-		WorkspaceId: pipelineSer.WorkspaceId,
-		Triggers:    pipelineSer.Triggers,
-		CreateUser:  user.Name,
-		UpdateUser:  user.Name,
-		CreateTime:  time.Now(),
-		UpdateTime:  time.Now(),
+		Name:               pipelineSer.Name,
+		WorkspaceId:        pipelineSer.WorkspaceId,
+		Triggers:           pipelineSer.Triggers,
+		CreateUser:         user.Name,
+		UpdateUser:         user.Name,
+		CreateTime:         time.Now(),
+		UpdateTime:         time.Now(),
+		CommitStatus:       pipelineSer.CommitStatus,
+		Definition:         pipelineSer.Definition,
+		DefinitionBranches: pipelineSer.DefinitionBranches,
+		Params:             pipelineSer.Params,
+		MaxConcurrent:      pipelineSer.MaxConcurrent,
+		CancelSuperseded:   pipelineSer.CancelSuperseded,
 	}
 	if len(pipelineSer.Triggers) == 0 {
 		return &utils.Response{Code: code.ParamsError, Msg: "流水线触发源不能为空"}
@@ -42,22 +50,28 @@ func (p *ServicePipeline) Create(pipelineSer *serializers.PipelineSerializer, us
 	if resp := p.CheckTrigger(workspace, pipelineSer); !resp.IsSuccess() {
 		return resp
 	}
+	if resp := p.checkDefinition(workspace, pipelineSer); !resp.IsSuccess() {
+		return resp
+	}
+	if err = checkPipelineParams(pipelineSer.Params); err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
+	if pipelineSer.MaxConcurrent < 0 {
+		return &utils.Response{Code: code.ParamsError, Msg: "最大并发构建数不能小于0"}
+	}
 	var stages []*types.PipelineStage
 	for _, stageSer := range pipelineSer.Stages {
-		if stageSer.TriggerMode != types.StageTriggerModeAuto && stageSer.TriggerMode != types.StageTriggerModeManual {
-			return &utils.Response{
-				Code: code.ParamsError,
-				Msg:  fmt.Sprintf("trigger mode %s is unknown", stageSer.TriggerMode),
-			}
-		}
-		stage := &types.PipelineStage{
-			Name:         stageSer.Name,
-			TriggerMode:  stageSer.TriggerMode,
-			CustomParams: stageSer.CustomParams,
-			Jobs:         stageSer.Jobs,
+		stage, resp := p.newStage(&stageSer)
+		if !resp.IsSuccess() {
+			return resp
 		}
+		stage.ID = 0
 		stages = append(stages, stage)
 	}
+	stages, resp := p.sortStages(stages)
+	if !resp.IsSuccess() {
+		return resp
+	}
 	pipeline, err = p.models.ManagerPipeline.CreatePipeline(pipeline, stages)
 	if err != nil {
 		return &utils.Response{
@@ -71,9 +85,193 @@ func (p *ServicePipeline) Create(pipelineSer *serializers.PipelineSerializer, us
 	}
 }
 
+// checkDefinition 校验流水线阶段的配置来源，只有代码空间可以从代码仓库读取流水线配置，
+// 并且需要指定受保护分支，避免任意分支的提交者通过配置文件绕过流水线的编辑权限
+func (p *ServicePipeline) checkDefinition(workspace *types.PipelineWorkspace, pipelineSer *serializers.PipelineSerializer) *utils.Response {
+	if pipelineSer.Definition == "" {
+		return &utils.Response{Code: code.Success}
+	}
+	if pipelineSer.Definition != types.PipelineDefinitionCode {
+		return &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("流水线配置来源%s错误", pipelineSer.Definition)}
+	}
+	if workspace.Type != types.WorkspaceTypeCode {
+		return &utils.Response{Code: code.ParamsError, Msg: "只有代码空间支持从代码仓库读取流水线配置"}
+	}
+	if len(pipelineSer.DefinitionBranches) == 0 {
+		return &utils.Response{Code: code.ParamsError, Msg: "从代码仓库读取流水线配置时，受保护分支不能为空"}
+	}
+	for _, branch := range pipelineSer.DefinitionBranches {
+		if _, err := path.Match(branch, ""); err != nil || branch == "" {
+			return &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("受保护分支「%s」格式错误", branch)}
+		}
+	}
+	return &utils.Response{Code: code.Success}
+}
+
+// newStage 校验阶段参数，并生成流水线阶段
+func (p *ServicePipeline) newStage(stageSer *serializers.PipelineStageSerializer) (*types.PipelineStage, *utils.Response) {
+	switch stageSer.TriggerMode {
+	case types.StageTriggerModeAuto, types.StageTriggerModeManual:
+		stageSer.Approval = types.PipelineStageApproval{}
+	case types.StageTriggerModeApproval:
+		if err := p.checkStageApproval(&stageSer.Approval); err != nil {
+			return nil, &utils.Response{Code: code.ParamsError, Msg: "阶段审批配置错误：" + err.Error()}
+		}
+	default:
+		return nil, &utils.Response{
+			Code: code.ParamsError,
+			Msg:  fmt.Sprintf("trigger mode %s is unknown", stageSer.TriggerMode),
+		}
+	}
+	if stageSer.MaxParallel < 0 {
+		return nil, &utils.Response{Code: code.ParamsError, Msg: "阶段任务最大并发数不能小于0"}
+	}
+	if stageSer.Timeout < 0 {
+		return nil, &utils.Response{Code: code.ParamsError, Msg: "阶段超时时间不能小于0"}
+	}
+	if err := checkWhen(stageSer.When); err != nil {
+		return nil, &utils.Response{Code: code.ParamsError, Msg: "阶段" + err.Error()}
+	}
+	for _, job := range stageSer.Jobs {
+		if job.Timeout < 0 {
+			return nil, &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("任务「%s」超时时间不能小于0", job.Name)}
+		}
+		if err := checkWhen(job.When); err != nil {
+			return nil, &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("任务「%s」%s", job.Name, err.Error())}
+		}
+		if err := checkJobRetry(job.Retry); err != nil {
+			return nil, &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("任务「%s」重试策略错误：%s", job.Name, err.Error())}
+		}
+	}
+	if stageSer.FailurePolicy == "" {
+		stageSer.FailurePolicy = types.StageFailurePolicyWaitAll
+	}
+	if stageSer.FailurePolicy != types.StageFailurePolicyWaitAll && stageSer.FailurePolicy != types.StageFailurePolicyFailFast {
+		return nil, &utils.Response{
+			Code: code.ParamsError,
+			Msg:  fmt.Sprintf("failure policy %s is unknown", stageSer.FailurePolicy),
+		}
+	}
+	return &types.PipelineStage{
+		ID:            stageSer.ID,
+		Name:          stageSer.Name,
+		TriggerMode:   stageSer.TriggerMode,
+		CustomParams:  stageSer.CustomParams,
+		Jobs:          stageSer.Jobs,
+		MaxParallel:   stageSer.MaxParallel,
+		FailurePolicy: stageSer.FailurePolicy,
+		DependsOn:     stageSer.DependsOn,
+		Timeout:       stageSer.Timeout,
+		When:          stageSer.When,
+		Approval:      stageSer.Approval,
+	}, &utils.Response{Code: code.Success}
+}
+
+// checkStageApproval 校验审批阶段的审批人配置，审批用户需要存在，审批角色为流水线空间的成员角色
+func (p *ServicePipeline) checkStageApproval(approval *types.PipelineStageApproval) error {
+	if len(approval.Users) == 0 && len(approval.Roles) == 0 {
+		return fmt.Errorf("审批用户以及审批角色不能都为空")
+	}
+	for _, userName := range approval.Users {
+		if _, err := p.models.UserManager.Get(userName); err != nil {
+			return fmt.Errorf("审批用户「%s」不存在", userName)
+		}
+	}
+	for _, role := range approval.Roles {
+		if role != types.RoleTypeViewer && role != types.RoleTypeEditor && role != types.RoleTypeAdmin {
+			return fmt.Errorf("审批角色%s不支持", role)
+		}
+	}
+	if approval.Quorum < 0 {
+		return fmt.Errorf("审批通过人数不能小于0")
+	}
+	if len(approval.Roles) == 0 && approval.Quorum > len(approval.Users) {
+		return fmt.Errorf("审批通过人数不能大于审批用户数")
+	}
+	return nil
+}
+
+// sortStages 校验阶段之间的依赖，并按照依赖关系对阶段进行拓扑排序
+// 未配置依赖的阶段依赖前一个阶段，阶段依赖存在循环时返回错误
+func (p *ServicePipeline) sortStages(stages []*types.PipelineStage) ([]*types.PipelineStage, *utils.Response) {
+	stageMap := make(map[string]*types.PipelineStage)
+	for i, stage := range stages {
+		if _, ok := stageMap[stage.Name]; ok {
+			return nil, &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("阶段「%s」名称重复", stage.Name)}
+		}
+		stageMap[stage.Name] = stage
+		if stage.DependsOn == nil {
+			stage.DependsOn = types.StringList{}
+			if i > 0 {
+				stage.DependsOn = types.StringList{stages[i-1].Name}
+			}
+		}
+	}
+	inDegree := make(map[string]int)
+	for _, stage := range stages {
+		depMap := make(map[string]struct{})
+		for _, dep := range stage.DependsOn {
+			if dep == stage.Name {
+				return nil, &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("阶段「%s」不能依赖自身", stage.Name)}
+			}
+			if _, ok := stageMap[dep]; !ok {
+				return nil, &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("阶段「%s」依赖的阶段「%s」不存在", stage.Name, dep)}
+			}
+			if _, ok := depMap[dep]; ok {
+				return nil, &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("阶段「%s」依赖的阶段「%s」重复", stage.Name, dep)}
+			}
+			depMap[dep] = struct{}{}
+		}
+		inDegree[stage.Name] = len(stage.DependsOn)
+	}
+	// 每次取原顺序中第一个没有未完成依赖的阶段，保证排序结果稳定
+	var sorted []*types.PipelineStage
+	visited := make(map[string]bool)
+	for len(sorted) < len(stages) {
+		var next *types.PipelineStage
+		for _, stage := range stages {
+			if !visited[stage.Name] && inDegree[stage.Name] == 0 {
+				next = stage
+				break
+			}
+		}
+		if next == nil {
+			var cycleStages []string
+			for _, stage := range stages {
+				if !visited[stage.Name] {
+					cycleStages = append(cycleStages, stage.Name)
+				}
+			}
+			return nil, &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("阶段依赖存在循环：%s", strings.Join(cycleStages, ","))}
+		}
+		visited[next.Name] = true
+		sorted = append(sorted, next)
+		for _, stage := range stages {
+			for _, dep := range stage.DependsOn {
+				if dep == next.Name {
+					inDegree[stage.Name]--
+				}
+			}
+		}
+	}
+	return sorted, &utils.Response{Code: code.Success}
+}
+
 func (p *ServicePipeline) CheckTrigger(workspace *types.PipelineWorkspace, pipelineSer *serializers.PipelineSerializer) *utils.Response {
+	if err := checkCommitStatus(workspace, pipelineSer.CommitStatus); err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
 	triggerWorkspaceIdMap := make(map[uint]struct{})
 	for _, trigger := range pipelineSer.Triggers {
+		if trigger.Type == types.PipelineTriggerTypeSchedule {
+			if workspace.Type == types.WorkspaceTypeCode && trigger.Branch == "" {
+				return &utils.Response{Code: code.ParamsError, Msg: "定时触发的构建分支不能为空"}
+			}
+			if _, _, err := parseScheduleTrigger(trigger); err != nil {
+				return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+			}
+			continue
+		}
 		if workspace.Type == types.WorkspaceTypeCode && trigger.Type != types.PipelineTriggerTypeCode {
 			return &utils.Response{
 				Code: code.ParamsError,
@@ -117,29 +315,42 @@ func (p *ServicePipeline) Update(pipelineSer *serializers.PipelineSerializer, us
 			Msg:  fmt.Sprintf("获取流水线失败:%s", err.Error()),
 		}
 	}
+	if pipeline.WorkspaceId != workspace.ID {
+		return &utils.Response{Code: code.ParamsError, Msg: "流水线不属于当前空间"}
+	}
 	pipeline.Name = pipelineSer.Name
 	pipeline.Triggers = pipelineSer.Triggers
+	pipeline.CommitStatus = pipelineSer.CommitStatus
+	pipeline.Definition = pipelineSer.Definition
+	pipeline.DefinitionBranches = pipelineSer.DefinitionBranches
+	pipeline.Params = pipelineSer.Params
+	pipeline.MaxConcurrent = pipelineSer.MaxConcurrent
+	pipeline.CancelSuperseded = pipelineSer.CancelSuperseded
 	pipeline.UpdateUser = user.Name
 	if resp := p.CheckTrigger(workspace, pipelineSer); !resp.IsSuccess() {
 		return resp
 	}
+	if resp := p.checkDefinition(workspace, pipelineSer); !resp.IsSuccess() {
+		return resp
+	}
+	if err = checkPipelineParams(pipelineSer.Params); err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
+	if pipelineSer.MaxConcurrent < 0 {
+		return &utils.Response{Code: code.ParamsError, Msg: "最大并发构建数不能小于0"}
+	}
 	var stages []*types.PipelineStage
 	for _, stageSer := range pipelineSer.Stages {
-		if stageSer.TriggerMode != types.StageTriggerModeAuto && stageSer.TriggerMode != types.StageTriggerModeManual {
-			return &utils.Response{
-				Code: code.ParamsError,
-				Msg:  fmt.Sprintf("trigger mode %s is unknown", stageSer.TriggerMode),
-			}
-		}
-		stage := &types.PipelineStage{
-			ID:           stageSer.ID,
-			Name:         stageSer.Name,
-			TriggerMode:  stageSer.TriggerMode,
-			CustomParams: stageSer.CustomParams,
-			Jobs:         stageSer.Jobs,
+		stage, resp := p.newStage(&stageSer)
+		if !resp.IsSuccess() {
+			return resp
 		}
 		stages = append(stages, stage)
 	}
+	stages, resp := p.sortStages(stages)
+	if !resp.IsSuccess() {
+		return resp
+	}
 	pipeline, err = p.models.ManagerPipeline.UpdatePipeline(pipeline, stages)
 	if err != nil {
 		return &utils.Response{
@@ -208,6 +419,19 @@ func (p *ServicePipeline) GetPipeline(pipelineId uint) *utils.Response {
 	return &utils.Response{Code: code.Success, Data: data}
 }
 
+// BuildParams 获取流水线的构建参数定义，用于生成构建表单
+func (p *ServicePipeline) BuildParams(pipelineId uint) *utils.Response {
+	pipeline, err := p.models.ManagerPipeline.Get(pipelineId)
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: err.Error()}
+	}
+	params := pipeline.Params
+	if params == nil {
+		params = types.PipelineParams{}
+	}
+	return &utils.Response{Code: code.Success, Data: params}
+}
+
 func (p *ServicePipeline) ListPipeline(workspaceId uint) *utils.Response {
 	pipelines, err := p.models.ManagerPipeline.List(workspaceId)
 	if err != nil {
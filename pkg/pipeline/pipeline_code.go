@@ -0,0 +1,192 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/kubespace/kubespace/pkg/model/types"
+	"github.com/kubespace/kubespace/pkg/utils"
+	"github.com/kubespace/kubespace/pkg/utils/code"
+	"github.com/kubespace/kubespace/pkg/views/serializers"
+	"k8s.io/klog"
+	"path"
+	"sigs.k8s.io/yaml"
+)
+
+// codePipelineDefinition 代码仓库中流水线配置文件的内容，一个代码空间有多条流水线时，
+// 可以在pipelines中按流水线名称分别配置阶段，未配置当前流水线时使用stages
+type codePipelineDefinition struct {
+	Stages    []serializers.PipelineStageSerializer `json:"stages"`
+	Pipelines map[string]*codePipelineStages        `json:"pipelines"`
+}
+
+type codePipelineStages struct {
+	Stages []serializers.PipelineStageSerializer `json:"stages"`
+}
+
+// getCodeFile 获取代码仓库中指定提交的文件内容
+func (r *ServicePipelineRun) getCodeFile(workspace *types.PipelineWorkspace, branch, commitId, path string) ([]byte, error) {
+	auth, err := r.getCodeAuth(workspace.CodeSecretId)
+	if err != nil {
+		return nil, err
+	}
+	cloneOptions := &git.CloneOptions{
+		Auth:            auth,
+		URL:             workspace.CodeUrl,
+		ReferenceName:   plumbing.NewBranchReferenceName(branch),
+		SingleBranch:    true,
+		Depth:           1,
+		NoCheckout:      true,
+		InsecureSkipTLS: true,
+	}
+	repo, err := git.Clone(memory.NewStorage(), nil, cloneOptions)
+	if err != nil {
+		return nil, fmt.Errorf("克隆代码失败：%s", err.Error())
+	}
+	hash := plumbing.NewHash(commitId)
+	commit, err := repo.CommitObject(hash)
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		// 构建的提交不是分支的最新提交时，获取分支的完整提交历史
+		cloneOptions.Depth = 0
+		if repo, err = git.Clone(memory.NewStorage(), nil, cloneOptions); err != nil {
+			return nil, fmt.Errorf("克隆代码失败：%s", err.Error())
+		}
+		commit, err = repo.CommitObject(hash)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("获取代码提交%s失败：%s", commitId, err.Error())
+	}
+	file, err := commit.File(path)
+	if err != nil {
+		if errors.Is(err, object.ErrFileNotFound) {
+			return nil, fmt.Errorf("代码提交%s中未找到流水线配置文件%s", commitId, path)
+		}
+		return nil, fmt.Errorf("获取文件%s失败：%s", path, err.Error())
+	}
+	content, err := file.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("读取文件%s失败：%s", path, err.Error())
+	}
+	return []byte(content), nil
+}
+
+// parseCodeDefinition 解析并校验流水线配置文件，返回按依赖排序后的阶段
+func (r *ServicePipelineRun) parseCodeDefinition(pipeline *types.Pipeline, content []byte) ([]*types.PipelineStage, *utils.Response) {
+	errResp := func(format string, a ...interface{}) *utils.Response {
+		return &utils.Response{
+			Code: code.ParamsError,
+			Msg:  fmt.Sprintf("流水线配置文件%s错误：%s", types.PipelineCodeDefinitionFile, fmt.Sprintf(format, a...)),
+		}
+	}
+	var definition codePipelineDefinition
+	if err := yaml.UnmarshalStrict(content, &definition); err != nil {
+		return nil, errResp("%s", err.Error())
+	}
+	stageSers := definition.Stages
+	if pipelineStages, ok := definition.Pipelines[pipeline.Name]; ok && pipelineStages != nil {
+		stageSers = pipelineStages.Stages
+	}
+	if len(stageSers) == 0 {
+		return nil, errResp("未配置流水线「%s」的阶段", pipeline.Name)
+	}
+	pipelineService := NewPipelineService(r.models)
+	var stages []*types.PipelineStage
+	for i := range stageSers {
+		stageSer := &stageSers[i]
+		if stageSer.Name == "" {
+			return nil, errResp("第%d个阶段名称为空", i+1)
+		}
+		if stageSer.TriggerMode == "" {
+			stageSer.TriggerMode = types.StageTriggerModeAuto
+		}
+		if len(stageSer.Jobs) == 0 {
+			return nil, errResp("阶段「%s」未配置任务", stageSer.Name)
+		}
+		for j, job := range stageSer.Jobs {
+			if job == nil || job.Name == "" {
+				return nil, errResp("阶段「%s」第%d个任务名称为空", stageSer.Name, j+1)
+			}
+			if job.PluginKey == "" {
+				return nil, errResp("阶段「%s」任务「%s」未配置插件", stageSer.Name, job.Name)
+			}
+			if _, err := r.models.PipelinePluginManager.GetByKey(job.PluginKey); err != nil {
+				return nil, errResp("阶段「%s」任务「%s」的插件「%s」不存在", stageSer.Name, job.Name, job.PluginKey)
+			}
+		}
+		stage, resp := pipelineService.newStage(stageSer)
+		if !resp.IsSuccess() {
+			return nil, errResp("阶段「%s」%s", stageSer.Name, resp.Msg)
+		}
+		stage.ID = 0
+		stage.PipelineId = pipeline.ID
+		stages = append(stages, stage)
+	}
+	stages, resp := pipelineService.sortStages(stages)
+	if !resp.IsSuccess() {
+		return nil, errResp("%s", resp.Msg)
+	}
+	return stages, &utils.Response{Code: code.Success}
+}
+
+// isDefinitionBranch 分支是否为可以读取流水线配置文件的受保护分支
+func isDefinitionBranch(pipeline *types.Pipeline, branch string) bool {
+	for _, pattern := range pipeline.DefinitionBranches {
+		if matched, err := path.Match(pattern, branch); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// codeDefinitionStages 从构建代码提交中的流水线配置文件生成本次构建的阶段，返回配置文件的版本
+func (r *ServicePipelineRun) codeDefinitionStages(pipeline *types.Pipeline, workspace *types.PipelineWorkspace, branch, commitId string) ([]*types.PipelineStage, string, *utils.Response) {
+	if !isDefinitionBranch(pipeline, branch) {
+		return nil, "", &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("分支「%s」不是受保护分支，不能读取流水线配置文件", branch)}
+	}
+	if commitId == "" {
+		return nil, "", &utils.Response{Code: code.ParamsError, Msg: "未获取到构建的代码提交，无法读取流水线配置文件"}
+	}
+	content, err := r.getCodeFile(workspace, branch, commitId, types.PipelineCodeDefinitionFile)
+	if err != nil {
+		klog.Errorf("get pipeline id=%d code definition error: %s", pipeline.ID, err.Error())
+		return nil, "", &utils.Response{Code: code.GetError, Msg: err.Error()}
+	}
+	stages, resp := r.parseCodeDefinition(pipeline, content)
+	if !resp.IsSuccess() {
+		return nil, "", resp
+	}
+	return stages, types.PipelineCodeDefinitionFile + "@" + commitId, resp
+}
+
+// CodeDefinition 读取分支最新提交中的流水线配置文件，返回解析后的阶段，用于校验配置文件
+func (r *ServicePipelineRun) CodeDefinition(pipelineId uint, branch string) *utils.Response {
+	pipeline, err := r.models.ManagerPipeline.Get(pipelineId)
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: err.Error()}
+	}
+	workspace, err := r.models.PipelineWorkspaceManager.Get(pipeline.WorkspaceId)
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: err.Error()}
+	}
+	if workspace.Type != types.WorkspaceTypeCode {
+		return &utils.Response{Code: code.ParamsError, Msg: "只有代码空间支持从代码仓库读取流水线配置"}
+	}
+	if branch == "" {
+		return &utils.Response{Code: code.ParamsError, Msg: "代码分支不能为空"}
+	}
+	commitId, err := r.getCodeBranchCommitId(workspace.CodeUrl, branch, workspace.CodeSecretId)
+	if err != nil {
+		return &utils.Response{Code: code.GetError, Msg: err.Error()}
+	}
+	stages, ref, resp := r.codeDefinitionStages(pipeline, workspace, branch, commitId)
+	if !resp.IsSuccess() {
+		return resp
+	}
+	return &utils.Response{Code: code.Success, Data: map[string]interface{}{
+		"definition_ref": ref,
+		"stages":         stages,
+	}}
+}
@@ -0,0 +1,240 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/kubespace/kubespace/pkg/model/types"
+	"io/ioutil"
+	"k8s.io/klog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	commitStatePending = "pending"
+	commitStateSuccess = "success"
+	commitStateFailure = "failure"
+	commitStateCancel  = "cancel"
+)
+
+var commitStatusClient = &http.Client{Timeout: 10 * time.Second}
+
+// checkCommitStatus 校验流水线的提交状态回写配置
+func checkCommitStatus(workspace *types.PipelineWorkspace, cs *types.PipelineCommitStatus) error {
+	if cs == nil || !cs.Enable {
+		return nil
+	}
+	if workspace.Type != types.WorkspaceTypeCode {
+		return fmt.Errorf("只有代码空间流水线支持回写提交状态")
+	}
+	switch cs.Provider {
+	case types.CommitStatusProviderGithub, types.CommitStatusProviderGitlab, types.CommitStatusProviderGitea:
+	default:
+		return fmt.Errorf("不支持的代码仓库类型：%s", cs.Provider)
+	}
+	if _, err := commitStatusApiUrl(cs, workspace.CodeUrl); err != nil {
+		return err
+	}
+	if cs.KubespaceUrl != "" {
+		if _, err := url.ParseRequestURI(cs.KubespaceUrl); err != nil {
+			return fmt.Errorf("kubespace访问地址格式不正确：%s", err.Error())
+		}
+	}
+	return nil
+}
+
+// commitStatusApiUrl 获取代码仓库api地址，未配置时根据代码地址的域名生成
+func commitStatusApiUrl(cs *types.PipelineCommitStatus, codeUrl string) (string, error) {
+	if cs.ApiUrl != "" {
+		if _, err := url.ParseRequestURI(cs.ApiUrl); err != nil {
+			return "", fmt.Errorf("代码仓库api地址格式不正确：%s", err.Error())
+		}
+		return strings.TrimSuffix(cs.ApiUrl, "/"), nil
+	}
+	var scheme, host string
+	if u, err := url.Parse(codeUrl); err == nil && u.Host != "" && strings.HasPrefix(u.Scheme, "http") {
+		scheme, host = u.Scheme, u.Host
+	} else if match := regexp.MustCompile(`^git@([\w.\-]+):`).FindStringSubmatch(codeUrl); len(match) == 2 {
+		scheme, host = "https", match[1]
+	} else {
+		return "", fmt.Errorf("根据代码地址生成代码仓库api地址失败，请配置api地址")
+	}
+	switch cs.Provider {
+	case types.CommitStatusProviderGithub:
+		if host == "github.com" {
+			return "https://api.github.com", nil
+		}
+		return fmt.Sprintf("%s://%s/api/v3", scheme, host), nil
+	case types.CommitStatusProviderGitlab:
+		return fmt.Sprintf("%s://%s/api/v4", scheme, host), nil
+	default:
+		return fmt.Sprintf("%s://%s/api/v1", scheme, host), nil
+	}
+}
+
+// reportCommitStatus 将流水线构建状态回写到构建的代码提交，回写失败只记录日志，不影响构建
+func (r *ServicePipelineRun) reportCommitStatus(pipelineRunId uint) {
+	pipelineRun, err := r.models.ManagerPipelineRun.Get(pipelineRunId)
+	if err != nil {
+		klog.Errorf("get pipeline run id=%d error: %s", pipelineRunId, err.Error())
+		return
+	}
+	pipeline, err := r.models.ManagerPipeline.Get(pipelineRun.PipelineId)
+	if err != nil {
+		klog.Errorf("get pipeline id=%d error: %s", pipelineRun.PipelineId, err.Error())
+		return
+	}
+	cs := pipeline.CommitStatus
+	if cs == nil || !cs.Enable {
+		return
+	}
+	commitId, _ := pipelineRun.Env["PIPELINE_CODE_COMMIT_ID"].(string)
+	if commitId == "" {
+		return
+	}
+	workspace, err := r.models.PipelineWorkspaceManager.Get(pipeline.WorkspaceId)
+	if err != nil {
+		klog.Errorf("get workspace id=%d error: %s", pipeline.WorkspaceId, err.Error())
+		return
+	}
+	if workspace.Type != types.WorkspaceTypeCode {
+		return
+	}
+	token, err := r.getCodeToken(workspace.CodeSecretId)
+	if err != nil {
+		klog.Errorf("report pipeline run id=%d commit status error: %s", pipelineRun.ID, err.Error())
+		return
+	}
+	apiUrl, err := commitStatusApiUrl(cs, workspace.CodeUrl)
+	if err != nil {
+		klog.Errorf("report pipeline run id=%d commit status error: %s", pipelineRun.ID, err.Error())
+		return
+	}
+	state, description := commitState(pipelineRun.Status)
+	statusContext := cs.Context
+	if statusContext == "" {
+		statusContext = "kubespace/" + pipeline.Name
+	}
+	targetUrl := ""
+	if cs.KubespaceUrl != "" {
+		targetUrl = fmt.Sprintf("%s/ui/pipespace/%d/pipeline/%d/build/%d",
+			strings.TrimSuffix(cs.KubespaceUrl, "/"), workspace.ID, pipeline.ID, pipelineRun.ID)
+	}
+	report := &commitStatusReport{
+		Repo:        workspace.Name,
+		CommitId:    commitId,
+		State:       state,
+		Context:     statusContext,
+		TargetUrl:   targetUrl,
+		Description: fmt.Sprintf("#%d %s", pipelineRun.BuildNumber, description),
+	}
+	if err = sendCommitStatus(cs.Provider, apiUrl, token, report); err != nil {
+		klog.Errorf("report pipeline run id=%d commit %s status error: %s", pipelineRun.ID, commitId, err.Error())
+		return
+	}
+	klog.Infof("report pipeline run id=%d commit %s status %s", pipelineRun.ID, commitId, state)
+}
+
+// commitStatusReport 回写到代码提交的状态，Repo为代码空间名称，即代码仓库的路径
+type commitStatusReport struct {
+	Repo        string
+	CommitId    string
+	State       string
+	Context     string
+	TargetUrl   string
+	Description string
+}
+
+// sendCommitStatus 根据代码仓库类型调用对应的提交状态api
+func sendCommitStatus(provider, apiUrl, token string, report *commitStatusReport) error {
+	var reqUrl string
+	var body map[string]interface{}
+	header := http.Header{}
+	if provider == types.CommitStatusProviderGitlab {
+		gitlabStates := map[string]string{
+			commitStatePending: "running",
+			commitStateSuccess: "success",
+			commitStateFailure: "failed",
+			commitStateCancel:  "canceled",
+		}
+		reqUrl = fmt.Sprintf("%s/projects/%s/statuses/%s", apiUrl, url.PathEscape(report.Repo), report.CommitId)
+		body = map[string]interface{}{
+			"state":       gitlabStates[report.State],
+			"name":        report.Context,
+			"target_url":  report.TargetUrl,
+			"description": report.Description,
+		}
+		header.Set("PRIVATE-TOKEN", token)
+	} else {
+		// GitHub以及Gitea的提交状态api兼容，取消的构建标记为error状态
+		state := report.State
+		if state == commitStateCancel {
+			state = "error"
+		}
+		reqUrl = fmt.Sprintf("%s/repos/%s/statuses/%s", apiUrl, report.Repo, report.CommitId)
+		body = map[string]interface{}{
+			"state":       state,
+			"context":     report.Context,
+			"target_url":  report.TargetUrl,
+			"description": report.Description,
+		}
+		header.Set("Authorization", "token "+token)
+	}
+	return postCommitStatus(reqUrl, header, body)
+}
+
+// getCodeToken 获取访问代码仓库api的token，密码类型的密钥使用密码作为token
+func (r *ServicePipelineRun) getCodeToken(secretId uint) (string, error) {
+	secret, err := r.models.SettingsSecretManager.Get(secretId)
+	if err != nil {
+		return "", fmt.Errorf("获取代码密钥失败：%s", err.Error())
+	}
+	switch secret.Type {
+	case types.SettingsSecretTypeToken:
+		return secret.AccessToken, nil
+	case types.SettingsSecretTypePassword:
+		return secret.Password, nil
+	}
+	return "", fmt.Errorf("代码密钥「%s」不是token或密码类型，无法访问代码仓库api", secret.Name)
+}
+
+func commitState(status string) (string, string) {
+	switch status {
+	case types.PipelineStatusOK:
+		return commitStateSuccess, "构建成功"
+	case types.PipelineStatusError:
+		return commitStateFailure, "构建失败"
+	case types.PipelineStatusCancel:
+		return commitStateCancel, "构建已取消"
+	case types.PipelineStatusPause:
+		return commitStatePending, "构建等待手动执行"
+	}
+	return commitStatePending, "构建执行中"
+}
+
+func postCommitStatus(reqUrl string, header http.Header, body map[string]interface{}) error {
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, reqUrl, bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := commitStatusClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("status code %d: %s", resp.StatusCode, string(data))
+	}
+	return nil
+}
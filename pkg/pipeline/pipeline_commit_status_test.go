@@ -0,0 +1,207 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kubespace/kubespace/pkg/model/types"
+)
+
+// commitStatusRequest 代码仓库stub服务收到的提交状态请求
+type commitStatusRequest struct {
+	method string
+	path   string
+	header http.Header
+	body   map[string]interface{}
+}
+
+func newCommitStatusServer(t *testing.T, statusCode int) (*httptest.Server, *[]commitStatusRequest) {
+	var requests []commitStatusRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode commit status body error: %s", err.Error())
+		}
+		requests = append(requests, commitStatusRequest{
+			method: r.Method,
+			path:   r.URL.EscapedPath(),
+			header: r.Header.Clone(),
+			body:   body,
+		})
+		w.WriteHeader(statusCode)
+		_, _ = w.Write([]byte(`{"message":"stub"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestSendCommitStatus(t *testing.T) {
+	cases := []struct {
+		name       string
+		provider   string
+		state      string
+		path       string
+		authHeader string
+		authValue  string
+		body       map[string]interface{}
+	}{
+		{
+			name:       "github success",
+			provider:   types.CommitStatusProviderGithub,
+			state:      commitStateSuccess,
+			path:       "/repos/group/repo/statuses/abc123",
+			authHeader: "Authorization",
+			authValue:  "token secret-token",
+			body: map[string]interface{}{
+				"state":       "success",
+				"context":     "kubespace/build",
+				"target_url":  "http://kubespace/build/1",
+				"description": "#1 构建成功",
+			},
+		},
+		{
+			name:       "github cancel reported as error",
+			provider:   types.CommitStatusProviderGithub,
+			state:      commitStateCancel,
+			path:       "/repos/group/repo/statuses/abc123",
+			authHeader: "Authorization",
+			authValue:  "token secret-token",
+			body: map[string]interface{}{
+				"state":       "error",
+				"context":     "kubespace/build",
+				"target_url":  "http://kubespace/build/1",
+				"description": "#1 构建成功",
+			},
+		},
+		{
+			name:       "gitea failure",
+			provider:   types.CommitStatusProviderGitea,
+			state:      commitStateFailure,
+			path:       "/repos/group/repo/statuses/abc123",
+			authHeader: "Authorization",
+			authValue:  "token secret-token",
+			body: map[string]interface{}{
+				"state":       "failure",
+				"context":     "kubespace/build",
+				"target_url":  "http://kubespace/build/1",
+				"description": "#1 构建成功",
+			},
+		},
+		{
+			name:       "gitlab pending",
+			provider:   types.CommitStatusProviderGitlab,
+			state:      commitStatePending,
+			path:       "/projects/group%2Frepo/statuses/abc123",
+			authHeader: "PRIVATE-TOKEN",
+			authValue:  "secret-token",
+			body: map[string]interface{}{
+				"state":       "running",
+				"name":        "kubespace/build",
+				"target_url":  "http://kubespace/build/1",
+				"description": "#1 构建成功",
+			},
+		},
+		{
+			name:       "gitlab cancel",
+			provider:   types.CommitStatusProviderGitlab,
+			state:      commitStateCancel,
+			path:       "/projects/group%2Frepo/statuses/abc123",
+			authHeader: "PRIVATE-TOKEN",
+			authValue:  "secret-token",
+			body: map[string]interface{}{
+				"state":       "canceled",
+				"name":        "kubespace/build",
+				"target_url":  "http://kubespace/build/1",
+				"description": "#1 构建成功",
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server, requests := newCommitStatusServer(t, http.StatusCreated)
+			err := sendCommitStatus(c.provider, server.URL, "secret-token", &commitStatusReport{
+				Repo:        "group/repo",
+				CommitId:    "abc123",
+				State:       c.state,
+				Context:     "kubespace/build",
+				TargetUrl:   "http://kubespace/build/1",
+				Description: "#1 构建成功",
+			})
+			if err != nil {
+				t.Fatalf("send commit status error: %s", err.Error())
+			}
+			if len(*requests) != 1 {
+				t.Fatalf("stub server received %d requests, want 1", len(*requests))
+			}
+			req := (*requests)[0]
+			if req.method != http.MethodPost {
+				t.Errorf("method = %s, want POST", req.method)
+			}
+			if req.path != c.path {
+				t.Errorf("path = %s, want %s", req.path, c.path)
+			}
+			if got := req.header.Get(c.authHeader); got != c.authValue {
+				t.Errorf("header %s = %q, want %q", c.authHeader, got, c.authValue)
+			}
+			if got := req.header.Get("Content-Type"); got != "application/json" {
+				t.Errorf("content type = %q, want application/json", got)
+			}
+			if len(req.body) != len(c.body) {
+				t.Errorf("body = %v, want %v", req.body, c.body)
+			}
+			for k, v := range c.body {
+				if req.body[k] != v {
+					t.Errorf("body[%s] = %v, want %v", k, req.body[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestSendCommitStatusError(t *testing.T) {
+	server, _ := newCommitStatusServer(t, http.StatusUnauthorized)
+	err := sendCommitStatus(types.CommitStatusProviderGithub, server.URL, "bad-token", &commitStatusReport{
+		Repo:     "group/repo",
+		CommitId: "abc123",
+		State:    commitStateSuccess,
+	})
+	if err == nil {
+		t.Fatal("send commit status expected error for unauthorized response")
+	}
+	if !strings.Contains(err.Error(), "status code 401") || !strings.Contains(err.Error(), "stub") {
+		t.Errorf("error = %q, want status code and response body", err.Error())
+	}
+}
+
+func TestCommitStatusApiUrl(t *testing.T) {
+	cases := []struct {
+		name     string
+		provider string
+		apiUrl   string
+		codeUrl  string
+		want     string
+	}{
+		{"github.com", types.CommitStatusProviderGithub, "", "https://github.com/group/repo.git", "https://api.github.com"},
+		{"github enterprise", types.CommitStatusProviderGithub, "", "http://git.example.com/group/repo.git", "http://git.example.com/api/v3"},
+		{"gitlab ssh url", types.CommitStatusProviderGitlab, "", "git@gitlab.example.com:group/repo.git", "https://gitlab.example.com/api/v4"},
+		{"gitea", types.CommitStatusProviderGitea, "", "https://gitea.example.com/group/repo.git", "https://gitea.example.com/api/v1"},
+		{"configured api url", types.CommitStatusProviderGitlab, "https://api.example.com/v4/", "git@gitlab.example.com:group/repo.git", "https://api.example.com/v4"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := commitStatusApiUrl(&types.PipelineCommitStatus{Provider: c.provider, ApiUrl: c.apiUrl}, c.codeUrl)
+			if err != nil {
+				t.Fatalf("commit status api url error: %s", err.Error())
+			}
+			if got != c.want {
+				t.Errorf("commit status api url = %s, want %s", got, c.want)
+			}
+		})
+	}
+	if _, err := commitStatusApiUrl(&types.PipelineCommitStatus{Provider: types.CommitStatusProviderGithub}, "/local/repo"); err == nil {
+		t.Error("commit status api url expected error for local code url")
+	}
+}
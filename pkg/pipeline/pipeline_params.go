@@ -0,0 +1,214 @@
+package pipeline
+
+import (
+	"fmt"
+	"github.com/kubespace/kubespace/pkg/model/types"
+	"github.com/kubespace/kubespace/pkg/utils"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var pipelineParamNameRegexp = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// reservedBuildParams 构建时已使用的参数名称，流水线构建参数不能使用
+var reservedBuildParams = []string{"branch", "build_ids"}
+
+// checkPipelineParams 校验流水线构建参数定义
+func checkPipelineParams(params types.PipelineParams) error {
+	names := make(map[string]bool)
+	for _, param := range params {
+		if param == nil || !pipelineParamNameRegexp.MatchString(param.Name) {
+			return fmt.Errorf("构建参数名称只能包含字母、数字以及下划线，且不能以数字开头")
+		}
+		if strings.HasPrefix(strings.ToUpper(param.Name), "PIPELINE_") || utils.Contains(reservedBuildParams, param.Name) {
+			return fmt.Errorf("构建参数名称「%s」为系统保留名称", param.Name)
+		}
+		if names[param.Name] {
+			return fmt.Errorf("构建参数「%s」重复", param.Name)
+		}
+		names[param.Name] = true
+		switch param.Type {
+		case types.PipelineParamTypeString, types.PipelineParamTypeBool, types.PipelineParamTypeNumber:
+		case types.PipelineParamTypeChoice:
+			if len(param.Options) == 0 {
+				return fmt.Errorf("构建参数「%s」的可选值不能为空", param.Name)
+			}
+		case types.PipelineParamTypeSecret:
+			// 密钥参数只能使用流水线中指定的密钥，避免构建时提交任意密钥id获取密钥内容
+			if len(param.Options) == 0 {
+				return fmt.Errorf("构建参数「%s」的可选密钥不能为空", param.Name)
+			}
+			for _, option := range param.Options {
+				if _, err := paramSecretId(option); err != nil {
+					return fmt.Errorf("构建参数「%s」的可选密钥错误：%s", param.Name, err.Error())
+				}
+			}
+		default:
+			return fmt.Errorf("构建参数「%s」的类型%s不支持", param.Name, param.Type)
+		}
+		if isEmptyParamValue(param.Default) {
+			continue
+		}
+		defaultValue, err := convertParamValue(param, param.Default)
+		if err != nil {
+			return fmt.Errorf("构建参数「%s」的默认值错误：%s", param.Name, err.Error())
+		}
+		param.Default = defaultValue
+	}
+	return nil
+}
+
+func isEmptyParamValue(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	if s, ok := value.(string); ok && s == "" {
+		return true
+	}
+	return false
+}
+
+// convertParamValue 将提交的参数值转换为参数定义的类型
+func convertParamValue(param *types.PipelineParam, value interface{}) (interface{}, error) {
+	switch param.Type {
+	case types.PipelineParamTypeString:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		return fmt.Sprintf("%v", value), nil
+	case types.PipelineParamTypeChoice:
+		s := fmt.Sprintf("%v", value)
+		if !utils.Contains(param.Options, s) {
+			return nil, fmt.Errorf("参数值%s不在可选值%s中", s, strings.Join(param.Options, ","))
+		}
+		return s, nil
+	case types.PipelineParamTypeBool:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("参数值%s不是布尔类型", v)
+			}
+			return b, nil
+		}
+		return nil, fmt.Errorf("参数值%v不是布尔类型", value)
+	case types.PipelineParamTypeNumber:
+		switch v := value.(type) {
+		case float64:
+			return v, nil
+		case int:
+			return float64(v), nil
+		case string:
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("参数值%s不是数字", v)
+			}
+			return f, nil
+		}
+		return nil, fmt.Errorf("参数值%v不是数字", value)
+	case types.PipelineParamTypeSecret:
+		secretId, err := paramSecretId(value)
+		if err != nil {
+			return nil, err
+		}
+		if !utils.Contains(param.Options, strconv.FormatUint(uint64(secretId), 10)) {
+			return nil, fmt.Errorf("密钥id=%d不在可选密钥中", secretId)
+		}
+		return secretId, nil
+	}
+	return nil, fmt.Errorf("参数类型%s不支持", param.Type)
+}
+
+// paramSecretId 获取密钥参数的密钥id，json解析后的数字为float64类型
+func paramSecretId(value interface{}) (uint, error) {
+	if f, ok := value.(float64); ok {
+		if f <= 0 || f != float64(uint(f)) {
+			return 0, fmt.Errorf("参数值%v不是密钥id", value)
+		}
+		return uint(f), nil
+	}
+	secretId, err := strconv.ParseUint(fmt.Sprintf("%v", value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("参数值%v不是密钥id", value)
+	}
+	return uint(secretId), nil
+}
+
+// InitialParamEnvs 根据流水线的构建参数定义校验构建参数，并注入到构建的环境变量中，
+// 未提交的参数使用默认值，密钥参数只注入密钥id
+func (r *ServicePipelineRun) InitialParamEnvs(pipeline *types.Pipeline, params, envs map[string]interface{}) error {
+	for _, param := range pipeline.Params {
+		value, ok := params[param.Name]
+		if !ok || isEmptyParamValue(value) {
+			value = param.Default
+		}
+		if isEmptyParamValue(value) {
+			if param.Required {
+				return fmt.Errorf("构建参数「%s」不能为空", param.Name)
+			}
+			envs[param.Name] = ""
+			continue
+		}
+		envValue, err := convertParamValue(param, value)
+		if err != nil {
+			return fmt.Errorf("构建参数「%s」错误：%s", param.Name, err.Error())
+		}
+		if param.Type == types.PipelineParamTypeSecret {
+			if _, err = r.models.SettingsSecretManager.Get(envValue.(uint)); err != nil {
+				return fmt.Errorf("构建参数「%s」的密钥不存在：%s", param.Name, err.Error())
+			}
+		}
+		envs[param.Name] = envValue
+	}
+	return nil
+}
+
+// resolveSecretParamEnvs 将环境变量中密钥参数的密钥id替换为密钥内容，返回替换后的副本以及需要在日志中隐藏的密钥，
+// 密钥参数以流水线当前的构建参数定义为准，且密钥id需要在参数的可选密钥中，不使用环境变量中传递的参数类型
+func (r *ServicePipelineRun) resolveSecretParamEnvs(pipeline *types.Pipeline, envs map[string]interface{}) (map[string]interface{}, []string, error) {
+	var resolved map[string]interface{}
+	var masks []string
+	for _, param := range pipeline.Params {
+		if param.Type != types.PipelineParamTypeSecret {
+			continue
+		}
+		value, ok := envs[param.Name]
+		if !ok || isEmptyParamValue(value) {
+			continue
+		}
+		secretId, err := convertParamValue(param, value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("构建参数「%s」错误：%s", param.Name, err.Error())
+		}
+		secret, err := r.models.SettingsSecretManager.Get(secretId.(uint))
+		if err != nil {
+			return nil, nil, fmt.Errorf("获取构建参数「%s」的密钥失败：%s", param.Name, err.Error())
+		}
+		var secretValue string
+		switch secret.Type {
+		case types.SettingsSecretTypePassword:
+			secretValue = secret.Password
+		case types.SettingsSecretTypeKey:
+			secretValue = secret.PrivateKey
+		case types.SettingsSecretTypeToken:
+			secretValue = secret.AccessToken
+		}
+		if resolved == nil {
+			resolved = make(map[string]interface{}, len(envs))
+			for k, v := range envs {
+				resolved[k] = v
+			}
+		}
+		resolved[param.Name] = secretValue
+		if secretValue != "" {
+			masks = append(masks, secretValue)
+		}
+	}
+	if resolved == nil {
+		return envs, nil, nil
+	}
+	return resolved, masks, nil
+}
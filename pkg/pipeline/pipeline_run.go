@@ -1,6 +1,7 @@
 package pipeline
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"github.com/go-git/go-git/v5"
@@ -39,30 +40,58 @@ type codeCommit struct {
 type ServicePipelineRun struct {
 	models         *model.Models
 	builtInPlugins *plugins.Plugins
+	// 派发阶段任务时加锁，防止任务回调时重复派发
+	dispatchLock sync.Mutex
+	// 启动排队中的构建时加锁，防止本副本并发启动时超过并发数限制，多副本之间通过redis锁互斥
+	queueLock sync.Mutex
+	// 当前服务实例的标识，记录到执行的任务中，其它实例根据任务心跳判断实例是否仍在运行
+	instanceId string
 }
 
 func NewPipelineRunService(models *model.Models, kr *kube_resource.KubeResources) *ServicePipelineRun {
+	hostname, _ := os.Hostname()
 	r := &ServicePipelineRun{
-		models: models,
+		models:     models,
+		instanceId: hostname + "-" + utils.CreateUUID(),
 	}
 	r.builtInPlugins = plugins.NewPlugins(models, kr, r.Callback)
 	return r
 }
 
+// withLock 获取redis锁后执行f，多副本部署时同一时间只有一个副本执行，未获取到锁时跳过本次执行
+func (r *ServicePipelineRun) withLock(key string, expiration time.Duration, f func()) {
+	locked, err := r.models.LockManager.Lock(key, expiration)
+	if err != nil {
+		klog.Errorf("lock %s error: %s", key, err.Error())
+		return
+	}
+	if !locked {
+		klog.V(1).Infof("lock %s is held by other replica, skip", key)
+		return
+	}
+	defer func() {
+		if err := r.models.LockManager.Unlock(key); err != nil {
+			klog.Errorf("unlock %s error: %s", key, err.Error())
+		}
+	}()
+	f()
+}
+
 func (r *ServicePipelineRun) ListPipelineRun(pipelineId uint, lastBuildNumber int, status string, limit int) *utils.Response {
 	pipelineRuns, err := r.models.ManagerPipelineRun.ListPipelineRun(pipelineId, lastBuildNumber, status, limit)
 	if err != nil {
 		return &utils.Response{Code: code.DBError, Msg: err.Error()}
 	}
 	var retData []map[string]interface{}
-	for _, pipelineRun := range pipelineRuns {
+	for i, pipelineRun := range pipelineRuns {
 		stagesRun, err := r.models.ManagerPipelineRun.StagesRun(pipelineRun.ID)
 		if err != nil {
 			return &utils.Response{Code: code.DBError, Msg: err.Error()}
 		}
+		maskedRun, maskedStages := r.models.ManagerPipelineRun.MaskPipelineRun(&pipelineRuns[i], stagesRun)
 		data := map[string]interface{}{
-			"pipeline_run": pipelineRun,
-			"stages_run":   stagesRun,
+			"pipeline_run": maskedRun,
+			"stages_run":   maskedStages,
 		}
 		retData = append(retData, data)
 	}
@@ -86,10 +115,20 @@ func (r *ServicePipelineRun) GetPipelineRun(pipelineRunId uint) *utils.Response
 	if err != nil {
 		return &utils.Response{Code: code.DBError, Msg: err.Error()}
 	}
+	// 阶段之间的依赖关系，from为上游阶段，to为下游阶段
+	stageEdges := make([]map[string]uint, 0)
+	for _, stageRun := range stagesRun {
+		stageRun.PrevStageRunIds = r.models.ManagerPipelineRun.PrevStageRunIds(stageRun)
+		for _, prevId := range stageRun.PrevStageRunIds {
+			stageEdges = append(stageEdges, map[string]uint{"from": prevId, "to": stageRun.ID})
+		}
+	}
+	pipelineRun, stagesRun = r.models.ManagerPipelineRun.MaskPipelineRun(pipelineRun, stagesRun)
 	data := map[string]interface{}{
 		"pipeline":     pipeline,
 		"pipeline_run": pipelineRun,
 		"stages_run":   stagesRun,
+		"stage_edges":  stageEdges,
 		"workspace": map[string]interface{}{
 			"id":       workspace.ID,
 			"name":     workspace.Name,
@@ -185,29 +224,57 @@ func (r *ServicePipelineRun) getCodeBranchCommitId(codeUrl, branch string, secre
 	return "", fmt.Errorf("获取代码远程分支失败：未找到%s分支", branch)
 }
 
+// MatchTriggerBranch 手动构建时校验分支是否匹配流水线的代码触发条件，未配置代码触发时匹配所有分支
 func (r *ServicePipelineRun) MatchTriggerBranch(triggers types.PipelineTriggers, branch string) bool {
 	for _, trigger := range triggers {
-		if trigger.Branch == "" && trigger.Operator != types.PipelineTriggerOperatorExclude {
-			return true
+		if trigger.Type == types.PipelineTriggerTypeCode {
+			return r.matchCodeTriggers(triggers, "", branch)
+		}
+	}
+	return true
+}
+
+// matchCodeTriggers 匹配流水线的代码触发条件，branchType为空时不区分分支类型；
+// 分支被任一排除条件匹配时不触发，否则有任一条件匹配即触发
+func (r *ServicePipelineRun) matchCodeTriggers(triggers types.PipelineTriggers, branchType, branch string) bool {
+	matched := false
+	for _, trigger := range triggers {
+		if trigger.Type != types.PipelineTriggerTypeCode {
+			continue
 		}
-		if trigger.Operator == types.PipelineTriggerOperatorEqual && trigger.Branch == branch {
-			return true
+		triggerBranchType := trigger.BranchType
+		if triggerBranchType == "" {
+			triggerBranchType = types.PipelineBranchTypeBranch
 		}
-		if trigger.Operator == types.PipelineTriggerOperatorExclude && trigger.Branch == branch {
-			return false
+		if branchType != "" && triggerBranchType != branchType {
+			continue
+		}
+		if trigger.Branch == "" {
+			matched = true
+			continue
 		}
-		if trigger.Operator == types.PipelineTriggerOperatorInclude {
-			matched, err := regexp.MatchString(trigger.Branch, branch)
+		switch trigger.Operator {
+		case types.PipelineTriggerOperatorExclude:
+			if trigger.Branch == branch {
+				return false
+			}
+			matched = true
+		case types.PipelineTriggerOperatorInclude:
+			ok, err := regexp.MatchString(trigger.Branch, branch)
 			if err != nil {
 				klog.Errorf("regex %s match branch %s error: %s", trigger.Branch, branch, err.Error())
 				continue
 			}
-			if matched {
-				return true
+			if ok {
+				matched = true
+			}
+		default:
+			if trigger.Branch == branch {
+				matched = true
 			}
 		}
 	}
-	return true
+	return matched
 }
 
 type BuildForPipelineParamsBuilds struct {
@@ -231,14 +298,15 @@ type BuildForPipelineParams struct {
 	BuildIds []*BuildForPipelineParamsBuilds `json:"build_ids"`
 }
 
-func (r *ServicePipelineRun) InitialEnvs(pipeline *types.Pipeline, workspace *types.PipelineWorkspace, params map[string]interface{}) (map[string]interface{}, error) {
+// InitialEnvs 初始化构建的环境变量，commit不为空时使用传入的代码提交信息，否则从代码仓库获取分支的最新提交
+func (r *ServicePipelineRun) InitialEnvs(pipeline *types.Pipeline, workspace *types.PipelineWorkspace, params map[string]interface{}, commit *codeCommit) (map[string]interface{}, error) {
 	envs := map[string]interface{}{}
 	envs[types.PipelineEnvWorkspaceId] = workspace.ID
 	envs[types.PipelineEnvWorkspaceName] = workspace.Name
 	envs[types.PipelineEnvPipelineId] = pipeline.ID
 	envs[types.PipelineEnvPipelineName] = pipeline.Name
 	if workspace.Type == types.WorkspaceTypeCode {
-		if err := r.InitialCodeEnvs(pipeline, workspace, params, envs); err != nil {
+		if err := r.InitialCodeEnvs(pipeline, workspace, params, envs, commit); err != nil {
 			return nil, err
 		}
 	} else if workspace.Type == types.WorkspaceTypeCustom {
@@ -300,11 +368,14 @@ func (r *ServicePipelineRun) InitialEnvs(pipeline *types.Pipeline, workspace *ty
 		}
 		envs[types.PipelineEnvPipelineBuildId] = strings.Join(pipelineBuildId, ",")
 	}
+	if err := r.InitialParamEnvs(pipeline, params, envs); err != nil {
+		return nil, err
+	}
 
 	return envs, nil
 }
 
-func (r *ServicePipelineRun) InitialCodeEnvs(pipeline *types.Pipeline, workspace *types.PipelineWorkspace, params, envs map[string]interface{}) error {
+func (r *ServicePipelineRun) InitialCodeEnvs(pipeline *types.Pipeline, workspace *types.PipelineWorkspace, params, envs map[string]interface{}, commit *codeCommit) error {
 	envs["PIPELINE_CODE_URL"] = workspace.CodeUrl
 	branch, ok := params["branch"]
 	if ok {
@@ -312,6 +383,14 @@ func (r *ServicePipelineRun) InitialCodeEnvs(pipeline *types.Pipeline, workspace
 	} else {
 		return fmt.Errorf("未获取到代码分支参数")
 	}
+	if commit != nil {
+		// webhook触发时代码提交信息从回调内容中获取，不再访问代码仓库
+		envs["PIPELINE_CODE_COMMIT_ID"] = commit.CommitId
+		envs["PIPELINE_CODE_COMMIT_AUTHOR"] = commit.Author
+		envs["PIPELINE_CODE_COMMIT_MESSAGE"] = commit.Message
+		envs["PIPELINE_CODE_COMMIT_TIME"] = commit.CommitTime
+		return nil
+	}
 	if !r.MatchTriggerBranch(pipeline.Triggers, branch.(string)) {
 		return fmt.Errorf("代码分支未匹配到该流水线")
 	}
@@ -347,6 +426,10 @@ func (r *ServicePipelineRun) InitialCodeEnvs(pipeline *types.Pipeline, workspace
 }
 
 func (r *ServicePipelineRun) Build(buildSer *serializers.PipelineBuildSerializer, user *types.User) *utils.Response {
+	return r.build(buildSer, user, nil)
+}
+
+func (r *ServicePipelineRun) build(buildSer *serializers.PipelineBuildSerializer, user *types.User, commit *codeCommit) *utils.Response {
 	pipeline, err := r.models.ManagerPipeline.Get(buildSer.PipelineId)
 	if err != nil {
 		return &utils.Response{Code: code.DBError, Msg: err.Error()}
@@ -355,36 +438,68 @@ func (r *ServicePipelineRun) Build(buildSer *serializers.PipelineBuildSerializer
 	if err != nil {
 		return &utils.Response{Code: code.DBError, Msg: err.Error()}
 	}
-	stages, err := r.models.ManagerPipeline.Stages(buildSer.PipelineId)
+	envs, err := r.InitialEnvs(pipeline, workspace, buildSer.Params, commit)
 	if err != nil {
-		return &utils.Response{Code: code.DBError, Msg: err.Error()}
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
+	var stages []*types.PipelineStage
+	var definitionRef string
+	branch := fmt.Sprintf("%v", envs["PIPELINE_CODE_BRANCH"])
+	if pipeline.Definition == types.PipelineDefinitionCode && workspace.Type == types.WorkspaceTypeCode && isDefinitionBranch(pipeline, branch) {
+		// 受保护分支使用构建提交中的流水线配置文件生成阶段，其它分支使用流水线中配置的阶段
+		var resp *utils.Response
+		commitId := fmt.Sprintf("%v", envs["PIPELINE_CODE_COMMIT_ID"])
+		stages, definitionRef, resp = r.codeDefinitionStages(pipeline, workspace, branch, commitId)
+		if !resp.IsSuccess() {
+			return resp
+		}
+	} else {
+		stages, err = r.models.ManagerPipeline.Stages(buildSer.PipelineId)
+		if err != nil {
+			return &utils.Response{Code: code.DBError, Msg: err.Error()}
+		}
 	}
 	if len(stages) == 0 {
 		return &utils.Response{Code: code.DataNotExists, Msg: "当前流水线未配置阶段"}
 	}
-	envs, err := r.InitialEnvs(pipeline, workspace, buildSer.Params)
-	if err != nil {
-		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
-	}
 	var stagesRun []*types.PipelineRunStage
 	for _, stage := range stages {
 		stageRun := types.PipelineRunStage{
-			Name:         stage.Name,
-			TriggerMode:  stage.TriggerMode,
-			Status:       types.PipelineStatusWait,
-			Env:          map[string]interface{}{},
-			CustomParams: stage.CustomParams,
-			CreateTime:   time.Now(),
-			UpdateTime:   time.Now(),
+			Name:          stage.Name,
+			TriggerMode:   stage.TriggerMode,
+			Status:        types.PipelineStatusWait,
+			Env:           map[string]interface{}{},
+			CustomParams:  stage.CustomParams,
+			MaxParallel:   stage.MaxParallel,
+			FailurePolicy: stage.FailurePolicy,
+			DependsOn:     stage.DependsOn,
+			Timeout:       stage.Timeout,
+			When:          stage.When,
+			Approval:      stage.Approval,
+			CreateTime:    time.Now(),
+			UpdateTime:    time.Now(),
 		}
 		var stageRunJobs types.PipelineRunJobs
 		for _, stageJob := range stage.Jobs {
+			timeout := stageJob.Timeout
+			if timeout == 0 {
+				plugin, err := r.models.PipelinePluginManager.GetByKey(stageJob.PluginKey)
+				if err != nil {
+					return &utils.Response{Code: code.DBError, Msg: fmt.Sprintf("获取任务「%s」插件失败：%s", stageJob.Name, err.Error())}
+				}
+				timeout = plugin.Timeout
+			}
 			stageRunJob := &types.PipelineRunJob{
 				Name:      stageJob.Name,
 				PluginKey: stageJob.PluginKey,
 				Status:    types.PipelineStatusWait,
 				Params:    stageJob.Params,
 				Env:       map[string]interface{}{},
+				Timeout:   timeout,
+				When:      stageJob.When,
+			}
+			if stageJob.Retry != nil {
+				stageRunJob.Retry = *stageJob.Retry
 			}
 			stageRunJobs = append(stageRunJobs, stageRunJob)
 		}
@@ -392,19 +507,25 @@ func (r *ServicePipelineRun) Build(buildSer *serializers.PipelineBuildSerializer
 		stagesRun = append(stagesRun, &stageRun)
 	}
 	pipelineRun := &types.PipelineRun{
-		PipelineId: buildSer.PipelineId,
-		Status:     types.PipelineStatusWait,
-		Operator:   user.Name,
-		Params:     buildSer.Params,
-		Env:        envs,
-		CreateTime: time.Now(),
-		UpdateTime: time.Now(),
+		PipelineId:    buildSer.PipelineId,
+		Status:        types.PipelineStatusWait,
+		Operator:      user.Name,
+		Params:        buildSer.Params,
+		Env:           envs,
+		DefinitionRef: definitionRef,
+		CreateTime:    time.Now(),
+		UpdateTime:    time.Now(),
 	}
 	pipelineRun, err = r.models.ManagerPipelineRun.CreatePipelineRun(pipelineRun, stagesRun)
 	if err != nil {
 		return &utils.Response{Code: code.DBError, Msg: err.Error()}
 	}
-	go r.Execute(pipelineRun, 0, types.StageTriggerModeAuto)
+	go r.reportCommitStatus(pipelineRun.ID)
+	// 构建先进入队列，由dispatchPipelineRuns根据并发数限制按顺序启动
+	go func() {
+		r.cancelSupersededRuns(pipeline, pipelineRun)
+		r.dispatchPipelineRuns()
+	}()
 	return &utils.Response{Code: code.Success, Data: pipelineRun}
 }
 
@@ -444,11 +565,16 @@ func (r *ServicePipelineRun) recoverExecute(pipelineRun *types.PipelineRun) {
 	}
 }
 
-func (r *ServicePipelineRun) Execute(pipelineRun *types.PipelineRun, prevStageId uint, trigger string) {
+// Execute 执行构建中所有上游阶段都已成功的阶段，所有阶段都执行成功后构建完成
+func (r *ServicePipelineRun) Execute(pipelineRun *types.PipelineRun, trigger string) {
 	defer r.recoverExecute(pipelineRun)
-	nextStage, err := r.models.ManagerPipelineRun.NextStageRun(pipelineRun.ID, prevStageId)
+	if currRun, err := r.models.ManagerPipelineRun.Get(pipelineRun.ID); err == nil && currRun.Status == types.PipelineStatusCancel {
+		klog.Infof("pipeline run id=%d has been canceled, stop executing", pipelineRun.ID)
+		return
+	}
+	readyStages, allOK, err := r.models.ManagerPipelineRun.ReadyStageRuns(pipelineRun.ID)
 	if err != nil {
-		klog.Errorf("get pipeline run id=%d next stage error, current stage id %d", pipelineRun.ID, prevStageId)
+		klog.Errorf("get pipeline run id=%d ready stages error: %s", pipelineRun.ID, err.Error())
 		pipelineRun.Status = types.PipelineStatusError
 		err = r.models.ManagerPipelineRun.UpdatePipelineRun(pipelineRun)
 		if err != nil {
@@ -456,54 +582,275 @@ func (r *ServicePipelineRun) Execute(pipelineRun *types.PipelineRun, prevStageId
 		}
 		return
 	}
-	if nextStage == nil {
+	if allOK {
 		pipelineRun.Status = types.PipelineStatusOK
 		err = r.models.ManagerPipelineRun.UpdatePipelineRun(pipelineRun)
 		if err != nil {
 			klog.Errorf("update pipeline run error: %s", err.Error())
 		}
+		r.reportCommitStatus(pipelineRun.ID)
+		r.dispatchPipelineRuns()
+		return
+	}
+	for _, stageRun := range readyStages {
+		r.executeStage(stageRun, trigger)
+	}
+}
+
+// executeStage 执行阶段，自动触发时手动执行以及审批的阶段会暂停
+func (r *ServicePipelineRun) executeStage(stageRun *types.PipelineRunStage, trigger string) {
+	fromStatus := []string{types.PipelineStatusWait}
+	if trigger == types.StageTriggerModeManual {
+		fromStatus = append(fromStatus, types.PipelineStatusPause, types.PipelineStatusError)
+	}
+	envs, err := r.models.ManagerPipelineRun.GetEnvBeforeStageRun(stageRun)
+	if err != nil {
+		klog.Errorf("get stage id=%d envs error: %v", stageRun.ID, err)
+		return
+	}
+	stageRun.Env = envs
+	// 执行条件不满足的阶段直接跳过，不需要等待手动执行
+	matched, err := evaluateWhen(stageRun.When, envs)
+	if err != nil {
+		klog.Errorf("evaluate stage id=%d when error: %v", stageRun.ID, err)
+		r.failStageRun(stageRun, err.Error())
 		return
 	}
-	if nextStage.TriggerMode == types.StageTriggerModeManual && trigger == types.StageTriggerModeAuto {
-		klog.Infof("current stage id=%d trigger mode is manual, pausing...", nextStage.ID)
-		if _, _, err = r.models.ManagerPipelineRun.UpdatePipelineStageRun(&pipeline.UpdateStageObj{
-			StageRunId:     nextStage.ID,
+	if !matched {
+		r.skipStageRun(stageRun, fromStatus)
+		return
+	}
+	if stageRun.TriggerMode != types.StageTriggerModeAuto && trigger == types.StageTriggerModeAuto {
+		klog.Infof("current stage id=%d trigger mode is %s, pausing...", stageRun.ID, stageRun.TriggerMode)
+		if _, _, err := r.models.ManagerPipelineRun.UpdatePipelineStageRun(&pipeline.UpdateStageObj{
+			StageRunId:     stageRun.ID,
 			StageRunStatus: types.PipelineStatusPause,
 		}); err != nil {
-			klog.Errorf("update stage id=%d status to pause error: %v", nextStage.ID, err)
+			klog.Errorf("update stage id=%d status to pause error: %v", stageRun.ID, err)
 		}
 		return
 	}
-	envs, _ := r.models.ManagerPipelineRun.GetEnvBeforeStageRun(nextStage)
-	klog.Info(envs)
-	nextStage.Env = envs
-	nextStage.ExecTime = time.Now()
-	nextStage.Status = types.PipelineStatusDoing
-	err = r.models.ManagerPipelineRun.UpdateStageRun(nextStage)
+	started, err := r.models.ManagerPipelineRun.StartStageRun(stageRun, fromStatus)
 	if err != nil {
-		klog.Errorf("update stage id=%d exec time error: %v", nextStage.ID, err)
+		klog.Errorf("update stage id=%d status to doing error: %v", stageRun.ID, err)
 		return
 	}
-	runJobs := nextStage.Jobs
-	for _, runJob := range runJobs {
+	if !started {
+		klog.Infof("stage id=%d has been started, skip executing", stageRun.ID)
+		return
+	}
+	r.dispatchStageJobs(stageRun.ID)
+}
+
+// skipStageRun 阶段执行条件不满足时跳过阶段，并继续执行下游阶段
+func (r *ServicePipelineRun) skipStageRun(stageRun *types.PipelineRunStage, fromStatus []string) {
+	klog.Infof("stage id=%d when %q is not matched, skipping", stageRun.ID, stageRun.When)
+	skipped, err := r.models.ManagerPipelineRun.SkipStageRun(stageRun, fromStatus)
+	if err != nil {
+		klog.Errorf("update stage id=%d status to skipped error: %v", stageRun.ID, err)
+		return
+	}
+	if !skipped {
+		klog.Infof("stage id=%d has been started, skip executing", stageRun.ID)
+		return
+	}
+	pipelineRun, err := r.models.ManagerPipelineRun.Get(stageRun.PipelineRunId)
+	if err != nil {
+		klog.Errorf("get pipeline run id=%d error: %v", stageRun.PipelineRunId, err)
+		return
+	}
+	go r.Execute(pipelineRun, types.StageTriggerModeAuto)
+}
+
+// failStageRun 阶段执行条件计算失败时，将阶段中的任务置为error
+func (r *ServicePipelineRun) failStageRun(stageRun *types.PipelineRunStage, msg string) {
+	for _, runJob := range stageRun.Jobs {
+		runJob.Status = types.PipelineStatusError
+		runJob.Result = &utils.Response{Code: code.ParamsError, Msg: msg}
+	}
+	pipelineRun, _, err := r.models.ManagerPipelineRun.UpdatePipelineStageRun(&pipeline.UpdateStageObj{
+		StageRunId:   stageRun.ID,
+		StageRunJobs: stageRun.Jobs,
+	})
+	if err != nil {
+		klog.Errorf("update stage id=%d jobs status to error: %v", stageRun.ID, err)
+		return
+	}
+	go r.reportCommitStatus(pipelineRun.ID)
+}
+
+// dispatchStageJobs 按照阶段的最大并发数，将阶段中等待的任务置为doing并执行
+func (r *ServicePipelineRun) dispatchStageJobs(stageRunId uint) {
+	r.dispatchLock.Lock()
+	stageRun, err := r.models.ManagerPipelineRun.GetStageRun(stageRunId)
+	if err != nil {
+		r.dispatchLock.Unlock()
+		klog.Errorf("get stage run id=%d error: %s", stageRunId, err.Error())
+		return
+	}
+	if stageRun.Status != types.PipelineStatusDoing {
+		r.dispatchLock.Unlock()
+		return
+	}
+	doingCnt := 0
+	now := time.Now()
+	var waitJobs, skipJobs types.PipelineRunJobs
+	for _, runJob := range stageRun.Jobs {
+		if runJob.Status == types.PipelineStatusDoing {
+			doingCnt++
+		} else if runJob.Status == types.PipelineStatusWait && runJob.RetryTime != nil && now.Before(*runJob.RetryTime) {
+			// 等待自动重试的任务，由retryJobRun设置的定时器到时间后重新调度
+			continue
+		} else if runJob.Status == types.PipelineStatusWait {
+			// 根据阶段的env计算任务的执行条件，不满足或者计算失败的任务不再执行
+			matched, err := evaluateWhen(runJob.When, stageRun.Env)
+			if err != nil {
+				runJob.Status = types.PipelineStatusError
+				runJob.Result = &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+				skipJobs = append(skipJobs, runJob)
+			} else if !matched {
+				runJob.Status = types.PipelineStatusSkipped
+				runJob.Result = &utils.Response{Code: code.Success, Msg: fmt.Sprintf("执行条件「%s」不满足，跳过执行", runJob.When)}
+				skipJobs = append(skipJobs, runJob)
+			} else {
+				waitJobs = append(waitJobs, runJob)
+			}
+		}
+	}
+	if len(skipJobs) > 0 {
+		pipelineRun, currStageRun, err := r.models.ManagerPipelineRun.UpdatePipelineStageRun(&pipeline.UpdateStageObj{
+			StageRunId:   stageRunId,
+			StageRunJobs: skipJobs,
+		})
+		r.dispatchLock.Unlock()
+		if err != nil {
+			klog.Errorf("update stage run id=%d skipped jobs error: %s", stageRunId, err.Error())
+			return
+		}
+		// 跳过的任务相当于已执行完成，由stageJobFinished继续执行剩余的任务或者下游阶段
+		finishedJob := skipJobs[len(skipJobs)-1]
+		for _, runJob := range skipJobs {
+			if runJob.Status == types.PipelineStatusError {
+				finishedJob = runJob
+				break
+			}
+		}
+		r.stageJobFinished(pipelineRun, currStageRun, finishedJob)
+		return
+	}
+	if stageRun.MaxParallel > 0 {
+		if doingCnt >= stageRun.MaxParallel {
+			waitJobs = nil
+		} else if len(waitJobs) > stageRun.MaxParallel-doingCnt {
+			waitJobs = waitJobs[:stageRun.MaxParallel-doingCnt]
+		}
+	}
+	var runJobs types.PipelineRunJobs
+	for _, runJob := range waitJobs {
+		if err = r.models.ManagerPipelineRun.ClaimJobRun(runJob.ID, r.instanceId); err != nil {
+			klog.Errorf("update job run id=%d executor error: %s", runJob.ID, err.Error())
+			break
+		}
 		runJob.Status = types.PipelineStatusDoing
-		_, nextStage, _ = r.models.ManagerPipelineRun.UpdatePipelineStageRun(&pipeline.UpdateStageObj{
-			StageRunId:   nextStage.ID,
+		runJob.ExecTime = time.Now()
+		runJob.RetryTime = nil
+		_, stageRun, err = r.models.ManagerPipelineRun.UpdatePipelineStageRun(&pipeline.UpdateStageObj{
+			StageRunId:   stageRunId,
 			StageRunJobs: types.PipelineRunJobs{runJob},
 		})
-		resp := r.ExecuteJob(nextStage, runJob)
-		if !resp.IsSuccess() {
-			runJob.Result = resp
-			runJob.Status = types.PipelineStatusError
+		if err != nil {
+			klog.Errorf("update job run id=%d status to doing error: %s", runJob.ID, err.Error())
+			break
+		}
+		if stageRun.Status == types.PipelineStatusCancel {
+			klog.Infof("stage run id=%d has been canceled, stop executing jobs", stageRun.ID)
+			break
 		}
+		runJobs = append(runJobs, runJob)
 	}
+	r.dispatchLock.Unlock()
+	if len(runJobs) > 0 {
+		r.executeStageJobs(stageRun, runJobs)
+	}
+}
+
+// executeStageJobs 执行阶段中已置为doing的任务，执行失败的任务置为error
+func (r *ServicePipelineRun) executeStageJobs(stageRun *types.PipelineRunStage, runJobs types.PipelineRunJobs) {
 	for _, runJob := range runJobs {
-		if runJob.Status == types.PipelineStatusError {
-			_, nextStage, _ = r.models.ManagerPipelineRun.UpdatePipelineStageRun(&pipeline.UpdateStageObj{
-				StageRunId:   nextStage.ID,
-				StageRunJobs: types.PipelineRunJobs{runJob},
-			})
+		resp := r.ExecuteJob(stageRun, runJob)
+		if resp.IsSuccess() {
+			continue
 		}
+		runJob.Result = resp
+		runJob.Status = types.PipelineStatusError
+		r.retryJobRun(runJob)
+		pipelineRun, currStageRun, err := r.models.ManagerPipelineRun.UpdatePipelineStageRun(&pipeline.UpdateStageObj{
+			StageRunId:   stageRun.ID,
+			StageRunJobs: types.PipelineRunJobs{runJob},
+		})
+		if err != nil {
+			klog.Errorf("update job run id=%d status to error: %s", runJob.ID, err.Error())
+			continue
+		}
+		r.stageJobFinished(pipelineRun, currStageRun, runJob)
+	}
+}
+
+// stageJobFinished 阶段中任务执行完成后，根据阶段状态继续执行
+// 1. 任务失败且阶段失败策略为fail_fast，则取消阶段中其它未完成的任务；
+// 2. 阶段仍在执行中，则继续执行等待的任务；
+// 3. 阶段执行成功，则执行下一个阶段。
+func (r *ServicePipelineRun) stageJobFinished(pipelineRun *types.PipelineRun, stageRun *types.PipelineRunStage, jobRun *types.PipelineRunJob) {
+	if pipelineRun == nil || stageRun == nil {
+		return
+	}
+	if pipelineRun.Status == types.PipelineStatusError || pipelineRun.Status == types.PipelineStatusCancel {
+		go r.reportCommitStatus(pipelineRun.ID)
+		go r.dispatchPipelineRuns()
+	}
+	if jobRun.Status == types.PipelineStatusError && stageRun.FailurePolicy == types.StageFailurePolicyFailFast {
+		r.cancelStageJobs(stageRun, jobRun)
+	} else if stageRun.Status == types.PipelineStatusDoing {
+		r.dispatchStageJobs(stageRun.ID)
+	} else if pipeline.StageRunSucceeded(stageRun.Status) {
+		go r.Execute(pipelineRun, types.StageTriggerModeAuto)
+	}
+}
+
+// cancelStageJobs 取消阶段中除失败任务外其它未完成的任务
+func (r *ServicePipelineRun) cancelStageJobs(stageRun *types.PipelineRunStage, failedJob *types.PipelineRunJob) {
+	runJobs, err := r.models.ManagerPipelineRun.GetStageRunJobs(stageRun.ID)
+	if err != nil {
+		klog.Errorf("get stage run id=%d jobs error: %s", stageRun.ID, err.Error())
+		return
+	}
+	var cancelJobs, doingJobs types.PipelineRunJobs
+	for _, runJob := range runJobs {
+		if runJob.ID == failedJob.ID {
+			continue
+		}
+		if runJob.Status != types.PipelineStatusWait && runJob.Status != types.PipelineStatusDoing {
+			continue
+		}
+		if runJob.Status == types.PipelineStatusDoing {
+			doingJobs = append(doingJobs, runJob)
+		}
+		runJob.Status = types.PipelineStatusCancel
+		runJob.Result = &utils.Response{Code: code.PluginError, Msg: fmt.Sprintf("任务「%s」执行失败，取消执行", failedJob.Name)}
+		cancelJobs = append(cancelJobs, runJob)
+	}
+	if len(cancelJobs) == 0 {
+		return
+	}
+	if _, _, err = r.models.ManagerPipelineRun.UpdatePipelineStageRun(&pipeline.UpdateStageObj{
+		StageRunId:   stageRun.ID,
+		StageRunJobs: cancelJobs,
+	}); err != nil {
+		klog.Errorf("cancel stage run id=%d jobs error: %s", stageRun.ID, err.Error())
+		return
+	}
+	for _, runJob := range doingJobs {
+		r.cancelJob(runJob)
 	}
 }
 
@@ -620,21 +967,49 @@ func (r *ServicePipelineRun) ExecuteJob(stageRun *types.PipelineRunStage, runJob
 	executeParams := map[string]interface{}{
 		"job_id": runJob.ID,
 	}
+	pipelineRun, err := r.models.ManagerPipelineRun.Get(stageRun.PipelineRunId)
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: fmt.Sprintf("获取流水线构建失败:%v", err)}
+	}
+	pipeline, err := r.models.ManagerPipeline.Get(pipelineRun.PipelineId)
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: fmt.Sprintf("获取流水线失败:%v", err)}
+	}
+	envs, masks, err := r.resolveSecretParamEnvs(pipeline, stageRun.Env)
+	if err != nil {
+		klog.Errorf("resolve job run id=%d secret params error: %s", runJob.ID, err.Error())
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
 	for _, pluginParam := range plugin.Params.Params {
 		if pluginParam.ParamName == "" {
 			continue
 		}
-		executeParams[pluginParam.ParamName] = r.getJobExecParam(stageRun.Env, runJob.Params, pluginParam)
+		executeParams[pluginParam.ParamName] = r.getJobExecParam(envs, runJob.Params, pluginParam)
+		masks = append(masks, secretMasks(pluginParam.From, executeParams[pluginParam.ParamName])...)
+	}
+	if err = r.models.ManagerPipelineRun.UpdateJobRunMasks(runJob.ID, masks); err != nil {
+		klog.Errorf("update job run id=%d masks error: %s", runJob.ID, err.Error())
+		return &utils.Response{Code: code.DBError, Msg: "更新任务密钥掩码失败：" + err.Error()}
 	}
+	runJob.Masks = masks
 	if plugin.Url == types.PipelinePluginBuiltinUrl {
 		pluginParams := &plugins.PluginParams{
 			JobId:     runJob.ID,
+			Attempt:   runJob.Attempt,
 			PluginKey: plugin.Key,
 			Params:    executeParams,
+			Masks:     masks,
 		}
 		return r.builtInPlugins.Execute(pluginParams)
 	} else {
-		data, err := utils.HttpPost(plugin.Url, executeParams)
+		// 外部插件回调时需要携带该令牌，令牌在回调后失效
+		callbackToken := utils.CreateUUID()
+		if err = r.models.ManagerPipelineRun.UpdateJobRunCallbackToken(runJob.ID, callbackToken); err != nil {
+			klog.Errorf("update job run id=%d callback token error: %s", runJob.ID, err.Error())
+			return &utils.Response{Code: code.DBError, Msg: "更新任务回调令牌失败：" + err.Error()}
+		}
+		executeParams["callback_token"] = callbackToken
+		data, err := utils.HttpPostSigned(plugin.Url, executeParams, plugin.Secret)
 		if err != nil {
 			klog.Errorf("request %s error: %v", plugin.Url, err)
 			return &utils.Response{Code: code.RequestError, Msg: "请求插件接口失败:" + err.Error()}
@@ -661,7 +1036,7 @@ func (r *ServicePipelineRun) getJobRunResultEnvs(jobRun *types.PipelineRunJob) m
 	}
 	plugin, err := r.models.PipelinePluginManager.GetByKey(jobRun.PluginKey)
 	if err != nil {
-		klog.Errorf("get jobRun %s(%s) plugin error: %s", jobRun.ID, jobRun.Name, err.Error())
+		klog.Errorf("get jobRun %d(%s) plugin error: %s", jobRun.ID, jobRun.Name, err.Error())
 		return nil
 	}
 	if len(plugin.ResultEnv.EnvPath) == 0 {
@@ -681,6 +1056,64 @@ func (r *ServicePipelineRun) getJobRunResultEnvs(jobRun *types.PipelineRunJob) m
 	return envs
 }
 
+// checkCallbackToken 校验外部插件请求的任务在执行中并且回调令牌正确
+func (r *ServicePipelineRun) checkCallbackToken(jobId uint, token string) *utils.Response {
+	jobRun, err := r.models.ManagerPipelineRun.GetJobRun(jobId)
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: "获取任务失败：" + err.Error()}
+	}
+	if jobRun.Status != types.PipelineStatusDoing {
+		return &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("任务当前状态为%s，不能回调", jobRun.Status)}
+	}
+	if token == "" || subtle.ConstantTimeCompare([]byte(jobRun.CallbackToken), []byte(token)) != 1 {
+		klog.Warningf("job run id=%d callback with invalid token", jobId)
+		return &utils.Response{Code: code.AuthError, Msg: "任务回调令牌错误"}
+	}
+	return &utils.Response{Code: code.Success}
+}
+
+// VerifyCallback 校验外部插件的回调，任务需要在执行中并且回调令牌正确，校验通过后令牌失效
+func (r *ServicePipelineRun) VerifyCallback(jobId uint, token string) *utils.Response {
+	if resp := r.checkCallbackToken(jobId, token); !resp.IsSuccess() {
+		return resp
+	}
+	ok, err := r.models.ManagerPipelineRun.ConsumeJobRunCallbackToken(jobId, token)
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: "校验任务回调令牌失败：" + err.Error()}
+	}
+	if !ok {
+		return &utils.Response{Code: code.AuthError, Msg: "任务回调令牌已失效"}
+	}
+	return &utils.Response{Code: code.Success}
+}
+
+// maxPluginLogSize 外部插件单次追加日志的最大字节数
+const maxPluginLogSize = 1 << 20
+
+// AppendPluginLog 外部插件在任务执行过程中追加日志，使用任务的回调令牌认证，令牌不会失效
+func (r *ServicePipelineRun) AppendPluginLog(logSer *serializers.PipelineCallbackLogSerializer) *utils.Response {
+	if len(logSer.Logs) > maxPluginLogSize {
+		return &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("单次追加的日志不能超过%d字节", maxPluginLogSize)}
+	}
+	if resp := r.checkCallbackToken(logSer.JobId, logSer.CallbackToken); !resp.IsSuccess() {
+		return resp
+	}
+	if logSer.Logs == "" {
+		return &utils.Response{Code: code.Success}
+	}
+	if err := r.AppendJobLog(logSer.JobId, withTrailingNewline(logSer.Logs)); err != nil {
+		return &utils.Response{Code: code.DBError, Msg: "追加任务日志失败：" + err.Error()}
+	}
+	return &utils.Response{Code: code.Success}
+}
+
+func withTrailingNewline(log string) string {
+	if strings.HasSuffix(log, "\n") {
+		return log
+	}
+	return log + "\n"
+}
+
 func (r *ServicePipelineRun) Callback(callbackSer serializers.PipelineCallbackSerializer) *utils.Response {
 	callbackJobRun, err := r.models.ManagerPipelineRun.GetJobRun(callbackSer.JobId)
 	if err != nil {
@@ -692,6 +1125,20 @@ func (r *ServicePipelineRun) Callback(callbackSer serializers.PipelineCallbackSe
 		klog.Errorf("get job run id=%v stage error: %v", callbackSer.JobId, err)
 		return &utils.Response{Code: code.DBError, Msg: err.Error()}
 	}
+	if callbackJobRun.Status == types.PipelineStatusCancel {
+		klog.Infof("job run id=%v has been canceled, ignore callback", callbackJobRun.ID)
+		return &utils.Response{Code: code.ParamsError, Msg: "任务已取消"}
+	}
+	// 内置插件超时重试后，之前的执行结束时回调不能覆盖当前执行的状态
+	if callbackSer.Attempt > 0 && (callbackJobRun.Status != types.PipelineStatusDoing || callbackJobRun.Attempt != callbackSer.Attempt) {
+		klog.Infof("job run id=%v attempt %d is stale, current attempt %d status %s, ignore callback",
+			callbackJobRun.ID, callbackSer.Attempt, callbackJobRun.Attempt, callbackJobRun.Status)
+		return &utils.Response{Code: code.ParamsError, Msg: "任务的该次执行已结束"}
+	}
+	// 外部插件回调时可以携带剩余未推送的日志
+	if callbackSer.Logs != "" {
+		r.AppendJobLog(callbackJobRun.ID, withTrailingNewline(callbackSer.Logs))
+	}
 	if callbackSer.Result == nil {
 		//klog.Infof("stage run id=%v job=%v callback return nil", stageRun.ID, callbackJobRun.JobId)
 		resp := &utils.Response{Code: code.ParamsError, Msg: "stage job callback return nil"}
@@ -704,6 +1151,7 @@ func (r *ServicePipelineRun) Callback(callbackSer serializers.PipelineCallbackSe
 		callbackJobRun.Status = types.PipelineStatusOK
 	} else {
 		callbackJobRun.Status = types.PipelineStatusError
+		r.retryJobRun(callbackJobRun)
 	}
 	envs := r.getJobRunResultEnvs(callbackJobRun)
 	if envs != nil {
@@ -714,9 +1162,11 @@ func (r *ServicePipelineRun) Callback(callbackSer serializers.PipelineCallbackSe
 		StageRunId:   stageRun.ID,
 		StageRunJobs: types.PipelineRunJobs{callbackJobRun},
 	})
-	if stageRun != nil && stageRun.Status == types.PipelineStatusOK {
-		go r.Execute(pipelineRun, stageRun.ID, types.StageTriggerModeAuto)
+	if err != nil {
+		klog.Errorf("update job run id=%v callback result error: %v", callbackJobRun.ID, err)
+		return &utils.Response{Code: code.DBError, Msg: err.Error()}
 	}
+	go r.stageJobFinished(pipelineRun, stageRun, callbackJobRun)
 	return &utils.Response{Code: code.Success}
 }
 
@@ -725,6 +1175,16 @@ func (r *ServicePipelineRun) ManualExecuteStage(manualSer *serializers.PipelineS
 	if err != nil {
 		return &utils.Response{Code: code.DBError, Msg: err.Error()}
 	}
+	if stageRun.TriggerMode == types.StageTriggerModeApproval {
+		return &utils.Response{Code: code.ParamsError, Msg: "审批阶段需要审批通过后才能执行"}
+	}
+	pipelineRun, err := r.models.ManagerPipelineRun.Get(stageRun.PipelineRunId)
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: err.Error()}
+	}
+	if pipelineRun.Status == types.PipelineStatusWait {
+		return &utils.Response{Code: code.ParamsError, Msg: "构建正在排队中，不能手动执行阶段"}
+	}
 	if len(manualSer.CustomParams) > 0 {
 		stageRun.CustomParams = manualSer.CustomParams
 	}
@@ -739,14 +1199,16 @@ func (r *ServicePipelineRun) ManualExecuteStage(manualSer *serializers.PipelineS
 	if err = r.models.ManagerPipelineRun.UpdateStageJobRunParams(stageRun, stageRun.Jobs); err != nil {
 		return &utils.Response{Code: code.DBError, Msg: "更新阶段任务参数失败:" + err.Error()}
 	}
-	pipelineRun, err := r.models.ManagerPipelineRun.Get(stageRun.PipelineRunId)
-	if err != nil {
-		return &utils.Response{Code: code.DBError, Msg: err.Error()}
-	}
-	go r.Execute(pipelineRun, stageRun.PrevStageRunId, types.StageTriggerModeManual)
+	go r.executeManualStage(pipelineRun, stageRun)
 	return &utils.Response{Code: code.Success}
 }
 
+func (r *ServicePipelineRun) executeManualStage(pipelineRun *types.PipelineRun, stageRun *types.PipelineRunStage) {
+	defer r.recoverExecute(pipelineRun)
+	r.executeStage(stageRun, types.StageTriggerModeManual)
+	r.reportCommitStatus(pipelineRun.ID)
+}
+
 func (r *ServicePipelineRun) RetryStage(retrySer *serializers.PipelineStageRetrySerializer) *utils.Response {
 	stageRun, err := r.models.ManagerPipelineRun.GetStageRun(retrySer.StageRunId)
 	if err != nil {
@@ -756,6 +1218,13 @@ func (r *ServicePipelineRun) RetryStage(retrySer *serializers.PipelineStageRetry
 		klog.Infof("current stage run id=%v status is %v, not error", stageRun.ID, stageRun.Status)
 		return &utils.Response{Code: code.RequestError, Msg: "current stage run id=%v status is %v, not error"}
 	}
+	if stageRun.TriggerMode == types.StageTriggerModeApproval {
+		// 审批阶段重试时需要重新审批
+		if _, _, err = r.models.ManagerPipelineRun.ResetStageRunApprovals(stageRun.ID); err != nil {
+			return &utils.Response{Code: code.DBError, Msg: err.Error()}
+		}
+		return &utils.Response{Code: code.Success}
+	}
 	//pipelineRun, stageRun, err := r.models.ManagerPipelineRun.UpdatePipelineStageRun(stageRun.ID, types.PipelineStatusDoing, nil)
 	pipelineRun, stageRun, err := r.models.ManagerPipelineRun.UpdatePipelineStageRun(&pipeline.UpdateStageObj{
 		StageRunId: stageRun.ID,
@@ -764,11 +1233,91 @@ func (r *ServicePipelineRun) RetryStage(retrySer *serializers.PipelineStageRetry
 	if err != nil {
 		return &utils.Response{Code: code.DBError, Msg: err.Error()}
 	}
-	go r.Execute(pipelineRun, stageRun.PrevStageRunId, types.StageTriggerModeManual)
+	go r.executeManualStage(pipelineRun, stageRun)
 	return &utils.Response{Code: code.Success}
 }
 
+// Cancel 取消正在执行的流水线构建，正在执行的任务会通知插件停止执行
+func (r *ServicePipelineRun) Cancel(cancelSer *serializers.PipelineRunCancelSerializer) *utils.Response {
+	pipelineRun, doingJobs, err := r.models.ManagerPipelineRun.CancelPipelineRun(cancelSer.PipelineRunId)
+	if err != nil {
+		return &utils.Response{Code: code.UpdateError, Msg: "取消构建失败：" + err.Error()}
+	}
+	for _, job := range doingJobs {
+		r.cancelJob(job)
+	}
+	go r.reportCommitStatus(pipelineRun.ID)
+	go r.dispatchPipelineRuns()
+	return &utils.Response{Code: code.Success, Data: pipelineRun}
+}
+
+func (r *ServicePipelineRun) cancelJob(jobRun *types.PipelineRunJob) {
+	plugin, err := r.models.PipelinePluginManager.GetByKey(jobRun.PluginKey)
+	if err != nil {
+		klog.Errorf("get plugin key=%s error: %v", jobRun.PluginKey, err)
+		return
+	}
+	if plugin.Url == types.PipelinePluginBuiltinUrl {
+		if !r.builtInPlugins.Cancel(jobRun.ID) {
+			klog.Infof("job run id=%d is not executing in builtin plugins", jobRun.ID)
+		}
+		return
+	}
+	cancelUrl := strings.TrimSuffix(plugin.Url, "/") + "/cancel"
+	if _, err = utils.HttpPostSigned(cancelUrl, map[string]interface{}{"job_id": jobRun.ID}, plugin.Secret); err != nil {
+		klog.Errorf("request %s to cancel job run id=%d error: %v", cancelUrl, jobRun.ID, err)
+	}
+}
+
+// appendJobLog 在任务日志后追加日志
+func (r *ServicePipelineRun) appendJobLog(jobRunId uint, format string, a ...interface{}) {
+	log := fmt.Sprintf("%s %s\n", time.Now().Format("2006-01-02 15:04:05"), fmt.Sprintf(format, a...))
+	r.AppendJobLog(jobRunId, log)
+}
+
+// AppendJobLog 使用任务的密钥掩码替换日志中的密钥后追加到任务日志，插件外部写入的日志也通过该方法追加
+func (r *ServicePipelineRun) AppendJobLog(jobRunId uint, log string) error {
+	masker, err := r.models.ManagerPipelineRun.JobRunMasker(jobRunId)
+	if err != nil {
+		klog.Errorf("get job run id=%d masks error: %s", jobRunId, err.Error())
+		return err
+	}
+	if err = r.models.PipelineJobLogManager.AppendLog(jobRunId, masker.Mask(log)); err != nil {
+		klog.Errorf("append job run id=%d log error: %s", jobRunId, err.Error())
+		return err
+	}
+	return nil
+}
+
 func (r *ServicePipelineRun) JobLog(jobRunId uint) *utils.Response {
 
 	return &utils.Response{Code: code.Success}
 }
+
+// secretMasks 获取来源为代码密钥、镜像仓库以及流水线资源的插件参数中的密钥
+func secretMasks(from string, value interface{}) []string {
+	switch from {
+	case types.PluginParamsFromCodeSecret, types.PluginParamsFromImageRegistry, types.PluginParamsFromPipelineResource:
+	default:
+		return nil
+	}
+	var masks []string
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, key := range []string{"password", "private_key", "access_token"} {
+			if s, ok := v[key].(string); ok && s != "" {
+				masks = append(masks, s)
+			}
+		}
+		if secret, ok := v["secret"]; ok {
+			masks = append(masks, secretMasks(from, secret)...)
+		}
+	case map[string]string:
+		for _, key := range []string{"password", "private_key", "access_token"} {
+			if v[key] != "" {
+				masks = append(masks, v[key])
+			}
+		}
+	}
+	return masks
+}
@@ -0,0 +1,73 @@
+package pipeline
+
+import (
+	"fmt"
+	"github.com/kubespace/kubespace/pkg/model/types"
+	"github.com/kubespace/kubespace/pkg/utils"
+	"github.com/kubespace/kubespace/pkg/utils/code"
+	"github.com/kubespace/kubespace/pkg/views/serializers"
+	"k8s.io/klog"
+	"time"
+	"unicode/utf8"
+)
+
+// maxApprovalCommentLength 审批意见的最大字符数
+const maxApprovalCommentLength = 500
+
+// isStageApprover 用户是否可以审批该阶段，用户在审批用户中，或者拥有流水线空间中的审批角色
+func (r *ServicePipelineRun) isStageApprover(stageRun *types.PipelineRunStage, user *types.User, workspaceId uint) bool {
+	if utils.Contains(stageRun.Approval.Users, user.Name) {
+		return true
+	}
+	for _, role := range stageRun.Approval.Roles {
+		if r.models.UserRoleManager.HasScopeRole(user, types.RoleScopePipeline, workspaceId, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// ApproveStage 审批暂停中的审批阶段，审批通过人数达到要求后执行阶段，审批拒绝时阶段失败
+func (r *ServicePipelineRun) ApproveStage(approvalSer *serializers.PipelineStageApprovalSerializer, user *types.User) *utils.Response {
+	if approvalSer.Result != types.StageApprovalApprove && approvalSer.Result != types.StageApprovalReject {
+		return &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("审批结果%s错误", approvalSer.Result)}
+	}
+	if utf8.RuneCountInString(approvalSer.Comment) > maxApprovalCommentLength {
+		return &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("审批意见不能超过%d个字符", maxApprovalCommentLength)}
+	}
+	stageRun, err := r.models.ManagerPipelineRun.GetStageRun(approvalSer.StageRunId)
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: err.Error()}
+	}
+	if stageRun.TriggerMode != types.StageTriggerModeApproval {
+		return &utils.Response{Code: code.ParamsError, Msg: "当前阶段不是审批阶段"}
+	}
+	pipelineRun, err := r.models.ManagerPipelineRun.Get(stageRun.PipelineRunId)
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: err.Error()}
+	}
+	pipelineObj, err := r.models.ManagerPipeline.Get(pipelineRun.PipelineId)
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: err.Error()}
+	}
+	if !r.isStageApprover(stageRun, user, pipelineObj.WorkspaceId) {
+		return &utils.Response{Code: code.AuthError, Msg: fmt.Sprintf("用户「%s」没有审批阶段「%s」的权限", user.Name, stageRun.Name)}
+	}
+	stageRun, approved, err := r.models.ManagerPipelineRun.ApproveStageRun(stageRun.ID, &types.PipelineRunStageApproval{
+		UserId:   user.ID,
+		UserName: user.Name,
+		Result:   approvalSer.Result,
+		Comment:  approvalSer.Comment,
+		Time:     time.Now(),
+	})
+	if err != nil {
+		return &utils.Response{Code: code.UpdateError, Msg: "审批失败：" + err.Error()}
+	}
+	klog.Infof("user %s %s stage run id=%d", user.Name, approvalSer.Result, stageRun.ID)
+	if approvalSer.Result == types.StageApprovalReject {
+		go r.reportCommitStatus(pipelineRun.ID)
+	} else if approved {
+		go r.executeManualStage(pipelineRun, stageRun)
+	}
+	return &utils.Response{Code: code.Success, Data: stageRun}
+}
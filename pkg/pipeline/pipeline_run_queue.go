@@ -0,0 +1,99 @@
+package pipeline
+
+import (
+	"fmt"
+	"github.com/kubespace/kubespace/pkg/conf"
+	"github.com/kubespace/kubespace/pkg/model/types"
+	"github.com/kubespace/kubespace/pkg/views/serializers"
+	"k8s.io/klog"
+	"time"
+)
+
+// WatchQueue 定时启动排队中的构建，构建完成、暂停以及服务重启后排队的构建都可以继续执行
+func (r *ServicePipelineRun) WatchQueue() {
+	r.dispatchPipelineRuns()
+	tick := time.NewTicker(5 * time.Second)
+	defer tick.Stop()
+	for range tick.C {
+		r.dispatchPipelineRuns()
+	}
+}
+
+// dispatchPipelineRuns 按照创建顺序启动排队中（wait状态）的构建，构建需要同时满足以下限制：
+// 1. 流水线执行中以及暂停的构建数小于流水线的最大并发构建数；
+// 2. 全局执行中的构建数小于全局的最大并发构建数，达到全局限制时，后面排队的构建都不会启动。
+// 多副本部署时只有获取到redis锁的副本启动构建，其它副本排队的构建由下一次定时启动。
+func (r *ServicePipelineRun) dispatchPipelineRuns() {
+	r.queueLock.Lock()
+	defer r.queueLock.Unlock()
+	r.withLock("pipeline_run_queue", time.Minute, r.startQueuedPipelineRuns)
+}
+
+func (r *ServicePipelineRun) startQueuedPipelineRuns() {
+	queuedRuns, err := r.models.ManagerPipelineRun.ListQueuedPipelineRun()
+	if err != nil {
+		klog.Errorf("list queued pipeline runs error: %s", err.Error())
+		return
+	}
+	if len(queuedRuns) == 0 {
+		return
+	}
+	pipelineActive, doing, err := r.models.ManagerPipelineRun.CountActivePipelineRun()
+	if err != nil {
+		klog.Errorf("count active pipeline runs error: %s", err.Error())
+		return
+	}
+	maxBuilds := conf.AppConfig.PipelineMaxConcurrentBuilds
+	pipelines := make(map[uint]*types.Pipeline)
+	for i := range queuedRuns {
+		if maxBuilds > 0 && doing >= maxBuilds {
+			klog.Infof("running pipeline builds reach the limit %d, %d builds are queued", maxBuilds, len(queuedRuns)-i)
+			return
+		}
+		pipelineRun := &queuedRuns[i]
+		pipelineObj, ok := pipelines[pipelineRun.PipelineId]
+		if !ok {
+			if pipelineObj, err = r.models.ManagerPipeline.Get(pipelineRun.PipelineId); err != nil {
+				klog.Errorf("get pipeline id=%d error: %s", pipelineRun.PipelineId, err.Error())
+				continue
+			}
+			pipelines[pipelineRun.PipelineId] = pipelineObj
+		}
+		if pipelineObj.MaxConcurrent > 0 && pipelineActive[pipelineRun.PipelineId] >= pipelineObj.MaxConcurrent {
+			continue
+		}
+		started, err := r.models.ManagerPipelineRun.StartPipelineRun(pipelineRun)
+		if err != nil {
+			klog.Errorf("start pipeline run id=%d error: %s", pipelineRun.ID, err.Error())
+			continue
+		}
+		if !started {
+			continue
+		}
+		pipelineActive[pipelineRun.PipelineId]++
+		doing++
+		go r.Execute(pipelineRun, types.StageTriggerModeAuto)
+	}
+}
+
+// cancelSupersededRuns 取消流水线中同一分支上比当前构建更早的未完成构建
+func (r *ServicePipelineRun) cancelSupersededRuns(pipelineObj *types.Pipeline, pipelineRun *types.PipelineRun) {
+	branch, _ := pipelineRun.Env["PIPELINE_CODE_BRANCH"].(string)
+	if !pipelineObj.CancelSuperseded || branch == "" {
+		return
+	}
+	unfinishedRuns, err := r.models.ManagerPipelineRun.ListPipelineUnfinishedRun(pipelineObj.ID)
+	if err != nil {
+		klog.Errorf("list pipeline id=%d unfinished runs error: %s", pipelineObj.ID, err.Error())
+		return
+	}
+	for _, run := range unfinishedRuns {
+		if run.ID >= pipelineRun.ID || fmt.Sprintf("%v", run.Env["PIPELINE_CODE_BRANCH"]) != branch {
+			continue
+		}
+		klog.Infof("pipeline run id=%d is superseded by id=%d on branch %s, canceling", run.ID, pipelineRun.ID, branch)
+		if resp := r.Cancel(&serializers.PipelineRunCancelSerializer{PipelineRunId: run.ID}); !resp.IsSuccess() {
+			klog.Errorf("cancel superseded pipeline run id=%d error: %s", run.ID, resp.Msg)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package pipeline
+
+import (
+	"fmt"
+	"github.com/kubespace/kubespace/pkg/model/manager/pipeline"
+	"github.com/kubespace/kubespace/pkg/model/types"
+	"github.com/kubespace/kubespace/pkg/utils"
+	"github.com/kubespace/kubespace/pkg/utils/code"
+	"k8s.io/klog"
+	"time"
+)
+
+const (
+	// 实例更新执行中任务心跳的间隔
+	jobHeartbeatInterval = 10 * time.Second
+	// 任务心跳超过该时间未更新时，认为执行任务的实例已停止
+	jobHeartbeatTimeout = 30 * time.Second
+)
+
+// ResumePipelineRuns 定时更新当前实例未完成任务的心跳，并恢复执行实例停止后中断的流水线构建，
+// 构建中未完成任务的心跳都已超时时，由当前实例接管构建，排队中（wait状态）的构建由WatchQueue启动
+// 1. 构建中doing的阶段，根据插件是否可恢复，重新执行或失败阶段中doing的任务，并执行未开始的任务；
+// 2. 继续执行构建中上游阶段都已成功的阶段。
+func (r *ServicePipelineRun) ResumePipelineRuns() {
+	r.withLock("pipeline_run_resume", time.Minute, r.resumePipelineRuns)
+	tick := time.NewTicker(jobHeartbeatInterval)
+	defer tick.Stop()
+	for range tick.C {
+		if err := r.models.ManagerPipelineRun.HeartbeatJobRuns(r.instanceId); err != nil {
+			klog.Errorf("update instance %s job runs heartbeat error: %s", r.instanceId, err.Error())
+		}
+		r.withLock("pipeline_run_resume", time.Minute, r.resumePipelineRuns)
+	}
+}
+
+func (r *ServicePipelineRun) resumePipelineRuns() {
+	pipelineRuns, err := r.models.ManagerPipelineRun.ListUnfinishedPipelineRun()
+	if err != nil {
+		klog.Errorf("list unfinished pipeline runs error: %s", err.Error())
+		return
+	}
+	expiredBefore := time.Now().Add(-jobHeartbeatTimeout)
+	for i := range pipelineRuns {
+		if pipelineRuns[i].Status == types.PipelineStatusWait {
+			continue
+		}
+		claimed, err := r.models.ManagerPipelineRun.ClaimOrphanedPipelineRun(pipelineRuns[i].ID, r.instanceId, expiredBefore)
+		if err != nil {
+			klog.Errorf("claim pipeline run id=%d error: %s", pipelineRuns[i].ID, err.Error())
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		r.resumePipelineRun(&pipelineRuns[i])
+	}
+}
+
+func (r *ServicePipelineRun) resumePipelineRun(pipelineRun *types.PipelineRun) {
+	klog.Infof("resume pipeline run id=%d with status %s", pipelineRun.ID, pipelineRun.Status)
+	stagesRun, err := r.models.ManagerPipelineRun.StagesRun(pipelineRun.ID)
+	if err != nil {
+		klog.Errorf("get pipeline run id=%d stages error: %s", pipelineRun.ID, err.Error())
+		return
+	}
+	for _, stageRun := range stagesRun {
+		if stageRun.Status == types.PipelineStatusDoing {
+			go r.resumeStageRun(pipelineRun, stageRun)
+		}
+	}
+	go r.Execute(pipelineRun, types.StageTriggerModeAuto)
+}
+
+func (r *ServicePipelineRun) resumeStageRun(pipelineRun *types.PipelineRun, stageRun *types.PipelineRunStage) {
+	defer r.recoverExecute(pipelineRun)
+	var resumeJobs types.PipelineRunJobs
+	for _, jobRun := range stageRun.Jobs {
+		// 原实例设置的重试定时器已失效，重新设置
+		if jobRun.Status == types.PipelineStatusWait && jobRun.RetryTime != nil && time.Now().Before(*jobRun.RetryTime) {
+			r.scheduleJobRetry(stageRun.ID, *jobRun.RetryTime)
+			continue
+		}
+		if jobRun.Status != types.PipelineStatusDoing {
+			continue
+		}
+		plugin, err := r.models.PipelinePluginManager.GetByKey(jobRun.PluginKey)
+		if err != nil {
+			klog.Errorf("get plugin key=%s error: %v", jobRun.PluginKey, err)
+			r.appendJobLog(jobRun.ID, "获取任务插件失败，无法恢复执行：%v", err)
+			r.failResumeJob(stageRun, jobRun, fmt.Sprintf("获取执行插件错误:%v", err))
+			continue
+		}
+		if !plugin.Resumable {
+			r.appendJobLog(jobRun.ID, "执行任务的服务实例已停止，任务执行中断，插件「%s」不支持恢复执行，任务置为失败", plugin.Name)
+			r.failResumeJob(stageRun, jobRun, "执行任务的服务实例已停止，任务执行中断")
+			continue
+		}
+		r.appendJobLog(jobRun.ID, "执行任务的服务实例已停止，任务执行中断，插件「%s」支持恢复执行，重新执行任务", plugin.Name)
+		jobRun.ExecTime = time.Now()
+		if _, _, err = r.models.ManagerPipelineRun.UpdatePipelineStageRun(&pipeline.UpdateStageObj{
+			StageRunId:   stageRun.ID,
+			StageRunJobs: types.PipelineRunJobs{jobRun},
+		}); err != nil {
+			klog.Errorf("update job run id=%d exec time error: %s", jobRun.ID, err.Error())
+		}
+		resumeJobs = append(resumeJobs, jobRun)
+	}
+	if len(resumeJobs) > 0 {
+		r.executeStageJobs(stageRun, resumeJobs)
+	}
+	// 继续执行阶段中等待的任务
+	r.dispatchStageJobs(stageRun.ID)
+}
+
+func (r *ServicePipelineRun) failResumeJob(stageRun *types.PipelineRunStage, jobRun *types.PipelineRunJob, msg string) {
+	jobRun.Status = types.PipelineStatusError
+	jobRun.Result = &utils.Response{Code: code.PluginError, Msg: msg}
+	r.retryJobRun(jobRun)
+	pipelineRun, currStageRun, err := r.models.ManagerPipelineRun.UpdatePipelineStageRun(&pipeline.UpdateStageObj{
+		StageRunId:   stageRun.ID,
+		StageRunJobs: types.PipelineRunJobs{jobRun},
+	})
+	if err != nil {
+		klog.Errorf("update job run id=%d status to error: %s", jobRun.ID, err.Error())
+		return
+	}
+	r.stageJobFinished(pipelineRun, currStageRun, jobRun)
+}
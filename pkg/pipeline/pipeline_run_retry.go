@@ -0,0 +1,116 @@
+package pipeline
+
+import (
+	"fmt"
+	"github.com/kubespace/kubespace/pkg/model/types"
+	"github.com/kubespace/kubespace/pkg/utils"
+	"github.com/kubespace/kubespace/pkg/utils/code"
+	"time"
+)
+
+// maxJobRetryAttempts 任务自动重试策略允许的最大执行次数
+const maxJobRetryAttempts = 10
+
+// defaultJobRetryOn 重试策略未指定触发重试的结果码时，只重试请求失败以及超时的任务，
+// 插件执行失败的任务可能已经产生了副作用，如已推送的tag，需要显式指定才会重试
+var defaultJobRetryOn = []string{code.RequestError, code.TimeoutError}
+
+// checkJobRetry 校验任务的自动重试策略
+func checkJobRetry(retry *types.PipelineJobRetry) error {
+	if retry == nil {
+		return nil
+	}
+	if retry.MaxAttempts < 0 || retry.MaxAttempts > maxJobRetryAttempts {
+		return fmt.Errorf("最大执行次数需要在0到%d之间", maxJobRetryAttempts)
+	}
+	if retry.Backoff < 0 || retry.MaxBackoff < 0 || retry.BackoffFactor < 0 {
+		return fmt.Errorf("重试等待时间不能小于0")
+	}
+	for _, retryOn := range retry.RetryOn {
+		// 已回滚的任务重试会重新部署回滚前的版本，不允许重试
+		if retryOn == "" || retryOn == code.Success || retryOn == code.PluginRolledBack {
+			return fmt.Errorf("触发重试的结果码%q错误", retryOn)
+		}
+	}
+	return nil
+}
+
+// jobRunRetryable 任务执行失败后，是否还可以根据重试策略自动重试
+func jobRunRetryable(jobRun *types.PipelineRunJob) bool {
+	if jobRun.Status != types.PipelineStatusError || jobRun.Result == nil {
+		return false
+	}
+	if jobRun.Retries+1 >= jobRun.Retry.MaxAttempts || jobRun.Result.Code == code.PluginRolledBack {
+		return false
+	}
+	retryOn := jobRun.Retry.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = defaultJobRetryOn
+	}
+	return utils.Contains(retryOn, jobRun.Result.Code)
+}
+
+// retryJobRun 任务执行失败后，根据任务的重试策略判断是否自动重试，
+// 需要重试时将任务重新置为wait并设置下一次执行的时间，每次重试只设置一个定时器，到时间后由dispatchStageJobs重新执行，
+// 每次执行的结果以及日志起始偏移记录在PipelineRunJobAttempt中
+func (r *ServicePipelineRun) retryJobRun(jobRun *types.PipelineRunJob) bool {
+	if !jobRunRetryable(jobRun) {
+		return false
+	}
+	backoff := jobRun.Retry.BackoffDuration(jobRun.Retries)
+	retryTime := time.Now().Add(backoff)
+	jobRun.Retries++
+	jobRun.Status = types.PipelineStatusWait
+	jobRun.RetryTime = &retryTime
+	r.appendJobLog(jobRun.ID, "第%d次执行失败：%s，%s后进行第%d次重试",
+		jobRun.Attempt, jobRun.Result.Msg, backoff.String(), jobRun.Retries)
+	// 没有等待时间的重试，由调用方更新任务状态后的stageJobFinished直接调度
+	if backoff > 0 {
+		r.scheduleJobRetry(jobRun.StageRunId, retryTime)
+	}
+	return true
+}
+
+// scheduleJobRetry 到重试时间后重新调度阶段中等待的任务，
+// 定时器先于任务状态更新触发时，调用方更新状态后的调度也会执行已到重试时间的任务
+func (r *ServicePipelineRun) scheduleJobRetry(stageRunId uint, retryTime time.Time) {
+	time.AfterFunc(time.Until(retryTime), func() {
+		r.dispatchStageJobs(stageRunId)
+	})
+}
+
+// JobAttempts 获取任务的所有执行记录
+func (r *ServicePipelineRun) JobAttempts(jobRunId uint) *utils.Response {
+	attempts, err := r.models.ManagerPipelineRun.ListJobRunAttempts(jobRunId)
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: err.Error()}
+	}
+	if attempts, err = r.models.ManagerPipelineRun.MaskJobRunAttempts(jobRunId, attempts); err != nil {
+		return &utils.Response{Code: code.DBError, Msg: "隐藏执行记录中的密钥失败：" + err.Error()}
+	}
+	return &utils.Response{Code: code.Success, Data: attempts}
+}
+
+// JobAttemptLog 获取任务某一次执行的日志，即该次执行的日志起始偏移到下一次执行的日志起始偏移之间的内容
+func (r *ServicePipelineRun) JobAttemptLog(jobRunId uint, attempt int) *utils.Response {
+	attempts, err := r.models.ManagerPipelineRun.ListJobRunAttempts(jobRunId)
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: err.Error()}
+	}
+	for i, jobAttempt := range attempts {
+		if jobAttempt.Attempt != attempt {
+			continue
+		}
+		logs, _, err := r.models.PipelineJobLogManager.GetLogFrom(jobRunId, jobAttempt.LogOffset)
+		if err != nil {
+			return &utils.Response{Code: code.DBError, Msg: "获取任务日志失败：" + err.Error()}
+		}
+		if i+1 < len(attempts) {
+			if size := attempts[i+1].LogOffset - jobAttempt.LogOffset; size >= 0 && int64(len(logs)) > size {
+				logs = logs[:size]
+			}
+		}
+		return &utils.Response{Code: code.Success, Data: logs}
+	}
+	return &utils.Response{Code: code.DataNotExists, Msg: fmt.Sprintf("任务第%d次执行记录不存在", attempt)}
+}
@@ -0,0 +1,84 @@
+package pipeline
+
+import (
+	"fmt"
+	"github.com/kubespace/kubespace/pkg/model/manager/pipeline"
+	"github.com/kubespace/kubespace/pkg/model/types"
+	"github.com/kubespace/kubespace/pkg/utils"
+	"github.com/kubespace/kubespace/pkg/utils/code"
+	"k8s.io/klog"
+	"time"
+)
+
+// WatchTimeout 定时检查正在执行的阶段和任务是否超时，超时的任务置为失败，
+// 多副本部署时每次只有获取到redis锁的副本检查，防止同一任务被重复置为失败以及重复重试
+func (r *ServicePipelineRun) WatchTimeout() {
+	tick := time.NewTicker(10 * time.Second)
+	defer tick.Stop()
+	for range tick.C {
+		r.withLock("pipeline_run_timeout", time.Minute, r.checkTimeout)
+	}
+}
+
+func (r *ServicePipelineRun) checkTimeout() {
+	stageRuns, jobRuns, err := r.models.ManagerPipelineRun.ListTimeoutCandidates()
+	if err != nil {
+		klog.Errorf("list timeout candidate stages and jobs error: %s", err.Error())
+		return
+	}
+	now := time.Now()
+	for i, jobRun := range jobRuns {
+		if now.Before(jobRun.ExecTime.Add(time.Duration(jobRun.Timeout) * time.Second)) {
+			continue
+		}
+		msg := fmt.Sprintf("任务执行超时，超时时间%d秒", jobRun.Timeout)
+		r.timeoutJobs(jobRun.StageRunId, types.PipelineRunJobs{&jobRuns[i]}, msg, true)
+	}
+	for _, stageRun := range stageRuns {
+		if now.Before(stageRun.ExecTime.Add(time.Duration(stageRun.Timeout) * time.Second)) {
+			continue
+		}
+		runJobs, err := r.models.ManagerPipelineRun.GetStageRunJobs(stageRun.ID)
+		if err != nil {
+			klog.Errorf("get stage run id=%d jobs error: %s", stageRun.ID, err.Error())
+			continue
+		}
+		var unfinishedJobs types.PipelineRunJobs
+		for _, jobRun := range runJobs {
+			if jobRun.Status == types.PipelineStatusDoing || jobRun.Status == types.PipelineStatusWait {
+				unfinishedJobs = append(unfinishedJobs, jobRun)
+			}
+		}
+		msg := fmt.Sprintf("阶段执行超时，超时时间%d秒", stageRun.Timeout)
+		r.timeoutJobs(stageRun.ID, unfinishedJobs, msg, false)
+	}
+}
+
+// timeoutJobs 停止执行超时的任务，并将任务置为失败，之后继续推进阶段的执行，
+// 任务超时时根据任务的重试策略自动重试，阶段超时时不再重试
+func (r *ServicePipelineRun) timeoutJobs(stageRunId uint, jobRuns types.PipelineRunJobs, msg string, retry bool) {
+	if len(jobRuns) == 0 {
+		return
+	}
+	for _, jobRun := range jobRuns {
+		klog.Infof("job run id=%d timeout: %s", jobRun.ID, msg)
+		if jobRun.Status == types.PipelineStatusDoing {
+			r.cancelJob(jobRun)
+		}
+		jobRun.Status = types.PipelineStatusError
+		jobRun.Result = &utils.Response{Code: code.TimeoutError, Msg: msg}
+		r.appendJobLog(jobRun.ID, msg)
+		if retry {
+			r.retryJobRun(jobRun)
+		}
+	}
+	pipelineRun, stageRun, err := r.models.ManagerPipelineRun.UpdatePipelineStageRun(&pipeline.UpdateStageObj{
+		StageRunId:   stageRunId,
+		StageRunJobs: jobRuns,
+	})
+	if err != nil {
+		klog.Errorf("update stage run id=%d timeout jobs error: %s", stageRunId, err.Error())
+		return
+	}
+	r.stageJobFinished(pipelineRun, stageRun, jobRuns[0])
+}
@@ -0,0 +1,97 @@
+package pipeline
+
+import (
+	"fmt"
+	"github.com/kubespace/kubespace/pkg/model/types"
+	"github.com/kubespace/kubespace/pkg/views/serializers"
+	"github.com/robfig/cron/v3"
+	"k8s.io/klog"
+	"time"
+)
+
+// parseScheduleTrigger 解析定时触发的cron表达式以及时区，时区为空时使用服务所在时区
+func parseScheduleTrigger(trigger *types.PipelineTrigger) (cron.Schedule, *time.Location, error) {
+	if trigger.Cron == "" {
+		return nil, nil, fmt.Errorf("定时触发的cron表达式不能为空")
+	}
+	schedule, err := cron.ParseStandard(trigger.Cron)
+	if err != nil {
+		return nil, nil, fmt.Errorf("定时触发的cron表达式%s错误：%s", trigger.Cron, err.Error())
+	}
+	loc := time.Local
+	if trigger.Timezone != "" {
+		if loc, err = time.LoadLocation(trigger.Timezone); err != nil {
+			return nil, nil, fmt.Errorf("定时触发的时区%s错误：%s", trigger.Timezone, err.Error())
+		}
+	}
+	return schedule, loc, nil
+}
+
+// RunSchedule 定时检查流水线的定时触发源，到达触发时间后以系统用户发起构建，
+// 多副本部署时通过redis锁保证同一触发时间只会构建一次
+func (r *ServicePipelineRun) RunSchedule() {
+	last := time.Now()
+	tick := time.NewTicker(20 * time.Second)
+	defer tick.Stop()
+	for now := range tick.C {
+		r.schedule(last, now)
+		last = now
+	}
+}
+
+func (r *ServicePipelineRun) schedule(from, to time.Time) {
+	pipelines, err := r.models.ManagerPipeline.ListByTriggerType(types.PipelineTriggerTypeSchedule)
+	if err != nil {
+		klog.Errorf("list schedule pipelines error: %s", err.Error())
+		return
+	}
+	for _, pipeline := range pipelines {
+		for i, trigger := range pipeline.Triggers {
+			if trigger.Type != types.PipelineTriggerTypeSchedule {
+				continue
+			}
+			schedule, loc, err := parseScheduleTrigger(trigger)
+			if err != nil {
+				klog.Errorf("parse pipeline id=%d schedule trigger error: %s", pipeline.ID, err.Error())
+				continue
+			}
+			next := schedule.Next(from.In(loc))
+			if next.After(to) {
+				continue
+			}
+			lockKey := fmt.Sprintf("pipeline_schedule:%d:%d:%d", pipeline.ID, i, next.Unix())
+			locked, err := r.models.LockManager.Lock(lockKey, 10*time.Minute)
+			if err != nil {
+				klog.Errorf("lock pipeline id=%d schedule error: %s", pipeline.ID, err.Error())
+				continue
+			}
+			if !locked {
+				continue
+			}
+			r.scheduleBuild(&pipeline, trigger)
+		}
+	}
+}
+
+func (r *ServicePipelineRun) scheduleBuild(pipeline *types.Pipeline, trigger *types.PipelineTrigger) {
+	workspace, err := r.models.PipelineWorkspaceManager.Get(pipeline.WorkspaceId)
+	if err != nil {
+		klog.Errorf("get pipeline id=%d workspace error: %s", pipeline.ID, err.Error())
+		return
+	}
+	params := make(map[string]interface{})
+	for k, v := range trigger.Params {
+		params[k] = v
+	}
+	if workspace.Type == types.WorkspaceTypeCode {
+		params["branch"] = trigger.Branch
+	}
+	klog.Infof("schedule build pipeline id=%d with cron %s", pipeline.ID, trigger.Cron)
+	resp := r.Build(&serializers.PipelineBuildSerializer{
+		PipelineId: pipeline.ID,
+		Params:     params,
+	}, &types.User{Name: types.PipelineSystemUser})
+	if !resp.IsSuccess() {
+		klog.Errorf("schedule build pipeline id=%d error: %s", pipeline.ID, resp.Msg)
+	}
+}
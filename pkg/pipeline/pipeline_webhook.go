@@ -0,0 +1,325 @@
+package pipeline
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/kubespace/kubespace/pkg/model/types"
+	"github.com/kubespace/kubespace/pkg/utils"
+	"github.com/kubespace/kubespace/pkg/utils/code"
+	"github.com/kubespace/kubespace/pkg/views/serializers"
+	"k8s.io/klog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	webhookProviderGithub = "github"
+	webhookProviderGitlab = "gitlab"
+	webhookProviderGitea  = "gitea"
+
+	emptyCommitId = "0000000000000000000000000000000000000000"
+)
+
+// webhookEvent 从代码仓库回调内容中解析出的推送或合并请求事件
+type webhookEvent struct {
+	BranchType string
+	Branch     string
+	Commit     *codeCommit
+}
+
+type webhookCommit struct {
+	Id        string `json:"id"`
+	Message   string `json:"message"`
+	Timestamp string `json:"timestamp"`
+	Author    struct {
+		Name     string `json:"name"`
+		Username string `json:"username"`
+	} `json:"author"`
+}
+
+func (c *webhookCommit) codeCommit() *codeCommit {
+	commitTime, err := time.Parse(time.RFC3339, c.Timestamp)
+	if err != nil {
+		commitTime = time.Now()
+	}
+	author := c.Author.Name
+	if author == "" {
+		author = c.Author.Username
+	}
+	return &codeCommit{
+		CommitId:   c.Id,
+		Author:     author,
+		Message:    c.Message,
+		CommitTime: commitTime,
+	}
+}
+
+// pushPayload GitHub、Gitea以及GitLab推送事件的回调内容
+type pushPayload struct {
+	Ref         string          `json:"ref"`
+	After       string          `json:"after"`
+	CheckoutSha string          `json:"checkout_sha"`
+	Deleted     bool            `json:"deleted"`
+	HeadCommit  *webhookCommit  `json:"head_commit"`
+	Commits     []webhookCommit `json:"commits"`
+}
+
+// pullRequestPayload GitHub以及Gitea合并请求事件的回调内容
+type pullRequestPayload struct {
+	Action      string `json:"action"`
+	PullRequest struct {
+		Title     string `json:"title"`
+		UpdatedAt string `json:"updated_at"`
+		User      struct {
+			Login    string `json:"login"`
+			Username string `json:"username"`
+		} `json:"user"`
+		Head struct {
+			Ref string `json:"ref"`
+			Sha string `json:"sha"`
+		} `json:"head"`
+	} `json:"pull_request"`
+}
+
+// mergeRequestPayload GitLab合并请求事件的回调内容
+type mergeRequestPayload struct {
+	ObjectAttributes struct {
+		Action       string        `json:"action"`
+		SourceBranch string        `json:"source_branch"`
+		OldRev       string        `json:"oldrev"`
+		LastCommit   webhookCommit `json:"last_commit"`
+	} `json:"object_attributes"`
+}
+
+// Webhook 接收代码仓库的推送以及合并请求回调，对代码空间中触发条件匹配的流水线发起构建
+func (r *ServicePipelineRun) Webhook(workspaceId uint, header http.Header, body []byte) *utils.Response {
+	workspace, err := r.models.PipelineWorkspaceManager.Get(workspaceId)
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: "获取流水线空间失败：" + err.Error()}
+	}
+	if workspace.Type != types.WorkspaceTypeCode {
+		return &utils.Response{Code: code.ParamsError, Msg: "只有代码空间支持webhook触发"}
+	}
+	provider, eventType := webhookProvider(header)
+	if provider == "" {
+		return &utils.Response{Code: code.ParamsError, Msg: "不支持的webhook请求，未识别到代码仓库类型"}
+	}
+	if !verifyWebhook(provider, workspace.WebhookSecret, header, body) {
+		return &utils.Response{Code: code.AuthError, Msg: "webhook密钥校验失败"}
+	}
+	payload, err := webhookPayload(header, body)
+	if err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: "解析webhook回调内容失败：" + err.Error()}
+	}
+	event, err := parseWebhookEvent(provider, eventType, payload)
+	if err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: "解析webhook回调内容失败：" + err.Error()}
+	}
+	if event == nil {
+		return &utils.Response{Code: code.Success, Msg: fmt.Sprintf("忽略%s事件%s", provider, eventType)}
+	}
+	klog.Infof("receive %s webhook event %s for workspace id=%d branch %s commit %s",
+		provider, eventType, workspace.ID, event.Branch, event.Commit.CommitId)
+
+	pipelines, err := r.models.ManagerPipeline.List(workspace.ID)
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: "获取流水线失败：" + err.Error()}
+	}
+	var builds []map[string]interface{}
+	for _, pipeline := range pipelines {
+		if !r.matchCodeTriggers(pipeline.Triggers, event.BranchType, event.Branch) {
+			continue
+		}
+		build := map[string]interface{}{
+			"pipeline_id":   pipeline.ID,
+			"pipeline_name": pipeline.Name,
+		}
+		resp := r.build(&serializers.PipelineBuildSerializer{
+			PipelineId: pipeline.ID,
+			Params:     map[string]interface{}{"branch": event.Branch},
+		}, &types.User{Name: types.PipelineSystemUser}, event.Commit)
+		if !resp.IsSuccess() {
+			klog.Errorf("webhook build pipeline id=%d error: %s", pipeline.ID, resp.Msg)
+			build["error"] = resp.Msg
+		} else if pipelineRun, ok := resp.Data.(*types.PipelineRun); ok {
+			build["build_id"] = pipelineRun.ID
+			build["build_number"] = pipelineRun.BuildNumber
+		}
+		builds = append(builds, build)
+	}
+	return &utils.Response{Code: code.Success, Data: map[string]interface{}{
+		"branch": event.Branch,
+		"builds": builds,
+	}}
+}
+
+// webhookProvider 根据请求头识别代码仓库类型以及事件类型，Gitea会同时携带GitHub的请求头，需要优先判断
+func webhookProvider(header http.Header) (string, string) {
+	if event := header.Get("X-Gitea-Event"); event != "" {
+		return webhookProviderGitea, event
+	}
+	if event := header.Get("X-Gitlab-Event"); event != "" {
+		return webhookProviderGitlab, event
+	}
+	if event := header.Get("X-GitHub-Event"); event != "" {
+		return webhookProviderGithub, event
+	}
+	return "", ""
+}
+
+// verifyWebhook 校验webhook密钥，GitLab直接携带密钥，GitHub以及Gitea使用密钥对请求体进行HMAC-SHA256签名
+func verifyWebhook(provider, secret string, header http.Header, body []byte) bool {
+	if secret == "" {
+		return false
+	}
+	switch provider {
+	case webhookProviderGitlab:
+		return subtle.ConstantTimeCompare([]byte(header.Get("X-Gitlab-Token")), []byte(secret)) == 1
+	case webhookProviderGithub:
+		signature := strings.TrimPrefix(header.Get("X-Hub-Signature-256"), "sha256=")
+		return hmacEqual(secret, body, signature)
+	case webhookProviderGitea:
+		return hmacEqual(secret, body, header.Get("X-Gitea-Signature"))
+	}
+	return false
+}
+
+func hmacEqual(secret string, body []byte, signature string) bool {
+	if signature == "" {
+		return false
+	}
+	sign, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(sign, mac.Sum(nil))
+}
+
+// webhookPayload GitHub以及Gitea可以配置表单格式回调，回调内容在payload参数中
+func webhookPayload(header http.Header, body []byte) ([]byte, error) {
+	if !strings.HasPrefix(header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return body, nil
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(values.Get("payload")), nil
+}
+
+// parseWebhookEvent 解析推送以及合并请求事件，不需要触发构建的事件返回nil
+func parseWebhookEvent(provider, eventType string, payload []byte) (*webhookEvent, error) {
+	switch {
+	case eventType == "push" || eventType == "Push Hook":
+		return parsePushEvent(payload)
+	case provider == webhookProviderGitlab && eventType == "Merge Request Hook":
+		return parseMergeRequestEvent(payload)
+	case provider != webhookProviderGitlab && eventType == "pull_request":
+		return parsePullRequestEvent(payload)
+	}
+	return nil, nil
+}
+
+func parsePushEvent(payload []byte) (*webhookEvent, error) {
+	var push pushPayload
+	if err := json.Unmarshal(payload, &push); err != nil {
+		return nil, err
+	}
+	// 只处理分支推送，忽略标签推送以及删除分支
+	if !strings.HasPrefix(push.Ref, "refs/heads/") || push.Deleted || push.After == emptyCommitId {
+		return nil, nil
+	}
+	commitId := push.CheckoutSha
+	if commitId == "" {
+		commitId = push.After
+	}
+	var commit *codeCommit
+	if push.HeadCommit != nil && push.HeadCommit.Id != "" {
+		commit = push.HeadCommit.codeCommit()
+	}
+	for i := range push.Commits {
+		if push.Commits[i].Id == commitId {
+			commit = push.Commits[i].codeCommit()
+		}
+	}
+	if commit == nil {
+		if commitId == "" {
+			return nil, fmt.Errorf("未获取到代码提交信息")
+		}
+		commit = &codeCommit{CommitId: commitId, CommitTime: time.Now()}
+	}
+	return &webhookEvent{
+		BranchType: types.PipelineBranchTypeBranch,
+		Branch:     strings.TrimPrefix(push.Ref, "refs/heads/"),
+		Commit:     commit,
+	}, nil
+}
+
+// parsePullRequestEvent 合并请求新建、更新以及重新打开时，构建合并请求的源分支
+func parsePullRequestEvent(payload []byte) (*webhookEvent, error) {
+	var pr pullRequestPayload
+	if err := json.Unmarshal(payload, &pr); err != nil {
+		return nil, err
+	}
+	switch pr.Action {
+	case "opened", "reopened", "synchronize", "synchronized":
+	default:
+		return nil, nil
+	}
+	head := pr.PullRequest.Head
+	if head.Ref == "" || head.Sha == "" {
+		return nil, fmt.Errorf("未获取到合并请求的源分支信息")
+	}
+	commitTime, err := time.Parse(time.RFC3339, pr.PullRequest.UpdatedAt)
+	if err != nil {
+		commitTime = time.Now()
+	}
+	author := pr.PullRequest.User.Login
+	if author == "" {
+		author = pr.PullRequest.User.Username
+	}
+	return &webhookEvent{
+		BranchType: types.PipelineBranchTypeRequest,
+		Branch:     head.Ref,
+		Commit: &codeCommit{
+			CommitId:   head.Sha,
+			Author:     author,
+			Message:    pr.PullRequest.Title,
+			CommitTime: commitTime,
+		},
+	}, nil
+}
+
+func parseMergeRequestEvent(payload []byte) (*webhookEvent, error) {
+	var mr mergeRequestPayload
+	if err := json.Unmarshal(payload, &mr); err != nil {
+		return nil, err
+	}
+	attrs := mr.ObjectAttributes
+	// 合并请求更新时只有推送了新的提交才会携带oldrev
+	switch attrs.Action {
+	case "open", "reopen":
+	case "update":
+		if attrs.OldRev == "" {
+			return nil, nil
+		}
+	default:
+		return nil, nil
+	}
+	if attrs.SourceBranch == "" || attrs.LastCommit.Id == "" {
+		return nil, fmt.Errorf("未获取到合并请求的源分支信息")
+	}
+	return &webhookEvent{
+		BranchType: types.PipelineBranchTypeRequest,
+		Branch:     attrs.SourceBranch,
+		Commit:     attrs.LastCommit.codeCommit(),
+	}, nil
+}
@@ -0,0 +1,366 @@
+package pipeline
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 阶段以及任务的执行条件表达式，根据env计算是否执行，支持以下语法：
+// 1. 变量：${NAME}或者NAME，不存在的变量为空字符串，比较运算符右边的变量只能使用${NAME}；
+// 2. 字面量：'main'、"main"、数字以及true/false；
+// 3. 比较：==、!=，以及正则匹配=~、!~；
+// 4. 逻辑运算：&&、||、!，以及括号；
+// 单独的值为非空且不为false时条件成立，如：CODE_BUILD_IMAGES && PIPELINE_CODE_BRANCH == 'main'
+
+const (
+	whenTokenIdent = iota
+	whenTokenVariable
+	whenTokenString
+	whenTokenOp
+)
+
+type whenToken struct {
+	kind  int
+	value string
+	pos   int
+}
+
+type whenNode interface {
+	eval(envs map[string]interface{}) (string, error)
+}
+
+type whenLiteral struct {
+	value string
+}
+
+type whenVariable struct {
+	name string
+	// 未使用${}引用的变量
+	bare bool
+}
+
+type whenNot struct {
+	node whenNode
+}
+
+type whenBinary struct {
+	op          string
+	left, right whenNode
+	// 右边为字面量时预先编译的正则
+	regexp *regexp.Regexp
+}
+
+var whenIdentRegexp = regexp.MustCompile(`^[A-Za-z0-9_.\-]+`)
+
+var whenOperators = []string{"&&", "||", "==", "!=", "=~", "!~", "!", "(", ")"}
+
+func whenBool(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
+
+func whenTruthy(value string) bool {
+	return value != "" && value != "false"
+}
+
+func (n *whenLiteral) eval(map[string]interface{}) (string, error) {
+	return n.value, nil
+}
+
+func (n *whenVariable) eval(envs map[string]interface{}) (string, error) {
+	return whenEnvValue(envs[n.name]), nil
+}
+
+func (n *whenNot) eval(envs map[string]interface{}) (string, error) {
+	value, err := n.node.eval(envs)
+	if err != nil {
+		return "", err
+	}
+	return whenBool(!whenTruthy(value)), nil
+}
+
+func (n *whenBinary) eval(envs map[string]interface{}) (string, error) {
+	left, err := n.left.eval(envs)
+	if err != nil {
+		return "", err
+	}
+	// 逻辑运算短路求值
+	switch n.op {
+	case "&&":
+		if !whenTruthy(left) {
+			return whenBool(false), nil
+		}
+	case "||":
+		if whenTruthy(left) {
+			return whenBool(true), nil
+		}
+	}
+	right, err := n.right.eval(envs)
+	if err != nil {
+		return "", err
+	}
+	switch n.op {
+	case "&&", "||":
+		return whenBool(whenTruthy(right)), nil
+	case "==":
+		return whenBool(left == right), nil
+	case "!=":
+		return whenBool(left != right), nil
+	case "=~", "!~":
+		re := n.regexp
+		if re == nil {
+			if re, err = regexp.Compile(right); err != nil {
+				return "", fmt.Errorf("正则表达式%s错误：%s", right, err.Error())
+			}
+		}
+		return whenBool(re.MatchString(left) == (n.op == "=~")), nil
+	}
+	return "", fmt.Errorf("不支持的运算符%s", n.op)
+}
+
+// whenEnvValue 将env的值转为字符串，json解析后的数字为float64类型
+func whenEnvValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return whenBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+func tokenizeWhen(expr string) ([]whenToken, error) {
+	var tokens []whenToken
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			i++
+			continue
+		}
+		if c == '\'' || c == '"' {
+			var value strings.Builder
+			j := i + 1
+			for ; j < len(expr) && expr[j] != c; j++ {
+				if expr[j] == '\\' && j+1 < len(expr) {
+					j++
+				}
+				value.WriteByte(expr[j])
+			}
+			if j >= len(expr) {
+				return nil, fmt.Errorf("第%d个字符开始的字符串未结束", i+1)
+			}
+			tokens = append(tokens, whenToken{kind: whenTokenString, value: value.String(), pos: i})
+			i = j + 1
+			continue
+		}
+		if strings.HasPrefix(expr[i:], "${") {
+			end := strings.IndexByte(expr[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("第%d个字符开始的变量未结束", i+1)
+			}
+			name := strings.TrimSpace(expr[i+2 : i+end])
+			if !pipelineParamNameRegexp.MatchString(name) {
+				return nil, fmt.Errorf("变量名称%s错误", name)
+			}
+			tokens = append(tokens, whenToken{kind: whenTokenVariable, value: name, pos: i})
+			i += end + 1
+			continue
+		}
+		matched := false
+		for _, op := range whenOperators {
+			if strings.HasPrefix(expr[i:], op) {
+				tokens = append(tokens, whenToken{kind: whenTokenOp, value: op, pos: i})
+				i += len(op)
+				matched = true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+		ident := whenIdentRegexp.FindString(expr[i:])
+		if ident == "" {
+			return nil, fmt.Errorf("第%d个字符%q不支持", i+1, c)
+		}
+		tokens = append(tokens, whenToken{kind: whenTokenIdent, value: ident, pos: i})
+		i += len(ident)
+	}
+	return tokens, nil
+}
+
+type whenParser struct {
+	tokens []whenToken
+	pos    int
+}
+
+func (p *whenParser) peekOp(ops ...string) string {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != whenTokenOp {
+		return ""
+	}
+	for _, op := range ops {
+		if p.tokens[p.pos].value == op {
+			return op
+		}
+	}
+	return ""
+}
+
+func (p *whenParser) parseOr() (whenNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekOp("||") != "" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &whenBinary{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *whenParser) parseAnd() (whenNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekOp("&&") != "" {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &whenBinary{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *whenParser) parseUnary() (whenNode, error) {
+	if p.peekOp("!") != "" {
+		p.pos++
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &whenNot{node: node}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *whenParser) parseCompare() (whenNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	op := p.peekOp("==", "!=", "=~", "!~")
+	if op == "" {
+		return left, nil
+	}
+	p.pos++
+	rightToken := p.pos
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	// 如 PIPELINE_CODE_BRANCH == main，右边的main通常是漏写了引号的字面量，而不是变量
+	if variable, ok := right.(*whenVariable); ok && variable.bare {
+		return nil, fmt.Errorf("第%d个字符%s需要使用引号作为字符串，或者使用${%s}引用变量",
+			p.tokens[rightToken].pos+1, variable.name, variable.name)
+	}
+	node := &whenBinary{op: op, left: left, right: right}
+	if literal, ok := right.(*whenLiteral); ok && (op == "=~" || op == "!~") {
+		if node.regexp, err = regexp.Compile(literal.value); err != nil {
+			return nil, fmt.Errorf("正则表达式%s错误：%s", literal.value, err.Error())
+		}
+	}
+	return node, nil
+}
+
+func (p *whenParser) parseOperand() (whenNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("表达式不完整")
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+	switch token.kind {
+	case whenTokenString:
+		return &whenLiteral{value: token.value}, nil
+	case whenTokenVariable:
+		return &whenVariable{name: token.value}, nil
+	case whenTokenIdent:
+		if token.value == "true" || token.value == "false" || !pipelineParamNameRegexp.MatchString(token.value) {
+			return &whenLiteral{value: token.value}, nil
+		}
+		return &whenVariable{name: token.value, bare: true}, nil
+	}
+	if token.value == "(" {
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peekOp(")") == "" {
+			return nil, fmt.Errorf("第%d个字符开始的括号未闭合", token.pos+1)
+		}
+		p.pos++
+		return node, nil
+	}
+	return nil, fmt.Errorf("第%d个字符%s位置错误", token.pos+1, token.value)
+}
+
+// parseWhen 解析执行条件表达式
+func parseWhen(expr string) (whenNode, error) {
+	tokens, err := tokenizeWhen(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("表达式为空")
+	}
+	p := &whenParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		token := p.tokens[p.pos]
+		return nil, fmt.Errorf("第%d个字符%s位置错误", token.pos+1, token.value)
+	}
+	return node, nil
+}
+
+// checkWhen 校验执行条件表达式，为空时不校验
+func checkWhen(expr string) error {
+	if strings.TrimSpace(expr) == "" {
+		return nil
+	}
+	if _, err := parseWhen(expr); err != nil {
+		return fmt.Errorf("执行条件「%s」错误：%s", expr, err.Error())
+	}
+	return nil
+}
+
+// evaluateWhen 根据env计算执行条件是否成立，条件为空时总是成立
+func evaluateWhen(expr string, envs map[string]interface{}) (bool, error) {
+	if strings.TrimSpace(expr) == "" {
+		return true, nil
+	}
+	node, err := parseWhen(expr)
+	if err != nil {
+		return false, fmt.Errorf("执行条件「%s」错误：%s", expr, err.Error())
+	}
+	value, err := node.eval(envs)
+	if err != nil {
+		return false, fmt.Errorf("执行条件「%s」计算失败：%s", expr, err.Error())
+	}
+	return whenTruthy(value), nil
+}
@@ -0,0 +1,113 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEvaluateWhen(t *testing.T) {
+	envs := map[string]interface{}{
+		"PIPELINE_CODE_BRANCH": "release/1.0",
+		"EMPTY":                "",
+		"FALSE":                "false",
+		"TRUE_BOOL":            true,
+		"FALSE_BOOL":           false,
+		"COUNT":                float64(3),
+		"QUOTE":                "it's",
+		"PATTERN":              "^release/",
+		"BAD_PATTERN":          "(",
+	}
+	cases := []struct {
+		name string
+		expr string
+		want bool
+	}{
+		{"empty expression", "", true},
+		{"blank expression", "  ", true},
+		{"bare variable", "PIPELINE_CODE_BRANCH", true},
+		{"braced variable", "${PIPELINE_CODE_BRANCH}", true},
+		{"missing variable", "NOT_EXISTS", false},
+		{"empty variable", "EMPTY", false},
+		{"false string", "FALSE", false},
+		{"bool env", "TRUE_BOOL && !FALSE_BOOL", true},
+		{"literal true", "true", true},
+		{"literal false", "false", false},
+		{"equal single quote", "PIPELINE_CODE_BRANCH == 'release/1.0'", true},
+		{"equal double quote", `PIPELINE_CODE_BRANCH == "release/1.0"`, true},
+		{"not equal", "PIPELINE_CODE_BRANCH != 'main'", true},
+		{"compare variables", "${PIPELINE_CODE_BRANCH} == ${PIPELINE_CODE_BRANCH}", true},
+		{"compare number", "COUNT == 3", true},
+		{"compare bool", "TRUE_BOOL == true", true},
+		{"escaped single quote", `QUOTE == 'it\'s'`, true},
+		{"escaped double quote", `QUOTE == "it\"s"`, false},
+		{"quote inside other quote", `QUOTE == "it's"`, true},
+		{"regexp match", "PIPELINE_CODE_BRANCH =~ '^release/'", true},
+		{"regexp not match", "PIPELINE_CODE_BRANCH !~ '^release/'", false},
+		{"regexp from variable", "PIPELINE_CODE_BRANCH =~ ${PATTERN}", true},
+		{"and binds tighter than or", "TRUE_BOOL || FALSE_BOOL && FALSE_BOOL", true},
+		{"and binds tighter than or left", "FALSE_BOOL && TRUE_BOOL || TRUE_BOOL", true},
+		{"parentheses", "(TRUE_BOOL || FALSE_BOOL) && FALSE_BOOL", false},
+		{"not binds tighter than and", "!FALSE_BOOL && TRUE_BOOL", true},
+		{"double not", "!!TRUE_BOOL", true},
+		{"not comparison", "!(PIPELINE_CODE_BRANCH == 'main')", true},
+		{"short circuit and", "FALSE_BOOL && PIPELINE_CODE_BRANCH =~ ${BAD_PATTERN}", false},
+		{"short circuit or", "TRUE_BOOL || PIPELINE_CODE_BRANCH =~ ${BAD_PATTERN}", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := evaluateWhen(c.expr, envs)
+			if err != nil {
+				t.Fatalf("evaluateWhen(%q) error: %s", c.expr, err.Error())
+			}
+			if got != c.want {
+				t.Errorf("evaluateWhen(%q) = %v, want %v", c.expr, got, c.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateWhenError(t *testing.T) {
+	envs := map[string]interface{}{"BAD_PATTERN": "("}
+	cases := []struct {
+		name string
+		expr string
+		err  string
+	}{
+		{"bare word on right of comparison", "PIPELINE_CODE_BRANCH == main", "第25个字符main需要使用引号"},
+		{"bare word on right of regexp", "A =~ release", "第6个字符release需要使用引号"},
+		{"unterminated string", "A == 'abc", "第6个字符开始的字符串未结束"},
+		{"unterminated variable", "${A == 'b'", "第1个字符开始的变量未结束"},
+		{"invalid variable name", "${1A}", "变量名称1A错误"},
+		{"unsupported character", "A # B", "第3个字符'#'不支持"},
+		{"unclosed parenthesis", "(A || B", "第1个字符开始的括号未闭合"},
+		{"incomplete comparison", "A ==", "表达式不完整"},
+		{"misplaced operator", "A == )", "第6个字符)位置错误"},
+		{"trailing token", "A B", "第3个字符B位置错误"},
+		{"invalid regexp literal", "A =~ '('", "正则表达式(错误"},
+		{"invalid regexp variable", "A =~ ${BAD_PATTERN}", "计算失败"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := evaluateWhen(c.expr, envs)
+			if err == nil {
+				t.Fatalf("evaluateWhen(%q) expected error containing %q", c.expr, c.err)
+			}
+			if !strings.Contains(err.Error(), c.err) {
+				t.Errorf("evaluateWhen(%q) error = %q, want containing %q", c.expr, err.Error(), c.err)
+			}
+		})
+	}
+}
+
+func TestCheckWhen(t *testing.T) {
+	if err := checkWhen(""); err != nil {
+		t.Errorf("checkWhen empty expression error: %s", err.Error())
+	}
+	if err := checkWhen("PIPELINE_CODE_BRANCH == 'main' && ${BUILD}"); err != nil {
+		t.Errorf("checkWhen valid expression error: %s", err.Error())
+	}
+	err := checkWhen("A &&")
+	if err == nil || !strings.Contains(err.Error(), "执行条件「A &&」错误") {
+		t.Errorf("checkWhen invalid expression error = %v", err)
+	}
+}
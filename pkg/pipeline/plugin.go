@@ -0,0 +1,273 @@
+package pipeline
+
+import (
+	"fmt"
+	"github.com/kubespace/kubespace/pkg/model"
+	"github.com/kubespace/kubespace/pkg/model/types"
+	"github.com/kubespace/kubespace/pkg/utils"
+	"github.com/kubespace/kubespace/pkg/utils/code"
+	"github.com/kubespace/kubespace/pkg/views/serializers"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// pluginTestTimeout 测试插件连接的超时时间
+const pluginTestTimeout = 10 * time.Second
+
+var (
+	pluginKeyRegexp = regexp.MustCompile("^[a-z][a-z0-9_]{0,49}$")
+	envNameRegexp   = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+)
+
+// pluginParamsFromNameRequired 插件参数来源以及是否需要配置来源名称
+var pluginParamsFromNameRequired = map[string]bool{
+	types.PluginParamsFromEnv:              true,
+	types.PluginParamsFromJob:              true,
+	types.PluginParamsFromPipelineResource: true,
+	// 为空时使用代码构建的镜像仓库
+	types.PluginParamsFromImageRegistry: false,
+	types.PluginParamsFromCodeSecret:    false,
+	types.PluginParamsFromPipelineEnv:   false,
+}
+
+// PluginService 流水线插件注册，内置插件由服务启动时初始化，外部插件通过接口注册
+type PluginService struct {
+	models *model.Models
+}
+
+func NewPluginService(models *model.Models) *PluginService {
+	return &PluginService{
+		models: models,
+	}
+}
+
+func (p *PluginService) pluginData(plugin *types.PipelinePlugin) map[string]interface{} {
+	return map[string]interface{}{
+		"id":          plugin.ID,
+		"name":        plugin.Name,
+		"key":         plugin.Key,
+		"url":         plugin.Url,
+		"version":     plugin.Version,
+		"params":      plugin.Params.Params,
+		"result_env":  plugin.ResultEnv.EnvPath,
+		"resumable":   plugin.Resumable,
+		"timeout":     plugin.Timeout,
+		"builtin":     p.models.PipelinePluginManager.IsBuiltin(plugin.Key),
+		"create_time": plugin.CreateTime,
+		"update_time": plugin.UpdateTime,
+	}
+}
+
+func (p *PluginService) List() *utils.Response {
+	plugins, err := p.models.PipelinePluginManager.List()
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: "获取插件列表失败：" + err.Error()}
+	}
+	var data []map[string]interface{}
+	for i := range plugins {
+		data = append(data, p.pluginData(&plugins[i]))
+	}
+	return &utils.Response{Code: code.Success, Data: data}
+}
+
+func (p *PluginService) Get(pluginId uint) *utils.Response {
+	plugin, err := p.models.PipelinePluginManager.Get(pluginId)
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: "获取插件失败：" + err.Error()}
+	}
+	return &utils.Response{Code: code.Success, Data: p.pluginData(plugin)}
+}
+
+func (p *PluginService) checkPlugin(ser *serializers.PipelinePluginSerializer) *utils.Response {
+	if strings.TrimSpace(ser.Name) == "" {
+		return &utils.Response{Code: code.ParamsError, Msg: "插件名称不能为空"}
+	}
+	if !pluginKeyRegexp.MatchString(ser.Key) {
+		return &utils.Response{Code: code.ParamsError, Msg: "插件标识只能包含小写字母、数字以及下划线，以字母开头，且不超过50个字符"}
+	}
+	if strings.TrimSpace(ser.Version) == "" {
+		return &utils.Response{Code: code.ParamsError, Msg: "插件版本不能为空"}
+	}
+	pluginUrl, err := url.Parse(ser.Url)
+	if err != nil || (pluginUrl.Scheme != "http" && pluginUrl.Scheme != "https") || pluginUrl.Host == "" {
+		return &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("插件地址「%s」格式不正确，需要为http或https地址", ser.Url)}
+	}
+	if ser.Timeout < 0 {
+		return &utils.Response{Code: code.ParamsError, Msg: "插件超时时间不能小于0"}
+	}
+	paramNames := make(map[string]bool)
+	for _, param := range ser.Params {
+		if param == nil || param.ParamName == "" {
+			return &utils.Response{Code: code.ParamsError, Msg: "插件参数名称不能为空"}
+		}
+		if paramNames[param.ParamName] {
+			return &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("插件参数「%s」重复", param.ParamName)}
+		}
+		paramNames[param.ParamName] = true
+		nameRequired, ok := pluginParamsFromNameRequired[param.From]
+		if !ok {
+			return &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("插件参数「%s」的来源「%s」不支持", param.ParamName, param.From)}
+		}
+		if nameRequired && param.FromName == "" {
+			return &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("插件参数「%s」的来源名称不能为空", param.ParamName)}
+		}
+	}
+	envNames := make(map[string]bool)
+	for _, env := range ser.ResultEnv {
+		if env == nil || !envNameRegexp.MatchString(env.EnvName) {
+			return &utils.Response{Code: code.ParamsError, Msg: "插件结果环境变量名称只能包含字母、数字以及下划线，且不能以数字开头"}
+		}
+		if env.ResultName == "" {
+			return &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("插件结果环境变量「%s」对应的结果名称不能为空", env.EnvName)}
+		}
+		if envNames[env.EnvName] {
+			return &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("插件结果环境变量「%s」重复", env.EnvName)}
+		}
+		envNames[env.EnvName] = true
+	}
+	return nil
+}
+
+func (p *PluginService) Create(ser *serializers.PipelinePluginSerializer) *utils.Response {
+	if resp := p.checkPlugin(ser); resp != nil {
+		return resp
+	}
+	if p.models.PipelinePluginManager.IsBuiltin(ser.Key) {
+		return &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("插件标识「%s」为内置插件", ser.Key)}
+	}
+	if _, err := p.models.PipelinePluginManager.GetByKey(ser.Key); err == nil {
+		return &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("插件标识「%s」已存在", ser.Key)}
+	}
+	now := time.Now()
+	plugin := &types.PipelinePlugin{
+		Name:       ser.Name,
+		Key:        ser.Key,
+		Url:        ser.Url,
+		Version:    ser.Version,
+		Params:     types.PipelinePluginParams{Params: ser.Params},
+		ResultEnv:  types.PipelinePluginResultEnv{EnvPath: ser.ResultEnv},
+		Resumable:  ser.Resumable,
+		Timeout:    ser.Timeout,
+		Secret:     utils.CreateUUID(),
+		CreateTime: now,
+		UpdateTime: now,
+	}
+	if _, err := p.models.PipelinePluginManager.Create(plugin); err != nil {
+		return &utils.Response{Code: code.DBError, Msg: "创建插件失败：" + err.Error()}
+	}
+	data := p.pluginData(plugin)
+	data["secret"] = plugin.Secret
+	return &utils.Response{Code: code.Success, Data: data}
+}
+
+// Update 更新外部插件，插件标识被流水线任务引用，不可以修改
+func (p *PluginService) Update(pluginId uint, ser *serializers.PipelinePluginSerializer) *utils.Response {
+	plugin, err := p.models.PipelinePluginManager.Get(pluginId)
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: "获取插件失败：" + err.Error()}
+	}
+	if p.models.PipelinePluginManager.IsBuiltin(plugin.Key) {
+		return &utils.Response{Code: code.ParamsError, Msg: "内置插件不可以修改"}
+	}
+	if ser.Key == "" {
+		ser.Key = plugin.Key
+	}
+	if ser.Key != plugin.Key {
+		return &utils.Response{Code: code.ParamsError, Msg: "插件标识不可以修改"}
+	}
+	if resp := p.checkPlugin(ser); resp != nil {
+		return resp
+	}
+	plugin.Name = ser.Name
+	plugin.Url = ser.Url
+	plugin.Version = ser.Version
+	plugin.Params = types.PipelinePluginParams{Params: ser.Params}
+	plugin.ResultEnv = types.PipelinePluginResultEnv{EnvPath: ser.ResultEnv}
+	plugin.Resumable = ser.Resumable
+	plugin.Timeout = ser.Timeout
+	plugin.UpdateTime = time.Now()
+	if _, err = p.models.PipelinePluginManager.Update(plugin); err != nil {
+		return &utils.Response{Code: code.DBError, Msg: "更新插件失败：" + err.Error()}
+	}
+	return &utils.Response{Code: code.Success, Data: p.pluginData(plugin)}
+}
+
+// Delete 删除外部插件，有流水线使用该插件时不可以删除
+func (p *PluginService) Delete(pluginId uint) *utils.Response {
+	plugin, err := p.models.PipelinePluginManager.Get(pluginId)
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: "获取插件失败：" + err.Error()}
+	}
+	if p.models.PipelinePluginManager.IsBuiltin(plugin.Key) {
+		return &utils.Response{Code: code.ParamsError, Msg: "内置插件不可以删除"}
+	}
+	pipelineIds, err := p.models.PipelinePluginManager.ReferencedPipelines(plugin.Key)
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: "获取插件使用的流水线失败：" + err.Error()}
+	}
+	if len(pipelineIds) > 0 {
+		var names []string
+		for _, pipelineId := range pipelineIds {
+			if pipeline, err := p.models.ManagerPipeline.Get(pipelineId); err == nil {
+				names = append(names, pipeline.Name)
+			}
+		}
+		return &utils.Response{Code: code.ParamsError, Msg: fmt.Sprintf("插件正在被流水线「%s」使用，不可以删除", strings.Join(names, "、"))}
+	}
+	if err = p.models.PipelinePluginManager.Delete(plugin); err != nil {
+		return &utils.Response{Code: code.DBError, Msg: "删除插件失败：" + err.Error()}
+	}
+	return &utils.Response{Code: code.Success}
+}
+
+// Secret 获取插件请求签名的密钥，regenerate为true或者密钥为空时重新生成
+func (p *PluginService) Secret(pluginId uint, regenerate bool) *utils.Response {
+	plugin, err := p.models.PipelinePluginManager.Get(pluginId)
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: "获取插件失败：" + err.Error()}
+	}
+	if plugin.Url == types.PipelinePluginBuiltinUrl {
+		return &utils.Response{Code: code.ParamsError, Msg: "内置插件不需要签名密钥"}
+	}
+	if regenerate || plugin.Secret == "" {
+		plugin.Secret = utils.CreateUUID()
+		plugin.UpdateTime = time.Now()
+		if _, err = p.models.PipelinePluginManager.Update(plugin); err != nil {
+			return &utils.Response{Code: code.DBError, Msg: "更新插件密钥失败：" + err.Error()}
+		}
+	}
+	return &utils.Response{Code: code.Success, Data: map[string]interface{}{
+		"secret": plugin.Secret,
+		"header": utils.SignatureHeader,
+	}}
+}
+
+// TestConnection 测试插件地址是否可以访问，插件服务返回5xx时认为插件不可用
+func (p *PluginService) TestConnection(pluginId uint) *utils.Response {
+	plugin, err := p.models.PipelinePluginManager.Get(pluginId)
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: "获取插件失败：" + err.Error()}
+	}
+	if plugin.Url == types.PipelinePluginBuiltinUrl {
+		return &utils.Response{Code: code.Success, Msg: "内置插件不需要测试连接", Data: map[string]interface{}{"builtin": true}}
+	}
+	client := &http.Client{Timeout: pluginTestTimeout}
+	start := time.Now()
+	resp, err := client.Get(plugin.Url)
+	if err != nil {
+		return &utils.Response{Code: code.RequestError, Msg: fmt.Sprintf("连接插件地址%s失败：%s", plugin.Url, err.Error())}
+	}
+	resp.Body.Close()
+	data := map[string]interface{}{
+		"builtin":     false,
+		"status_code": resp.StatusCode,
+		"latency":     time.Since(start).Milliseconds(),
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return &utils.Response{Code: code.RequestError, Msg: fmt.Sprintf("插件地址%s返回错误，status code %d", plugin.Url, resp.StatusCode), Data: data}
+	}
+	return &utils.Response{Code: code.Success, Data: data}
+}
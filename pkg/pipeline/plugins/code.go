@@ -0,0 +1,46 @@
+package plugins
+
+import (
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	sshgit "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/kubespace/kubespace/pkg/model/types"
+	"golang.org/x/crypto/ssh"
+)
+
+// codeSecret 代码空间密钥参数，对应PluginParamsFromCodeSecret
+type codeSecret struct {
+	Type        string `json:"type"`
+	User        string `json:"user"`
+	Password    string `json:"password"`
+	PrivateKey  string `json:"private_key"`
+	AccessToken string `json:"access_token"`
+}
+
+// codeAuth 根据代码密钥生成访问代码仓库的认证方式
+func codeAuth(secret *codeSecret) (transport.AuthMethod, error) {
+	if secret == nil {
+		return nil, nil
+	}
+	switch secret.Type {
+	case types.SettingsSecretTypeKey:
+		privateKey, err := sshgit.NewPublicKeys("git", []byte(secret.PrivateKey), "")
+		if err != nil {
+			return nil, err
+		}
+		privateKey.HostKeyCallbackHelper = sshgit.HostKeyCallbackHelper{
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		}
+		return privateKey, nil
+	case types.SettingsSecretTypePassword:
+		return &http.BasicAuth{Username: secret.User, Password: secret.Password}, nil
+	case types.SettingsSecretTypeToken:
+		// token认证时用户名可以为任意非空值
+		user := secret.User
+		if user == "" {
+			user = "oauth2"
+		}
+		return &http.BasicAuth{Username: user, Password: secret.AccessToken}, nil
+	}
+	return nil, nil
+}
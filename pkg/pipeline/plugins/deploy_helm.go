@@ -0,0 +1,493 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/kubespace/kubespace/pkg/kube_resource"
+	"github.com/kubespace/kubespace/pkg/model"
+	"github.com/kubespace/kubespace/pkg/model/types"
+	"github.com/kubespace/kubespace/pkg/utils"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/repo"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sigs.k8s.io/yaml"
+	"strconv"
+	"strings"
+)
+
+const (
+	// HelmChartSourceAppStore 使用应用商店中的应用chart
+	HelmChartSourceAppStore = "app_store"
+	// HelmChartSourceResource 使用流水线资源中配置的chart仓库或chart包地址
+	HelmChartSourceResource = "resource"
+	// HelmChartSourceCode 使用代码仓库中的chart目录
+	HelmChartSourceCode = "code"
+)
+
+// envReferenceRegexp values中${ENV_NAME}格式的环境变量引用
+var envReferenceRegexp = regexp.MustCompile(`\$\{(\w+)\}`)
+
+type DeployHelmPlugin struct {
+	*model.Models
+	*kube_resource.KubeResources
+}
+
+func (p DeployHelmPlugin) Execute(params *PluginParams) (interface{}, error) {
+	deploy, err := NewDeployHelm(params, p.Models, p.KubeResources)
+	if err != nil {
+		return nil, err
+	}
+	if err = deploy.execute(); err != nil {
+		return nil, err
+	}
+	return deploy.result, nil
+}
+
+type deployHelmResource struct {
+	Type   string      `json:"type"`
+	Value  string      `json:"value"`
+	Secret *codeSecret `json:"secret"`
+}
+
+type deployHelmParams struct {
+	Cluster        string                 `json:"cluster"`
+	Namespace      string                 `json:"namespace"`
+	Name           string                 `json:"name"`
+	ChartSource    string                 `json:"chart_source"`
+	App            interface{}            `json:"app"`
+	Resource       *deployHelmResource    `json:"resource"`
+	Chart          string                 `json:"chart"`
+	ChartVersion   string                 `json:"chart_version"`
+	CodeUrl        string                 `json:"code_url"`
+	CodeCommitId   string                 `json:"code_commit_id"`
+	CodeSecret     *codeSecret            `json:"code_secret"`
+	Values         string                 `json:"values"`
+	Set            map[string]interface{} `json:"set"`
+	Images         string                 `json:"images"`
+	Env            map[string]interface{} `json:"env"`
+	WaitRollout    bool                   `json:"wait_rollout"`
+	RolloutTimeout int                    `json:"rollout_timeout"`
+}
+
+type deployHelmResult struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Revision  int    `json:"revision"`
+	Manifest  string `json:"manifest"`
+}
+
+// deployHelm 将chart安装或升级到指定集群的命名空间，chart通过agent从kubespace下载
+type deployHelm struct {
+	models        *model.Models
+	kubeResources *kube_resource.KubeResources
+	params        *deployHelmParams
+	jobId         uint
+	cluster       *types.Cluster
+	chart         *chart.Chart
+	chartPath     string
+	values        map[string]interface{}
+	result        *deployHelmResult
+	ctx           context.Context
+	*PluginLogger
+}
+
+func NewDeployHelm(params *PluginParams, models *model.Models, kr *kube_resource.KubeResources) (*deployHelm, error) {
+	var helmParams deployHelmParams
+	marshalParams, err := json.Marshal(params.Params)
+	if err != nil {
+		params.Logger.Log("插件参数：%v", params.Params)
+		return nil, fmt.Errorf("marshal params error: %s", err.Error())
+	}
+	err = json.Unmarshal(marshalParams, &helmParams)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal deploy helm params error: %s", err.Error())
+	}
+	return &deployHelm{
+		models:        models,
+		kubeResources: kr,
+		params:        &helmParams,
+		jobId:         params.JobId,
+		result:        &deployHelmResult{},
+		PluginLogger:  params.Logger,
+		ctx:           params.Context,
+	}, nil
+}
+
+func (d *deployHelm) execute() error {
+	if d.params.Name == "" {
+		d.Log("应用名称参数为空")
+		return fmt.Errorf("应用名称参数为空")
+	}
+	if d.params.Namespace == "" {
+		d.params.Namespace = "default"
+	}
+	cluster, err := d.models.ClusterManager.GetByName(d.params.Cluster)
+	if err != nil {
+		d.Log("获取集群失败：%s", err.Error())
+		return err
+	}
+	d.cluster = cluster
+	switch d.params.ChartSource {
+	case HelmChartSourceAppStore:
+		err = d.loadAppStoreChart()
+	case HelmChartSourceResource:
+		err = d.loadResourceChart()
+	case HelmChartSourceCode:
+		err = d.loadCodeChart()
+	default:
+		err = fmt.Errorf("不支持的chart来源：%s", d.params.ChartSource)
+		d.Log("%s", err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	if d.ctx.Err() != nil {
+		return d.ctx.Err()
+	}
+	if err = d.renderValues(); err != nil {
+		d.Log("生成values失败：%s", err.Error())
+		return err
+	}
+	valuesBytes, err := yaml.Marshal(d.values)
+	if err != nil {
+		return err
+	}
+	installParams := map[string]interface{}{
+		"name":       d.params.Name,
+		"namespace":  d.params.Namespace,
+		"chart_path": d.chartPath,
+		"values":     string(valuesBytes),
+	}
+	d.Log("部署chart「%s-%s」到集群「%s」命名空间「%s」，应用名称：%s", d.chart.Name(), d.chart.Metadata.Version,
+		cluster.Name1, d.params.Namespace, d.params.Name)
+	var resp *utils.Response
+	if release := getHelmRelease(d.kubeResources, cluster.Name, d.params.Name, d.params.Namespace); release != nil {
+		d.Log("应用已安装，当前版本：%d，开始升级", release.Version)
+		resp = d.kubeResources.Helm.UpdateObj(cluster.Name, installParams)
+	} else {
+		d.Log("开始安装应用")
+		resp = d.kubeResources.Helm.Create(cluster.Name, installParams)
+	}
+	if !resp.IsSuccess() {
+		d.Log("部署失败：%s", resp.Msg)
+		return errors.New(resp.Msg)
+	}
+	d.result.Name = d.params.Name
+	d.result.Namespace = d.params.Namespace
+	if release := getHelmRelease(d.kubeResources, cluster.Name, d.params.Name, d.params.Namespace); release != nil {
+		d.result.Revision = release.Version
+		d.result.Manifest = release.Manifest
+	}
+	if d.result.Manifest == "" {
+		d.result.Manifest = d.renderManifest()
+	}
+	d.Log("部署成功，应用版本：%d", d.result.Revision)
+	if d.params.WaitRollout {
+		verifier := newRolloutVerifier(d.ctx, d.kubeResources, cluster.Name, d.params.RolloutTimeout, d.PluginLogger)
+		if err = verifier.Wait(workloadsFromManifest(d.result.Manifest, d.params.Namespace)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type helmRelease struct {
+	Name     string `json:"name"`
+	Version  int    `json:"version"`
+	Status   string `json:"status"`
+	Manifest string `json:"manifest"`
+}
+
+// getHelmRelease 通过agent获取已安装的应用，未安装时返回nil
+func getHelmRelease(kr *kube_resource.KubeResources, cluster, name, namespace string) *helmRelease {
+	resp := kr.Helm.Get(cluster, map[string]interface{}{
+		"name":      name,
+		"namespace": namespace,
+	})
+	if !resp.IsSuccess() || resp.Data == nil {
+		return nil
+	}
+	var release helmRelease
+	if err := convertResponseData(resp.Data, &release); err != nil || release.Version == 0 {
+		return nil
+	}
+	return &release
+}
+
+// renderManifest agent未返回manifest时，使用部署的chart以及values在本地渲染
+func (d *deployHelm) renderManifest() string {
+	install := action.NewInstall(new(action.Configuration))
+	install.ReleaseName = d.params.Name
+	install.Namespace = d.params.Namespace
+	install.ClientOnly = true
+	install.DryRun = true
+	release, err := install.Run(d.chart, d.values)
+	if err != nil {
+		d.Log("渲染应用manifest失败：%s", err.Error())
+		return ""
+	}
+	return release.Manifest
+}
+
+func (d *deployHelm) loadAppStoreChart() error {
+	appId, err := strconv.ParseUint(fmt.Sprintf("%v", d.params.App), 10, 64)
+	if err != nil {
+		d.Log("应用商店应用参数不正确：%v", d.params.App)
+		return fmt.Errorf("应用商店应用参数不正确：%v", d.params.App)
+	}
+	storeApp, err := d.models.AppStoreManager.GetStoreApp(uint(appId))
+	if err != nil {
+		d.Log("获取应用商店应用失败：%s", err.Error())
+		return err
+	}
+	var appVersion *types.AppVersion
+	if d.params.ChartVersion == "" {
+		appVersion, err = d.models.AppStoreManager.GetLatestVersion(storeApp.ID)
+		if err != nil {
+			d.Log("获取应用「%s」最新版本失败：%s", storeApp.Name, err.Error())
+			return err
+		}
+	} else {
+		versions, err := d.models.ProjectAppVersionManager.ListAppVersions(types.AppVersionScopeStoreApp, storeApp.ID)
+		if err != nil {
+			d.Log("获取应用「%s」版本失败：%s", storeApp.Name, err.Error())
+			return err
+		}
+		for i := range *versions {
+			if (*versions)[i].PackageVersion == d.params.ChartVersion {
+				appVersion = &(*versions)[i]
+				break
+			}
+		}
+		if appVersion == nil {
+			d.Log("应用「%s」不存在版本%s", storeApp.Name, d.params.ChartVersion)
+			return fmt.Errorf("应用「%s」不存在版本%s", storeApp.Name, d.params.ChartVersion)
+		}
+	}
+	appChart, err := d.models.ProjectAppVersionManager.GetAppVersionChart(appVersion.ChartPath)
+	if err != nil {
+		d.Log("获取应用chart失败：%s", err.Error())
+		return err
+	}
+	if d.chart, err = loader.LoadArchive(bytes.NewReader(appChart.Content)); err != nil {
+		d.Log("加载应用chart失败：%s", err.Error())
+		return err
+	}
+	d.chartPath = appVersion.ChartPath
+	if d.params.Values == "" {
+		d.params.Values = appVersion.Values
+	}
+	d.Log("使用应用商店应用「%s」版本%s", storeApp.Name, appVersion.PackageVersion)
+	return nil
+}
+
+// loadResourceChart 流水线资源值为chart仓库地址时根据chart名称以及版本查找，否则作为chart包地址直接下载
+func (d *deployHelm) loadResourceChart() error {
+	resource := d.params.Resource
+	if resource == nil || resource.Value == "" {
+		d.Log("流水线资源参数为空")
+		return fmt.Errorf("流水线资源参数为空")
+	}
+	var user, password string
+	if resource.Secret != nil {
+		user, password = resource.Secret.User, resource.Secret.Password
+		if resource.Secret.Type == types.SettingsSecretTypeToken {
+			password = resource.Secret.AccessToken
+		}
+	}
+	chartUrl := resource.Value
+	if d.params.Chart != "" {
+		d.Log("从chart仓库%s查找chart「%s」版本%s", resource.Value, d.params.Chart, d.params.ChartVersion)
+		indexBytes, err := d.download(strings.TrimSuffix(resource.Value, "/")+"/index.yaml", user, password)
+		if err != nil {
+			d.Log("获取chart仓库索引失败：%s", err.Error())
+			return err
+		}
+		var index repo.IndexFile
+		if err = yaml.Unmarshal(indexBytes, &index); err != nil {
+			d.Log("解析chart仓库索引失败：%s", err.Error())
+			return err
+		}
+		index.SortEntries()
+		chartVersion, err := index.Get(d.params.Chart, d.params.ChartVersion)
+		if err != nil || len(chartVersion.URLs) == 0 {
+			d.Log("chart仓库中不存在chart「%s」版本%s", d.params.Chart, d.params.ChartVersion)
+			return fmt.Errorf("chart仓库中不存在chart「%s」版本%s", d.params.Chart, d.params.ChartVersion)
+		}
+		if chartUrl, err = repo.ResolveReferenceURL(resource.Value, chartVersion.URLs[0]); err != nil {
+			return err
+		}
+	}
+	d.Log("下载chart包%s", chartUrl)
+	chartBytes, err := d.download(chartUrl, user, password)
+	if err != nil {
+		d.Log("下载chart包失败：%s", err.Error())
+		return err
+	}
+	if d.chart, err = loader.LoadArchive(bytes.NewReader(chartBytes)); err != nil {
+		d.Log("加载chart失败：%s", err.Error())
+		return err
+	}
+	return d.saveChart(chartBytes)
+}
+
+func (d *deployHelm) download(url, user, password string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if user != "" || password != "" {
+		req.SetBasicAuth(user, password)
+	}
+	resp, err := registryHttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return body, nil
+}
+
+// loadCodeChart 克隆构建的代码提交，并将代码中的chart目录打包
+func (d *deployHelm) loadCodeChart() error {
+	if d.params.CodeUrl == "" || d.params.CodeCommitId == "" {
+		d.Log("未获取到构建的代码")
+		return fmt.Errorf("未获取到构建的代码")
+	}
+	auth, err := codeAuth(d.params.CodeSecret)
+	if err != nil {
+		d.Log("生成代码密钥失败：%s", err.Error())
+		return err
+	}
+	codeDir := "/tmp/" + utils.CreateUUID()
+	defer os.RemoveAll(codeDir)
+	d.Log("克隆代码%s", d.params.CodeUrl)
+	repository, err := git.PlainCloneContext(d.ctx, codeDir, false, &git.CloneOptions{
+		Auth:            auth,
+		URL:             d.params.CodeUrl,
+		NoCheckout:      true,
+		InsecureSkipTLS: true,
+	})
+	if err != nil {
+		d.Log("克隆代码失败：%s", err.Error())
+		return err
+	}
+	worktree, err := repository.Worktree()
+	if err != nil {
+		return err
+	}
+	if err = worktree.Checkout(&git.CheckoutOptions{Hash: plumbing.NewHash(d.params.CodeCommitId)}); err != nil {
+		d.Log("检出代码提交%s失败：%s", d.params.CodeCommitId, err.Error())
+		return err
+	}
+	chartDir := filepath.Join(codeDir, filepath.Clean("/"+d.params.Chart))
+	if d.chart, err = loader.Load(chartDir); err != nil {
+		d.Log("加载代码中的chart目录「%s」失败：%s", d.params.Chart, err.Error())
+		return err
+	}
+	packageDir := codeDir + "-package"
+	defer os.RemoveAll(packageDir)
+	if err = os.MkdirAll(packageDir, 0755); err != nil {
+		return err
+	}
+	packagePath, err := chartutil.Save(d.chart, packageDir)
+	if err != nil {
+		d.Log("打包chart失败：%s", err.Error())
+		return err
+	}
+	chartBytes, err := ioutil.ReadFile(packagePath)
+	if err != nil {
+		return err
+	}
+	return d.saveChart(chartBytes)
+}
+
+// saveChart 保存chart包，agent部署时通过chart_path下载，任务重试或者重新执行时覆盖之前保存的chart包
+func (d *deployHelm) saveChart(chartBytes []byte) error {
+	d.chartPath = fmt.Sprintf("pipeline/%d/%s", d.jobId,
+		d.models.ProjectAppVersionManager.NewPackageFilenameFromNameVersion(d.chart.Name(), d.chart.Metadata.Version))
+	if err := d.models.ProjectAppVersionManager.SaveChart(d.chartPath, chartBytes); err != nil {
+		d.Log("保存chart包失败：%s", err.Error())
+		return err
+	}
+	return nil
+}
+
+// renderValues 依次替换values中引用的环境变量、构建的镜像以及指定路径的值
+func (d *deployHelm) renderValues() error {
+	values := d.expandEnv(d.params.Values)
+	d.values = map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(values), &d.values); err != nil {
+		return err
+	}
+	if d.values == nil {
+		d.values = map[string]interface{}{}
+	}
+	if d.params.Images != "" {
+		upgrade := &upgradeApp{images: strings.Split(d.params.Images, ","), PluginLogger: d.PluginLogger}
+		if _, err := upgrade.replaceValuesImage(d.values); err != nil {
+			return err
+		}
+	}
+	for path, value := range d.params.Set {
+		if s, ok := value.(string); ok {
+			value = d.expandEnv(s)
+		}
+		if err := setValuesPath(d.values, path, value); err != nil {
+			return err
+		}
+		d.Log("设置values：%s=%v", path, value)
+	}
+	return nil
+}
+
+// expandEnv 替换${ENV_NAME}格式的环境变量引用，不存在的环境变量保持不变
+func (d *deployHelm) expandEnv(s string) string {
+	return envReferenceRegexp.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envReferenceRegexp.FindStringSubmatch(ref)[1]
+		if v, ok := d.params.Env[name]; ok && v != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		return ref
+	})
+}
+
+// setValuesPath 按照a.b.c格式的路径设置values，中间不存在的路径会自动创建
+func setValuesPath(values map[string]interface{}, path string, value interface{}) error {
+	keys := strings.Split(path, ".")
+	current := values
+	for i, key := range keys {
+		if key == "" {
+			return fmt.Errorf("values路径%s格式不正确", path)
+		}
+		if i == len(keys)-1 {
+			current[key] = value
+			return nil
+		}
+		next, ok := current[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			current[key] = next
+		}
+		current = next
+	}
+	return nil
+}
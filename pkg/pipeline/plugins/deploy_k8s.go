@@ -1,6 +1,7 @@
 package plugins
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -31,6 +32,9 @@ func (p DeployK8sPlugin) Execute(params *PluginParams) (interface{}, error) {
 	}
 	err = deploy.execute()
 	if err != nil {
+		if deploy.result.RolledBack {
+			return deploy.result, err
+		}
 		return nil, err
 	}
 	return deploy.result, nil
@@ -41,9 +45,22 @@ type deployK8sParams struct {
 	Namespace string `json:"namespace"`
 	Yaml      string `json:"yaml"`
 	Images    string `json:"images"`
+	// 部署后等待工作负载就绪
+	WaitRollout    bool `json:"wait_rollout"`
+	RolloutTimeout int  `json:"rollout_timeout"`
+	// 部署失败时恢复部署前的资源
+	RollbackOnFailure bool `json:"rollback_on_failure"`
 }
 
 type deployK8sResult struct {
+	// 部署失败后是否已经回滚
+	RolledBack bool `json:"rolled_back,omitempty"`
+	// 本次部署的资源内容
+	Manifest string `json:"manifest,omitempty"`
+	// 回滚恢复的部署前资源内容
+	RollbackManifest string   `json:"rollback_manifest,omitempty"`
+	Restored         []string `json:"restored,omitempty"`
+	Deleted          []string `json:"deleted,omitempty"`
 }
 
 type deployK8s struct {
@@ -52,6 +69,7 @@ type deployK8s struct {
 	params        *deployK8sParams
 	images        []string
 	result        *deployK8sResult
+	ctx           context.Context
 	*PluginLogger
 }
 
@@ -74,6 +92,7 @@ func NewDeployK8s(params *PluginParams, models *model.Models, kr *kube_resource.
 		params:        &deployParams,
 		result:        &deployK8sResult{},
 		PluginLogger:  params.Logger,
+		ctx:           params.Context,
 	}, nil
 }
 
@@ -117,8 +136,28 @@ func (u *deployK8s) execute() error {
 		u.Log("未匹配到可替换的镜像")
 	}
 	u.Log(destYamlStr)
+	if u.ctx.Err() != nil {
+		return u.ctx.Err()
+	}
+	var snapshot *manifestSnapshot
+	if u.params.RollbackOnFailure {
+		if snapshot, err = newManifestSnapshot(u.kubeResources, cluster.Name, destYamlStr, u.params.Namespace, u.PluginLogger); err != nil {
+			u.Log("获取部署前的资源失败：%s", err.Error())
+			return err
+		}
+	}
 	u.Log("开始部署资源到集群「%s」", cluster.Name1)
-	resp := u.kubeResources.Cluster.Apply(cluster.Name, map[string]string{
+	if err = u.deploy(cluster.Name, destYamlStr); err != nil {
+		if snapshot != nil && u.ctx.Err() == nil {
+			return u.rollback(snapshot, destYamlStr, err)
+		}
+		return err
+	}
+	return nil
+}
+
+func (u *deployK8s) deploy(cluster, destYamlStr string) error {
+	resp := u.kubeResources.Cluster.Apply(cluster, map[string]string{
 		"yaml": destYamlStr,
 	})
 	if !resp.IsSuccess() {
@@ -127,9 +166,32 @@ func (u *deployK8s) execute() error {
 	} else {
 		u.Log("部署资源到集群成功")
 	}
+	if u.params.WaitRollout {
+		verifier := newRolloutVerifier(u.ctx, u.kubeResources, cluster, u.params.RolloutTimeout, u.PluginLogger)
+		if err := verifier.Wait(workloadsFromManifest(destYamlStr, u.params.Namespace)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// rollback 部署失败后恢复部署前的资源，回滚失败时返回部署以及回滚的错误
+func (u *deployK8s) rollback(snapshot *manifestSnapshot, destYamlStr string, deployErr error) error {
+	u.Log("部署失败，开始回滚")
+	restored, deleted, err := snapshot.Rollback(u.PluginLogger)
+	if err != nil {
+		return fmt.Errorf("%s，回滚失败：%s", deployErr.Error(), err.Error())
+	}
+	rollbackManifest, _ := snapshot.Manifest()
+	u.result.RolledBack = true
+	u.result.Manifest = destYamlStr
+	u.result.RollbackManifest = rollbackManifest
+	u.result.Restored = restored
+	u.result.Deleted = deleted
+	u.Log("回滚成功")
+	return &RolledBackError{Err: deployErr}
+}
+
 func (u *deployK8s) replaceResourceImage(yamlStr string) (string, bool, error) {
 	yamlDict := make(map[string]interface{})
 	err := yaml.Unmarshal([]byte(yamlStr), &yamlDict)
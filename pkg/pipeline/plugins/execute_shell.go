@@ -0,0 +1,524 @@
+package plugins
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kubespace/kubespace/pkg/kube_resource"
+	"github.com/kubespace/kubespace/pkg/model"
+	"github.com/kubespace/kubespace/pkg/utils"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	executeShellDefaultImage = "bash:5.1"
+	executeShellDefaultShell = "bash"
+	executeShellContainer    = "shell"
+	// 执行完成的Job保留一小时后由k8s自动清理
+	executeShellJobTTL = 3600
+	// 执行脚本的Job以及Pod标签，用于查询Pod
+	executeShellJobLabel = "kubespace.cn/pipeline-job-id"
+)
+
+var (
+	// 查询Pod启动以及Job完成状态的间隔
+	executeShellPodInterval = 2 * time.Second
+	executeShellJobInterval = 3 * time.Second
+	// 脚本执行结束后等待agent发送完剩余日志的时间
+	executeShellLogWait = 2 * time.Second
+)
+
+type ExecuteShellPlugin struct {
+	*model.Models
+	*kube_resource.KubeResources
+}
+
+func (p ExecuteShellPlugin) Execute(params *PluginParams) (interface{}, error) {
+	shell, err := NewExecuteShell(params, p.Models, p.KubeResources)
+	if err != nil {
+		return nil, err
+	}
+	return shell.execute()
+}
+
+type executeShellParams struct {
+	Cluster   string                 `json:"cluster"`
+	Namespace string                 `json:"namespace"`
+	Image     string                 `json:"image"`
+	Script    string                 `json:"script"`
+	Shell     string                 `json:"shell"`
+	Env       map[string]interface{} `json:"env"`
+}
+
+type executeShellResult struct {
+	ExitCode int32 `json:"exit_code"`
+}
+
+// executeShell 将脚本渲染为k8s Job在指定集群中执行，并将Pod日志写入任务日志
+type executeShell struct {
+	models        *model.Models
+	kubeResources *kube_resource.KubeResources
+	params        *executeShellParams
+	jobId         uint
+	cluster       string
+	jobName       string
+	// 执行参数中的密钥，包含密钥的环境变量通过Secret注入，不以明文写入Job
+	masks []string
+	ctx   context.Context
+	*PluginLogger
+}
+
+func NewExecuteShell(params *PluginParams, models *model.Models, kr *kube_resource.KubeResources) (*executeShell, error) {
+	var shellParams executeShellParams
+	marshalParams, err := json.Marshal(params.Params)
+	if err != nil {
+		params.Logger.Log("插件参数：%v", params.Params)
+		return nil, fmt.Errorf("marshal params error: %s", err.Error())
+	}
+	err = json.Unmarshal(marshalParams, &shellParams)
+	if err != nil {
+		params.Logger.Log("插件参数: %s", string(marshalParams))
+		return nil, fmt.Errorf("unmarshal execute shell params error: %s", err.Error())
+	}
+	return &executeShell{
+		models:        models,
+		kubeResources: kr,
+		params:        &shellParams,
+		jobId:         params.JobId,
+		masks:         params.Masks,
+		PluginLogger:  params.Logger,
+		ctx:           params.Context,
+	}, nil
+}
+
+func (s *executeShell) execute() (*executeShellResult, error) {
+	if strings.TrimSpace(s.params.Script) == "" {
+		s.Log("要执行的脚本为空")
+		return nil, fmt.Errorf("要执行的脚本为空")
+	}
+	if s.params.Cluster == "" {
+		s.Log("集群参数为空")
+		return nil, fmt.Errorf("集群参数为空")
+	}
+	cluster, err := s.models.ClusterManager.GetByName(s.params.Cluster)
+	if err != nil {
+		s.Log("获取集群失败：%s", err.Error())
+		return nil, err
+	}
+	s.cluster = cluster.Name
+	return s.run(cluster.Name1)
+}
+
+// run 在s.cluster集群中创建Job执行脚本，等待执行完成并返回脚本的退出码，clusterName为日志中显示的集群名称
+func (s *executeShell) run(clusterName string) (*executeShellResult, error) {
+	if s.params.Namespace == "" {
+		s.params.Namespace = "default"
+	}
+	if s.params.Image == "" {
+		s.params.Image = executeShellDefaultImage
+	}
+	if s.params.Shell == "" {
+		s.params.Shell = executeShellDefaultShell
+	}
+	s.jobName = fmt.Sprintf("kubespace-shell-%d-%d", s.jobId, time.Now().Unix())
+	envs, secretEnvs, err := s.renderEnvs()
+	if err != nil {
+		s.Log("生成执行脚本的环境变量失败：%s", err.Error())
+		return nil, err
+	}
+	jobYaml, err := s.renderJob(envs)
+	if err != nil {
+		s.Log("生成执行脚本的Job失败：%s", err.Error())
+		return nil, err
+	}
+	s.Log("在集群「%s」命名空间「%s」中使用镜像「%s」执行脚本", clusterName, s.params.Namespace, s.params.Image)
+	if len(secretEnvs) > 0 {
+		if err = s.applySecret(secretEnvs, nil); err != nil {
+			s.Log("创建执行脚本的Secret失败：%s", err.Error())
+			return nil, err
+		}
+		defer s.deleteSecret()
+	}
+	resp := s.kubeResources.Cluster.Apply(s.cluster, map[string]string{"yaml": jobYaml})
+	if !resp.IsSuccess() {
+		s.Log("创建执行脚本的Job失败：%s", resp.Msg)
+		return nil, errors.New(resp.Msg)
+	}
+	s.Log("创建Job「%s」成功，等待Pod启动", s.jobName)
+	if len(secretEnvs) > 0 {
+		s.ownSecretByJob(secretEnvs)
+	}
+
+	pod, err := s.waitPodStarted()
+	if err != nil {
+		s.cleanup(pod)
+		return nil, err
+	}
+	var logWg sync.WaitGroup
+	logWg.Add(1)
+	stopLog := s.streamPodLog(pod.Name, &logWg)
+	exitCode, err := s.waitJobFinished(pod.Name)
+	stopLog()
+	logWg.Wait()
+	if err != nil {
+		s.cleanup(pod)
+		return nil, err
+	}
+	if exitCode != 0 {
+		s.Log("脚本执行失败，退出码：%d", exitCode)
+		return nil, fmt.Errorf("脚本执行失败，退出码：%d", exitCode)
+	}
+	s.Log("脚本执行成功")
+	return &executeShellResult{ExitCode: exitCode}, nil
+}
+
+// renderEnvs 将流水线环境变量渲染为容器的环境变量，值中包含密钥的环境变量从Secret中引用，
+// 返回容器环境变量以及需要写入Secret的环境变量
+func (s *executeShell) renderEnvs() ([]corev1.EnvVar, map[string]string, error) {
+	var envs []corev1.EnvVar
+	secretEnvs := make(map[string]string)
+	for name, value := range s.params.Env {
+		if len(validation.IsEnvVarName(name)) > 0 {
+			continue
+		}
+		var v string
+		switch val := value.(type) {
+		case string:
+			v = val
+		case nil:
+			v = ""
+		default:
+			bytes, err := json.Marshal(val)
+			if err != nil {
+				return nil, nil, err
+			}
+			v = string(bytes)
+		}
+		if !s.containsSecret(v) {
+			envs = append(envs, corev1.EnvVar{Name: name, Value: v})
+			continue
+		}
+		secretEnvs[name] = v
+		envs = append(envs, corev1.EnvVar{
+			Name: name,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: s.jobName},
+					Key:                  name,
+				},
+			},
+		})
+	}
+	sort.Slice(envs, func(i, j int) bool {
+		return envs[i].Name < envs[j].Name
+	})
+	return envs, secretEnvs, nil
+}
+
+func (s *executeShell) containsSecret(value string) bool {
+	for _, mask := range s.masks {
+		if mask != "" && strings.Contains(value, mask) {
+			return true
+		}
+	}
+	return false
+}
+
+// renderSecret 生成与Job同名的Secret，ownerJob不为空时Secret随Job一起被k8s清理
+func (s *executeShell) renderSecret(secretEnvs map[string]string, ownerJob *batchv1.Job) (string, error) {
+	secret := corev1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.jobName,
+			Namespace: s.params.Namespace,
+			Labels:    map[string]string{executeShellJobLabel: fmt.Sprintf("%d", s.jobId)},
+		},
+		Type:       corev1.SecretTypeOpaque,
+		StringData: secretEnvs,
+	}
+	if ownerJob != nil {
+		secret.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: "batch/v1",
+			Kind:       "Job",
+			Name:       ownerJob.Name,
+			UID:        ownerJob.UID,
+		}}
+	}
+	bytes, err := yaml.Marshal(secret)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+func (s *executeShell) applySecret(secretEnvs map[string]string, ownerJob *batchv1.Job) error {
+	secretYaml, err := s.renderSecret(secretEnvs, ownerJob)
+	if err != nil {
+		return err
+	}
+	if resp := s.kubeResources.Cluster.Apply(s.cluster, map[string]string{"yaml": secretYaml}); !resp.IsSuccess() {
+		return errors.New(resp.Msg)
+	}
+	return nil
+}
+
+// ownSecretByJob Job创建后将Secret的owner设置为Job，服务异常退出未删除Secret时，由k8s随Job一起清理
+func (s *executeShell) ownSecretByJob(secretEnvs map[string]string) {
+	job, err := s.getJob()
+	if err == nil {
+		err = s.applySecret(secretEnvs, job)
+	}
+	if err != nil {
+		klog.Warningf("job %d set secret %s owner error: %s", s.jobId, s.jobName, err.Error())
+	}
+}
+
+// deleteSecret 脚本执行结束后删除注入密钥的Secret
+func (s *executeShell) deleteSecret() {
+	resources := []map[string]string{{"name": s.jobName, "namespace": s.params.Namespace}}
+	if resp := s.kubeResources.Secret.Delete(s.cluster, map[string]interface{}{"resources": resources}); !resp.IsSuccess() {
+		s.Log("删除Secret「%s」失败：%s", s.jobName, resp.Msg)
+	}
+}
+
+// renderJob 将脚本、镜像以及环境变量渲染为Job，失败不重试
+func (s *executeShell) renderJob(envs []corev1.EnvVar) (string, error) {
+	labels := map[string]string{executeShellJobLabel: fmt.Sprintf("%d", s.jobId)}
+	var backoffLimit int32 = 0
+	var ttl int32 = executeShellJobTTL
+	job := batchv1.Job{
+		TypeMeta: metav1.TypeMeta{APIVersion: "batch/v1", Kind: "Job"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.jobName,
+			Namespace: s.params.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            &backoffLimit,
+			TTLSecondsAfterFinished: &ttl,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:    executeShellContainer,
+							Image:   s.params.Image,
+							Command: []string{s.params.Shell, "-c", s.params.Script},
+							Env:     envs,
+						},
+					},
+				},
+			},
+		},
+	}
+	bytes, err := yaml.Marshal(job)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+func (s *executeShell) getJob() (*batchv1.Job, error) {
+	resp := s.kubeResources.Job.Get(s.cluster, map[string]interface{}{
+		"name":      s.jobName,
+		"namespace": s.params.Namespace,
+	})
+	if !resp.IsSuccess() {
+		return nil, errors.New(resp.Msg)
+	}
+	var job batchv1.Job
+	if err := convertResponseData(resp.Data, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (s *executeShell) getPod() (*corev1.Pod, error) {
+	resp := s.kubeResources.Pod.List(s.cluster, map[string]interface{}{
+		"namespace": s.params.Namespace,
+		"label_selector": map[string]interface{}{
+			"matchLabels": map[string]string{"job-name": s.jobName},
+		},
+	})
+	if !resp.IsSuccess() {
+		return nil, errors.New(resp.Msg)
+	}
+	var pods []corev1.Pod
+	if err := convertResponseData(resp.Data, &pods); err != nil {
+		return nil, err
+	}
+	if len(pods) == 0 {
+		return nil, nil
+	}
+	return &pods[0], nil
+}
+
+// waitPodStarted 等待执行脚本的Pod中容器开始运行或者已经结束
+func (s *executeShell) waitPodStarted() (*corev1.Pod, error) {
+	tick := time.NewTicker(executeShellPodInterval)
+	defer tick.Stop()
+	var lastReason string
+	for {
+		select {
+		case <-s.ctx.Done():
+			return nil, s.ctx.Err()
+		case <-tick.C:
+		}
+		pod, err := s.getPod()
+		if err != nil {
+			s.Log("获取执行脚本的Pod失败：%s", err.Error())
+			return nil, err
+		}
+		if pod == nil {
+			continue
+		}
+		if pod.Status.Phase != corev1.PodPending {
+			return pod, nil
+		}
+		for _, cs := range pod.Status.ContainerStatuses {
+			if cs.State.Waiting == nil || cs.State.Waiting.Reason == lastReason {
+				continue
+			}
+			lastReason = cs.State.Waiting.Reason
+			s.Log("Pod「%s」等待中：%s %s", pod.Name, cs.State.Waiting.Reason, cs.State.Waiting.Message)
+			if cs.State.Waiting.Reason == "ErrImagePull" || cs.State.Waiting.Reason == "InvalidImageName" {
+				return pod, fmt.Errorf("拉取镜像「%s」失败：%s", s.params.Image, cs.State.Waiting.Message)
+			}
+		}
+	}
+}
+
+// streamPodLog 通过agent读取Pod日志并按行写入任务日志，返回停止读取日志的函数
+func (s *executeShell) streamPodLog(podName string, wg *sync.WaitGroup) func() {
+	session := s.kubeResources.Pod.KubeMessage.NewLogSession()
+	sessionId := utils.CreateUUID()
+	resp := s.kubeResources.Pod.OpenLog(s.cluster, map[string]interface{}{
+		"namespace":  s.params.Namespace,
+		"name":       podName,
+		"container":  executeShellContainer,
+		"session_id": sessionId,
+	})
+	if !resp.IsSuccess() {
+		s.Log("读取Pod「%s」日志失败：%s", podName, resp.Msg)
+		session.Close()
+		wg.Done()
+		return func() {}
+	}
+	var line []byte
+	var lineLock sync.Mutex
+	go func() {
+		defer wg.Done()
+		err := session.ReceiveLog(sessionId, func(data string) {
+			d, err := base64.StdEncoding.DecodeString(data)
+			if err != nil {
+				klog.Errorf("decode log data error: %s", err.Error())
+				return
+			}
+			lineLock.Lock()
+			defer lineLock.Unlock()
+			line = append(line, d...)
+			for {
+				idx := strings.IndexByte(string(line), '\n')
+				if idx < 0 {
+					break
+				}
+				s.Log("%s", strings.TrimSuffix(string(line[:idx]), "\r"))
+				line = line[idx+1:]
+			}
+		})
+		if err != nil {
+			klog.V(1).Infof("job %d pod %s log session closed: %s", s.jobId, podName, err.Error())
+		}
+		lineLock.Lock()
+		defer lineLock.Unlock()
+		if len(line) > 0 {
+			s.Log("%s", string(line))
+		}
+	}()
+	return func() {
+		// 等待agent发送完剩余的日志
+		time.Sleep(executeShellLogWait)
+		s.kubeResources.Pod.CloseLog(s.cluster, map[string]interface{}{"session_id": sessionId})
+		session.Close()
+	}
+}
+
+// waitJobFinished 等待Job执行完成，返回脚本容器的退出码
+func (s *executeShell) waitJobFinished(podName string) (int32, error) {
+	tick := time.NewTicker(executeShellJobInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return 0, s.ctx.Err()
+		case <-tick.C:
+		}
+		job, err := s.getJob()
+		if err != nil {
+			s.Log("获取Job「%s」状态失败：%s", s.jobName, err.Error())
+			return 0, err
+		}
+		if job.Status.Succeeded == 0 && job.Status.Failed == 0 {
+			continue
+		}
+		pod, err := s.getPod()
+		if err != nil {
+			s.Log("获取执行脚本的Pod失败：%s", err.Error())
+			return 0, err
+		}
+		if pod != nil {
+			for _, cs := range pod.Status.ContainerStatuses {
+				if cs.Name == executeShellContainer && cs.State.Terminated != nil {
+					return cs.State.Terminated.ExitCode, nil
+				}
+			}
+		}
+		if job.Status.Succeeded > 0 {
+			return 0, nil
+		}
+		for _, c := range job.Status.Conditions {
+			if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+				return 0, fmt.Errorf("Job「%s」执行失败：%s %s", s.jobName, c.Reason, c.Message)
+			}
+		}
+		return 0, fmt.Errorf("Job「%s」执行失败，未获取到Pod「%s」的退出码", s.jobName, podName)
+	}
+}
+
+// cleanup 任务取消或者执行异常时删除Job以及Pod
+func (s *executeShell) cleanup(pod *corev1.Pod) {
+	resources := []map[string]string{{"name": s.jobName, "namespace": s.params.Namespace}}
+	if resp := s.kubeResources.Job.Delete(s.cluster, map[string]interface{}{"resources": resources}); !resp.IsSuccess() {
+		s.Log("删除Job「%s」失败：%s", s.jobName, resp.Msg)
+	}
+	if pod == nil {
+		pod, _ = s.getPod()
+	}
+	if pod != nil {
+		podResources := []map[string]string{{"name": pod.Name, "namespace": pod.Namespace}}
+		if resp := s.kubeResources.Pod.Delete(s.cluster, map[string]interface{}{"resources": podResources}); !resp.IsSuccess() {
+			s.Log("删除Pod「%s」失败：%s", pod.Name, resp.Msg)
+		}
+	}
+}
+
+// convertResponseData 将agent返回的k8s资源转换为对应的结构体
+func convertResponseData(data interface{}, obj interface{}) error {
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(dataBytes, obj)
+}
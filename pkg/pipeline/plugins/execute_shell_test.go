@@ -0,0 +1,390 @@
+package plugins
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kubespace/kubespace/pkg/kube_resource"
+	"github.com/kubespace/kubespace/pkg/model/types"
+	"github.com/kubespace/kubespace/pkg/utils"
+	"github.com/kubespace/kubespace/pkg/utils/code"
+	"github.com/kubespace/kubespace/pkg/views/serializers"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// fakeShellAgent 模拟集群agent，响应MiddleMessage请求并通过日志会话推送Pod日志
+type fakeShellAgent struct {
+	mu sync.Mutex
+	// Job是否执行完成，以及完成后脚本容器的退出码
+	finished bool
+	exitCode int32
+	// 打开日志会话后推送的日志块
+	logs     []string
+	jobName  string
+	applied  []string
+	jobYaml  string
+	deleted  []string
+	closed   []string
+	sessions map[string]chan string
+	// 打开Pod日志会话时关闭，此时脚本已开始运行
+	logOpened chan struct{}
+}
+
+func newFakeShellAgent(finished bool, exitCode int32, logs ...string) *fakeShellAgent {
+	return &fakeShellAgent{
+		finished:  finished,
+		exitCode:  exitCode,
+		logs:      logs,
+		sessions:  make(map[string]chan string),
+		logOpened: make(chan struct{}),
+	}
+}
+
+func (a *fakeShellAgent) SendRequest(req *kube_resource.MiddleRequest) *utils.Response {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch req.Resource + "/" + req.Action {
+	case kube_resource.ClusterType + "/" + kube_resource.APPLY:
+		return a.apply(req.Params.(map[string]string)["yaml"])
+	case kube_resource.JobType + "/" + kube_resource.GetAction:
+		return a.getJob()
+	case kube_resource.PodType + "/" + kube_resource.ListAction:
+		return a.listPods()
+	case kube_resource.PodType + "/" + kube_resource.OpenLogAction:
+		ch := a.logChannel(req.Params.(map[string]interface{})["session_id"].(string))
+		for _, l := range a.logs {
+			ch <- base64.StdEncoding.EncodeToString([]byte(l))
+		}
+		close(a.logOpened)
+		return &utils.Response{Code: code.Success}
+	case kube_resource.PodType + "/" + kube_resource.CloseLogAction:
+		a.closed = append(a.closed, req.Params.(map[string]interface{})["session_id"].(string))
+		return &utils.Response{Code: code.Success}
+	case kube_resource.JobType + "/" + kube_resource.DeleteAction,
+		kube_resource.PodType + "/" + kube_resource.DeleteAction,
+		kube_resource.SecretType + "/" + kube_resource.DeleteAction:
+		resources := req.Params.(map[string]interface{})["resources"].([]map[string]string)
+		for _, r := range resources {
+			a.deleted = append(a.deleted, req.Resource+"/"+r["name"])
+		}
+		return &utils.Response{Code: code.Success}
+	}
+	return &utils.Response{Code: code.RequestError, Msg: "unexpected request " + req.Resource + "/" + req.Action}
+}
+
+func (a *fakeShellAgent) apply(objYaml string) *utils.Response {
+	var obj struct {
+		metav1.TypeMeta   `json:",inline"`
+		metav1.ObjectMeta `json:"metadata"`
+	}
+	if err := yaml.Unmarshal([]byte(objYaml), &obj); err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
+	a.applied = append(a.applied, obj.Kind+"/"+obj.Name)
+	if obj.Kind == "Job" {
+		a.jobName = obj.Name
+		a.jobYaml = objYaml
+	}
+	return &utils.Response{Code: code.Success}
+}
+
+func (a *fakeShellAgent) getJob() *utils.Response {
+	if a.jobName == "" {
+		return &utils.Response{Code: code.RequestError, Msg: "job not found"}
+	}
+	job := batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: a.jobName, UID: "job-uid"}}
+	if a.finished && a.exitCode == 0 {
+		job.Status.Succeeded = 1
+	} else if a.finished {
+		job.Status.Failed = 1
+	} else {
+		job.Status.Active = 1
+	}
+	return &utils.Response{Code: code.Success, Data: job}
+}
+
+func (a *fakeShellAgent) listPods() *utils.Response {
+	if a.jobName == "" {
+		return &utils.Response{Code: code.Success, Data: []corev1.Pod{}}
+	}
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: a.jobName + "-pod", Namespace: "default"},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name:  executeShellContainer,
+				State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+			}},
+		},
+	}
+	if a.finished {
+		pod.Status.Phase = corev1.PodSucceeded
+		if a.exitCode != 0 {
+			pod.Status.Phase = corev1.PodFailed
+		}
+		pod.Status.ContainerStatuses[0].State = corev1.ContainerState{
+			Terminated: &corev1.ContainerStateTerminated{ExitCode: a.exitCode},
+		}
+	}
+	return &utils.Response{Code: code.Success, Data: []corev1.Pod{pod}}
+}
+
+func (a *fakeShellAgent) logChannel(sessionId string) chan string {
+	ch, ok := a.sessions[sessionId]
+	if !ok {
+		ch = make(chan string, 100)
+		a.sessions[sessionId] = ch
+	}
+	return ch
+}
+
+func (a *fakeShellAgent) ClusterConnected(cluster string) bool {
+	return true
+}
+
+func (a *fakeShellAgent) HasWatchReceive(cluster string) bool {
+	return false
+}
+
+func (a *fakeShellAgent) NewLogSession() kube_resource.LogSession {
+	return &fakeLogSession{agent: a, done: make(chan struct{})}
+}
+
+func (a *fakeShellAgent) snapshot() (applied, deleted, closed []string, jobYaml string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string{}, a.applied...), append([]string{}, a.deleted...), append([]string{}, a.closed...), a.jobYaml
+}
+
+type fakeLogSession struct {
+	agent *fakeShellAgent
+	done  chan struct{}
+	once  sync.Once
+}
+
+// ReceiveLog 会话关闭前先处理完agent已发送的日志
+func (s *fakeLogSession) ReceiveLog(sessionId string, reqHandle func(string)) error {
+	s.agent.mu.Lock()
+	ch := s.agent.logChannel(sessionId)
+	s.agent.mu.Unlock()
+	for {
+		select {
+		case data := <-ch:
+			reqHandle(data)
+		case <-s.done:
+			for {
+				select {
+				case data := <-ch:
+					reqHandle(data)
+				default:
+					return errors.New("session closed")
+				}
+			}
+		}
+	}
+}
+
+func (s *fakeLogSession) Close() {
+	s.once.Do(func() { close(s.done) })
+}
+
+type fakeJobLogs struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (l *fakeJobLogs) AppendLog(jobId uint, log string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logs = append(l.logs, log)
+	return nil
+}
+
+func (l *fakeJobLogs) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.logs, "")
+}
+
+// clusterShellPlugin 跳过数据库中的集群查询，直接在fake agent对应的集群中执行脚本
+type clusterShellPlugin struct {
+	kr *kube_resource.KubeResources
+}
+
+func (p clusterShellPlugin) Execute(params *PluginParams) (interface{}, error) {
+	shell, err := NewExecuteShell(params, nil, p.kr)
+	if err != nil {
+		return nil, err
+	}
+	shell.cluster = "test"
+	return shell.run("test")
+}
+
+func newTestShellPlugins(t *testing.T, agent *fakeShellAgent) (*Plugins, *fakeJobLogs, chan serializers.PipelineCallbackSerializer) {
+	podInterval, jobInterval, logWait := executeShellPodInterval, executeShellJobInterval, executeShellLogWait
+	executeShellPodInterval, executeShellJobInterval, executeShellLogWait = 10*time.Millisecond, 10*time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() {
+		executeShellPodInterval, executeShellJobInterval, executeShellLogWait = podInterval, jobInterval, logWait
+	})
+	jobLogs := &fakeJobLogs{}
+	callbacks := make(chan serializers.PipelineCallbackSerializer, 1)
+	p := &Plugins{
+		Plugins: map[string]PluginExecutor{
+			types.BuiltinPluginExecuteShellJob: clusterShellPlugin{kr: kube_resource.NewKubeResources(agent)},
+		},
+		callback: func(callbackSer serializers.PipelineCallbackSerializer) *utils.Response {
+			callbacks <- callbackSer
+			return &utils.Response{Code: code.Success}
+		},
+		cancels: make(map[uint]*pluginCancel),
+		jobLogs: jobLogs,
+	}
+	return p, jobLogs, callbacks
+}
+
+func executeTestShell(t *testing.T, p *Plugins, env map[string]interface{}, masks []string) {
+	resp := p.Execute(&PluginParams{
+		JobId:     1,
+		Attempt:   1,
+		PluginKey: types.BuiltinPluginExecuteShellJob,
+		Params:    map[string]interface{}{"cluster": "test", "script": "echo hello", "env": env},
+		Masks:     masks,
+	})
+	if !resp.IsSuccess() {
+		t.Fatalf("execute plugin error: %s", resp.Msg)
+	}
+}
+
+func waitCallback(t *testing.T, callbacks chan serializers.PipelineCallbackSerializer) serializers.PipelineCallbackSerializer {
+	select {
+	case ser := <-callbacks:
+		return ser
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait plugin callback timeout")
+	}
+	return serializers.PipelineCallbackSerializer{}
+}
+
+func TestExecuteShellExitCode(t *testing.T) {
+	cases := []struct {
+		name     string
+		exitCode int32
+		code     string
+		msg      string
+		log      string
+	}{
+		{"exit zero succeeds", 0, code.Success, "", "脚本执行成功"},
+		{"non zero exit fails", 2, code.PluginError, "脚本执行失败，退出码：2", "脚本执行失败，退出码：2"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			agent := newFakeShellAgent(true, c.exitCode)
+			p, jobLogs, callbacks := newTestShellPlugins(t, agent)
+			executeTestShell(t, p, nil, nil)
+
+			ser := waitCallback(t, callbacks)
+			if ser.JobId != 1 || ser.Attempt != 1 {
+				t.Errorf("callback job %d attempt %d, want job 1 attempt 1", ser.JobId, ser.Attempt)
+			}
+			if ser.Result.Code != c.code {
+				t.Fatalf("callback code = %s, want %s, msg: %s", ser.Result.Code, c.code, ser.Result.Msg)
+			}
+			if c.code == code.Success {
+				result, ok := ser.Result.Data.(*executeShellResult)
+				if !ok || result.ExitCode != 0 {
+					t.Errorf("callback data = %#v, want exit code 0", ser.Result.Data)
+				}
+			} else if ser.Result.Msg != c.msg {
+				t.Errorf("callback msg = %q, want %q", ser.Result.Msg, c.msg)
+			}
+			if !strings.Contains(jobLogs.String(), c.log) {
+				t.Errorf("job logs = %q, want containing %q", jobLogs.String(), c.log)
+			}
+			// 正常结束的Job由k8s按TTL清理，不主动删除
+			if _, deleted, _, _ := agent.snapshot(); len(deleted) != 0 {
+				t.Errorf("deleted resources = %v, want none", deleted)
+			}
+		})
+	}
+}
+
+func TestExecuteShellLogStreaming(t *testing.T) {
+	agent := newFakeShellAgent(true, 0, "hello\nwor", "ld\r\n", "last line without newline")
+	p, jobLogs, callbacks := newTestShellPlugins(t, agent)
+	executeTestShell(t, p, nil, nil)
+
+	if ser := waitCallback(t, callbacks); ser.Result.Code != code.Success {
+		t.Fatalf("callback code = %s, msg: %s", ser.Result.Code, ser.Result.Msg)
+	}
+	logs := jobLogs.String()
+	for _, line := range []string{"hello\n", "world\n", "last line without newline\n"} {
+		if !strings.Contains(logs, line) {
+			t.Errorf("job logs = %q, want containing line %q", logs, line)
+		}
+	}
+	if strings.Contains(logs, "\r") {
+		t.Errorf("job logs = %q, want carriage return trimmed", logs)
+	}
+	if strings.Index(logs, "last line without newline") > strings.Index(logs, "脚本执行成功") {
+		t.Errorf("job logs = %q, want pod logs flushed before result", logs)
+	}
+	if _, _, closed, _ := agent.snapshot(); len(closed) != 1 {
+		t.Errorf("closed log sessions = %v, want 1", closed)
+	}
+}
+
+func TestExecuteShellCancel(t *testing.T) {
+	agent := newFakeShellAgent(false, 0)
+	p, jobLogs, callbacks := newTestShellPlugins(t, agent)
+	executeTestShell(t, p, map[string]interface{}{"TOKEN": "s3cret-token", "NAME": "test"}, []string{"s3cret-token"})
+
+	select {
+	case <-agent.logOpened:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait job running timeout")
+	}
+	if !p.Cancel(1) {
+		t.Fatal("cancel running job returned false")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(jobLogs.String(), "任务已取消") {
+		if time.Now().After(deadline) {
+			t.Fatalf("wait job canceled timeout, logs: %q", jobLogs.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	applied, deleted, closed, jobYaml := agent.snapshot()
+	jobName := strings.TrimPrefix(applied[len(applied)-1], "Secret/")
+	want := []string{"job/" + jobName, "pod/" + jobName + "-pod", "secret/" + jobName}
+	if fmt.Sprint(deleted) != fmt.Sprint(want) {
+		t.Errorf("deleted resources = %v, want %v", deleted, want)
+	}
+	if fmt.Sprint(applied) != fmt.Sprint([]string{"Secret/" + jobName, "Job/" + jobName, "Secret/" + jobName}) {
+		t.Errorf("applied resources = %v, want secret, job and owned secret", applied)
+	}
+	if strings.Contains(jobYaml, "s3cret-token") || !strings.Contains(jobYaml, "secretKeyRef") {
+		t.Errorf("job yaml should reference secret instead of plain value:\n%s", jobYaml)
+	}
+	if len(closed) != 1 {
+		t.Errorf("closed log sessions = %v, want 1", closed)
+	}
+	select {
+	case ser := <-callbacks:
+		t.Errorf("canceled job should not callback, got %v", ser.Result)
+	case <-time.After(50 * time.Millisecond):
+	}
+	p.cancelLock.Lock()
+	defer p.cancelLock.Unlock()
+	if _, ok := p.cancels[1]; ok {
+		t.Error("canceled job should be removed from running cancels")
+	}
+}
@@ -1,7 +1,8 @@
 package plugins
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/kubespace/kubespace/pkg/kube_resource"
 	"github.com/kubespace/kubespace/pkg/model"
@@ -11,42 +12,60 @@ import (
 	"github.com/kubespace/kubespace/pkg/views/serializers"
 	"k8s.io/klog"
 	"runtime"
+	"sync"
 )
 
 type PluginExecutor interface {
 	Execute(params *PluginParams) (interface{}, error)
 }
 
+// jobLogAppender 任务日志的存储，由PipelineJobLogManager写入数据库
+type jobLogAppender interface {
+	AppendLog(jobId uint, log string) error
+}
+
 type PluginLogger struct {
-	jobId  uint
-	models *model.Models
-	*bytes.Buffer
+	jobId   uint
+	jobLogs jobLogAppender
+	masker  *utils.Masker
 }
 
+// Log 追加一行任务日志，日志分块存储，每次只写入新增的日志
 func (l *PluginLogger) Log(format string, a ...interface{}) {
-	_, err := l.Buffer.WriteString(fmt.Sprintf(format+"\n", a...))
+	err := l.jobLogs.AppendLog(l.jobId, l.masker.Mask(fmt.Sprintf(format+"\n", a...)))
 	if err != nil {
-		klog.Errorf("write job %s log to buffer error: %s", l.jobId, err.Error())
-	} else {
-		err = l.models.PipelineJobLogManager.UpdateLog(l.jobId, l.Buffer.String())
-		if err != nil {
-			klog.Errorf("update job %s log to db errror: %s", l.jobId, err.Error())
-		}
+		klog.Errorf("append job %d log to db error: %s", l.jobId, err.Error())
 	}
 }
 
 type PluginParams struct {
-	JobId     uint
+	JobId uint
+	// 任务当前的执行次数，回调时携带，过期的执行不会覆盖重试后的任务状态
+	Attempt   int
 	PluginKey string
 	Params    map[string]interface{}
 	Logger    *PluginLogger
+	// 任务取消时Context会被cancel，插件执行过程中需要检查是否已取消
+	Context context.Context
+	// 执行参数中的密钥，日志中会替换为***
+	Masks []string
 }
 
 type PluginCallback func(callbackSer serializers.PipelineCallbackSerializer) *utils.Response
 
+// pluginCancel 正在执行的任务某一次执行的取消函数
+type pluginCancel struct {
+	attempt int
+	cancel  context.CancelFunc
+}
+
 type Plugins struct {
 	Plugins  map[string]PluginExecutor
 	callback PluginCallback
+	// 正在执行的任务取消函数
+	cancels    map[uint]*pluginCancel
+	cancelLock sync.Mutex
+	jobLogs    jobLogAppender
 	*kube_resource.KubeResources
 	*model.Models
 }
@@ -55,11 +74,16 @@ func NewPlugins(models *model.Models, kr *kube_resource.KubeResources, callback
 	p := &Plugins{
 		Plugins:       make(map[string]PluginExecutor),
 		callback:      callback,
+		cancels:       make(map[uint]*pluginCancel),
+		jobLogs:       models.PipelineJobLogManager,
 		Models:        models,
 		KubeResources: kr,
 	}
 	p.Plugins[types.BuiltinPluginUpgradeApp] = UpgradeAppPlugin{Models: models, KubeResources: kr}
 	p.Plugins[types.BuiltinPluginDeployK8s] = DeployK8sPlugin{Models: models, KubeResources: kr}
+	p.Plugins[types.BuiltinPluginExecuteShellJob] = ExecuteShellPlugin{Models: models, KubeResources: kr}
+	p.Plugins[types.BuiltinPluginRelease] = ReleasePlugin{Models: models, KubeResources: kr}
+	p.Plugins[types.BuiltinPluginDeployHelm] = DeployHelmPlugin{Models: models, KubeResources: kr}
 	return p
 }
 
@@ -72,15 +96,48 @@ func (b *Plugins) Execute(pluginParams *PluginParams) *utils.Response {
 		return &utils.Response{Code: code.PluginError, Msg: "not found plugin executor: " + pluginParams.PluginKey}
 	}
 	pluginParams.Logger = &PluginLogger{
-		jobId:  pluginParams.JobId,
-		models: b.Models,
-		Buffer: new(bytes.Buffer),
+		jobId:   pluginParams.JobId,
+		jobLogs: b.jobLogs,
+		masker:  utils.NewMasker(pluginParams.Masks),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	pluginParams.Context = ctx
+	b.cancelLock.Lock()
+	// 超时后重试的任务，之前的执行可能仍未结束，取消之前的执行
+	if stale, ok := b.cancels[pluginParams.JobId]; ok {
+		stale.cancel()
 	}
+	b.cancels[pluginParams.JobId] = &pluginCancel{attempt: pluginParams.Attempt, cancel: cancel}
+	b.cancelLock.Unlock()
 	go b.doExecute(executor, pluginParams)
 	return &utils.Response{Code: code.Success}
 }
 
+// Cancel 取消正在执行的任务，任务取消后不再回调
+func (b *Plugins) Cancel(jobId uint) bool {
+	b.cancelLock.Lock()
+	defer b.cancelLock.Unlock()
+	running, ok := b.cancels[jobId]
+	if !ok {
+		return false
+	}
+	running.cancel()
+	delete(b.cancels, jobId)
+	return true
+}
+
+// finish 任务某一次执行结束，只清理该次执行的取消函数，不影响重试后新的执行
+func (b *Plugins) finish(jobId uint, attempt int) {
+	b.cancelLock.Lock()
+	defer b.cancelLock.Unlock()
+	if running, ok := b.cancels[jobId]; ok && running.attempt == attempt {
+		running.cancel()
+		delete(b.cancels, jobId)
+	}
+}
+
 func (b *Plugins) doExecute(executor PluginExecutor, pluginParams *PluginParams) {
+	defer b.finish(pluginParams.JobId, pluginParams.Attempt)
 	defer func() {
 		if err := recover(); err != nil {
 			klog.Error("error: ", err)
@@ -88,21 +145,32 @@ func (b *Plugins) doExecute(executor PluginExecutor, pluginParams *PluginParams)
 			n := runtime.Stack(buf[:], false)
 			klog.Errorf("==> %s\n", string(buf[:n]))
 			pluginParams.Logger.Log("==> %s\n", string(buf[:n]))
-			b.Callback(pluginParams.JobId, &utils.Response{Code: code.UnknownError, Msg: fmt.Sprintf("%v", err)})
+			b.Callback(pluginParams, &utils.Response{Code: code.UnknownError, Msg: fmt.Sprintf("%v", err)})
 		}
 	}()
 	result, err := executor.Execute(pluginParams)
+	if pluginParams.Context.Err() != nil {
+		klog.Infof("job %d plugin %s has been canceled", pluginParams.JobId, pluginParams.PluginKey)
+		pluginParams.Logger.Log("任务已取消")
+		return
+	}
 	if err != nil {
-		klog.Errorf("execute job %s plugin %s error: %s", pluginParams.JobId, pluginParams.PluginKey, err.Error())
-		b.Callback(pluginParams.JobId, &utils.Response{Code: code.PluginError, Msg: err.Error()})
+		klog.Errorf("execute job %d plugin %s error: %s", pluginParams.JobId, pluginParams.PluginKey, err.Error())
+		var rolledBack *RolledBackError
+		if errors.As(err, &rolledBack) {
+			b.Callback(pluginParams, &utils.Response{Code: code.PluginRolledBack, Msg: err.Error(), Data: result})
+			return
+		}
+		b.Callback(pluginParams, &utils.Response{Code: code.PluginError, Msg: err.Error()})
 		return
 	}
-	b.Callback(pluginParams.JobId, &utils.Response{Code: code.Success, Data: result})
+	b.Callback(pluginParams, &utils.Response{Code: code.Success, Data: result})
 }
 
-func (b *Plugins) Callback(jobId uint, resp *utils.Response) {
-	klog.Infof("job=%d callback response: %v", jobId, resp)
+func (b *Plugins) Callback(pluginParams *PluginParams, resp *utils.Response) {
+	jobId := pluginParams.JobId
+	klog.Infof("job=%d attempt=%d callback response: %v", jobId, pluginParams.Attempt, resp)
 
-	res := b.callback(serializers.PipelineCallbackSerializer{JobId: jobId, Result: resp})
+	res := b.callback(serializers.PipelineCallbackSerializer{JobId: jobId, Attempt: pluginParams.Attempt, Result: resp})
 	klog.Infof("job=%d callback to pipeline return: %v", jobId, res)
 }
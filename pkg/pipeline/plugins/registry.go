@@ -0,0 +1,250 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	dockerHubRegistry    = "docker.io"
+	dockerHubApiRegistry = "registry-1.docker.io"
+)
+
+// manifestMediaTypes 获取镜像manifest时支持的类型，包括多架构镜像
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+var registryHttpClient = &http.Client{
+	Timeout: 60 * time.Second,
+	Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	},
+}
+
+// imageReference 镜像地址解析后的仓库、镜像名称以及tag或digest
+type imageReference struct {
+	Registry   string
+	Repository string
+	Reference  string
+}
+
+func parseImageReference(image string) (*imageReference, error) {
+	image = strings.TrimSpace(image)
+	if image == "" {
+		return nil, fmt.Errorf("镜像地址为空")
+	}
+	ref := &imageReference{Registry: dockerHubRegistry}
+	name := image
+	if idx := strings.Index(name, "@"); idx > 0 {
+		ref.Reference = name[idx+1:]
+		name = name[:idx]
+	} else if idx = strings.LastIndex(name, ":"); idx > strings.LastIndex(name, "/") {
+		ref.Reference = name[idx+1:]
+		name = name[:idx]
+	}
+	if ref.Reference == "" {
+		ref.Reference = "latest"
+	}
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.Registry = parts[0]
+		name = parts[1]
+	}
+	if ref.Registry == dockerHubRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if name == "" {
+		return nil, fmt.Errorf("镜像地址%s格式不正确", image)
+	}
+	ref.Repository = name
+	return ref, nil
+}
+
+// Image 使用新的tag生成镜像地址
+func (r *imageReference) Image(tag string) string {
+	if r.Registry == dockerHubRegistry {
+		return strings.TrimPrefix(r.Repository, "library/") + ":" + tag
+	}
+	return r.Registry + "/" + r.Repository + ":" + tag
+}
+
+// registryClient 通过镜像仓库v2接口操作镜像，支持basic以及token认证
+type registryClient struct {
+	ctx      context.Context
+	user     string
+	password string
+	// 同一个镜像仓库认证后的Authorization头
+	authorization map[string]string
+}
+
+func newRegistryClient(ctx context.Context, user, password string) *registryClient {
+	return &registryClient{
+		ctx:           ctx,
+		user:          user,
+		password:      password,
+		authorization: make(map[string]string),
+	}
+}
+
+// Retag 将镜像的manifest推送到新的tag，不需要拉取镜像层
+func (c *registryClient) Retag(ref *imageReference, tag string) error {
+	manifestPath := fmt.Sprintf("/v2/%s/manifests/", ref.Repository)
+	header := http.Header{}
+	header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	resp, body, err := c.do(ref, http.MethodGet, manifestPath+ref.Reference, header, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("获取镜像manifest失败，status code %d: %s", resp.StatusCode, string(body))
+	}
+	mediaType := resp.Header.Get("Content-Type")
+	if mediaType == "" {
+		var manifest struct {
+			MediaType string `json:"mediaType"`
+		}
+		json.Unmarshal(body, &manifest)
+		mediaType = manifest.MediaType
+	}
+	header = http.Header{}
+	header.Set("Content-Type", mediaType)
+	resp, respBody, err := c.do(ref, http.MethodPut, manifestPath+tag, header, body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("推送镜像manifest失败，status code %d: %s", resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+// do 请求镜像仓库接口，返回401时根据WWW-Authenticate认证后重新请求
+func (c *registryClient) do(ref *imageReference, method, path string, header http.Header, body []byte) (*http.Response, []byte, error) {
+	registry := ref.Registry
+	if registry == dockerHubRegistry {
+		registry = dockerHubApiRegistry
+	}
+	scheme := "https"
+	resp, respBody, err := c.request(method, scheme+"://"+registry+path, header, body, registry)
+	if err != nil {
+		// 兼容未开启https的私有镜像仓库
+		scheme = "http"
+		if resp, respBody, err = c.request(method, scheme+"://"+registry+path, header, body, registry); err != nil {
+			return nil, nil, err
+		}
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, respBody, nil
+	}
+	authorization, err := c.auth(resp.Header.Get("WWW-Authenticate"), ref.Repository)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.authorization[registry] = authorization
+	return c.request(method, scheme+"://"+registry+path, header, body, registry)
+}
+
+func (c *registryClient) request(method, reqUrl string, header http.Header, body []byte, registry string) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(c.ctx, method, reqUrl, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if authorization, ok := c.authorization[registry]; ok {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := registryHttpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, respBody, nil
+}
+
+// auth 根据镜像仓库返回的认证方式生成Authorization头
+func (c *registryClient) auth(challenge, repository string) (string, error) {
+	scheme, params := parseAuthChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.user == "" {
+			return "", fmt.Errorf("镜像仓库需要认证，未配置镜像仓库用户")
+		}
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(c.user, c.password)
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+		realm := params["realm"]
+		if realm == "" {
+			return "", fmt.Errorf("镜像仓库认证地址为空")
+		}
+		query := url.Values{}
+		if service := params["service"]; service != "" {
+			query.Set("service", service)
+		}
+		query.Set("scope", fmt.Sprintf("repository:%s:pull,push", repository))
+		req, err := http.NewRequestWithContext(c.ctx, http.MethodGet, realm+"?"+query.Encode(), nil)
+		if err != nil {
+			return "", err
+		}
+		if c.user != "" {
+			req.SetBasicAuth(c.user, c.password)
+		}
+		resp, err := registryHttpClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("获取镜像仓库token失败，status code %d: %s", resp.StatusCode, string(body))
+		}
+		var token struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}
+		if err = json.Unmarshal(body, &token); err != nil {
+			return "", fmt.Errorf("解析镜像仓库token失败：%s", err.Error())
+		}
+		if token.Token == "" {
+			token.Token = token.AccessToken
+		}
+		return "Bearer " + token.Token, nil
+	}
+	return "", fmt.Errorf("不支持的镜像仓库认证方式：%s", challenge)
+}
+
+// parseAuthChallenge 解析WWW-Authenticate头，如Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseAuthChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) < 2 {
+		return parts[0], params
+	}
+	for _, kv := range strings.Split(parts[1], ",") {
+		pair := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		params[strings.ToLower(pair[0])] = strings.Trim(pair[1], "\"")
+	}
+	return parts[0], params
+}
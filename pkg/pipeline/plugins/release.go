@@ -0,0 +1,280 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/kubespace/kubespace/pkg/kube_resource"
+	"github.com/kubespace/kubespace/pkg/model"
+	"github.com/kubespace/kubespace/pkg/model/types"
+	"github.com/kubespace/kubespace/pkg/utils"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ReleasePlugin struct {
+	*model.Models
+	*kube_resource.KubeResources
+}
+
+func (p ReleasePlugin) Execute(params *PluginParams) (interface{}, error) {
+	release, err := NewRelease(params, p.Models)
+	if err != nil {
+		return nil, err
+	}
+	if err = release.execute(); err != nil {
+		return nil, err
+	}
+	return release.result, nil
+}
+
+type releaseImageRegistry struct {
+	Registry string `json:"registry"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+type releaseParams struct {
+	WorkspaceId   interface{}           `json:"workspace_id"`
+	CodeUrl       string                `json:"code_url"`
+	CodeBranch    string                `json:"code_branch"`
+	CodeCommitId  string                `json:"code_commit_id"`
+	CodeSecret    *codeSecret           `json:"code_secret"`
+	Version       string                `json:"version"`
+	Images        string                `json:"images"`
+	ImageRegistry *releaseImageRegistry `json:"image_registry"`
+}
+
+type releaseResult struct {
+	Version string `json:"version"`
+	Images  string `json:"images"`
+}
+
+// release 发布版本，给构建的代码提交打tag，并将构建的镜像以版本号重新打tag
+type release struct {
+	models      *model.Models
+	params      *releaseParams
+	jobId       uint
+	workspaceId uint
+	result      *releaseResult
+	ctx         context.Context
+	*PluginLogger
+}
+
+func NewRelease(params *PluginParams, models *model.Models) (*release, error) {
+	var relParams releaseParams
+	marshalParams, err := json.Marshal(params.Params)
+	if err != nil {
+		params.Logger.Log("插件参数：%v", params.Params)
+		return nil, fmt.Errorf("marshal params error: %s", err.Error())
+	}
+	err = json.Unmarshal(marshalParams, &relParams)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal release params error: %s", err.Error())
+	}
+	return &release{
+		models:       models,
+		params:       &relParams,
+		jobId:        params.JobId,
+		result:       &releaseResult{},
+		PluginLogger: params.Logger,
+		ctx:          params.Context,
+	}, nil
+}
+
+func (r *release) execute() error {
+	version := strings.TrimSpace(r.params.Version)
+	if version == "" {
+		r.Log("发布版本号为空")
+		return fmt.Errorf("发布版本号为空")
+	}
+	if !plumbing.NewTagReferenceName(version).IsTag() || strings.ContainsAny(version, " ~^:?*[\\") {
+		r.Log("发布版本号「%s」格式不正确", version)
+		return fmt.Errorf("发布版本号「%s」格式不正确", version)
+	}
+	r.params.Version = version
+	workspaceId, err := strconv.ParseUint(fmt.Sprintf("%v", r.params.WorkspaceId), 10, 64)
+	if err != nil {
+		r.Log("获取流水线空间失败：%s", err.Error())
+		return fmt.Errorf("获取流水线空间失败：%s", err.Error())
+	}
+	r.workspaceId = uint(workspaceId)
+	exists, err := r.models.PipelineReleaseManager.ExistsRelease(r.workspaceId, version)
+	if err != nil {
+		r.Log("查询发布版本失败：%s", err.Error())
+		return err
+	}
+	if exists {
+		r.Log("发布版本号「%s」已存在", version)
+		return fmt.Errorf("发布版本号「%s」已存在", version)
+	}
+	// 先保存发布版本，由(workspace_id, release_version)唯一索引避免并发发布相同的版本，
+	// 后续步骤失败时删除已保存的版本以及已推送的代码tag，以便重试
+	workspaceRelease := &types.PipelineWorkspaceRelease{
+		WorkspaceId:    r.workspaceId,
+		ReleaseVersion: version,
+		JobRunId:       r.jobId,
+	}
+	if err = r.models.PipelineReleaseManager.Create(workspaceRelease); err != nil {
+		r.Log("保存发布版本失败：%s", err.Error())
+		return fmt.Errorf("保存发布版本「%s」失败，版本可能已存在：%s", version, err.Error())
+	}
+	tagPushed, err := r.tagCode()
+	if err == nil {
+		err = r.tagImages()
+	}
+	if err != nil {
+		if tagPushed {
+			r.deleteCodeTag()
+		}
+		if delErr := r.models.PipelineReleaseManager.Delete(workspaceRelease.ID); delErr != nil {
+			r.Log("删除发布版本失败：%s", delErr.Error())
+		}
+		return err
+	}
+	r.result.Version = version
+	r.Log("发布版本「%s」成功", version)
+	return nil
+}
+
+// tagCode 在构建的代码提交上创建版本tag并推送到代码仓库，返回tag是否已推送
+func (r *release) tagCode() (bool, error) {
+	if r.params.CodeUrl == "" {
+		r.Log("代码地址为空，不创建代码tag")
+		return false, nil
+	}
+	if r.params.CodeCommitId == "" {
+		r.Log("未获取到构建的代码提交")
+		return false, fmt.Errorf("未获取到构建的代码提交")
+	}
+	auth, err := codeAuth(r.params.CodeSecret)
+	if err != nil {
+		r.Log("生成代码密钥失败：%s", err.Error())
+		return false, err
+	}
+	r.Log("克隆代码%s", r.params.CodeUrl)
+	cloneOptions := &git.CloneOptions{
+		Auth:            auth,
+		URL:             r.params.CodeUrl,
+		NoCheckout:      true,
+		InsecureSkipTLS: true,
+	}
+	if r.params.CodeBranch != "" {
+		cloneOptions.ReferenceName = plumbing.NewBranchReferenceName(r.params.CodeBranch)
+		cloneOptions.SingleBranch = true
+	}
+	codeDir := "/tmp/" + utils.CreateUUID()
+	defer os.RemoveAll(codeDir)
+	repo, err := git.PlainCloneContext(r.ctx, codeDir, true, cloneOptions)
+	if err != nil {
+		r.Log("克隆代码失败：%s", err.Error())
+		return false, err
+	}
+	hash := plumbing.NewHash(r.params.CodeCommitId)
+	if _, err = repo.CommitObject(hash); err != nil {
+		r.Log("获取代码提交%s失败：%s", r.params.CodeCommitId, err.Error())
+		return false, err
+	}
+	_, err = repo.CreateTag(r.params.Version, hash, &git.CreateTagOptions{
+		Tagger: &object.Signature{
+			Name:  "kubespace",
+			Email: "kubespace@kubespace.cn",
+			When:  time.Now(),
+		},
+		Message: "Release " + r.params.Version,
+	})
+	if err != nil {
+		r.Log("创建代码tag失败：%s", err.Error())
+		return false, err
+	}
+	tagRef := "refs/tags/" + r.params.Version
+	err = repo.PushContext(r.ctx, &git.PushOptions{
+		RemoteName:      git.DefaultRemoteName,
+		RefSpecs:        []config.RefSpec{config.RefSpec(tagRef + ":" + tagRef)},
+		Auth:            auth,
+		InsecureSkipTLS: true,
+	})
+	if err != nil {
+		r.Log("推送代码tag失败：%s", err.Error())
+		return false, err
+	}
+	r.Log("代码提交%s创建tag「%s」成功", r.params.CodeCommitId, r.params.Version)
+	return true, nil
+}
+
+// deleteCodeTag 发布失败时删除已推送到代码仓库的版本tag，任务取消时也需要删除，因此不使用任务的context
+func (r *release) deleteCodeTag() {
+	auth, err := codeAuth(r.params.CodeSecret)
+	if err != nil {
+		r.Log("删除代码tag失败：%s", err.Error())
+		return
+	}
+	repo, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		r.Log("删除代码tag失败：%s", err.Error())
+		return
+	}
+	remote, err := repo.CreateRemote(&config.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{r.params.CodeUrl}})
+	if err != nil {
+		r.Log("删除代码tag失败：%s", err.Error())
+		return
+	}
+	tagRef := "refs/tags/" + r.params.Version
+	err = remote.PushContext(context.Background(), &git.PushOptions{
+		RemoteName:      git.DefaultRemoteName,
+		RefSpecs:        []config.RefSpec{config.RefSpec(":" + tagRef)},
+		Auth:            auth,
+		InsecureSkipTLS: true,
+	})
+	if err != nil {
+		r.Log("删除代码tag「%s」失败：%s", r.params.Version, err.Error())
+		return
+	}
+	r.Log("发布失败，已删除代码tag「%s」", r.params.Version)
+}
+
+// tagImages 将构建的镜像以版本号作为tag推送到镜像仓库
+func (r *release) tagImages() error {
+	if r.params.Images == "" {
+		r.Log("构建镜像为空，不需要发布镜像")
+		return nil
+	}
+	var user, password, registry string
+	if r.params.ImageRegistry != nil {
+		user, password, registry = r.params.ImageRegistry.User, r.params.ImageRegistry.Password, r.params.ImageRegistry.Registry
+	}
+	client := newRegistryClient(r.ctx, user, password)
+	// 只有镜像仓库与构建镜像仓库相同时使用认证信息
+	anonymous := newRegistryClient(r.ctx, "", "")
+	var releaseImages []string
+	for _, image := range strings.Split(r.params.Images, ",") {
+		if strings.TrimSpace(image) == "" {
+			continue
+		}
+		ref, err := parseImageReference(image)
+		if err != nil {
+			r.Log("%s", err.Error())
+			return err
+		}
+		releaseImage := ref.Image(r.params.Version)
+		r.Log("发布镜像：%s -> %s", image, releaseImage)
+		c := anonymous
+		if registry == "" || ref.Registry == registry {
+			c = client
+		}
+		if err = c.Retag(ref, r.params.Version); err != nil {
+			r.Log("发布镜像%s失败：%s", image, err.Error())
+			return err
+		}
+		releaseImages = append(releaseImages, releaseImage)
+	}
+	r.result.Images = strings.Join(releaseImages, ",")
+	return nil
+}
@@ -0,0 +1,167 @@
+package plugins
+
+import (
+	"fmt"
+	"github.com/kubespace/kubespace/pkg/kube_resource"
+	"github.com/kubespace/kubespace/pkg/utils"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+// RolledBackError 部署失败并且已经回滚，任务标记为失败，结果中同时返回部署以及回滚的版本
+type RolledBackError struct {
+	Err error
+}
+
+func (e *RolledBackError) Error() string {
+	return fmt.Sprintf("%s，已回滚", e.Err.Error())
+}
+
+func (e *RolledBackError) Unwrap() error {
+	return e.Err
+}
+
+// manifestSnapshot 部署前集群中已存在资源的内容，部署失败时重新apply进行回滚，部署前不存在的资源回滚时删除
+type manifestSnapshot struct {
+	kubeResources *kube_resource.KubeResources
+	cluster       string
+	// 部署前已存在的资源
+	existed []*unstructured.Unstructured
+	// 部署前不存在，由本次部署新建的资源
+	created []*unstructured.Unstructured
+}
+
+// snapshotResource 根据资源类型获取对应的agent资源，不支持的类型不做回滚
+func (s *manifestSnapshot) snapshotResource(kind string) *kube_resource.KubeResource {
+	kr := s.kubeResources
+	resources := map[string]*kube_resource.KubeResource{
+		"Deployment":              kr.Deployment,
+		"StatefulSet":             kr.Statefulset,
+		"DaemonSet":               kr.Daemonset,
+		"CronJob":                 kr.Cronjob,
+		"Service":                 kr.Service,
+		"Ingress":                 kr.Ingress,
+		"ConfigMap":               kr.ConfigMap,
+		"Secret":                  kr.Secret,
+		"ServiceAccount":          kr.ServiceAccount,
+		"Role":                    kr.Role,
+		"RoleBinding":             kr.Rolebinding,
+		"NetworkPolicy":           kr.NetworkPolicy,
+		"HorizontalPodAutoscaler": kr.Hpa,
+		"PersistentVolumeClaim":   kr.Pvc,
+	}
+	return resources[kind]
+}
+
+// newManifestSnapshot 部署前获取yaml中资源在集群中的当前内容
+func newManifestSnapshot(kr *kube_resource.KubeResources, cluster, manifest, namespace string, logger *PluginLogger) (*manifestSnapshot, error) {
+	s := &manifestSnapshot{kubeResources: kr, cluster: cluster}
+	for _, yamlStr := range strings.Split(manifest, "---\n") {
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+		if err := yaml.Unmarshal([]byte(yamlStr), &obj.Object); err != nil {
+			return nil, err
+		}
+		if len(obj.Object) == 0 || obj.GetName() == "" {
+			continue
+		}
+		if obj.GetNamespace() == "" {
+			obj.SetNamespace(namespace)
+		}
+		resource := s.snapshotResource(obj.GetKind())
+		if resource == nil {
+			logger.Log("%s/%s不支持回滚", obj.GetKind(), obj.GetName())
+			continue
+		}
+		resp := resource.Get(cluster, map[string]interface{}{
+			"name":      obj.GetName(),
+			"namespace": obj.GetNamespace(),
+		})
+		if isNotFoundResponse(resp, obj.GetName()) {
+			s.created = append(s.created, obj)
+			continue
+		}
+		// 其它获取失败的情况，如agent超时或者没有权限，无法确定资源是否存在，不能部署，否则回滚时会删除已有的资源
+		if !resp.IsSuccess() {
+			return nil, fmt.Errorf("获取资源%s/%s失败：%s", obj.GetKind(), obj.GetName(), resp.Msg)
+		}
+		current := &unstructured.Unstructured{}
+		if err := convertResponseData(resp.Data, &current.Object); err != nil {
+			return nil, err
+		}
+		if current.GetKind() == "" {
+			current.SetAPIVersion(obj.GetAPIVersion())
+			current.SetKind(obj.GetKind())
+		}
+		cleanSnapshotObject(current)
+		s.existed = append(s.existed, current)
+	}
+	return s, nil
+}
+
+// isNotFoundResponse agent返回的资源不存在错误，错误信息与kubernetes的NotFound错误一致，如deployments.apps "name" not found
+func isNotFoundResponse(resp *utils.Response, name string) bool {
+	return !resp.IsSuccess() && strings.Contains(resp.Msg, fmt.Sprintf("%q not found", name))
+}
+
+// cleanSnapshotObject 删除由集群生成的字段，只保留可以重新apply的内容
+func cleanSnapshotObject(obj *unstructured.Unstructured) {
+	delete(obj.Object, "status")
+	for _, field := range []string{"resourceVersion", "uid", "creationTimestamp", "generation", "managedFields", "selfLink"} {
+		unstructured.RemoveNestedField(obj.Object, "metadata", field)
+	}
+	annotations := obj.GetAnnotations()
+	if annotations != nil {
+		delete(annotations, "kubectl.kubernetes.io/last-applied-configuration")
+		delete(annotations, "deployment.kubernetes.io/revision")
+		obj.SetAnnotations(annotations)
+	}
+}
+
+// Manifest 部署前已存在资源的yaml内容
+func (s *manifestSnapshot) Manifest() (string, error) {
+	var manifests []string
+	for _, obj := range s.existed {
+		objBytes, err := yaml.Marshal(obj.Object)
+		if err != nil {
+			return "", err
+		}
+		manifests = append(manifests, string(objBytes))
+	}
+	return strings.Join(manifests, "---\n"), nil
+}
+
+// Rollback 重新apply部署前的资源内容，并删除本次部署新建的资源
+func (s *manifestSnapshot) Rollback(logger *PluginLogger) (restored []string, deleted []string, err error) {
+	if len(s.existed) > 0 {
+		manifest, err := s.Manifest()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, obj := range s.existed {
+			restored = append(restored, obj.GetKind()+"/"+obj.GetName())
+		}
+		resp := s.kubeResources.Cluster.Apply(s.cluster, map[string]string{
+			"yaml": manifest,
+		})
+		if !resp.IsSuccess() {
+			logger.Log("恢复部署前的资源失败：%s", resp.Msg)
+			return nil, nil, fmt.Errorf("恢复部署前的资源失败：%s", resp.Msg)
+		}
+		logger.Log("恢复部署前的资源：%s", strings.Join(restored, ", "))
+	}
+	for _, obj := range s.created {
+		resp := s.snapshotResource(obj.GetKind()).Delete(s.cluster, map[string]interface{}{
+			"resources": []map[string]string{{"name": obj.GetName(), "namespace": obj.GetNamespace()}},
+		})
+		if !resp.IsSuccess() {
+			logger.Log("删除新建的资源%s/%s失败：%s", obj.GetKind(), obj.GetName(), resp.Msg)
+			continue
+		}
+		deleted = append(deleted, obj.GetKind()+"/"+obj.GetName())
+	}
+	if len(deleted) > 0 {
+		logger.Log("删除本次部署新建的资源：%s", strings.Join(deleted, ", "))
+	}
+	return restored, deleted, nil
+}
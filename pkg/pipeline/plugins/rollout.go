@@ -0,0 +1,365 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kubespace/kubespace/pkg/kube_resource"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	yamlutil "k8s.io/apimachinery/pkg/util/yaml"
+	"strings"
+	"time"
+)
+
+// DefaultRolloutTimeout 等待工作负载就绪的默认超时时间（秒）
+const DefaultRolloutTimeout = 300
+
+// RolloutKinds 部署后需要等待就绪的工作负载类型
+var RolloutKinds = []string{"Deployment", "StatefulSet", "DaemonSet"}
+
+type rolloutWorkload struct {
+	Kind      string
+	Name      string
+	Namespace string
+}
+
+func (w *rolloutWorkload) String() string {
+	return fmt.Sprintf("%s/%s", w.Kind, w.Name)
+}
+
+// workloadsFromManifest 从部署的yaml或者helm应用manifest中解析需要等待就绪的工作负载
+func workloadsFromManifest(manifest, namespace string) []*rolloutWorkload {
+	var workloads []*rolloutWorkload
+	decoder := yamlutil.NewYAMLOrJSONDecoder(strings.NewReader(manifest), 4096)
+	for {
+		obj := &unstructured.Unstructured{}
+		if err := decoder.Decode(&obj.Object); err != nil {
+			break
+		}
+		if obj.Object == nil {
+			continue
+		}
+		kind := obj.GetKind()
+		found := false
+		for _, k := range RolloutKinds {
+			if k == kind {
+				found = true
+			}
+		}
+		if !found || obj.GetName() == "" {
+			continue
+		}
+		ns := obj.GetNamespace()
+		if ns == "" {
+			ns = namespace
+		}
+		workloads = append(workloads, &rolloutWorkload{Kind: kind, Name: obj.GetName(), Namespace: ns})
+	}
+	return workloads
+}
+
+// renderChartManifest 使用chart包以及values在本地渲染应用的manifest
+func renderChartManifest(chartBytes []byte, name, namespace string, values map[string]interface{}) (string, error) {
+	chart, err := loader.LoadArchive(bytes.NewReader(chartBytes))
+	if err != nil {
+		return "", err
+	}
+	install := action.NewInstall(new(action.Configuration))
+	install.ReleaseName = name
+	install.Namespace = namespace
+	install.ClientOnly = true
+	install.DryRun = true
+	release, err := install.Run(chart, values)
+	if err != nil {
+		return "", err
+	}
+	return release.Manifest, nil
+}
+
+// rolloutVerifier 通过agent轮询工作负载状态，直到全部就绪或者超时，失败时将Pod状态以及事件写入任务日志
+type rolloutVerifier struct {
+	ctx           context.Context
+	kubeResources *kube_resource.KubeResources
+	cluster       string
+	timeout       time.Duration
+	*PluginLogger
+}
+
+func newRolloutVerifier(ctx context.Context, kr *kube_resource.KubeResources, cluster string, timeout int, logger *PluginLogger) *rolloutVerifier {
+	if timeout <= 0 {
+		timeout = DefaultRolloutTimeout
+	}
+	return &rolloutVerifier{
+		ctx:           ctx,
+		kubeResources: kr,
+		cluster:       cluster,
+		timeout:       time.Duration(timeout) * time.Second,
+		PluginLogger:  logger,
+	}
+}
+
+// workloadStatus 工作负载当前的就绪状态
+type workloadStatus struct {
+	Ready    bool
+	Failed   bool
+	Message  string
+	Selector *metav1.LabelSelector
+}
+
+func (v *rolloutVerifier) Wait(workloads []*rolloutWorkload) error {
+	if len(workloads) == 0 {
+		return nil
+	}
+	var names []string
+	for _, w := range workloads {
+		names = append(names, w.String())
+	}
+	v.Log("等待工作负载就绪，超时时间%d秒：%s", int(v.timeout.Seconds()), strings.Join(names, ", "))
+	deadline := time.Now().Add(v.timeout)
+	pending := workloads
+	lastMessage := make(map[string]string)
+	tick := time.NewTicker(3 * time.Second)
+	defer tick.Stop()
+	for {
+		var notReady []*rolloutWorkload
+		for _, w := range pending {
+			status, err := v.status(w)
+			if err != nil {
+				v.Log("获取%s状态失败：%s", w, err.Error())
+				return err
+			}
+			if status.Ready {
+				v.Log("%s已就绪", w)
+				continue
+			}
+			if status.Message != lastMessage[w.String()] {
+				v.Log("%s：%s", w, status.Message)
+				lastMessage[w.String()] = status.Message
+			}
+			if status.Failed {
+				v.diagnose(w, status.Selector)
+				return fmt.Errorf("%s部署失败：%s", w, status.Message)
+			}
+			notReady = append(notReady, w)
+		}
+		if len(notReady) == 0 {
+			v.Log("所有工作负载已就绪")
+			return nil
+		}
+		pending = notReady
+		if time.Now().After(deadline) {
+			for _, w := range pending {
+				if status, err := v.status(w); err == nil {
+					v.diagnose(w, status.Selector)
+				}
+			}
+			return fmt.Errorf("等待工作负载就绪超时：%s", pending[0])
+		}
+		select {
+		case <-v.ctx.Done():
+			return v.ctx.Err()
+		case <-tick.C:
+		}
+	}
+}
+
+func (v *rolloutVerifier) get(resource *kube_resource.KubeResource, w *rolloutWorkload, obj interface{}) error {
+	resp := resource.Get(v.cluster, map[string]interface{}{
+		"name":      w.Name,
+		"namespace": w.Namespace,
+	})
+	if !resp.IsSuccess() {
+		return errors.New(resp.Msg)
+	}
+	return convertResponseData(resp.Data, obj)
+}
+
+// status 参考kubectl rollout status判断工作负载是否更新完成并且可用
+func (v *rolloutVerifier) status(w *rolloutWorkload) (*workloadStatus, error) {
+	switch w.Kind {
+	case "Deployment":
+		var deploy appsv1.Deployment
+		if err := v.get(v.kubeResources.Deployment, w, &deploy); err != nil {
+			return nil, err
+		}
+		return deploymentStatus(&deploy), nil
+	case "StatefulSet":
+		var sts appsv1.StatefulSet
+		if err := v.get(v.kubeResources.Statefulset, w, &sts); err != nil {
+			return nil, err
+		}
+		return statefulSetStatus(&sts), nil
+	case "DaemonSet":
+		var ds appsv1.DaemonSet
+		if err := v.get(v.kubeResources.Daemonset, w, &ds); err != nil {
+			return nil, err
+		}
+		return daemonSetStatus(&ds), nil
+	}
+	return &workloadStatus{Ready: true}, nil
+}
+
+func deploymentStatus(deploy *appsv1.Deployment) *workloadStatus {
+	s := &workloadStatus{Selector: deploy.Spec.Selector}
+	if deploy.Generation > deploy.Status.ObservedGeneration {
+		s.Message = "等待更新被处理"
+		return s
+	}
+	for _, c := range deploy.Status.Conditions {
+		if c.Type == appsv1.DeploymentProgressing && c.Reason == "ProgressDeadlineExceeded" {
+			s.Failed = true
+			s.Message = c.Message
+			return s
+		}
+	}
+	replicas := int32(1)
+	if deploy.Spec.Replicas != nil {
+		replicas = *deploy.Spec.Replicas
+	}
+	status := deploy.Status
+	switch {
+	case status.UpdatedReplicas < replicas:
+		s.Message = fmt.Sprintf("已更新%d/%d个副本", status.UpdatedReplicas, replicas)
+	case status.Replicas > status.UpdatedReplicas:
+		s.Message = fmt.Sprintf("等待%d个旧副本终止", status.Replicas-status.UpdatedReplicas)
+	case status.AvailableReplicas < status.UpdatedReplicas:
+		s.Message = fmt.Sprintf("已就绪%d/%d个副本", status.AvailableReplicas, status.UpdatedReplicas)
+	default:
+		s.Ready = true
+	}
+	return s
+}
+
+func statefulSetStatus(sts *appsv1.StatefulSet) *workloadStatus {
+	s := &workloadStatus{Selector: sts.Spec.Selector}
+	if sts.Generation > sts.Status.ObservedGeneration {
+		s.Message = "等待更新被处理"
+		return s
+	}
+	replicas := int32(1)
+	if sts.Spec.Replicas != nil {
+		replicas = *sts.Spec.Replicas
+	}
+	status := sts.Status
+	if status.ReadyReplicas < replicas {
+		s.Message = fmt.Sprintf("已就绪%d/%d个副本", status.ReadyReplicas, replicas)
+		return s
+	}
+	// OnDelete策略需要手动删除Pod才会更新，只判断副本就绪
+	if sts.Spec.UpdateStrategy.Type == appsv1.RollingUpdateStatefulSetStrategyType {
+		if ru := sts.Spec.UpdateStrategy.RollingUpdate; ru != nil && ru.Partition != nil && *ru.Partition > 0 {
+			if status.UpdatedReplicas < replicas-*ru.Partition {
+				s.Message = fmt.Sprintf("已更新%d/%d个分区副本", status.UpdatedReplicas, replicas-*ru.Partition)
+				return s
+			}
+		} else if status.UpdateRevision != status.CurrentRevision {
+			s.Message = fmt.Sprintf("已更新%d/%d个副本", status.UpdatedReplicas, replicas)
+			return s
+		}
+	}
+	s.Ready = true
+	return s
+}
+
+func daemonSetStatus(ds *appsv1.DaemonSet) *workloadStatus {
+	s := &workloadStatus{Selector: ds.Spec.Selector}
+	if ds.Generation > ds.Status.ObservedGeneration {
+		s.Message = "等待更新被处理"
+		return s
+	}
+	status := ds.Status
+	switch {
+	case status.UpdatedNumberScheduled < status.DesiredNumberScheduled:
+		s.Message = fmt.Sprintf("已更新%d/%d个节点", status.UpdatedNumberScheduled, status.DesiredNumberScheduled)
+	case status.NumberAvailable < status.DesiredNumberScheduled:
+		s.Message = fmt.Sprintf("已就绪%d/%d个节点", status.NumberAvailable, status.DesiredNumberScheduled)
+	default:
+		s.Ready = true
+	}
+	return s
+}
+
+// diagnose 将工作负载未就绪的Pod容器状态以及相关事件写入任务日志
+func (v *rolloutVerifier) diagnose(w *rolloutWorkload, selector *metav1.LabelSelector) {
+	v.Log("%s事件：", w)
+	v.logEvents(w.Kind, w.Name, w.Namespace)
+	if selector == nil {
+		return
+	}
+	resp := v.kubeResources.Pod.List(v.cluster, map[string]interface{}{
+		"namespace":      w.Namespace,
+		"label_selector": selector,
+	})
+	if !resp.IsSuccess() {
+		v.Log("获取%s的Pod失败：%s", w, resp.Msg)
+		return
+	}
+	var pods []corev1.Pod
+	if err := convertResponseData(resp.Data, &pods); err != nil {
+		v.Log("解析%s的Pod失败：%s", w, err.Error())
+		return
+	}
+	for _, pod := range pods {
+		if podReady(&pod) {
+			continue
+		}
+		v.Log("Pod「%s」状态：%s %s", pod.Name, pod.Status.Phase, pod.Status.Reason)
+		for _, cs := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+			v.Log("  容器「%s」就绪：%v，重启次数：%d，%s", cs.Name, cs.Ready, cs.RestartCount, containerStateString(cs.State))
+			if cs.LastTerminationState.Terminated != nil {
+				v.Log("  容器「%s」上次退出：%s", cs.Name, containerStateString(cs.LastTerminationState))
+			}
+		}
+		v.logEvents("Pod", pod.Name, pod.Namespace)
+	}
+}
+
+func (v *rolloutVerifier) logEvents(kind, name, namespace string) {
+	resp := v.kubeResources.Event.List(v.cluster, map[string]interface{}{
+		"namespace": namespace,
+		"kind":      kind,
+		"name":      name,
+	})
+	if !resp.IsSuccess() {
+		v.Log("  获取%s/%s事件失败：%s", kind, name, resp.Msg)
+		return
+	}
+	var events []corev1.Event
+	if err := convertResponseData(resp.Data, &events); err != nil {
+		v.Log("  解析%s/%s事件失败：%s", kind, name, err.Error())
+		return
+	}
+	for _, e := range events {
+		v.Log("  [%s] %s/%s %s：%s", e.Type, kind, name, e.Reason, strings.TrimSpace(e.Message))
+	}
+}
+
+func podReady(pod *corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodRunning {
+		return false
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func containerStateString(state corev1.ContainerState) string {
+	switch {
+	case state.Waiting != nil:
+		return fmt.Sprintf("等待中：%s %s", state.Waiting.Reason, state.Waiting.Message)
+	case state.Terminated != nil:
+		return fmt.Sprintf("已退出：%s，退出码：%d %s", state.Terminated.Reason, state.Terminated.ExitCode, state.Terminated.Message)
+	case state.Running != nil:
+		return "运行中"
+	}
+	return "未知"
+}
@@ -1,6 +1,7 @@
 package plugins
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/kubespace/kubespace/pkg/kube_resource"
@@ -24,6 +25,9 @@ func (p UpgradeAppPlugin) Execute(params *PluginParams) (interface{}, error) {
 	}
 	err = upgrade.execute()
 	if err != nil {
+		if upgrade.result.RolledBack {
+			return upgrade.result, err
+		}
 		return nil, err
 	}
 	return upgrade.result, nil
@@ -34,16 +38,35 @@ type upgradeAppParams struct {
 	Apps        []uint `json:"apps"`
 	WithInstall bool   `json:"with_install"`
 	Images      string `json:"images"`
+	// 安装/升级后等待工作负载就绪
+	WaitRollout    bool `json:"wait_rollout"`
+	RolloutTimeout int  `json:"rollout_timeout"`
+	// 安装/升级失败时回滚到升级前的应用版本
+	RollbackOnFailure bool `json:"rollback_on_failure"`
 }
 
 type upgradeAppResultApps struct {
 	Id   uint   `json:"id"`
 	Name string `json:"name"`
+	// 本次升级的应用版本号
+	Revision uint `json:"revision,omitempty"`
+	// 升级失败后回滚到的应用版本号
+	RollbackRevision uint `json:"rollback_revision,omitempty"`
+	RolledBack       bool `json:"rolled_back,omitempty"`
 }
 
 type upgradeAppResult struct {
-	Project string                  `json:"project"`
-	Apps    []*upgradeAppResultApps `json:"apps"`
+	Project    string                  `json:"project"`
+	Apps       []*upgradeAppResultApps `json:"apps"`
+	RolledBack bool                    `json:"rolled_back,omitempty"`
+}
+
+// upgradedApp 本次任务中已修改的应用，以及升级前的版本和values，任务失败时用于回滚
+type upgradedApp struct {
+	app          *types.ProjectApp
+	resultApp    *upgradeAppResultApps
+	prevRevision *types.ProjectAppRevision
+	prevValues   string
 }
 
 type upgradeApp struct {
@@ -52,7 +75,10 @@ type upgradeApp struct {
 	params        *upgradeAppParams
 	images        []string
 	result        *upgradeAppResult
+	ctx           context.Context
 	project       *types.Project
+	// 开启失败回滚时，记录已修改的应用，按修改的倒序回滚
+	upgraded []*upgradedApp
 	*PluginLogger
 }
 
@@ -75,6 +101,7 @@ func NewUpgradeApp(params *PluginParams, models *model.Models, kr *kube_resource
 		params:        &upgradeParams,
 		result:        &upgradeAppResult{},
 		PluginLogger:  params.Logger,
+		ctx:           params.Context,
 	}, nil
 }
 
@@ -99,7 +126,13 @@ func (u *upgradeApp) execute() error {
 	u.images = strings.Split(u.params.Images, ",")
 	u.Log("升级的镜像列表：%v", u.images)
 	for _, appId := range u.params.Apps {
+		if u.ctx.Err() != nil {
+			return u.ctx.Err()
+		}
 		if err = u.upgrade(appId, u.params.WithInstall); err != nil {
+			if u.params.WithInstall && u.params.RollbackOnFailure && u.ctx.Err() == nil {
+				return u.rollbackUpgraded(err)
+			}
 			return err
 		}
 	}
@@ -122,42 +155,159 @@ func (u *upgradeApp) upgrade(appId uint, withInstall bool) error {
 		return nil
 	}
 	if upgradeValues != "" {
+		prevValues := app.AppVersion.Values
+		var prevRevision *types.ProjectAppRevision
+		if withInstall && u.params.RollbackOnFailure {
+			if prevRevision, err = u.models.ProjectAppManager.GetLatestRevision(app.ID); err != nil {
+				u.Log("获取应用「%s」当前版本失败：%s", app.Name, err.Error())
+				return err
+			}
+		}
 		app.AppVersion.Values = upgradeValues
 		if err = u.models.ProjectAppVersionManager.UpdateAppVersion(app.AppVersion, "values"); err != nil {
 			u.Log("更新应用「%s」版本values失败：%s", app.Name, err.Error())
 			return err
 		}
 		u.Log("更新应用「%s」values成功", app.Name)
+		resultApp := &upgradeAppResultApps{
+			Id:   appId,
+			Name: app.Name,
+		}
+		u.result.Apps = append(u.result.Apps, resultApp)
+		if withInstall && u.params.RollbackOnFailure {
+			u.upgraded = append(u.upgraded, &upgradedApp{
+				app:          app,
+				resultApp:    resultApp,
+				prevRevision: prevRevision,
+				prevValues:   prevValues,
+			})
+		}
 		if withInstall {
-			installParams := map[string]interface{}{
-				"name":       app.Name,
-				"namespace":  u.project.Namespace,
-				"chart_path": app.AppVersion.ChartPath,
-				"values":     upgradeValues,
-			}
-			var resp *utils.Response
-			if app.Status != types.AppStatusUninstall {
-				u.Log("开始对应用进行升级")
-				resp = u.kubeResources.Helm.UpdateObj(u.project.ClusterId, installParams)
-			} else {
-				u.Log("开始对应用进行安装")
-				resp = u.kubeResources.Helm.Create(u.project.ClusterId, installParams)
-			}
-			if resp.IsSuccess() {
-				u.Log("安装/升级成功")
-			} else {
-				u.Log("安装/升级失败：%v", resp)
-				return fmt.Errorf("升级应用失败：%s", resp.Msg)
+			if err = u.install(app, resultApp); err != nil {
+				return err
 			}
 		}
-		u.result.Apps = append(u.result.Apps, &upgradeAppResultApps{
-			Id:   appId,
-			Name: app.Name,
-		})
 	}
 	return nil
 }
 
+// install 使用升级后的values安装或升级应用，并记录应用版本
+func (u *upgradeApp) install(app *types.ProjectApp, resultApp *upgradeAppResultApps) error {
+	installParams := map[string]interface{}{
+		"name":       app.Name,
+		"namespace":  u.project.Namespace,
+		"chart_path": app.AppVersion.ChartPath,
+		"values":     app.AppVersion.Values,
+	}
+	var resp *utils.Response
+	if app.Status != types.AppStatusUninstall {
+		u.Log("开始对应用进行升级")
+		resp = u.kubeResources.Helm.UpdateObj(u.project.ClusterId, installParams)
+	} else {
+		u.Log("开始对应用进行安装")
+		resp = u.kubeResources.Helm.Create(u.project.ClusterId, installParams)
+	}
+	if resp.IsSuccess() {
+		u.Log("安装/升级成功")
+	} else {
+		u.Log("安装/升级失败：%v", resp)
+		return fmt.Errorf("升级应用失败：%s", resp.Msg)
+	}
+	revision, err := u.models.ProjectAppManager.CreateRevision(app.AppVersion, app)
+	if err != nil {
+		klog.Errorf("create project app id=%d, name=%s revision error: %s", app.ID, app.Name, err)
+	} else if revision != nil {
+		resultApp.Revision = revision.BuildRevision
+	}
+	if u.params.WaitRollout {
+		if err = u.waitRollout(app.Name, app.AppVersion); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollbackUpgraded 任务失败后按修改的倒序回滚本次任务中已修改的所有应用，所有应用都回滚成功时返回RolledBackError，
+// 部分应用回滚失败时任务没有完全回滚，返回升级以及回滚失败的错误
+func (u *upgradeApp) rollbackUpgraded(upgradeErr error) error {
+	if len(u.upgraded) == 0 {
+		return upgradeErr
+	}
+	var failed []string
+	for i := len(u.upgraded) - 1; i >= 0; i-- {
+		if err := u.rollback(u.upgraded[i]); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		u.Log("部分应用回滚失败，任务未完全回滚")
+		return fmt.Errorf("%s，回滚失败：%s", upgradeErr.Error(), strings.Join(failed, "；"))
+	}
+	u.result.RolledBack = true
+	return &RolledBackError{Err: upgradeErr}
+}
+
+// rollback 回滚应用到升级前最新的应用版本，没有版本记录时使用升级前的values
+func (u *upgradeApp) rollback(upgraded *upgradedApp) error {
+	app, prevRevision, prevValues := upgraded.app, upgraded.prevRevision, upgraded.prevValues
+	if prevRevision == nil && app.Status == types.AppStatusUninstall {
+		u.Log("应用「%s」升级前未安装，无法回滚", app.Name)
+		return fmt.Errorf("应用「%s」升级前未安装，无法回滚", app.Name)
+	}
+	rollbackVersionId, rollbackValues := app.AppVersionId, prevValues
+	if prevRevision != nil {
+		rollbackVersionId, rollbackValues = prevRevision.AppVersionId, prevRevision.Values
+		u.Log("开始回滚应用「%s」到版本%d", app.Name, prevRevision.BuildRevision)
+	} else {
+		u.Log("开始回滚应用「%s」到升级前的values", app.Name)
+	}
+	rollbackVersion, err := u.models.ProjectAppVersionManager.GetAppVersion(rollbackVersionId)
+	if err != nil {
+		u.Log("获取回滚的应用版本失败：%s", err.Error())
+		return fmt.Errorf("获取应用「%s」回滚的版本失败：%s", app.Name, err.Error())
+	}
+	resp := u.kubeResources.Helm.UpdateObj(u.project.ClusterId, map[string]interface{}{
+		"name":       app.Name,
+		"namespace":  u.project.Namespace,
+		"chart_path": rollbackVersion.ChartPath,
+		"values":     rollbackValues,
+	})
+	if !resp.IsSuccess() {
+		u.Log("回滚应用「%s」失败：%s", app.Name, resp.Msg)
+		return fmt.Errorf("应用「%s」回滚失败：%s", app.Name, resp.Msg)
+	}
+	// 恢复升级时修改的版本values以及应用当前版本
+	if rollbackVersion.ID == app.AppVersion.ID {
+		app.AppVersion.Values = rollbackValues
+	} else {
+		app.AppVersion.Values = prevValues
+		rollbackVersion.Values = rollbackValues
+		if err = u.models.ProjectAppVersionManager.UpdateAppVersion(rollbackVersion, "values"); err != nil {
+			u.Log("更新应用「%s」版本values失败：%s", app.Name, err.Error())
+		}
+		app.AppVersionId = rollbackVersion.ID
+		if err = u.models.ProjectAppManager.UpdateProjectApp(app, "app_version_id"); err != nil {
+			u.Log("更新应用「%s」当前版本失败：%s", app.Name, err.Error())
+		}
+	}
+	if err = u.models.ProjectAppVersionManager.UpdateAppVersion(app.AppVersion, "values"); err != nil {
+		u.Log("更新应用「%s」版本values失败：%s", app.Name, err.Error())
+	}
+	rollbackVersion.Values = rollbackValues
+	revision, err := u.models.ProjectAppManager.CreateRevision(rollbackVersion, app)
+	if err != nil {
+		klog.Errorf("create project app id=%d, name=%s revision error: %s", app.ID, app.Name, err)
+	}
+	if prevRevision != nil {
+		upgraded.resultApp.RollbackRevision = prevRevision.BuildRevision
+	} else if revision != nil {
+		upgraded.resultApp.RollbackRevision = revision.BuildRevision
+	}
+	upgraded.resultApp.RolledBack = true
+	u.Log("应用「%s」回滚成功", app.Name)
+	return nil
+}
+
 func (u *upgradeApp) upgradeAppValues(values string) (replaced bool, upgradeValues string, err error) {
 	var valuesDict = map[string]interface{}{}
 	if err = yaml.Unmarshal([]byte(values), &valuesDict); err != nil {
@@ -300,3 +450,28 @@ func (u *upgradeApp) matchRepositoryReplace(value map[string]interface{}) bool {
 	}
 	return false
 }
+
+// waitRollout 等待应用中的工作负载就绪，agent未返回manifest时根据应用版本的chart以及values渲染
+func (u *upgradeApp) waitRollout(name string, appVersion *types.AppVersion) error {
+	manifest := ""
+	if release := getHelmRelease(u.kubeResources, u.project.ClusterId, name, u.project.Namespace); release != nil {
+		manifest = release.Manifest
+	}
+	if manifest == "" {
+		appChart, err := u.models.ProjectAppVersionManager.GetAppVersionChart(appVersion.ChartPath)
+		if err != nil {
+			u.Log("获取应用chart失败：%s", err.Error())
+			return err
+		}
+		values := map[string]interface{}{}
+		if err = yaml.Unmarshal([]byte(appVersion.Values), &values); err != nil {
+			return err
+		}
+		if manifest, err = renderChartManifest(appChart.Content, name, u.project.Namespace, values); err != nil {
+			u.Log("渲染应用manifest失败：%s", err.Error())
+			return err
+		}
+	}
+	verifier := newRolloutVerifier(u.ctx, u.kubeResources, u.project.ClusterId, u.params.RolloutTimeout, u.PluginLogger)
+	return verifier.Wait(workloadsFromManifest(manifest, u.project.Namespace))
+}
@@ -1,6 +1,7 @@
 package pipeline
 
 import (
+	"fmt"
 	"github.com/kubespace/kubespace/pkg/model"
 	"github.com/kubespace/kubespace/pkg/model/types"
 	"github.com/kubespace/kubespace/pkg/utils"
@@ -142,6 +143,9 @@ func (w *WorkspaceService) Create(workspaceSer *serializers.WorkspaceSerializer,
 		CreateTime:   time.Now(),
 		UpdateTime:   time.Now(),
 	}
+	if workspace.Type == types.WorkspaceTypeCode {
+		workspace.WebhookSecret = utils.CreateUUID()
+	}
 	resp := &utils.Response{Code: code.Success}
 	var defaultPipeline []*types.Pipeline
 	if workspace.Type == types.WorkspaceTypeCode {
@@ -159,3 +163,26 @@ func (w *WorkspaceService) Create(workspaceSer *serializers.WorkspaceSerializer,
 	resp.Data = workspace
 	return resp
 }
+
+// Webhook 获取代码空间的webhook回调地址以及校验密钥，regenerate为true或者密钥为空时重新生成密钥
+func (w *WorkspaceService) Webhook(workspaceId uint, regenerate bool, user *types.User) *utils.Response {
+	workspace, err := w.models.PipelineWorkspaceManager.Get(workspaceId)
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: "获取流水线空间失败：" + err.Error()}
+	}
+	if workspace.Type != types.WorkspaceTypeCode {
+		return &utils.Response{Code: code.ParamsError, Msg: "只有代码空间支持webhook触发"}
+	}
+	if regenerate || workspace.WebhookSecret == "" {
+		workspace.WebhookSecret = utils.CreateUUID()
+		workspace.UpdateUser = user.Name
+		workspace.UpdateTime = time.Now()
+		if _, err = w.models.PipelineWorkspaceManager.Update(workspace); err != nil {
+			return &utils.Response{Code: code.DBError, Msg: "更新webhook密钥失败：" + err.Error()}
+		}
+	}
+	return &utils.Response{Code: code.Success, Data: map[string]interface{}{
+		"url":    fmt.Sprintf("/api/v1/pipeline/webhook/%d", workspace.ID),
+		"secret": workspace.WebhookSecret,
+	}}
+}
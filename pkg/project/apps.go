@@ -174,7 +174,7 @@ func (a *AppService) InstallApp(user *types.User, serializer serializers.Project
 		return &utils.Response{Code: code.DBError, Msg: err.Error()}
 	}
 	if _, err = a.models.ProjectAppManager.CreateRevision(versionApp, projectApp); err != nil {
-		klog.Errorf("create project app id=%s, name=%s revision error: %s", projectApp.ID, projectApp.Name, err)
+		klog.Errorf("create project app id=%d, name=%s revision error: %s", projectApp.ID, projectApp.Name, err)
 	}
 	return &utils.Response{Code: code.Success}
 }
@@ -304,7 +304,7 @@ func (a *AppService) GetApp(appId uint) *utils.Response {
 	}
 	cluster, err := a.models.ClusterManager.GetByName(clusterId)
 	if err != nil {
-		klog.Errorf("get app %s cluster error: %s", appId, err.Error())
+		klog.Errorf("get app %d cluster error: %s", appId, err.Error())
 	}
 	data := map[string]interface{}{
 		"id":              projectApp.ID,
@@ -0,0 +1,287 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/kubespace/kubespace/pkg/model"
+	"github.com/kubespace/kubespace/pkg/model/types"
+	"github.com/kubespace/kubespace/pkg/utils"
+	"github.com/kubespace/kubespace/pkg/utils/code"
+	"github.com/kubespace/kubespace/pkg/views"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// permission 校验当前用户是否有调用接口的权限，根据接口声明的权限范围从请求中获取对应的范围id，
+// 并根据操作类型判断用户在该范围下是否有对应的角色
+func permission(m *model.Models, c *views.Context, v *views.View) *utils.Response {
+	if v.Scope == "" {
+		return &utils.Response{Code: code.Success}
+	}
+	if c.User.IsSuper {
+		return &utils.Response{Code: code.Success}
+	}
+	req := newPermRequest(c)
+	scope, scopeId, err := resolveScope(m, req, v)
+	if err != nil {
+		return &utils.Response{Code: code.AuthError, Msg: "获取权限范围失败：" + err.Error()}
+	}
+	role := types.OperationRoleType(v.Object, v.Operation)
+	if !m.UserRoleManager.HasScopeRole(c.User, scope, scopeId, role) {
+		return &utils.Response{
+			Code: code.AuthError,
+			Msg:  fmt.Sprintf("用户%s没有%s权限", c.User.Name, v.Operation),
+		}
+	}
+	return &utils.Response{Code: code.Success}
+}
+
+// userRoleObject 成员权限接口的对象，可以在请求中指定校验的权限范围
+const userRoleObject = "user_role"
+
+// permRequest 从路由参数、查询参数以及请求体中获取参数值
+type permRequest struct {
+	*views.Context
+	body map[string]interface{}
+}
+
+func newPermRequest(c *views.Context) *permRequest {
+	req := &permRequest{Context: c}
+	if c.Request.Body == nil || c.Request.Method == http.MethodGet {
+		return req
+	}
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return req
+	}
+	// 读取之后恢复请求体，以便接口处理函数可以再次绑定参数
+	c.Request.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+	_ = json.Unmarshal(body, &req.body)
+	return req
+}
+
+func (r *permRequest) value(key string) string {
+	if v := r.Param(key); v != "" {
+		return v
+	}
+	if v := r.Query(key); v != "" {
+		return v
+	}
+	switch v := r.body[key].(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+func (r *permRequest) uintValue(key string) (uint, bool, error) {
+	return parsePermId(key, r.value(key))
+}
+
+// paramUintValue 只从路由参数中获取对象id，路由中的对象id不能被查询参数或者请求体覆盖
+func (r *permRequest) paramUintValue(key string) (uint, bool, error) {
+	return parsePermId(key, r.Param(key))
+}
+
+func parsePermId(key, v string) (uint, bool, error) {
+	if v == "" {
+		return 0, false, nil
+	}
+	id, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, true, fmt.Errorf("参数%s=%s错误", key, v)
+	}
+	return uint(id), true, nil
+}
+
+// resolveScope 根据接口声明的权限范围，返回实际校验的权限范围以及范围id，
+// 请求中有对象id时从数据库中获取对象所属的范围，而不是使用请求参数中的范围id
+func resolveScope(m *model.Models, r *permRequest, v *views.View) (string, uint, error) {
+	switch v.Scope {
+	case types.RoleScopePlatform:
+		return resolvePlatformScope(m, r, v.Object)
+	case types.RoleScopeCluster:
+		id, err := resolveClusterId(m, r)
+		return types.RoleScopeCluster, id, err
+	case types.RoleScopePipeline:
+		id, err := resolveWorkspaceId(m, r)
+		return types.RoleScopePipeline, id, err
+	case types.RoleScopeProject:
+		return resolveProjectScope(m, r)
+	}
+	return "", 0, fmt.Errorf("未知的权限范围%s", v.Scope)
+}
+
+// resolvePlatformScope 平台级接口在平台范围下进行校验，只有成员权限接口可以在请求中指定权限范围，
+// 其它平台对象如用户、密钥、镜像仓库等不能通过请求参数降低校验的范围
+func resolvePlatformScope(m *model.Models, r *permRequest, object string) (string, uint, error) {
+	if object != userRoleObject {
+		return types.RoleScopePlatform, 0, nil
+	}
+	if userRoleId, ok, err := r.paramUintValue("userRoleId"); err != nil {
+		return "", 0, err
+	} else if ok {
+		userRole, err := m.UserRoleManager.Get(userRoleId)
+		if err != nil {
+			return "", 0, err
+		}
+		return userRole.Scope, userRole.ScopeId, nil
+	}
+	scope := r.value("scope")
+	if scope == "" || scope == types.RoleScopePlatform {
+		return types.RoleScopePlatform, 0, nil
+	}
+	scopeId, _, err := r.uintValue("scope_id")
+	if err != nil {
+		return "", 0, err
+	}
+	return scope, scopeId, nil
+}
+
+func resolveClusterId(m *model.Models, r *permRequest) (uint, error) {
+	name := r.value("cluster")
+	if name == "" {
+		return 0, fmt.Errorf("未获取到集群参数")
+	}
+	cluster, err := m.ClusterManager.GetByName(name)
+	if err != nil {
+		return 0, err
+	}
+	return cluster.ID, nil
+}
+
+// resolveWorkspaceId 获取流水线空间id，依次从路由中的对象id、请求中的对象id以及请求中的workspace_id获取
+func resolveWorkspaceId(m *model.Models, r *permRequest) (uint, error) {
+	if id, ok, err := r.paramUintValue("workspaceId"); err != nil || ok {
+		return id, err
+	}
+	if resourceId, ok, err := r.paramUintValue("resourceId"); err != nil {
+		return 0, err
+	} else if ok {
+		resource, err := m.PipelineResourceManager.Get(resourceId)
+		if err != nil {
+			return 0, err
+		}
+		return resource.WorkspaceId, nil
+	}
+	pipelineId, ok, err := resolvePipelineId(m, r)
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		pipeline, err := m.ManagerPipeline.Get(pipelineId)
+		if err != nil {
+			return 0, err
+		}
+		return pipeline.WorkspaceId, nil
+	}
+	id, ok, err := r.uintValue("workspace_id")
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("未获取到流水线参数")
+	}
+	return id, nil
+}
+
+// resolvePipelineId 根据路由或者请求中的流水线、构建、阶段以及任务id获取所属的流水线id
+func resolvePipelineId(m *model.Models, r *permRequest) (uint, bool, error) {
+	if id, ok, err := r.paramUintValue("pipelineId"); err != nil || ok {
+		return id, ok, err
+	}
+	var pipelineRunId uint
+	if id, ok, err := r.paramUintValue("pipelineRunId"); err != nil {
+		return 0, false, err
+	} else if ok {
+		pipelineRunId = id
+	} else if id, ok, err = r.paramUintValue("jobRunId"); err != nil {
+		return 0, false, err
+	} else if ok {
+		// 历史任务没有记录构建id，通过任务所属的阶段获取构建
+		jobRun, err := m.ManagerPipelineRun.GetJobRun(id)
+		if err != nil {
+			return 0, false, err
+		}
+		stageRun, err := m.ManagerPipelineRun.GetStageRun(jobRun.StageRunId)
+		if err != nil {
+			return 0, false, err
+		}
+		pipelineRunId = stageRun.PipelineRunId
+	} else if id, ok, err = r.uintValue("stage_run_id"); err != nil {
+		return 0, false, err
+	} else if ok {
+		stageRun, err := m.ManagerPipelineRun.GetStageRun(id)
+		if err != nil {
+			return 0, false, err
+		}
+		pipelineRunId = stageRun.PipelineRunId
+	} else if id, ok, err = r.uintValue("pipeline_run_id"); err != nil {
+		return 0, false, err
+	} else if ok {
+		pipelineRunId = id
+	} else {
+		return r.uintValue("pipeline_id")
+	}
+	pipelineRun, err := m.ManagerPipelineRun.Get(pipelineRunId)
+	if err != nil {
+		return 0, false, err
+	}
+	return pipelineRun.PipelineId, true, nil
+}
+
+// resolveProjectScope 工作空间应用接口，应用属于集群组件时在集群范围下进行校验
+func resolveProjectScope(m *model.Models, r *permRequest) (string, uint, error) {
+	if appVersionId, ok, err := r.paramUintValue("appVersionId"); err != nil {
+		return "", 0, err
+	} else if ok {
+		appVersion, err := m.ProjectAppVersionManager.GetAppVersion(appVersionId)
+		if err != nil {
+			return "", 0, err
+		}
+		if appVersion.Scope != types.AppVersionScopeProjectApp {
+			return "", 0, fmt.Errorf("应用版本id=%d不属于空间应用", appVersionId)
+		}
+		return resolveAppScope(m, appVersion.ScopeId)
+	}
+	if appId, ok, err := r.paramUintValue("appId"); err != nil {
+		return "", 0, err
+	} else if ok {
+		return resolveAppScope(m, appId)
+	}
+	if id, ok, err := r.paramUintValue("projectId"); err != nil || ok {
+		return types.RoleScopeProject, id, err
+	}
+	if appId, ok, err := r.uintValue("project_app_id"); err != nil {
+		return "", 0, err
+	} else if ok {
+		return resolveAppScope(m, appId)
+	}
+	scopeId, ok, err := r.uintValue("scope_id")
+	if err != nil {
+		return "", 0, err
+	}
+	if !ok {
+		return "", 0, fmt.Errorf("未获取到工作空间参数")
+	}
+	return appScopeToRoleScope(r.value("scope")), scopeId, nil
+}
+
+func resolveAppScope(m *model.Models, appId uint) (string, uint, error) {
+	app, err := m.ProjectAppManager.GetProjectApp(appId)
+	if err != nil {
+		return "", 0, err
+	}
+	return appScopeToRoleScope(app.Scope), app.ScopeId, nil
+}
+
+func appScopeToRoleScope(appScope string) string {
+	if appScope == types.AppVersionScopeComponent {
+		return types.RoleScopeCluster
+	}
+	return types.RoleScopeProject
+}
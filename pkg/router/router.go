@@ -7,6 +7,7 @@ import (
 	"github.com/kubespace/kubespace/pkg/model"
 	"github.com/kubespace/kubespace/pkg/model/mysql"
 	"github.com/kubespace/kubespace/pkg/model/types"
+	"github.com/kubespace/kubespace/pkg/pipeline"
 	"github.com/kubespace/kubespace/pkg/redis"
 	"github.com/kubespace/kubespace/pkg/sse"
 	"github.com/kubespace/kubespace/pkg/utils"
@@ -56,16 +57,24 @@ func NewRouter(redisOptions *redis.Options, mysqlOptions *mysql.Options) (*Route
 
 	// 统一认证的api接口
 	apiGroup := engine.Group("/api/v1")
-	viewsets := NewViewSets(kubeResources, models)
+	pipelineRunService := pipeline.NewPipelineRunService(models, kubeResources)
+	viewsets := NewViewSets(kubeResources, models, pipelineRunService)
 	for group, vs := range *viewsets {
 		g := apiGroup.Group(group)
 		for _, v := range vs {
-			g.Handle(v.Method, v.Path, apiWrapper(models, v.Handler))
+			if v.Scope != "" && !types.HasPermissionObject(v.Object) {
+				return nil, fmt.Errorf("view %s %s%s permission object %s not found", v.Method, group, v.Path, v.Object)
+			}
+			g.Handle(v.Method, v.Path, apiWrapper(models, v))
 		}
 	}
 
-	pipelineCallbackView := pipeline_views.NewPipelineCallback(models, kubeResources)
+	pipelineCallbackView := pipeline_views.NewPipelineCallback(models, pipelineRunService)
 	apiGroup.POST("/pipeline/callback", pipelineCallbackView.Callback)
+	apiGroup.POST("/pipeline/callback/log", pipelineCallbackView.Log)
+
+	pipelineWebhookView := pipeline_views.NewPipelineWebhook(models, pipelineRunService)
+	apiGroup.POST("/pipeline/webhook/:workspaceId", pipelineWebhookView.Webhook)
 
 	clusterAgent := views2.NewClusterAgent(models)
 	engine.GET("/v1/import/:token", clusterAgent.AgentYaml)
@@ -100,22 +109,35 @@ func NewRouter(redisOptions *redis.Options, mysqlOptions *mysql.Options) (*Route
 	helmView := kube_views.NewHelm(kubeResources, models)
 	engine.GET("/app/charts/*path", helmView.GetAppChart)
 
+	// 更新当前实例执行中任务的心跳，恢复执行实例停止后中断的流水线构建
+	go pipelineRunService.ResumePipelineRuns()
+	// 检查执行超时的流水线阶段及任务
+	go pipelineRunService.WatchTimeout()
+	// 按顺序启动排队中的流水线构建
+	go pipelineRunService.WatchQueue()
+	// 流水线定时触发构建
+	go pipelineRunService.RunSchedule()
+
 	return &Router{
 		Engine: engine,
 	}, nil
 }
 
-func apiWrapper(m *model.Models, handler views2.ViewHandler) gin.HandlerFunc {
+func apiWrapper(m *model.Models, v *views2.View) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authRes := auth(m, c)
 		if !authRes.IsSuccess() {
 			c.JSON(401, authRes)
-		} else {
-			context := &views2.Context{Context: c, User: authRes.Data.(*types.User)}
-			res := handler(context)
-			if res != nil {
-				c.JSON(200, res)
-			}
+			return
+		}
+		context := &views2.Context{Context: c, User: authRes.Data.(*types.User)}
+		if permRes := permission(m, context, v); !permRes.IsSuccess() {
+			c.JSON(403, permRes)
+			return
+		}
+		res := v.Handler(context)
+		if res != nil {
+			c.JSON(200, res)
 		}
 	}
 }
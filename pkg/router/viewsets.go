@@ -14,7 +14,7 @@ import (
 
 type ViewSets map[string][]*views.View
 
-func NewViewSets(kr *kube_resource.KubeResources, models *model.Models) *ViewSets {
+func NewViewSets(kr *kube_resource.KubeResources, models *model.Models, pipelineRunService *pipeline.ServicePipelineRun) *ViewSets {
 	cluster := views.NewCluster(models, kr)
 	user := views.NewUser(models)
 	userRole := views.NewUserRole(models)
@@ -45,12 +45,11 @@ func NewViewSets(kr *kube_resource.KubeResources, models *model.Models) *ViewSet
 	helm := kube_views.NewHelm(kr, models)
 	crd := kube_views.NewCrd(kr)
 
-	pipelineRunService := pipeline.NewPipelineRunService(models, kr)
-
 	pipelineWorkspace := pipeline_views.NewPipelineWorkspace(models)
 	pipelineViews := pipeline_views.NewPipeline(models, pipelineRunService)
 	pipelineRun := pipeline_views.NewPipelineRun(models, pipelineRunService)
 	pipelineResource := pipeline_views.NewPipelineResource(models)
+	pipelinePlugin := pipeline_views.NewPipelinePlugin(models)
 
 	settingsSecret := settings_views.NewSettingsSecret(models)
 	imageRegistry := settings_views.NewImageRegistry(models)
@@ -98,6 +97,7 @@ func NewViewSets(kr *kube_resource.KubeResources, models *model.Models) *ViewSet
 		"pipeline/pipeline":  pipelineViews.Views,
 		"pipeline/build":     pipelineRun.Views,
 		"pipeline/resource":  pipelineResource.Views,
+		"pipeline/plugin":    pipelinePlugin.Views,
 
 		"settings/secret":         settingsSecret.Views,
 		"settings/image_registry": imageRegistry.Views,
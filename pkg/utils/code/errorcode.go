@@ -19,4 +19,7 @@ const (
 	AuthError      = "AuthError"
 	HelmError      = "HelmError"
 	PluginError    = "PluginError"
+	TimeoutError   = "TimeoutError"
+	// PluginRolledBack 插件执行失败并且已经回滚
+	PluginRolledBack = "PluginRolledBack"
 )
@@ -29,7 +29,7 @@ func NewHttpClient(baseUrl string) (*HttpClient, error) {
 	httpClient := HttpClient{client: &http.Client{Transport: tr}}
 	u, err := url.Parse(baseUrl)
 	if err != nil {
-		klog.Error("http request url parse error: httpUrl=%s. error=%v", baseUrl, err)
+		klog.Errorf("http request url parse error: httpUrl=%s. error=%v", baseUrl, err)
 		return nil, err
 	}
 	httpClient.baseUrl = u.String()
@@ -74,7 +74,7 @@ func (c *HttpClient) doRequest(url string, method string, buf io.Reader) ([]byte
 			klog.Error("read received http resp body error: error=", err)
 			return nil, err
 		}
-		klog.Infof("doRequest get response: url=%s, method=%s, status=%s", url, method, resp.StatusCode)
+		klog.Infof("doRequest get response: url=%s, method=%s, status=%d", url, method, resp.StatusCode)
 		if resp.StatusCode != http.StatusOK {
 			klog.Errorf("receive http code not 200: httpcode=%d", resp.StatusCode)
 			return data, fmt.Errorf("status code %v", resp.StatusCode)
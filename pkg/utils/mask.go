@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// SecretMask 密钥在日志以及接口返回中替换后的内容
+const SecretMask = "***"
+
+// minSecretMaskLength 过短的值替换后会导致日志无法阅读，不作为掩码
+const minSecretMaskLength = 4
+
+// Masker 将字符串中的密钥替换为***
+type Masker struct {
+	replacer     *strings.Replacer
+	jsonReplacer *strings.Replacer
+}
+
+// NewMasker 根据密钥列表生成Masker，同时替换密钥原文以及json转义后的内容，如多行的私钥
+func NewMasker(masks []string) *Masker {
+	var values, jsonValues []string
+	seen := make(map[string]struct{})
+	for _, mask := range masks {
+		if len(mask) < minSecretMaskLength {
+			continue
+		}
+		if _, ok := seen[mask]; ok {
+			continue
+		}
+		seen[mask] = struct{}{}
+		values = append(values, mask)
+		escaped, _ := json.Marshal(mask)
+		jsonValues = append(jsonValues, strings.Trim(string(escaped), "\""))
+	}
+	if len(values) == 0 {
+		return &Masker{}
+	}
+	m := &Masker{
+		replacer:     newMaskReplacer(append(values, jsonValues...)),
+		jsonReplacer: newMaskReplacer(jsonValues),
+	}
+	return m
+}
+
+// newMaskReplacer 较长的密钥优先替换，避免密钥之间包含时替换不完整
+func newMaskReplacer(values []string) *strings.Replacer {
+	sort.SliceStable(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+	var oldNew []string
+	for _, v := range values {
+		oldNew = append(oldNew, v, SecretMask)
+	}
+	return strings.NewReplacer(oldNew...)
+}
+
+// Mask 替换字符串中的密钥
+func (m *Masker) Mask(s string) string {
+	if m == nil || m.replacer == nil {
+		return s
+	}
+	return m.replacer.Replace(s)
+}
+
+// MaskJSON 将src序列化后替换其中的密钥，再反序列化到dst中，不会修改src
+func (m *Masker) MaskJSON(src, dst interface{}) error {
+	data, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	if m != nil && m.jsonReplacer != nil {
+		data = []byte(m.jsonReplacer.Replace(string(data)))
+	}
+	return json.Unmarshal(data, dst)
+}
@@ -2,7 +2,9 @@ package utils
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -100,19 +102,38 @@ func MergeReplaceMap(mObj ...map[string]interface{}) map[string]interface{} {
 	return newObj
 }
 
+// SignatureHeader 请求体的HMAC-SHA256签名请求头，格式为sha256=<hex>
+const SignatureHeader = "X-Kubespace-Signature-256"
+
 func HttpPost(url string, body interface{}) ([]byte, error) {
-	bodyBytes, _ := json.Marshal(body)
+	return HttpPostSigned(url, body, "")
+}
+
+// HttpPostSigned 使用密钥对请求体进行HMAC-SHA256签名，签名放到X-Kubespace-Signature-256请求头，密钥为空时不签名。
+// 请求体中可能包含密钥，不打印请求体
+func HttpPostSigned(url string, body interface{}, secret string) ([]byte, error) {
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
 	klog.Infof("request for url=%s", url)
-	klog.Infof("request body: %s", string(bodyBytes))
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(bodyBytes))
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		req.Header.Set(SignatureHeader, "sha256="+SignBody(secret, bodyBytes))
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	data, errReadBody := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
 	if errReadBody != nil {
-		klog.Error("read received http resp body error: error=", err)
-		return nil, err
+		klog.Error("read received http resp body error: error=", errReadBody)
+		return nil, errReadBody
 	}
 	klog.Infof("doRequest get response: url=%s, status=%v", url, resp.StatusCode)
 	if resp.StatusCode != http.StatusOK {
@@ -122,3 +143,10 @@ func HttpPost(url string, body interface{}) ([]byte, error) {
 		return data, nil
 	}
 }
+
+// SignBody 使用密钥对内容进行HMAC-SHA256签名，返回hex编码的签名
+func SignBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
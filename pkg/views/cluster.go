@@ -27,14 +27,14 @@ func NewCluster(models *model.Models, kr *kube_resource.KubeResources) *Cluster
 		KubeResources: kr,
 	}
 	views := []*View{
-		NewView(http.MethodGet, "", cluster.list),
-		NewView(http.MethodPost, "", cluster.create),
-		NewView(http.MethodPost, "/members", cluster.members),
-		NewView(http.MethodGet, "/:cluster/detail", cluster.detail),
-		NewView(http.MethodPost, "/delete", cluster.delete),
-		NewView(http.MethodPost, "/apply/:cluster", cluster.apply),
-		NewView(http.MethodPost, "/createYaml/:cluster", cluster.createYaml),
-		NewView(http.MethodGet, "/:cluster/sse", cluster.resourceSSE),
+		NewView(http.MethodGet, "", cluster.list, "", "", ""),
+		NewView(http.MethodPost, "", cluster.create, types.RoleScopePlatform, "cluster", types.OpCreate),
+		NewView(http.MethodPost, "/members", cluster.members, types.RoleScopePlatform, "cluster", types.OpUpdate),
+		NewView(http.MethodGet, "/:cluster/detail", cluster.detail, types.RoleScopeCluster, "cluster", types.OpGet),
+		NewView(http.MethodPost, "/delete", cluster.delete, types.RoleScopePlatform, "cluster", types.OpDelete),
+		NewView(http.MethodPost, "/apply/:cluster", cluster.apply, types.RoleScopeCluster, "cluster", types.OpUpdate),
+		NewView(http.MethodPost, "/createYaml/:cluster", cluster.createYaml, types.RoleScopeCluster, "cluster", types.OpCreate),
+		NewView(http.MethodGet, "/:cluster/sse", cluster.resourceSSE, types.RoleScopeCluster, "cluster", types.OpGet),
 	}
 	cluster.Views = views
 	return cluster
@@ -246,7 +246,7 @@ func (clu *Cluster) resourceSSE(c *Context) *utils.Response {
 		klog.Infof("select for cluster %s resource %s channel", ser.Cluster, ser.Type)
 		select {
 		case <-clientGone:
-			klog.Info("select for cluster %s resource %s client gone", ser.Cluster, ser.Type)
+			klog.Infof("select for cluster %s resource %s client gone", ser.Cluster, ser.Type)
 			return nil
 		case event := <-streamClient.ClientChan:
 			c.SSEvent("message", event.Object)
@@ -2,6 +2,7 @@ package kube_views
 
 import (
 	"github.com/kubespace/kubespace/pkg/kube_resource"
+	"github.com/kubespace/kubespace/pkg/model/types"
 	"github.com/kubespace/kubespace/pkg/utils"
 	"github.com/kubespace/kubespace/pkg/utils/code"
 	"github.com/kubespace/kubespace/pkg/views"
@@ -19,11 +20,11 @@ func NewConfigMap(kr *kube_resource.KubeResources) *ConfigMap {
 		KubeResources: kr,
 	}
 	vs := []*views.View{
-		views.NewView(http.MethodGet, "/:cluster/:namespace/:name", cm.get),
-		views.NewView(http.MethodGet, "/:cluster", cm.list),
-		views.NewView(http.MethodPost, "/:cluster/delete", cm.delete),
-		views.NewView(http.MethodPost, "/:cluster/update/:namespace/:name", cm.updateYaml),
-		views.NewView(http.MethodPost, "/:cluster/update_obj/:namespace/:name", cm.updateObj),
+		views.NewView(http.MethodGet, "/:cluster/:namespace/:name", cm.get, types.RoleScopeCluster, "configmap", types.OpGet),
+		views.NewView(http.MethodGet, "/:cluster", cm.list, types.RoleScopeCluster, "configmap", types.OpGet),
+		views.NewView(http.MethodPost, "/:cluster/delete", cm.delete, types.RoleScopeCluster, "configmap", types.OpDelete),
+		views.NewView(http.MethodPost, "/:cluster/update/:namespace/:name", cm.updateYaml, types.RoleScopeCluster, "configmap", types.OpUpdate),
+		views.NewView(http.MethodPost, "/:cluster/update_obj/:namespace/:name", cm.updateObj, types.RoleScopeCluster, "configmap", types.OpUpdate),
 	}
 	cm.Views = vs
 	return cm
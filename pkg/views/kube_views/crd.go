@@ -2,6 +2,7 @@ package kube_views
 
 import (
 	"github.com/kubespace/kubespace/pkg/kube_resource"
+	"github.com/kubespace/kubespace/pkg/model/types"
 	"github.com/kubespace/kubespace/pkg/utils"
 	"github.com/kubespace/kubespace/pkg/utils/code"
 	"github.com/kubespace/kubespace/pkg/views"
@@ -19,8 +20,8 @@ func NewCrd(kr *kube_resource.KubeResources) *Crd {
 		KubeResources: kr,
 	}
 	vs := []*views.View{
-		views.NewView(http.MethodGet, "/:cluster", crd.list),
-		views.NewView(http.MethodGet, "/:cluster/:name", crd.get),
+		views.NewView(http.MethodGet, "/:cluster", crd.list, types.RoleScopeCluster, "crd", types.OpGet),
+		views.NewView(http.MethodGet, "/:cluster/:name", crd.get, types.RoleScopeCluster, "crd", types.OpGet),
 	}
 	crd.Views = vs
 	return crd
@@ -2,6 +2,7 @@ package kube_views
 
 import (
 	"github.com/kubespace/kubespace/pkg/kube_resource"
+	"github.com/kubespace/kubespace/pkg/model/types"
 	"github.com/kubespace/kubespace/pkg/utils"
 	"github.com/kubespace/kubespace/pkg/utils/code"
 	"github.com/kubespace/kubespace/pkg/views"
@@ -19,10 +20,10 @@ func NewDaemonset(kr *kube_resource.KubeResources) *Daemonset {
 		KubeResources: kr,
 	}
 	vs := []*views.View{
-		views.NewView(http.MethodGet, "/:cluster/:namespace/:name", d.get),
-		views.NewView(http.MethodGet, "/:cluster", d.list),
-		views.NewView(http.MethodPost, "/:cluster/delete", d.delete),
-		views.NewView(http.MethodPost, "/:cluster/update/:namespace/:name", d.updateYaml),
+		views.NewView(http.MethodGet, "/:cluster/:namespace/:name", d.get, types.RoleScopeCluster, "daemonset", types.OpGet),
+		views.NewView(http.MethodGet, "/:cluster", d.list, types.RoleScopeCluster, "daemonset", types.OpGet),
+		views.NewView(http.MethodPost, "/:cluster/delete", d.delete, types.RoleScopeCluster, "daemonset", types.OpDelete),
+		views.NewView(http.MethodPost, "/:cluster/update/:namespace/:name", d.updateYaml, types.RoleScopeCluster, "daemonset", types.OpUpdate),
 	}
 	d.Views = vs
 	return d
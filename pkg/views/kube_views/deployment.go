@@ -2,6 +2,7 @@ package kube_views
 
 import (
 	"github.com/kubespace/kubespace/pkg/kube_resource"
+	"github.com/kubespace/kubespace/pkg/model/types"
 	"github.com/kubespace/kubespace/pkg/utils"
 	"github.com/kubespace/kubespace/pkg/utils/code"
 	"github.com/kubespace/kubespace/pkg/views"
@@ -20,11 +21,11 @@ func NewDeployment(kr *kube_resource.KubeResources) *Deployment {
 		KubeResources: kr,
 	}
 	vs := []*views.View{
-		views.NewView(http.MethodGet, "/:cluster/:namespace/:name", d.get),
-		views.NewView(http.MethodGet, "/:cluster", d.list),
-		views.NewView(http.MethodPost, "/:cluster/delete", d.delete),
-		views.NewView(http.MethodPost, "/:cluster/update/:namespace/:name", d.updateYaml),
-		views.NewView(http.MethodPost, "/:cluster/update_obj/:namespace/:name", d.updateObj),
+		views.NewView(http.MethodGet, "/:cluster/:namespace/:name", d.get, types.RoleScopeCluster, "deployment", types.OpGet),
+		views.NewView(http.MethodGet, "/:cluster", d.list, types.RoleScopeCluster, "deployment", types.OpGet),
+		views.NewView(http.MethodPost, "/:cluster/delete", d.delete, types.RoleScopeCluster, "deployment", types.OpDelete),
+		views.NewView(http.MethodPost, "/:cluster/update/:namespace/:name", d.updateYaml, types.RoleScopeCluster, "deployment", types.OpUpdate),
+		views.NewView(http.MethodPost, "/:cluster/update_obj/:namespace/:name", d.updateObj, types.RoleScopeCluster, "deployment", types.OpUpdate),
 	}
 	d.Views = vs
 	return d
@@ -2,6 +2,7 @@ package kube_views
 
 import (
 	"github.com/kubespace/kubespace/pkg/kube_resource"
+	"github.com/kubespace/kubespace/pkg/model/types"
 	"github.com/kubespace/kubespace/pkg/utils"
 	"github.com/kubespace/kubespace/pkg/utils/code"
 	"github.com/kubespace/kubespace/pkg/views"
@@ -19,7 +20,7 @@ func NewEvent(kr *kube_resource.KubeResources) *Event {
 		KubeResources: kr,
 	}
 	vs := []*views.View{
-		views.NewView(http.MethodGet, "/:cluster", event.list),
+		views.NewView(http.MethodGet, "/:cluster", event.list, types.RoleScopeCluster, "event", types.OpGet),
 	}
 	event.Views = vs
 	return event
@@ -29,13 +29,13 @@ func NewHelm(kr *kube_resource.KubeResources, models *model.Models) *Helm {
 		models:        models,
 	}
 	vs := []*views.View{
-		views.NewView(http.MethodGet, "/app/list", helm.listApp),
-		views.NewView(http.MethodGet, "/app/get", helm.getApp),
-		views.NewView(http.MethodGet, "/release/:cluster", helm.list),
-		views.NewView(http.MethodGet, "/release/:cluster/get", helm.get),
-		views.NewView(http.MethodPost, "/release/:cluster", helm.create),
-		views.NewView(http.MethodPut, "/release/:cluster", helm.update),
-		views.NewView(http.MethodDelete, "/release/:cluster", helm.delete),
+		views.NewView(http.MethodGet, "/app/list", helm.listApp, "", "", ""),
+		views.NewView(http.MethodGet, "/app/get", helm.getApp, "", "", ""),
+		views.NewView(http.MethodGet, "/release/:cluster", helm.list, types.RoleScopeCluster, "helm", types.OpGet),
+		views.NewView(http.MethodGet, "/release/:cluster/get", helm.get, types.RoleScopeCluster, "helm", types.OpGet),
+		views.NewView(http.MethodPost, "/release/:cluster", helm.create, types.RoleScopeCluster, "helm", types.OpCreate),
+		views.NewView(http.MethodPut, "/release/:cluster", helm.update, types.RoleScopeCluster, "helm", types.OpUpdate),
+		views.NewView(http.MethodDelete, "/release/:cluster", helm.delete, types.RoleScopeCluster, "helm", types.OpDelete),
 	}
 	helm.Views = vs
 	return helm
@@ -2,6 +2,7 @@ package kube_views
 
 import (
 	"github.com/kubespace/kubespace/pkg/kube_resource"
+	"github.com/kubespace/kubespace/pkg/model/types"
 	"github.com/kubespace/kubespace/pkg/utils"
 	"github.com/kubespace/kubespace/pkg/utils/code"
 	"github.com/kubespace/kubespace/pkg/views"
@@ -19,10 +20,10 @@ func NewHpa(kr *kube_resource.KubeResources) *Hpa {
 		KubeResources: kr,
 	}
 	vs := []*views.View{
-		views.NewView(http.MethodGet, "/:cluster/:namespace/:name", h.get),
-		views.NewView(http.MethodGet, "/:cluster", h.list),
-		views.NewView(http.MethodPost, "/:cluster/delete", h.delete),
-		views.NewView(http.MethodPost, "/:cluster/update/:namespace/:name", h.updateYaml),
+		views.NewView(http.MethodGet, "/:cluster/:namespace/:name", h.get, types.RoleScopeCluster, "hpa", types.OpGet),
+		views.NewView(http.MethodGet, "/:cluster", h.list, types.RoleScopeCluster, "hpa", types.OpGet),
+		views.NewView(http.MethodPost, "/:cluster/delete", h.delete, types.RoleScopeCluster, "hpa", types.OpDelete),
+		views.NewView(http.MethodPost, "/:cluster/update/:namespace/:name", h.updateYaml, types.RoleScopeCluster, "hpa", types.OpUpdate),
 	}
 	h.Views = vs
 	return h
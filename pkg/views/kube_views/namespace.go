@@ -2,6 +2,7 @@ package kube_views
 
 import (
 	"github.com/kubespace/kubespace/pkg/kube_resource"
+	"github.com/kubespace/kubespace/pkg/model/types"
 	"github.com/kubespace/kubespace/pkg/utils"
 	"github.com/kubespace/kubespace/pkg/utils/code"
 	"github.com/kubespace/kubespace/pkg/views"
@@ -19,10 +20,10 @@ func NewNamespace(kr *kube_resource.KubeResources) *Namespace {
 		KubeResources: kr,
 	}
 	vs := []*views.View{
-		views.NewView(http.MethodGet, "/:cluster", ns.list),
-		views.NewView(http.MethodGet, "/:cluster/:name", ns.get),
-		views.NewView(http.MethodPost, "/:cluster/delete", ns.delete),
-		views.NewView(http.MethodPost, "/:cluster/update/:name", ns.updateYaml),
+		views.NewView(http.MethodGet, "/:cluster", ns.list, types.RoleScopeCluster, "namespace", types.OpGet),
+		views.NewView(http.MethodGet, "/:cluster/:name", ns.get, types.RoleScopeCluster, "namespace", types.OpGet),
+		views.NewView(http.MethodPost, "/:cluster/delete", ns.delete, types.RoleScopeCluster, "namespace", types.OpDelete),
+		views.NewView(http.MethodPost, "/:cluster/update/:name", ns.updateYaml, types.RoleScopeCluster, "namespace", types.OpUpdate),
 	}
 	ns.Views = vs
 	return ns
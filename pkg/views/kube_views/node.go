@@ -2,6 +2,7 @@ package kube_views
 
 import (
 	"github.com/kubespace/kubespace/pkg/kube_resource"
+	"github.com/kubespace/kubespace/pkg/model/types"
 	"github.com/kubespace/kubespace/pkg/utils"
 	"github.com/kubespace/kubespace/pkg/utils/code"
 	"github.com/kubespace/kubespace/pkg/views"
@@ -19,10 +20,10 @@ func NewNode(kr *kube_resource.KubeResources) *Node {
 		KubeResources: kr,
 	}
 	vs := []*views.View{
-		views.NewView(http.MethodGet, "/:cluster", node.list),
-		views.NewView(http.MethodGet, "/:cluster/:name", node.get),
-		views.NewView(http.MethodPost, "/:cluster/delete", node.delete),
-		views.NewView(http.MethodPost, "/:cluster/update/:name", node.updateYaml),
+		views.NewView(http.MethodGet, "/:cluster", node.list, types.RoleScopeCluster, "node", types.OpGet),
+		views.NewView(http.MethodGet, "/:cluster/:name", node.get, types.RoleScopeCluster, "node", types.OpGet),
+		views.NewView(http.MethodPost, "/:cluster/delete", node.delete, types.RoleScopeCluster, "node", types.OpDelete),
+		views.NewView(http.MethodPost, "/:cluster/update/:name", node.updateYaml, types.RoleScopeCluster, "node", types.OpUpdate),
 	}
 	node.Views = vs
 	return node
@@ -2,6 +2,7 @@ package kube_views
 
 import (
 	"github.com/kubespace/kubespace/pkg/kube_resource"
+	"github.com/kubespace/kubespace/pkg/model/types"
 	"github.com/kubespace/kubespace/pkg/utils"
 	"github.com/kubespace/kubespace/pkg/utils/code"
 	"github.com/kubespace/kubespace/pkg/views"
@@ -19,10 +20,10 @@ func NewPod(kr *kube_resource.KubeResources) *Pod {
 		KubeResources: kr,
 	}
 	vs := []*views.View{
-		views.NewView(http.MethodGet, "/:cluster/:namespace/:name", pod.get),
-		views.NewView(http.MethodPost, "/:cluster/list", pod.list),
-		views.NewView(http.MethodPost, "/:cluster/delete", pod.delete),
-		views.NewView(http.MethodPost, "/:cluster/update/:namespace/:name", pod.updateYaml),
+		views.NewView(http.MethodGet, "/:cluster/:namespace/:name", pod.get, types.RoleScopeCluster, "pod", types.OpGet),
+		views.NewView(http.MethodPost, "/:cluster/list", pod.list, types.RoleScopeCluster, "pod", types.OpGet),
+		views.NewView(http.MethodPost, "/:cluster/delete", pod.delete, types.RoleScopeCluster, "pod", types.OpDelete),
+		views.NewView(http.MethodPost, "/:cluster/update/:namespace/:name", pod.updateYaml, types.RoleScopeCluster, "pod", types.OpUpdate),
 	}
 	pod.Views = vs
 	return pod
@@ -2,6 +2,7 @@ package kube_views
 
 import (
 	"github.com/kubespace/kubespace/pkg/kube_resource"
+	"github.com/kubespace/kubespace/pkg/model/types"
 	"github.com/kubespace/kubespace/pkg/utils"
 	"github.com/kubespace/kubespace/pkg/utils/code"
 	"github.com/kubespace/kubespace/pkg/views"
@@ -19,10 +20,10 @@ func NewPV(kr *kube_resource.KubeResources) *PV {
 		KubeResources: kr,
 	}
 	vs := []*views.View{
-		views.NewView(http.MethodGet, "/:cluster/:name", pv.get),
-		views.NewView(http.MethodGet, "/:cluster", pv.list),
-		views.NewView(http.MethodPost, "/:cluster/delete", pv.delete),
-		views.NewView(http.MethodPost, "/:cluster/update/:name", pv.updateYaml),
+		views.NewView(http.MethodGet, "/:cluster/:name", pv.get, types.RoleScopeCluster, "pv", types.OpGet),
+		views.NewView(http.MethodGet, "/:cluster", pv.list, types.RoleScopeCluster, "pv", types.OpGet),
+		views.NewView(http.MethodPost, "/:cluster/delete", pv.delete, types.RoleScopeCluster, "pv", types.OpDelete),
+		views.NewView(http.MethodPost, "/:cluster/update/:name", pv.updateYaml, types.RoleScopeCluster, "pv", types.OpUpdate),
 	}
 	pv.Views = vs
 	return pv
@@ -2,6 +2,7 @@ package kube_views
 
 import (
 	"github.com/kubespace/kubespace/pkg/kube_resource"
+	"github.com/kubespace/kubespace/pkg/model/types"
 	"github.com/kubespace/kubespace/pkg/utils"
 	"github.com/kubespace/kubespace/pkg/utils/code"
 	"github.com/kubespace/kubespace/pkg/views"
@@ -19,10 +20,10 @@ func NewPvc(kr *kube_resource.KubeResources) *Pvc {
 		KubeResources: kr,
 	}
 	vs := []*views.View{
-		views.NewView(http.MethodGet, "/:cluster/:namespace/:name", pvc.get),
-		views.NewView(http.MethodGet, "/:cluster", pvc.list),
-		views.NewView(http.MethodPost, "/:cluster/delete", pvc.delete),
-		views.NewView(http.MethodPost, "/:cluster/update/:namespace/:name", pvc.updateYaml),
+		views.NewView(http.MethodGet, "/:cluster/:namespace/:name", pvc.get, types.RoleScopeCluster, "pvc", types.OpGet),
+		views.NewView(http.MethodGet, "/:cluster", pvc.list, types.RoleScopeCluster, "pvc", types.OpGet),
+		views.NewView(http.MethodPost, "/:cluster/delete", pvc.delete, types.RoleScopeCluster, "pvc", types.OpDelete),
+		views.NewView(http.MethodPost, "/:cluster/update/:namespace/:name", pvc.updateYaml, types.RoleScopeCluster, "pvc", types.OpUpdate),
 	}
 	pvc.Views = vs
 	return pvc
@@ -2,6 +2,7 @@ package kube_views
 
 import (
 	"github.com/kubespace/kubespace/pkg/kube_resource"
+	"github.com/kubespace/kubespace/pkg/model/types"
 	"github.com/kubespace/kubespace/pkg/utils"
 	"github.com/kubespace/kubespace/pkg/utils/code"
 	"github.com/kubespace/kubespace/pkg/views"
@@ -19,10 +20,10 @@ func NewStorageClass(kr *kube_resource.KubeResources) *StorageClass {
 		KubeResources: kr,
 	}
 	vs := []*views.View{
-		views.NewView(http.MethodGet, "/:cluster/:name", s.get),
-		views.NewView(http.MethodGet, "/:cluster", s.list),
-		views.NewView(http.MethodPost, "/:cluster/delete", s.delete),
-		views.NewView(http.MethodPost, "/:cluster/update/:name", s.updateYaml),
+		views.NewView(http.MethodGet, "/:cluster/:name", s.get, types.RoleScopeCluster, "sc", types.OpGet),
+		views.NewView(http.MethodGet, "/:cluster", s.list, types.RoleScopeCluster, "sc", types.OpGet),
+		views.NewView(http.MethodPost, "/:cluster/delete", s.delete, types.RoleScopeCluster, "sc", types.OpDelete),
+		views.NewView(http.MethodPost, "/:cluster/update/:name", s.updateYaml, types.RoleScopeCluster, "sc", types.OpUpdate),
 	}
 	s.Views = vs
 	return s
@@ -2,6 +2,7 @@ package pipeline_views
 
 import (
 	"github.com/kubespace/kubespace/pkg/model"
+	"github.com/kubespace/kubespace/pkg/model/types"
 	"github.com/kubespace/kubespace/pkg/pipeline"
 	"github.com/kubespace/kubespace/pkg/sse"
 	"github.com/kubespace/kubespace/pkg/utils"
@@ -28,12 +29,14 @@ func NewPipeline(models *model.Models, pipelineRunService *pipeline.ServicePipel
 		pipelineRunService: pipelineRunService,
 	}
 	vs := []*views.View{
-		views.NewView(http.MethodGet, "", pw.list),
-		views.NewView(http.MethodGet, "/:pipelineId", pw.get),
-		views.NewView(http.MethodGet, "/:pipelineId/sse", pw.sse),
-		views.NewView(http.MethodPost, "", pw.create),
-		views.NewView(http.MethodPut, "", pw.update),
-		views.NewView(http.MethodDelete, "/:pipelineId", pw.delete),
+		views.NewView(http.MethodGet, "", pw.list, types.RoleScopePipeline, "pipeline", types.OpGet),
+		views.NewView(http.MethodGet, "/:pipelineId", pw.get, types.RoleScopePipeline, "pipeline", types.OpGet),
+		views.NewView(http.MethodGet, "/:pipelineId/sse", pw.sse, types.RoleScopePipeline, "pipeline", types.OpGet),
+		views.NewView(http.MethodGet, "/:pipelineId/code_definition", pw.codeDefinition, types.RoleScopePipeline, "pipeline", types.OpGet),
+		views.NewView(http.MethodGet, "/:pipelineId/params", pw.params, types.RoleScopePipeline, "pipeline", types.OpGet),
+		views.NewView(http.MethodPost, "", pw.create, types.RoleScopePipeline, "pipeline", types.OpCreate),
+		views.NewView(http.MethodPut, "", pw.update, types.RoleScopePipeline, "pipeline", types.OpUpdate),
+		views.NewView(http.MethodDelete, "/:pipelineId", pw.delete, types.RoleScopePipeline, "pipeline", types.OpDelete),
 	}
 	pw.Views = vs
 	return pw
@@ -47,6 +50,28 @@ func (p *Pipeline) get(c *views.Context) *utils.Response {
 	return p.pipelineService.GetPipeline(uint(pipelineId))
 }
 
+// params 获取流水线的构建参数定义
+func (p *Pipeline) params(c *views.Context) *utils.Response {
+	pipelineId, err := strconv.ParseUint(c.Param("pipelineId"), 10, 64)
+	if err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
+	return p.pipelineService.BuildParams(uint(pipelineId))
+}
+
+// codeDefinition 读取代码分支中的流水线配置文件并校验
+func (p *Pipeline) codeDefinition(c *views.Context) *utils.Response {
+	var ser serializers.PipelineCodeDefinitionSerializer
+	if err := c.ShouldBindQuery(&ser); err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
+	pipelineId, err := strconv.ParseUint(c.Param("pipelineId"), 10, 64)
+	if err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
+	return p.pipelineRunService.CodeDefinition(uint(pipelineId), ser.Branch)
+}
+
 func (p *Pipeline) sse(c *views.Context) *utils.Response {
 	if c.Param("pipelineId") == "" {
 		return &utils.Response{Code: code.ParamsError, Msg: "get param pipeline run id error"}
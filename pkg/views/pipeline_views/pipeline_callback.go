@@ -2,7 +2,6 @@ package pipeline_views
 
 import (
 	"github.com/gin-gonic/gin"
-	"github.com/kubespace/kubespace/pkg/kube_resource"
 	"github.com/kubespace/kubespace/pkg/model"
 	"github.com/kubespace/kubespace/pkg/pipeline"
 	"github.com/kubespace/kubespace/pkg/utils"
@@ -17,11 +16,11 @@ type PipelineCallback struct {
 	pipelineRunService *pipeline.ServicePipelineRun
 }
 
-func NewPipelineCallback(models *model.Models, kr *kube_resource.KubeResources) *PipelineCallback {
+func NewPipelineCallback(models *model.Models, pipelineRunService *pipeline.ServicePipelineRun) *PipelineCallback {
 	pc := &PipelineCallback{
 		models:             models,
 		pipelineService:    pipeline.NewPipelineService(models),
-		pipelineRunService: pipeline.NewPipelineRunService(models, kr),
+		pipelineRunService: pipelineRunService,
 	}
 	return pc
 }
@@ -32,6 +31,29 @@ func (p *PipelineCallback) Callback(c *gin.Context) {
 		c.JSON(http.StatusOK, &utils.Response{Code: code.ParamsError, Msg: err.Error()})
 		return
 	}
+	if resp := p.pipelineRunService.VerifyCallback(ser.JobId, ser.CallbackToken); !resp.IsSuccess() {
+		if resp.Code == code.AuthError {
+			c.JSON(http.StatusUnauthorized, resp)
+		} else {
+			c.JSON(http.StatusOK, resp)
+		}
+		return
+	}
 	resp := p.pipelineRunService.Callback(ser)
 	c.JSON(http.StatusOK, resp)
 }
+
+// Log 外部插件在任务执行过程中追加任务日志
+func (p *PipelineCallback) Log(c *gin.Context) {
+	var ser serializers.PipelineCallbackLogSerializer
+	if err := c.ShouldBind(&ser); err != nil {
+		c.JSON(http.StatusOK, &utils.Response{Code: code.ParamsError, Msg: err.Error()})
+		return
+	}
+	resp := p.pipelineRunService.AppendPluginLog(&ser)
+	if resp.Code == code.AuthError {
+		c.JSON(http.StatusUnauthorized, resp)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
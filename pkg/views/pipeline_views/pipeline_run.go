@@ -1,7 +1,9 @@
 package pipeline_views
 
 import (
+	"fmt"
 	"github.com/kubespace/kubespace/pkg/model"
+	"github.com/kubespace/kubespace/pkg/model/types"
 	"github.com/kubespace/kubespace/pkg/pipeline"
 	"github.com/kubespace/kubespace/pkg/sse"
 	"github.com/kubespace/kubespace/pkg/utils"
@@ -28,14 +30,20 @@ func NewPipelineRun(models *model.Models, pipelineRunService *pipeline.ServicePi
 		pipelineRunService: pipelineRunService,
 	}
 	vs := []*views.View{
-		views.NewView(http.MethodGet, "list", pw.list),
-		views.NewView(http.MethodGet, "/:pipelineRunId", pw.get),
-		views.NewView(http.MethodGet, "/:pipelineRunId/sse", pw.sse),
-		views.NewView(http.MethodPost, "", pw.build),
-		views.NewView(http.MethodPost, "/manual_execute", pw.manual),
-		views.NewView(http.MethodPost, "/retry", pw.retry),
-		views.NewView(http.MethodGet, "/log/:jobRunId", pw.log),
-		views.NewView(http.MethodGet, "/log/:jobRunId/sse", pw.logStream),
+		views.NewView(http.MethodGet, "list", pw.list, types.RoleScopePipeline, "build", types.OpGet),
+		views.NewView(http.MethodGet, "/:pipelineRunId", pw.get, types.RoleScopePipeline, "build", types.OpGet),
+		views.NewView(http.MethodGet, "/:pipelineRunId/sse", pw.sse, types.RoleScopePipeline, "build", types.OpGet),
+		views.NewView(http.MethodPost, "", pw.build, types.RoleScopePipeline, "build", types.OpCreate),
+		views.NewView(http.MethodPost, "/manual_execute", pw.manual, types.RoleScopePipeline, "build", types.OpUpdate),
+		views.NewView(http.MethodPost, "/retry", pw.retry, types.RoleScopePipeline, "build", types.OpUpdate),
+		// 审批人在服务中根据阶段的审批配置校验
+		views.NewView(http.MethodPost, "/approve", pw.approve, types.RoleScopePipeline, "build", types.OpGet),
+		views.NewView(http.MethodPost, "/cancel", pw.cancel, types.RoleScopePipeline, "build", types.OpUpdate),
+		views.NewView(http.MethodGet, "/log/:jobRunId", pw.log, types.RoleScopePipeline, "build", types.OpGet),
+		views.NewView(http.MethodGet, "/log/:jobRunId/sse", pw.logStream, types.RoleScopePipeline, "build", types.OpGet),
+		views.NewView(http.MethodGet, "/log/:jobRunId/download", pw.logDownload, types.RoleScopePipeline, "build", types.OpGet),
+		views.NewView(http.MethodGet, "/job/:jobRunId/attempts", pw.jobAttempts, types.RoleScopePipeline, "build", types.OpGet),
+		views.NewView(http.MethodGet, "/job/:jobRunId/attempts/:attempt/log", pw.jobAttemptLog, types.RoleScopePipeline, "build", types.OpGet),
 	}
 	pw.Views = vs
 	return pw
@@ -131,6 +139,22 @@ func (p *PipelineRun) retry(c *views.Context) *utils.Response {
 	return p.pipelineRunService.RetryStage(&ser)
 }
 
+func (p *PipelineRun) approve(c *views.Context) *utils.Response {
+	var ser serializers.PipelineStageApprovalSerializer
+	if err := c.ShouldBind(&ser); err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
+	return p.pipelineRunService.ApproveStage(&ser, c.User)
+}
+
+func (p *PipelineRun) cancel(c *views.Context) *utils.Response {
+	var ser serializers.PipelineRunCancelSerializer
+	if err := c.ShouldBind(&ser); err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
+	return p.pipelineRunService.Cancel(&ser)
+}
+
 func (p *PipelineRun) log(c *views.Context) *utils.Response {
 	jobRunId, err := strconv.ParseUint(c.Param("jobRunId"), 10, 64)
 	if err != nil {
@@ -146,6 +170,29 @@ func (p *PipelineRun) log(c *views.Context) *utils.Response {
 	return &utils.Response{Code: code.Success, Data: jobLog.Logs}
 }
 
+// jobAttempts 获取任务每次执行的状态以及结果
+func (p *PipelineRun) jobAttempts(c *views.Context) *utils.Response {
+	jobRunId, err := strconv.ParseUint(c.Param("jobRunId"), 10, 64)
+	if err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
+	return p.pipelineRunService.JobAttempts(uint(jobRunId))
+}
+
+// jobAttemptLog 获取任务某一次执行的日志
+func (p *PipelineRun) jobAttemptLog(c *views.Context) *utils.Response {
+	jobRunId, err := strconv.ParseUint(c.Param("jobRunId"), 10, 64)
+	if err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
+	attempt, err := strconv.Atoi(c.Param("attempt"))
+	if err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
+	return p.pipelineRunService.JobAttemptLog(uint(jobRunId), attempt)
+}
+
+// logStream 推送任务日志，每次只推送从offset开始新增的日志以及下一次读取的偏移，不携带offset参数时从头开始推送
 func (p *PipelineRun) logStream(c *views.Context) *utils.Response {
 	if c.Param("jobRunId") == "" {
 		return &utils.Response{Code: code.ParamsError, Msg: "get param job run id error"}
@@ -154,7 +201,14 @@ func (p *PipelineRun) logStream(c *views.Context) *utils.Response {
 	if err != nil {
 		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
 	}
-	lastJobLog, err := p.models.ManagerPipelineRun.GetJobRunLog(uint(jobRunId), true)
+	var offset int64 = 0
+	if c.Query("offset") != "" {
+		offset, err = strconv.ParseInt(c.Query("offset"), 10, 64)
+		if err != nil || offset < 0 {
+			return &utils.Response{Code: code.ParamsError, Msg: "日志偏移参数错误"}
+		}
+	}
+	logs, offset, err := p.models.PipelineJobLogManager.GetLogFrom(uint(jobRunId), offset)
 	if err != nil {
 		return &utils.Response{Code: code.DBError, Msg: err.Error()}
 	}
@@ -168,36 +222,56 @@ func (p *PipelineRun) logStream(c *views.Context) *utils.Response {
 	w := c.Writer
 	w.Flush()
 	clientGone := w.CloseNotify()
-	if lastJobLog != nil {
-		c.SSEvent("message", lastJobLog.Logs)
+	sendLogs := func(logs string) {
+		c.SSEvent("message", map[string]interface{}{"logs": logs, "offset": offset})
+		w.Flush()
 	}
-	w.Flush()
-	//c.Stream()
-	tick := time.NewTicker(5 * time.Second)
+	sendLogs(logs)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
 	for {
-		klog.Infof("select for log channel")
 		select {
 		case <-clientGone:
 			klog.Info("log client gone")
 			return nil
 		case <-tick.C:
-			//c.SSEvent("message", event)
-			currJobLog, err := p.models.ManagerPipelineRun.GetJobRunLog(uint(jobRunId), false)
-			if err == nil {
-				if currJobLog != nil && (lastJobLog == nil || currJobLog.UpdateTime != lastJobLog.UpdateTime) {
-					lastJobLog, err = p.models.ManagerPipelineRun.GetJobRunLog(uint(jobRunId), true)
-					if err != nil {
-						klog.Errorf("get job id=%s log error: %s", jobRunId, err.Error())
-					} else {
-						c.SSEvent("message", lastJobLog.Logs)
-						w.Flush()
-					}
-				}
-			} else {
-				klog.Errorf("get job id=%s log error: %s", jobRunId, err.Error())
-				c.SSEvent("message", "{}")
-				w.Flush()
+			size, err := p.models.PipelineJobLogManager.Size(uint(jobRunId))
+			if err != nil {
+				klog.Errorf("get job id=%d log size error: %s", jobRunId, err.Error())
+				continue
+			}
+			if size <= offset {
+				continue
+			}
+			logs, offset, err = p.models.PipelineJobLogManager.GetLogFrom(uint(jobRunId), offset)
+			if err != nil {
+				klog.Errorf("get job id=%d log error: %s", jobRunId, err.Error())
+				continue
 			}
+			sendLogs(logs)
 		}
 	}
 }
+
+// logDownload 按日志块顺序输出任务的完整日志文件
+func (p *PipelineRun) logDownload(c *views.Context) *utils.Response {
+	jobRunId, err := strconv.ParseUint(c.Param("jobRunId"), 10, 64)
+	if err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
+	jobRun, err := p.models.ManagerPipelineRun.GetJobRun(uint(jobRunId))
+	if err != nil {
+		return &utils.Response{Code: code.DBError, Msg: "获取任务失败：" + err.Error()}
+	}
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=job-%d.log", jobRun.ID))
+	c.Status(http.StatusOK)
+	err = p.models.PipelineJobLogManager.EachChunk(jobRun.ID, func(logs string) error {
+		_, err := c.Writer.WriteString(logs)
+		return err
+	})
+	if err != nil {
+		klog.Errorf("download job id=%d log error: %s", jobRun.ID, err.Error())
+	}
+	return nil
+}
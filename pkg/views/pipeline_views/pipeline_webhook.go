@@ -0,0 +1,39 @@
+package pipeline_views
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/kubespace/kubespace/pkg/model"
+	"github.com/kubespace/kubespace/pkg/pipeline"
+	"github.com/kubespace/kubespace/pkg/utils"
+	"github.com/kubespace/kubespace/pkg/utils/code"
+	"net/http"
+	"strconv"
+)
+
+type PipelineWebhook struct {
+	models             *model.Models
+	pipelineRunService *pipeline.ServicePipelineRun
+}
+
+func NewPipelineWebhook(models *model.Models, pipelineRunService *pipeline.ServicePipelineRun) *PipelineWebhook {
+	return &PipelineWebhook{
+		models:             models,
+		pipelineRunService: pipelineRunService,
+	}
+}
+
+// Webhook 代码仓库回调接口，通过空间的webhook密钥校验，不经过统一认证
+func (p *PipelineWebhook) Webhook(c *gin.Context) {
+	workspaceId, err := strconv.ParseUint(c.Param("workspaceId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusOK, &utils.Response{Code: code.ParamsError, Msg: err.Error()})
+		return
+	}
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusOK, &utils.Response{Code: code.ParamsError, Msg: err.Error()})
+		return
+	}
+	resp := p.pipelineRunService.Webhook(uint(workspaceId), c.Request.Header, body)
+	c.JSON(http.StatusOK, resp)
+}
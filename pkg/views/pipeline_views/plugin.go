@@ -0,0 +1,97 @@
+package pipeline_views
+
+import (
+	"github.com/kubespace/kubespace/pkg/model"
+	"github.com/kubespace/kubespace/pkg/model/types"
+	"github.com/kubespace/kubespace/pkg/pipeline"
+	"github.com/kubespace/kubespace/pkg/utils"
+	"github.com/kubespace/kubespace/pkg/utils/code"
+	"github.com/kubespace/kubespace/pkg/views"
+	"github.com/kubespace/kubespace/pkg/views/serializers"
+	"net/http"
+	"strconv"
+)
+
+type PipelinePlugin struct {
+	Views         []*views.View
+	models        *model.Models
+	pluginService *pipeline.PluginService
+}
+
+func NewPipelinePlugin(models *model.Models) *PipelinePlugin {
+	plugin := &PipelinePlugin{
+		models:        models,
+		pluginService: pipeline.NewPluginService(models),
+	}
+	vs := []*views.View{
+		views.NewView(http.MethodGet, "", plugin.list, "", "", ""),
+		views.NewView(http.MethodGet, "/:pluginId", plugin.get, "", "", ""),
+		views.NewView(http.MethodPost, "", plugin.create, types.RoleScopePlatform, "pipeline_plugin", types.OpCreate),
+		views.NewView(http.MethodPut, "/:pluginId", plugin.update, types.RoleScopePlatform, "pipeline_plugin", types.OpUpdate),
+		views.NewView(http.MethodDelete, "/:pluginId", plugin.delete, types.RoleScopePlatform, "pipeline_plugin", types.OpDelete),
+		views.NewView(http.MethodPost, "/:pluginId/test", plugin.test, types.RoleScopePlatform, "pipeline_plugin", types.OpGet),
+		views.NewView(http.MethodPost, "/:pluginId/secret", plugin.secret, types.RoleScopePlatform, "pipeline_plugin", types.OpUpdate),
+	}
+	plugin.Views = vs
+	return plugin
+}
+
+func (p *PipelinePlugin) list(c *views.Context) *utils.Response {
+	return p.pluginService.List()
+}
+
+func (p *PipelinePlugin) get(c *views.Context) *utils.Response {
+	pluginId, err := strconv.ParseUint(c.Param("pluginId"), 10, 64)
+	if err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
+	return p.pluginService.Get(uint(pluginId))
+}
+
+func (p *PipelinePlugin) create(c *views.Context) *utils.Response {
+	var ser serializers.PipelinePluginSerializer
+	if err := c.ShouldBind(&ser); err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
+	return p.pluginService.Create(&ser)
+}
+
+func (p *PipelinePlugin) update(c *views.Context) *utils.Response {
+	var ser serializers.PipelinePluginSerializer
+	if err := c.ShouldBind(&ser); err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
+	pluginId, err := strconv.ParseUint(c.Param("pluginId"), 10, 64)
+	if err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
+	return p.pluginService.Update(uint(pluginId), &ser)
+}
+
+func (p *PipelinePlugin) delete(c *views.Context) *utils.Response {
+	pluginId, err := strconv.ParseUint(c.Param("pluginId"), 10, 64)
+	if err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
+	return p.pluginService.Delete(uint(pluginId))
+}
+
+func (p *PipelinePlugin) test(c *views.Context) *utils.Response {
+	pluginId, err := strconv.ParseUint(c.Param("pluginId"), 10, 64)
+	if err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
+	return p.pluginService.TestConnection(uint(pluginId))
+}
+
+func (p *PipelinePlugin) secret(c *views.Context) *utils.Response {
+	var ser serializers.PipelinePluginSecretSerializer
+	if err := c.ShouldBind(&ser); err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
+	pluginId, err := strconv.ParseUint(c.Param("pluginId"), 10, 64)
+	if err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
+	return p.pluginService.Secret(uint(pluginId), ser.Regenerate)
+}
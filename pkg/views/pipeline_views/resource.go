@@ -22,10 +22,10 @@ func NewPipelineResource(models *model.Models) *PipelineResource {
 		models: models,
 	}
 	vs := []*views.View{
-		views.NewView(http.MethodGet, "/:workspaceId", pipelineWs.list),
-		views.NewView(http.MethodPost, "", pipelineWs.create),
-		views.NewView(http.MethodPut, "/:id", pipelineWs.update),
-		views.NewView(http.MethodDelete, "/:id", pipelineWs.delete),
+		views.NewView(http.MethodGet, "/:workspaceId", pipelineWs.list, types.RoleScopePipeline, "resource", types.OpGet),
+		views.NewView(http.MethodPost, "", pipelineWs.create, types.RoleScopePipeline, "resource", types.OpCreate),
+		views.NewView(http.MethodPut, "/:resourceId", pipelineWs.update, types.RoleScopePipeline, "resource", types.OpUpdate),
+		views.NewView(http.MethodDelete, "/:resourceId", pipelineWs.delete, types.RoleScopePipeline, "resource", types.OpDelete),
 	}
 	pipelineWs.Views = vs
 	return pipelineWs
@@ -67,7 +67,7 @@ func (r *PipelineResource) update(c *views.Context) *utils.Response {
 		resp.Msg = err.Error()
 		return resp
 	}
-	resId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	resId, err := strconv.ParseUint(c.Param("resourceId"), 10, 64)
 	if err != nil {
 		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
 	}
@@ -110,7 +110,7 @@ func (r *PipelineResource) list(c *views.Context) *utils.Response {
 
 func (r *PipelineResource) delete(c *views.Context) *utils.Response {
 	resp := &utils.Response{Code: code.Success}
-	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	id, err := strconv.ParseUint(c.Param("resourceId"), 10, 64)
 	if err != nil {
 		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
 	}
@@ -25,13 +25,14 @@ func NewPipelineWorkspace(models *model.Models) *PipelineWorkspace {
 		workspaceService: pipeline.NewWorkspaceService(models),
 	}
 	vs := []*views.View{
-		views.NewView(http.MethodGet, "", pipelineWs.list),
-		views.NewView(http.MethodGet, "/latest_release", pipelineWs.latestReleaseVersion),
-		views.NewView(http.MethodGet, "/exists_release", pipelineWs.existsReleaseVersion),
-		views.NewView(http.MethodGet, "/:id", pipelineWs.get),
-		views.NewView(http.MethodPost, "", pipelineWs.create),
-		views.NewView(http.MethodPut, "/:id", pipelineWs.update),
-		views.NewView(http.MethodDelete, "/:id", pipelineWs.delete),
+		views.NewView(http.MethodGet, "", pipelineWs.list, "", "", ""),
+		views.NewView(http.MethodGet, "/latest_release", pipelineWs.latestReleaseVersion, types.RoleScopePipeline, "workspace", types.OpGet),
+		views.NewView(http.MethodGet, "/exists_release", pipelineWs.existsReleaseVersion, types.RoleScopePipeline, "workspace", types.OpGet),
+		views.NewView(http.MethodGet, "/:workspaceId", pipelineWs.get, types.RoleScopePipeline, "workspace", types.OpGet),
+		views.NewView(http.MethodPost, "", pipelineWs.create, types.RoleScopePlatform, "workspace", types.OpCreate),
+		views.NewView(http.MethodPut, "/:workspaceId", pipelineWs.update, types.RoleScopePipeline, "workspace", types.OpUpdate),
+		views.NewView(http.MethodDelete, "/:workspaceId", pipelineWs.delete, types.RoleScopePipeline, "workspace", types.OpDelete),
+		views.NewView(http.MethodPost, "/:workspaceId/webhook", pipelineWs.webhook, types.RoleScopePipeline, "workspace", types.OpUpdate),
 	}
 	pipelineWs.Views = vs
 	return pipelineWs
@@ -49,7 +50,7 @@ func (p *PipelineWorkspace) create(c *views.Context) *utils.Response {
 }
 
 func (p *PipelineWorkspace) update(c *views.Context) *utils.Response {
-	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	id, err := strconv.ParseUint(c.Param("workspaceId"), 10, 64)
 	if err != nil {
 		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
 	}
@@ -108,7 +109,7 @@ func (p *PipelineWorkspace) list(c *views.Context) *utils.Response {
 }
 
 func (p *PipelineWorkspace) get(c *views.Context) *utils.Response {
-	workspaceId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	workspaceId, err := strconv.ParseUint(c.Param("workspaceId"), 10, 64)
 	if err != nil {
 		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
 	}
@@ -121,7 +122,7 @@ func (p *PipelineWorkspace) get(c *views.Context) *utils.Response {
 
 func (p *PipelineWorkspace) delete(c *views.Context) *utils.Response {
 	resp := &utils.Response{Code: code.Success}
-	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	id, err := strconv.ParseUint(c.Param("workspaceId"), 10, 64)
 	if err != nil {
 		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
 	}
@@ -140,6 +141,18 @@ func (p *PipelineWorkspace) delete(c *views.Context) *utils.Response {
 	return resp
 }
 
+func (p *PipelineWorkspace) webhook(c *views.Context) *utils.Response {
+	workspaceId, err := strconv.ParseUint(c.Param("workspaceId"), 10, 64)
+	if err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
+	var ser serializers.WorkspaceWebhookSerializer
+	if err = c.ShouldBind(&ser); err != nil {
+		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
+	}
+	return p.workspaceService.Webhook(uint(workspaceId), ser.Regenerate, c.User)
+}
+
 func (p *PipelineWorkspace) latestReleaseVersion(c *views.Context) *utils.Response {
 	var ser serializers.WorkspaceReleaseSerializer
 	if err := c.ShouldBind(&ser); err != nil {
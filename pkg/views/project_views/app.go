@@ -2,6 +2,7 @@ package project_views
 
 import (
 	"github.com/kubespace/kubespace/pkg/model"
+	"github.com/kubespace/kubespace/pkg/model/types"
 	"github.com/kubespace/kubespace/pkg/project"
 	"github.com/kubespace/kubespace/pkg/utils"
 	"github.com/kubespace/kubespace/pkg/utils/code"
@@ -25,19 +26,19 @@ func NewProjectApp(models *model.Models, appService *project.AppService) *Projec
 		models:     models,
 	}
 	vs := []*views.View{
-		views.NewView(http.MethodGet, "", app.listApps),
-		views.NewView(http.MethodGet, "/versions", app.listAppVersions),
-		views.NewView(http.MethodGet, "/version/:id", app.getAppVersion),
-		views.NewView(http.MethodGet, "/status", app.listAppStatus),
-		views.NewView(http.MethodGet, "/status_sse", app.statusSSE),
-		views.NewView(http.MethodGet, "/:id", app.getApp),
-		views.NewView(http.MethodPost, "", app.create),
-		views.NewView(http.MethodPost, "/install", app.install),
-		views.NewView(http.MethodPost, "/destroy", app.destroy),
-		views.NewView(http.MethodPost, "/import_storeapp", app.importStoreapp),
-		views.NewView(http.MethodPost, "/duplicate_app", app.duplicateApp),
-		views.NewView(http.MethodDelete, "/version/:id", app.deleteAppVersion),
-		views.NewView(http.MethodDelete, "/:id", app.deleteApp),
+		views.NewView(http.MethodGet, "", app.listApps, types.RoleScopeProject, "app", types.OpGet),
+		views.NewView(http.MethodGet, "/versions", app.listAppVersions, types.RoleScopeProject, "app", types.OpGet),
+		views.NewView(http.MethodGet, "/version/:appVersionId", app.getAppVersion, types.RoleScopeProject, "app", types.OpGet),
+		views.NewView(http.MethodGet, "/status", app.listAppStatus, types.RoleScopeProject, "app", types.OpGet),
+		views.NewView(http.MethodGet, "/status_sse", app.statusSSE, types.RoleScopeProject, "app", types.OpGet),
+		views.NewView(http.MethodGet, "/:appId", app.getApp, types.RoleScopeProject, "app", types.OpGet),
+		views.NewView(http.MethodPost, "", app.create, types.RoleScopeProject, "app", types.OpCreate),
+		views.NewView(http.MethodPost, "/install", app.install, types.RoleScopeProject, "app", types.OpUpdate),
+		views.NewView(http.MethodPost, "/destroy", app.destroy, types.RoleScopeProject, "app", types.OpUpdate),
+		views.NewView(http.MethodPost, "/import_storeapp", app.importStoreapp, types.RoleScopeProject, "app", types.OpCreate),
+		views.NewView(http.MethodPost, "/duplicate_app", app.duplicateApp, types.RoleScopeProject, "app", types.OpCreate),
+		views.NewView(http.MethodDelete, "/version/:appVersionId", app.deleteAppVersion, types.RoleScopeProject, "app", types.OpDelete),
+		views.NewView(http.MethodDelete, "/:appId", app.deleteApp, types.RoleScopeProject, "app", types.OpDelete),
 	}
 	app.Views = vs
 	return app
@@ -72,7 +73,7 @@ func (a *ProjectApp) listAppStatus(c *views.Context) *utils.Response {
 }
 
 func (a *ProjectApp) getApp(c *views.Context) *utils.Response {
-	appId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	appId, err := strconv.ParseUint(c.Param("appId"), 10, 64)
 	if err != nil {
 		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
 	}
@@ -80,7 +81,7 @@ func (a *ProjectApp) getApp(c *views.Context) *utils.Response {
 }
 
 func (a *ProjectApp) deleteApp(c *views.Context) *utils.Response {
-	appId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	appId, err := strconv.ParseUint(c.Param("appId"), 10, 64)
 	if err != nil {
 		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
 	}
@@ -100,7 +101,7 @@ func (a *ProjectApp) listAppVersions(c *views.Context) *utils.Response {
 }
 
 func (a *ProjectApp) getAppVersion(c *views.Context) *utils.Response {
-	appVersionId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	appVersionId, err := strconv.ParseUint(c.Param("appVersionId"), 10, 64)
 	if err != nil {
 		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
 	}
@@ -108,7 +109,7 @@ func (a *ProjectApp) getAppVersion(c *views.Context) *utils.Response {
 }
 
 func (a *ProjectApp) deleteAppVersion(c *views.Context) *utils.Response {
-	appVersionId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	appVersionId, err := strconv.ParseUint(c.Param("appVersionId"), 10, 64)
 	if err != nil {
 		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
 	}
@@ -2,6 +2,7 @@ package project_views
 
 import (
 	"github.com/kubespace/kubespace/pkg/model"
+	"github.com/kubespace/kubespace/pkg/model/types"
 	"github.com/kubespace/kubespace/pkg/project"
 	"github.com/kubespace/kubespace/pkg/utils"
 	"github.com/kubespace/kubespace/pkg/utils/code"
@@ -25,11 +26,11 @@ func NewAppStore(models *model.Models, appStoreService *project.AppStoreService)
 		models:          models,
 	}
 	vs := []*views.View{
-		views.NewView(http.MethodGet, "", app.list),
-		views.NewView(http.MethodGet, "/:id", app.get),
-		views.NewView(http.MethodPost, "/resolve", app.resolveChart),
-		views.NewView(http.MethodPost, "/create", app.create),
-		views.NewView(http.MethodDelete, "/:appId/:versionId", app.deleteVersion),
+		views.NewView(http.MethodGet, "", app.list, "", "", ""),
+		views.NewView(http.MethodGet, "/:id", app.get, "", "", ""),
+		views.NewView(http.MethodPost, "/resolve", app.resolveChart, types.RoleScopePlatform, "appstore", types.OpCreate),
+		views.NewView(http.MethodPost, "/create", app.create, types.RoleScopePlatform, "appstore", types.OpCreate),
+		views.NewView(http.MethodDelete, "/:appId/:versionId", app.deleteVersion, types.RoleScopePlatform, "appstore", types.OpDelete),
 	}
 	app.Views = vs
 	return app
@@ -27,11 +27,11 @@ func NewProject(models *model.Models, projectService *projectservice.ServiceProj
 		projectService: projectService,
 	}
 	vs := []*views.View{
-		views.NewView(http.MethodGet, "", pipelineWs.list),
-		views.NewView(http.MethodGet, "/:id", pipelineWs.get),
-		views.NewView(http.MethodPost, "", pipelineWs.create),
-		views.NewView(http.MethodPut, "/:id", pipelineWs.update),
-		views.NewView(http.MethodDelete, "/:id", pipelineWs.delete),
+		views.NewView(http.MethodGet, "", pipelineWs.list, "", "", ""),
+		views.NewView(http.MethodGet, "/:projectId", pipelineWs.get, types.RoleScopeProject, "project", types.OpGet),
+		views.NewView(http.MethodPost, "", pipelineWs.create, types.RoleScopePlatform, "project", types.OpCreate),
+		views.NewView(http.MethodPut, "/:projectId", pipelineWs.update, types.RoleScopeProject, "project", types.OpUpdate),
+		views.NewView(http.MethodDelete, "/:projectId", pipelineWs.delete, types.RoleScopeProject, "project", types.OpDelete),
 	}
 	pipelineWs.Views = vs
 	return pipelineWs
@@ -67,7 +67,7 @@ func (p *Project) create(c *views.Context) *utils.Response {
 }
 
 func (p *Project) update(c *views.Context) *utils.Response {
-	projectId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	projectId, err := strconv.ParseUint(c.Param("projectId"), 10, 64)
 	if err != nil {
 		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
 	}
@@ -116,7 +116,7 @@ func (p *Project) list(c *views.Context) *utils.Response {
 		if !ok {
 			cluster, err = p.models.ClusterManager.GetByName(project.ClusterId)
 			if err != nil {
-				klog.Errorf("get project id=%s cluster error: %s", project.ID, err.Error())
+				klog.Errorf("get project id=%d cluster error: %s", project.ID, err.Error())
 			}
 			clusters[project.ClusterId] = cluster
 		}
@@ -138,7 +138,7 @@ func (p *Project) list(c *views.Context) *utils.Response {
 }
 
 func (p *Project) delete(c *views.Context) *utils.Response {
-	projectId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	projectId, err := strconv.ParseUint(c.Param("projectId"), 10, 64)
 	if err != nil {
 		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
 	}
@@ -146,7 +146,7 @@ func (p *Project) delete(c *views.Context) *utils.Response {
 }
 
 func (p *Project) get(c *views.Context) *utils.Response {
-	projectId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	projectId, err := strconv.ParseUint(c.Param("projectId"), 10, 64)
 	if err != nil {
 		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
 	}
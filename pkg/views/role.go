@@ -20,11 +20,11 @@ func NewRole(models *model.Models) *Role {
 		models: models,
 	}
 	views := []*View{
-		NewView(http.MethodGet, "/permissions", role.permissions),
-		NewView(http.MethodGet, "", role.list),
-		NewView(http.MethodPost, "", role.create),
-		NewView(http.MethodPut, "/:rolename", role.update),
-		NewView(http.MethodPost, "/delete", role.delete),
+		NewView(http.MethodGet, "/permissions", role.permissions, "", "", ""),
+		NewView(http.MethodGet, "", role.list, "", "", ""),
+		NewView(http.MethodPost, "", role.create, types.RoleScopePlatform, "role", types.OpCreate),
+		NewView(http.MethodPut, "/:rolename", role.update, types.RoleScopePlatform, "role", types.OpUpdate),
+		NewView(http.MethodPost, "/delete", role.delete, types.RoleScopePlatform, "role", types.OpDelete),
 	}
 	role.Views = views
 	role.models.RoleManager.Init()
@@ -156,7 +156,7 @@ func (r *Role) delete(c *Context) *utils.Response {
 	for _, du := range ser {
 		err := r.models.RoleManager.Delete(du.Name)
 		if err != nil {
-			klog.Errorf("delete user %s error: %s", c, err.Error())
+			klog.Errorf("delete role %s error: %s", du.Name, err.Error())
 			return &utils.Response{Code: code.DeleteError, Msg: err.Error()}
 		}
 	}
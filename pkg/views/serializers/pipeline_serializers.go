@@ -24,6 +24,10 @@ type WorkspaceListSerializer struct {
 	Type         string `json:"type" form:"type"`
 }
 
+type WorkspaceWebhookSerializer struct {
+	Regenerate bool `json:"regenerate" form:"regenerate"`
+}
+
 type WorkspaceReleaseSerializer struct {
 	WorkspaceId uint   `json:"workspace_id" form:"workspace_id"`
 	Version     string `json:"version" form:"version"`
@@ -35,6 +39,18 @@ type PipelineSerializer struct {
 	Name        string                    `json:"name"`
 	Triggers    types.PipelineTriggers    `json:"triggers"`
 	Stages      []PipelineStageSerializer `json:"stages"`
+	// 构建状态回写代码提交的配置
+	CommitStatus *types.PipelineCommitStatus `json:"commit_status"`
+	// 阶段配置来源，为code时从代码仓库的.kubespace/pipeline.yaml读取
+	Definition string `json:"definition"`
+	// 可以读取流水线配置文件的受保护分支
+	DefinitionBranches types.StringList `json:"definition_branches"`
+	// 构建参数定义
+	Params types.PipelineParams `json:"params"`
+	// 最大并发构建数，为0时不限制
+	MaxConcurrent int `json:"max_concurrent"`
+	// 新建构建时取消同一分支上未完成的旧构建
+	CancelSuperseded bool `json:"cancel_superseded"`
 }
 
 type PipelineTrigger struct {
@@ -49,11 +65,24 @@ type PipelineTriggerExpression struct {
 }
 
 type PipelineStageSerializer struct {
-	ID           uint                   `json:"id"`
-	Name         string                 `json:"name"`
-	TriggerMode  string                 `json:"trigger_mode"`
-	CustomParams map[string]interface{} `json:"custom_params"`
-	Jobs         types.PipelineJobs     `json:"jobs"`
+	ID            uint                   `json:"id"`
+	Name          string                 `json:"name"`
+	TriggerMode   string                 `json:"trigger_mode"`
+	CustomParams  map[string]interface{} `json:"custom_params"`
+	Jobs          types.PipelineJobs     `json:"jobs"`
+	MaxParallel   int                    `json:"max_parallel"`
+	FailurePolicy string                 `json:"failure_policy"`
+	// 依赖的上游阶段名称，为空时依赖前一个阶段
+	DependsOn []string `json:"depends_on"`
+	Timeout   int      `json:"timeout"`
+	// 阶段执行条件，为空时总是执行
+	When string `json:"when"`
+	// 审批阶段的审批人配置
+	Approval types.PipelineStageApproval `json:"approval"`
+}
+
+type PipelineCodeDefinitionSerializer struct {
+	Branch string `json:"branch" form:"branch"`
 }
 
 type PipelineListSerializer struct {
@@ -73,8 +102,19 @@ type PipelineBuildSerializer struct {
 }
 
 type PipelineCallbackSerializer struct {
-	JobId  uint            `json:"job_id"`
-	Result *utils.Response `json:"result"`
+	JobId         uint            `json:"job_id"`
+	CallbackToken string          `json:"callback_token"`
+	Result        *utils.Response `json:"result"`
+	// 回调时追加到任务日志的剩余日志
+	Logs string `json:"logs"`
+	// 内置插件回调时的任务执行次数，不能由外部插件指定
+	Attempt int `json:"-"`
+}
+
+type PipelineCallbackLogSerializer struct {
+	JobId         uint   `json:"job_id"`
+	CallbackToken string `json:"callback_token"`
+	Logs          string `json:"logs"`
 }
 
 type PipelineStageManualSerializer struct {
@@ -83,10 +123,20 @@ type PipelineStageManualSerializer struct {
 	JobParams    map[string]map[string]interface{} `json:"job_params"`
 }
 
+type PipelineStageApprovalSerializer struct {
+	StageRunId uint   `json:"stage_run_id"`
+	Result     string `json:"result"`
+	Comment    string `json:"comment"`
+}
+
 type PipelineStageRetrySerializer struct {
 	StageRunId uint `json:"stage_run_id"`
 }
 
+type PipelineRunCancelSerializer struct {
+	PipelineRunId uint `json:"pipeline_run_id"`
+}
+
 type PipelineResourceSerializer struct {
 	WorkspaceId uint   `json:"workspace_id" form:"workspace_id"`
 	Global      bool   `json:"global" form:"global"`
@@ -96,3 +146,18 @@ type PipelineResourceSerializer struct {
 	SecretId    uint   `json:"secret_id" form:"secret_id"`
 	Description string `json:"description" form:"description"`
 }
+
+type PipelinePluginSerializer struct {
+	Name      string                               `json:"name" form:"name"`
+	Key       string                               `json:"key" form:"key"`
+	Url       string                               `json:"url" form:"url"`
+	Version   string                               `json:"version" form:"version"`
+	Params    []*types.PipelinePluginParamsSpec    `json:"params" form:"params"`
+	ResultEnv []*types.PipelinePluginResultEnvPath `json:"result_env" form:"result_env"`
+	Resumable bool                                 `json:"resumable" form:"resumable"`
+	Timeout   int                                  `json:"timeout" form:"timeout"`
+}
+
+type PipelinePluginSecretSerializer struct {
+	Regenerate bool `json:"regenerate" form:"regenerate"`
+}
@@ -22,10 +22,10 @@ func NewImageRegistry(models *model.Models) *ImageRegistry {
 		models: models,
 	}
 	vs := []*views.View{
-		views.NewView(http.MethodGet, "", settings.list),
-		views.NewView(http.MethodPost, "", settings.create),
-		views.NewView(http.MethodPut, "/:id", settings.update),
-		views.NewView(http.MethodDelete, "/:id", settings.delete),
+		views.NewView(http.MethodGet, "", settings.list, "", "", ""),
+		views.NewView(http.MethodPost, "", settings.create, types.RoleScopePlatform, "image_registry", types.OpCreate),
+		views.NewView(http.MethodPut, "/:id", settings.update, types.RoleScopePlatform, "image_registry", types.OpUpdate),
+		views.NewView(http.MethodDelete, "/:id", settings.delete, types.RoleScopePlatform, "image_registry", types.OpDelete),
 	}
 	settings.Views = vs
 	return settings
@@ -22,10 +22,10 @@ func NewSettingsSecret(models *model.Models) *SettingsSecret {
 		models: models,
 	}
 	vs := []*views.View{
-		views.NewView(http.MethodGet, "", secret.list),
-		views.NewView(http.MethodPost, "", secret.create),
-		views.NewView(http.MethodPut, "/:id", secret.update),
-		views.NewView(http.MethodDelete, "/:id", secret.delete),
+		views.NewView(http.MethodGet, "", secret.list, "", "", ""),
+		views.NewView(http.MethodPost, "", secret.create, types.RoleScopePlatform, "settings_secret", types.OpCreate),
+		views.NewView(http.MethodPut, "/:id", secret.update, types.RoleScopePlatform, "settings_secret", types.OpUpdate),
+		views.NewView(http.MethodDelete, "/:id", secret.delete, types.RoleScopePlatform, "settings_secret", types.OpDelete),
 	}
 	secret.Views = vs
 	return secret
@@ -23,15 +23,15 @@ func NewUser(models *model.Models) *User {
 		models: models,
 	}
 	views := []*View{
-		NewView(http.MethodGet, "", user.list),
-		NewView(http.MethodGet, "/:id/roles", user.list),
-		NewView(http.MethodPost, "", user.create),
+		NewView(http.MethodGet, "", user.list, "", "", ""),
+		NewView(http.MethodGet, "/:id/roles", user.list, "", "", ""),
+		NewView(http.MethodPost, "", user.create, types.RoleScopePlatform, "user", types.OpCreate),
 		//NewView(http.MethodPost, "/admin", user.create),
-		NewView(http.MethodPut, "/", user.updateSelf),
-		NewView(http.MethodPut, "/:username", user.update),
+		NewView(http.MethodPut, "/", user.updateSelf, "", "", ""),
+		NewView(http.MethodPut, "/:username", user.update, types.RoleScopePlatform, "user", types.OpUpdate),
 
-		NewView(http.MethodGet, "/token", user.tokenUser),
-		NewView(http.MethodPost, "/delete", user.delete),
+		NewView(http.MethodGet, "/token", user.tokenUser, "", "", ""),
+		NewView(http.MethodPost, "/delete", user.delete, types.RoleScopePlatform, "user", types.OpDelete),
 	}
 	user.Views = views
 	return user
@@ -246,7 +246,7 @@ func (u *User) delete(c *Context) *utils.Response {
 	for _, du := range ser {
 		err := u.models.UserManager.Delete(du.Name)
 		if err != nil {
-			klog.Errorf("delete user %s error: %s", c, err.Error())
+			klog.Errorf("delete user %s error: %s", du.Name, err.Error())
 			return &utils.Response{Code: code.DeleteError, Msg: err.Error()}
 		}
 	}
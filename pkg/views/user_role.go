@@ -20,9 +20,9 @@ func NewUserRole(models *model.Models) *UserRole {
 		models: models,
 	}
 	views := []*View{
-		NewView(http.MethodGet, "", role.list),
-		NewView(http.MethodPost, "", role.update),
-		NewView(http.MethodDelete, "/:id", role.delete),
+		NewView(http.MethodGet, "", role.list, types.RoleScopePlatform, "user_role", types.OpGet),
+		NewView(http.MethodPost, "", role.update, types.RoleScopePlatform, "user_role", types.OpUpdate),
+		NewView(http.MethodDelete, "/:userRoleId", role.delete, types.RoleScopePlatform, "user_role", types.OpDelete),
 	}
 	role.Views = views
 	role.models.RoleManager.Init()
@@ -77,7 +77,7 @@ func (r *UserRole) update(c *Context) *utils.Response {
 }
 
 func (r *UserRole) delete(c *Context) *utils.Response {
-	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	id, err := strconv.ParseUint(c.Param("userRoleId"), 10, 64)
 	if err != nil {
 		return &utils.Response{Code: code.ParamsError, Msg: err.Error()}
 	}
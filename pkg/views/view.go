@@ -10,13 +10,21 @@ type View struct {
 	Method  string
 	Path    string
 	Handler ViewHandler
+	// 调用接口需要的权限：权限范围(platform/cluster/pipeline/project)、操作对象以及操作类型，
+	// Scope为空时只需要登录认证
+	Scope     string
+	Object    string
+	Operation string
 }
 
-func NewView(method, path string, handler ViewHandler) *View {
+func NewView(method, path string, handler ViewHandler, scope, object, operation string) *View {
 	return &View{
-		Method:  method,
-		Path:    path,
-		Handler: handler,
+		Method:    method,
+		Path:      path,
+		Handler:   handler,
+		Scope:     scope,
+		Object:    object,
+		Operation: operation,
 	}
 }
 
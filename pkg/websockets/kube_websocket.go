@@ -58,7 +58,7 @@ func (k *KubeWebsocket) MiddleRequestHandle() {
 			time.Sleep(5 * time.Second)
 		}
 	}
-	klog.V(1).Info("cluster %s middle request handle end", k.cluster)
+	klog.V(1).Infof("cluster %s middle request handle end", k.cluster)
 }
 
 func (k *KubeWebsocket) WsReceiveMsg() {
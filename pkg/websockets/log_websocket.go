@@ -88,7 +88,7 @@ func (l *LogWebsocket) WsReceiveMsg() {
 	for {
 		_, _, err := l.wsConn.ReadMessage()
 		if err != nil {
-			klog.Error("cluster %s log websocket close: %s", l.cluster, err)
+			klog.Errorf("cluster %s log websocket close: %s", l.cluster, err)
 			break
 		}
 	}